@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"qq/pkg/log"
+	"qq/pkg/qqclient/http"
+	"qq/repos/auditqq"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// AuditKeyEnv is the key the server signs its audit log with, which
+// verifying a local copy requires
+const AuditKeyEnv = "QQ_AUDIT_KEY"
+
+// auditClient is only implemented by the HTTP client
+type auditClient interface {
+	Audit(ctx context.Context, query http.AuditQuery) ([]http.AuditRecord, error)
+	VerifyAudit(ctx context.Context) (*http.AuditVerification, error)
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "query the audit log or verify its hash chain",
+	Long: "Query the audit log of the server, or a local copy of it with --file.\n" +
+		"With --verify the hash chain of the log is checked instead.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		query, err := readAuditQuery(cmd)
+		if err != nil {
+			log.Error(ctx, "failed to get audit query from command flags", log.Args{"error": err})
+			return err
+		}
+
+		verify, err := cmd.Flags().GetBool("verify")
+		if err != nil {
+			log.Error(ctx, "failed to get verify value from command flag", log.Args{"error": err})
+			return err
+		}
+
+		path, err := cmd.Flags().GetString("file")
+		if err != nil {
+			log.Error(ctx, "failed to get file value from command flag", log.Args{"error": err})
+			return err
+		}
+
+		log.Debug(ctx, "audit called")
+
+		if path != "" {
+			return auditFile(ctx, path, query, verify)
+		}
+
+		client, ctx, err := createClient(ctx)
+		if err != nil {
+			log.Error(ctx, "failed to create client", log.Args{"error": err})
+			return err
+		}
+
+		auditor, ok := client.(auditClient)
+		if !ok {
+			errText := "client does not support the audit log"
+			log.Error(ctx, errText)
+			return fmt.Errorf(errText)
+		}
+
+		if verify {
+			verification, err := auditor.VerifyAudit(ctx)
+			if err != nil {
+				log.Error(ctx, "failed to verify audit log", log.Args{"error": err})
+				return err
+			}
+
+			return reportVerification(ctx, *verification)
+		}
+
+		records, err := auditor.Audit(ctx, query)
+		if err != nil {
+			log.Error(ctx, "failed to query audit log", log.Args{"error": err})
+			return err
+		}
+
+		logAuditRecords(ctx, records)
+
+		return nil
+	},
+}
+
+func auditFile(ctx context.Context, path string, query http.AuditQuery, verify bool) error {
+	if verify {
+		verification, err := auditqq.VerifyFile(path, []byte(os.Getenv(AuditKeyEnv)))
+		if err != nil {
+			log.Error(ctx, "failed to verify audit log", log.Args{"error": err, "path": path})
+			return err
+		}
+
+		return reportVerification(ctx, http.AuditVerification{
+			Records:  verification.Records,
+			Valid:    verification.Valid,
+			BrokenAt: verification.BrokenAt,
+			Reason:   verification.Reason,
+		})
+	}
+
+	records, err := auditqq.QueryFile(path, auditqq.Query{
+		Key:    query.Key,
+		UserId: query.UserId,
+		Since:  query.Since,
+		Until:  query.Until,
+		Limit:  query.Limit,
+	})
+	if err != nil {
+		log.Error(ctx, "failed to query audit log", log.Args{"error": err, "path": path})
+		return err
+	}
+
+	logAuditRecords(ctx, records)
+
+	return nil
+}
+
+func reportVerification(ctx context.Context, verification http.AuditVerification) error {
+	if !verification.Valid {
+		log.Error(ctx, "audit log is broken", log.Args{"verification": verification})
+		return fmt.Errorf("audit log is broken at record %d: %s", verification.BrokenAt, verification.Reason)
+	}
+
+	log.Info(ctx, "audit command result", log.Args{"verification": verification})
+
+	return nil
+}
+
+func logAuditRecords[Record any](ctx context.Context, records []Record) {
+	data := log.Args{}
+	for i, record := range records {
+		key := fmt.Sprintf("record %v", i+1)
+		data[key] = record
+	}
+
+	log.Info(ctx, "audit command result", data)
+}
+
+func readAuditQuery(cmd *cobra.Command) (http.AuditQuery, error) {
+	var query http.AuditQuery
+	var err error
+
+	query.Key, err = cmd.Flags().GetString("key")
+	if err != nil {
+		return query, err
+	}
+
+	query.UserId, err = cmd.Flags().GetString("user")
+	if err != nil {
+		return query, err
+	}
+
+	query.Limit, err = cmd.Flags().GetInt("limit")
+	if err != nil {
+		return query, err
+	}
+
+	for name, value := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		text, err := cmd.Flags().GetString(name)
+		if err != nil {
+			return query, err
+		}
+
+		if text == "" {
+			continue
+		}
+
+		*value, err = time.Parse(time.RFC3339, text)
+		if err != nil {
+			return query, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	return query, nil
+}
+
+func init() {
+	auditCmd.Flags().String("key", "", "Only records of the key")
+	auditCmd.Flags().String("user", "", "Only records of the user")
+	auditCmd.Flags().String("since", "", "Only records at or after the RFC 3339 time")
+	auditCmd.Flags().String("until", "", "Only records before the RFC 3339 time")
+	auditCmd.Flags().Int("limit", 0, "Only the latest records")
+	auditCmd.Flags().Bool("verify", false, "Verify the hash chain instead of querying")
+	auditCmd.Flags().String("file", "", "Read a local audit log file instead of asking the server")
+	rootCmd.AddCommand(auditCmd)
+}
@@ -1,12 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"qq/pkg/log"
 	"qq/pkg/qqclient"
+	"qq/pkg/qqclient/http"
 
 	"github.com/spf13/cobra"
 )
 
+// batchGetClient gets all keys in a single request
+type batchGetClient interface {
+	GetBatch(ctx context.Context, keys []string) ([]http.BatchGetResult, error)
+}
+
 type keyReply struct {
 	key               string
 	asyncReplyChannel chan qqclient.AsyncReply[*qqclient.Entity]
@@ -25,6 +32,25 @@ var batchGetCmd = &cobra.Command{
 
 		log.Debug(ctx, "batch-get called")
 
+		if batchClient, ok := client.(batchGetClient); ok {
+			results, err := batchClient.GetBatch(ctx, args)
+			if err != nil {
+				log.Error(ctx, "failed to get batch", log.Args{"error": err})
+				return err
+			}
+
+			for _, result := range results {
+				if result.Entity == nil {
+					log.Info(ctx, "entity does not exist", log.Args{"key": result.Key})
+					continue
+				}
+
+				log.Info(ctx, "batch-get command result", log.Args{"key": result.Key, "entity": *result.Entity})
+			}
+
+			return nil
+		}
+
 		keyReplies := make([]keyReply, 0, len(args))
 
 		for _, key := range args {
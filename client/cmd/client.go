@@ -2,12 +2,16 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"qq/pkg/log"
 	"qq/pkg/qqclient"
+	"qq/pkg/qqclient/binaryqq"
+	"qq/pkg/qqclient/grpc"
 	"qq/pkg/qqclient/http"
 	"qq/pkg/qqclient/rabbitqq"
 	"qq/pkg/qqcontext"
+	"qq/pkg/qqtls"
 )
 
 func createClient(cmdContext context.Context) (qqclient.Client, context.Context, error) {
@@ -25,6 +29,12 @@ func createClient(cmdContext context.Context) (qqclient.Client, context.Context,
 		return nil, nil, err
 	}
 
+	credentials, err := readCredentials()
+	if err != nil {
+		log.Error(ctx, "failed to get credentials", log.Args{"error": err})
+		return nil, nil, err
+	}
+
 	var client qqclient.Client
 
 	switch clientType {
@@ -35,14 +45,65 @@ func createClient(cmdContext context.Context) (qqclient.Client, context.Context,
 			return nil, nil, err
 		}
 
-		client, err = rabbitqq.NewClient(ctx, queue)
+		client, err = rabbitqq.NewClientWithOptions(ctx, queue, rabbitqq.Options{Credentials: credentials})
 		if err != nil {
 			log.Error(ctx, "failed to create new client", log.Args{"error": err})
 			return nil, nil, err
 		}
 
 	case http.ClientType:
-		client = http.NewClient(ctx)
+		serverURL, err := rootCmd.Flags().GetString("server_url")
+		if err != nil {
+			log.Error(ctx, "failed to get server URL value from command flag ", log.Args{"error": err})
+			return nil, nil, err
+		}
+
+		tlsConfig, err := readTLSConfig()
+		if err != nil {
+			log.Error(ctx, "failed to configure TLS", log.Args{"error": err})
+			return nil, nil, err
+		}
+
+		client = http.NewClientWithOptions(ctx, http.Options{
+			ServerURL:   serverURL,
+			Credentials: credentials,
+			TLS:         tlsConfig,
+		})
+
+	case grpc.ClientType:
+		serverURL, err := rootCmd.Flags().GetString("grpc_server_url")
+		if err != nil {
+			log.Error(ctx, "failed to get gRPC server URL value from command flag ", log.Args{"error": err})
+			return nil, nil, err
+		}
+
+		tlsConfig, err := readTLSConfig()
+		if err != nil {
+			log.Error(ctx, "failed to configure TLS", log.Args{"error": err})
+			return nil, nil, err
+		}
+
+		client, err = grpc.NewClientWithOptions(ctx, grpc.Options{
+			ServerURL:   serverURL,
+			Credentials: credentials,
+			TLS:         tlsConfig,
+		})
+		if err != nil {
+			log.Error(ctx, "failed to create new client", log.Args{"error": err})
+			return nil, nil, err
+		}
+
+	case binaryqq.ClientType:
+		serverURL, err := rootCmd.Flags().GetString("binary_server_url")
+		if err != nil {
+			log.Error(ctx, "failed to get binary server URL value from command flag ", log.Args{"error": err})
+			return nil, nil, err
+		}
+
+		client = binaryqq.NewClientWithOptions(ctx, binaryqq.Options{
+			ServerURL:   serverURL,
+			Credentials: credentials,
+		})
 
 	default:
 		errText := "invalid client type"
@@ -52,3 +113,34 @@ func createClient(cmdContext context.Context) (qqclient.Client, context.Context,
 
 	return client, ctx, nil
 }
+
+// readTLSConfig returns nil, using the system roots, when no TLS flag is set
+func readTLSConfig() (*tls.Config, error) {
+	values := map[string]string{}
+
+	for _, name := range []string{"ca_file", "cert_file", "key_file"} {
+		value, err := rootCmd.Flags().GetString(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s value from command flag: %w", name, err)
+		}
+
+		values[name] = value
+	}
+
+	if values["ca_file"] == "" && values["cert_file"] == "" && values["key_file"] == "" {
+		return nil, nil
+	}
+
+	options := qqtls.ClientOptions{CAFile: values["ca_file"]}
+
+	if values["cert_file"] != "" || values["key_file"] != "" {
+		certificate, err := qqtls.LoadCertificateFile(values["cert_file"], values["key_file"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		options.Certificate = certificate
+	}
+
+	return qqtls.ClientConfig(options)
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"qq/pkg/auth"
+)
+
+const (
+	APIKeyEnv = "QQ_API_KEY"
+	TokenEnv  = "QQ_TOKEN"
+	ConfigEnv = "QQ_CONFIG"
+)
+
+// config is read from the file named by --config, QQ_CONFIG or
+// ~/.qq/config.json, in that order
+type config struct {
+	APIKey string `json:"api_key"`
+	Token  string `json:"token"`
+}
+
+// readCredentials takes the API key or token from the flags, then from the
+// environment, then from the config file; a token wins over an API key from
+// the same source
+func readCredentials() (*auth.Credentials, error) {
+	apiKey, err := rootCmd.Flags().GetString("api_key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key value from command flag: %w", err)
+	}
+
+	token, err := rootCmd.Flags().GetString("token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token value from command flag: %w", err)
+	}
+
+	if apiKey == "" && token == "" {
+		apiKey = os.Getenv(APIKeyEnv)
+		token = os.Getenv(TokenEnv)
+	}
+
+	if apiKey == "" && token == "" {
+		cfg, err := readConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		apiKey = cfg.APIKey
+		token = cfg.Token
+	}
+
+	switch {
+	case token != "":
+		return &auth.Credentials{Scheme: auth.SchemeBearer, Token: token}, nil
+	case apiKey != "":
+		return &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: apiKey}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func readConfig() (config, error) {
+	var cfg config
+
+	path, err := rootCmd.Flags().GetString("config")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get config value from command flag: %w", err)
+	}
+
+	explicit := path != ""
+
+	if path == "" {
+		path = os.Getenv(ConfigEnv)
+		explicit = path != ""
+	}
+
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return cfg, nil
+		}
+
+		path = filepath.Join(home, ".qq", "config.json")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
@@ -1,12 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"qq/pkg/log"
+	"qq/pkg/qqclient/http"
 
 	"github.com/spf13/cobra"
 )
 
+// scanClient streams the entities instead of loading them all at once
+type scanClient interface {
+	Scan(ctx context.Context) (http.EntityIterator, error)
+}
+
 var getAllCmd = &cobra.Command{
 	Use:   "get-all",
 	Short: "get all items",
@@ -20,6 +27,28 @@ var getAllCmd = &cobra.Command{
 
 		log.Debug(ctx, "get-all called")
 
+		if scanClient, ok := client.(scanClient); ok {
+			iterator, err := scanClient.Scan(ctx)
+			if err != nil {
+				log.Error(ctx, "failed to scan", log.Args{"error": err})
+				return err
+			}
+			defer iterator.Close()
+
+			for i := 1; iterator.Next(); i++ {
+				key := fmt.Sprintf("entity %v", i)
+				log.Info(ctx, "get-all command result", log.Args{key: iterator.Entity()})
+			}
+
+			err = iterator.Err()
+			if err != nil {
+				log.Error(ctx, "failed to scan", log.Args{"error": err})
+				return err
+			}
+
+			return nil
+		}
+
 		entities, err := client.GetAll(ctx)
 		if err != nil {
 			log.Error(ctx, "failed to get all", log.Args{"error": err})
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"qq/pkg/health"
+	"qq/pkg/log"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// healthClient is implemented by both the HTTP and the RabbitMQ clients
+type healthClient interface {
+	Health(ctx context.Context) (*health.Report, error)
+}
+
+var healthCmd = &cobra.Command{
+	Use:   "health",
+	Short: "check server readiness",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, ctx, err := createClient(cmd.Context())
+		if err != nil {
+			log.Error(ctx, "failed to create client", log.Args{"error": err})
+			return err
+		}
+
+		log.Debug(ctx, "health called")
+
+		checker, ok := client.(healthClient)
+		if !ok {
+			errText := "client does not support health checks"
+			log.Error(ctx, errText)
+			return fmt.Errorf(errText)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			log.Error(ctx, "failed to get timeout value from command flag", log.Args{"error": err})
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		report, err := checker.Health(ctx)
+		if err != nil {
+			log.Error(ctx, "failed to get health", log.Args{"error": err})
+			return err
+		}
+
+		data := log.Args{"status": report.Status}
+		for _, dependency := range report.Dependencies {
+			data[dependency.Name] = dependency
+		}
+
+		if !report.Up() {
+			log.Error(ctx, "server is not ready", data)
+			return fmt.Errorf("server is not ready")
+		}
+
+		log.Info(ctx, "health command result", data)
+
+		return nil
+	},
+}
+
+func init() {
+	healthCmd.Flags().Duration("timeout", 5*time.Second, "Timeout")
+	rootCmd.AddCommand(healthCmd)
+}
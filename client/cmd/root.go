@@ -3,6 +3,8 @@ package cmd
 import (
 	"os"
 	"path/filepath"
+	"qq/pkg/qqclient/binaryqq"
+	"qq/pkg/qqclient/grpc"
 	"qq/pkg/qqclient/http"
 	"qq/pkg/qqclient/rabbitqq"
 	"qq/pkg/qqcontext"
@@ -26,4 +28,13 @@ func init() {
 	rootCmd.PersistentFlags().String("queue", rabbitqq.RpcQueue, "Queue name")
 	rootCmd.PersistentFlags().String("user_id", qqcontext.DefaultUserIdValue, "User ID")
 	rootCmd.PersistentFlags().String("client_type", http.ClientType, "Client type")
+	rootCmd.PersistentFlags().String("api_key", "", "API key, also read from "+APIKeyEnv)
+	rootCmd.PersistentFlags().String("token", "", "JWT bearer token, also read from "+TokenEnv)
+	rootCmd.PersistentFlags().String("server_url", http.HTTPServerURL, "Server URL of the HTTP client, https:// for TLS")
+	rootCmd.PersistentFlags().String("grpc_server_url", grpc.GRPCServerURL, "Server address of the gRPC client")
+	rootCmd.PersistentFlags().String("binary_server_url", binaryqq.BinaryServerURL, "Server address of the binary client, unix://<path> for a Unix domain socket")
+	rootCmd.PersistentFlags().String("ca_file", "", "CA bundle to verify the HTTP server against")
+	rootCmd.PersistentFlags().String("cert_file", "", "Client certificate file for mutual TLS")
+	rootCmd.PersistentFlags().String("key_file", "", "Client key file for mutual TLS")
+	rootCmd.PersistentFlags().String("config", "", "Config file with api_key or token, also read from "+ConfigEnv)
 }
@@ -1,6 +1,7 @@
 package models
 
 type Entity struct {
-	Key   string
-	Value string
+	Key     string
+	Value   string
+	Version uint64
 }
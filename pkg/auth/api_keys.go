@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"qq/pkg/qqcontext"
+	"strings"
+)
+
+// APIKeys authenticates static API keys; keys are compared by their hashes
+// in constant time so that the comparison does not leak them
+type APIKeys struct {
+	users map[[sha256.Size]byte]string
+}
+
+var _ Authenticator = APIKeys{}
+
+// NewAPIKeys maps API keys to the user ids they authenticate
+func NewAPIKeys(keys map[string]string) APIKeys {
+	users := make(map[[sha256.Size]byte]string, len(keys))
+	for key, userId := range keys {
+		users[sha256.Sum256([]byte(key))] = userId
+	}
+
+	return APIKeys{users: users}
+}
+
+func (a APIKeys) Authenticate(ctx context.Context, credentials Credentials) (qqcontext.Identity, error) {
+	hash := sha256.Sum256([]byte(credentials.Token))
+
+	userId := ""
+	for keyHash, keyUserId := range a.users {
+		if subtle.ConstantTimeCompare(hash[:], keyHash[:]) == 1 {
+			userId = keyUserId
+		}
+	}
+
+	if userId == "" {
+		return qqcontext.Identity{}, ErrInvalidCredentials
+	}
+
+	return qqcontext.Identity{UserId: userId, Method: SchemeAPIKey}, nil
+}
+
+// ParseAPIKeys parses "key=user,key=user" into the map taken by NewAPIKeys
+func ParseAPIKeys(value string) (map[string]string, error) {
+	keys := map[string]string{}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, userId, found := strings.Cut(pair, "=")
+		if !found || key == "" || userId == "" {
+			return nil, fmt.Errorf("invalid API key %q: expected key=user", pair)
+		}
+
+		keys[key] = userId
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"qq/pkg/qqcontext"
+	"strings"
+)
+
+// AuthorizationHeader carries the credentials in HTTP requests and in AMQP
+// message headers
+const AuthorizationHeader = "Authorization"
+
+const (
+	SchemeAPIKey = "ApiKey"
+	SchemeBearer = "Bearer"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+type Credentials struct {
+	Scheme string
+	Token  string
+}
+
+// ParseCredentials parses an Authorization value such as "Bearer <token>";
+// the scheme is case-insensitive
+func ParseCredentials(value string) (Credentials, error) {
+	if value == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+
+	scheme, token, found := strings.Cut(value, " ")
+	token = strings.TrimSpace(token)
+	if !found || token == "" {
+		return Credentials{}, fmt.Errorf("%w: malformed authorization value", ErrInvalidCredentials)
+	}
+
+	for _, known := range []string{SchemeAPIKey, SchemeBearer} {
+		if strings.EqualFold(scheme, known) {
+			scheme = known
+		}
+	}
+
+	return Credentials{Scheme: scheme, Token: token}, nil
+}
+
+func (c Credentials) String() string {
+	return fmt.Sprintf("%s %s", c.Scheme, c.Token)
+}
+
+type Authenticator interface {
+	// Authenticate returns the identity the credentials belong to, or an
+	// error matching ErrInvalidCredentials
+	Authenticate(ctx context.Context, credentials Credentials) (qqcontext.Identity, error)
+}
+
+// Schemes authenticates credentials with the authenticator of their scheme
+type Schemes map[string]Authenticator
+
+var _ Authenticator = Schemes{}
+
+func (s Schemes) Authenticate(ctx context.Context, credentials Credentials) (qqcontext.Identity, error) {
+	authenticator, ok := s[credentials.Scheme]
+	if !ok {
+		return qqcontext.Identity{}, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidCredentials, credentials.Scheme)
+	}
+
+	return authenticator.Authenticate(ctx, credentials)
+}
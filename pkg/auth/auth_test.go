@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"qq/pkg/qqcontext"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCredentials(t *testing.T) {
+	testCases := []struct {
+		name   string
+		value  string
+		exp    Credentials
+		expErr error
+	}{
+		{
+			name:  "Bearer",
+			value: "Bearer abc",
+			exp:   Credentials{Scheme: SchemeBearer, Token: "abc"},
+		},
+		{
+			name:  "CaseInsensitiveScheme",
+			value: "apikey abc",
+			exp:   Credentials{Scheme: SchemeAPIKey, Token: "abc"},
+		},
+		{
+			name:   "Empty",
+			value:  "",
+			expErr: ErrNoCredentials,
+		},
+		{
+			name:   "NoToken",
+			value:  "Bearer",
+			expErr: ErrInvalidCredentials,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			credentials, err := ParseCredentials(testCase.value)
+			if testCase.expErr != nil {
+				assert.ErrorIs(t, err, testCase.expErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.exp, credentials)
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+
+	keys, err := ParseAPIKeys("key1=alice, key2=bob")
+	require.NoError(t, err)
+
+	authenticator := NewAPIKeys(keys)
+
+	identity, err := authenticator.Authenticate(ctx, Credentials{Scheme: SchemeAPIKey, Token: "key2"})
+	require.NoError(t, err)
+	assert.Equal(t, qqcontext.Identity{UserId: "bob", Method: SchemeAPIKey}, identity)
+
+	_, err = authenticator.Authenticate(ctx, Credentials{Scheme: SchemeAPIKey, Token: "key3"})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = ParseAPIKeys("key1")
+	assert.Error(t, err)
+}
+
+func TestJWT(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("secret")
+	now := time.Unix(1700000000, 0)
+
+	authenticator := JWT{
+		Secret:   secret,
+		Audience: "qq",
+		Leeway:   time.Minute,
+		Now:      func() time.Time { return now },
+	}
+
+	sign := func(claims Claims) string {
+		token, err := SignJWT(secret, claims)
+		require.NoError(t, err)
+		return token
+	}
+
+	valid := sign(Claims{Subject: "alice", Audience: Audience{"qq"}, ExpiresAt: now.Add(time.Hour).Unix()})
+	parts := strings.Split(valid, ".")
+
+	wrongSecret, err := SignJWT([]byte("other"), Claims{Subject: "alice", Audience: Audience{"qq"}, ExpiresAt: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		token  string
+		expErr bool
+	}{
+		{
+			name:  "Valid",
+			token: valid,
+		},
+		{
+			name:  "ExpiredWithinLeeway",
+			token: sign(Claims{Subject: "alice", Audience: Audience{"qq"}, ExpiresAt: now.Add(-time.Second).Unix()}),
+		},
+		{
+			name:   "Expired",
+			token:  sign(Claims{Subject: "alice", Audience: Audience{"qq"}, ExpiresAt: now.Add(-time.Hour).Unix()}),
+			expErr: true,
+		},
+		{
+			name:   "NotYetValid",
+			token:  sign(Claims{Subject: "alice", Audience: Audience{"qq"}, ExpiresAt: now.Add(2 * time.Hour).Unix(), NotBefore: now.Add(time.Hour).Unix()}),
+			expErr: true,
+		},
+		{
+			name:   "NoExpiry",
+			token:  sign(Claims{Subject: "alice", Audience: Audience{"qq"}}),
+			expErr: true,
+		},
+		{
+			name:  "AudienceArray",
+			token: sign(Claims{Subject: "alice", Audience: Audience{"other", "qq"}, ExpiresAt: now.Add(time.Hour).Unix()}),
+		},
+		{
+			name:   "WrongAudience",
+			token:  sign(Claims{Subject: "alice", Audience: Audience{"other"}, ExpiresAt: now.Add(time.Hour).Unix()}),
+			expErr: true,
+		},
+		{
+			name:   "WrongAudienceArray",
+			token:  sign(Claims{Subject: "alice", Audience: Audience{"other", "another"}, ExpiresAt: now.Add(time.Hour).Unix()}),
+			expErr: true,
+		},
+		{
+			name:   "NoSubject",
+			token:  sign(Claims{Audience: Audience{"qq"}, ExpiresAt: now.Add(time.Hour).Unix()}),
+			expErr: true,
+		},
+		{
+			name:   "WrongSecret",
+			token:  wrongSecret,
+			expErr: true,
+		},
+		{
+			name:   "TamperedClaims",
+			token:  parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"bob","aud":"qq"}`)) + "." + parts[2],
+			expErr: true,
+		},
+		{
+			name:   "AlgorithmNone",
+			token:  base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".",
+			expErr: true,
+		},
+		{
+			name:   "Malformed",
+			token:  "abc",
+			expErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(ctx, Credentials{Scheme: SchemeBearer, Token: testCase.token})
+			if testCase.expErr {
+				assert.ErrorIs(t, err, ErrInvalidCredentials)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, qqcontext.Identity{UserId: "alice", Method: SchemeBearer}, identity)
+		})
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	ctx := context.Background()
+
+	authenticator := Schemes{SchemeAPIKey: NewAPIKeys(map[string]string{"key": "alice"})}
+
+	identity, err := authenticator.Authenticate(ctx, Credentials{Scheme: SchemeAPIKey, Token: "key"})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", identity.UserId)
+
+	_, err = authenticator.Authenticate(ctx, Credentials{Scheme: SchemeBearer, Token: "key"})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
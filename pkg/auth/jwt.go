@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"qq/pkg/qqcontext"
+	"strings"
+	"time"
+)
+
+// Claims are the registered JWT claims qq reads; Subject is the user id
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+// Audience is the aud claim, which RFC 7519 allows to be a single string or
+// an array of strings; a single audience is encoded as a string
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var audience string
+
+	err := json.Unmarshal(data, &audience)
+	if err == nil {
+		*a = Audience{audience}
+		return nil
+	}
+
+	var audiences []string
+
+	err = json.Unmarshal(data, &audiences)
+	if err != nil {
+		return fmt.Errorf("aud is neither a string nor an array of strings")
+	}
+
+	*a = audiences
+
+	return nil
+}
+
+func (a Audience) contains(audience string) bool {
+	for _, candidate := range a {
+		if candidate == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+const jwtAlgorithm = "HS256"
+
+// JWT authenticates bearer tokens signed with HMAC-SHA256; other algorithms,
+// including "none", are rejected
+type JWT struct {
+	Secret []byte
+	// Issuer and Audience are checked when set
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway time.Duration
+	// AllowNoExpiry accepts tokens without exp, which are otherwise
+	// rejected since they would be valid forever
+	AllowNoExpiry bool
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+var _ Authenticator = JWT{}
+
+func (j JWT) Authenticate(ctx context.Context, credentials Credentials) (qqcontext.Identity, error) {
+	claims, err := j.verify(credentials.Token)
+	if err != nil {
+		return qqcontext.Identity{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	return qqcontext.Identity{UserId: claims.Subject, Method: SchemeBearer}, nil
+}
+
+func (j JWT) verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT")
+	}
+
+	var header jwtHeader
+
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode header: %w", err)
+	}
+
+	if header.Algorithm != jwtAlgorithm {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	if !hmac.Equal(signature, sign(j.Secret, parts[0]+"."+parts[1])) {
+		return nil, fmt.Errorf("signature mismatch")
+	}
+
+	var claims Claims
+
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode claims: %w", err)
+	}
+
+	err = j.validate(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+func (j JWT) validate(claims Claims) error {
+	now := time.Now()
+	if j.Now != nil {
+		now = j.Now()
+	}
+
+	if claims.Subject == "" {
+		return fmt.Errorf("token has no subject")
+	}
+
+	if claims.ExpiresAt == 0 && !j.AllowNoExpiry {
+		return fmt.Errorf("token has no expiry")
+	}
+
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(j.Leeway)) {
+		return fmt.Errorf("token is expired")
+	}
+
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-j.Leeway)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	if j.Issuer != "" && claims.Issuer != j.Issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+
+	if j.Audience != "" && !claims.Audience.contains(j.Audience) {
+		return fmt.Errorf("unexpected audience %q", []string(claims.Audience))
+	}
+
+	return nil
+}
+
+// SignJWT issues an HS256 token for claims
+func SignJWT(secret []byte, claims Claims) (string, error) {
+	header, err := encodeSegment(jwtHeader{Algorithm: jwtAlgorithm, Type: "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode header: %w", err)
+	}
+
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode claims: %w", err)
+	}
+
+	signingInput := header + "." + payload
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign(secret, signingInput)), nil
+}
+
+func sign(secret []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+func encodeSegment(value any) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
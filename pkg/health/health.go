@@ -0,0 +1,107 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// CheckTimeout bounds every dependency check, so that a hanging dependency
+// is reported as down instead of blocking the probe
+const CheckTimeout = 2 * time.Second
+
+type DependencyReport struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyReport `json:"dependencies"`
+}
+
+func (r Report) Up() bool {
+	return r.Status == StatusUp
+}
+
+type Check func(ctx context.Context) error
+
+type Dependency struct {
+	Name  string
+	Check Check
+}
+
+type Checker interface {
+	// Ready runs all dependency checks concurrently; the report is up only
+	// when every dependency is
+	Ready(ctx context.Context) Report
+}
+
+type checker struct {
+	dependencies []Dependency
+}
+
+var _ Checker = checker{}
+
+func NewChecker(dependencies ...Dependency) Checker {
+	return checker{
+		dependencies: dependencies,
+	}
+}
+
+func (c checker) Ready(ctx context.Context) Report {
+	report := Report{
+		Status:       StatusUp,
+		Dependencies: make([]DependencyReport, len(c.dependencies)),
+	}
+
+	var wg sync.WaitGroup
+
+	for i, dependency := range c.dependencies {
+		wg.Add(1)
+		go func(i int, dependency Dependency) {
+			defer wg.Done()
+			report.Dependencies[i] = check(ctx, dependency)
+		}(i, dependency)
+	}
+
+	wg.Wait()
+
+	for _, dependency := range report.Dependencies {
+		if dependency.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+
+	return report
+}
+
+func check(ctx context.Context, dependency Dependency) DependencyReport {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- dependency.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = fmt.Errorf("check timed out: %w", ctx.Err())
+	}
+
+	if err != nil {
+		return DependencyReport{Name: dependency.Name, Status: StatusDown, Error: err.Error()}
+	}
+
+	return DependencyReport{Name: dependency.Name, Status: StatusUp}
+}
@@ -0,0 +1,76 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckerReady(t *testing.T) {
+	ctx := context.Background()
+
+	up := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+
+	release := make(chan struct{})
+	defer close(release)
+	hanging := func(ctx context.Context) error { <-release; return nil }
+
+	testCases := []struct {
+		name         string
+		dependencies []Dependency
+		ctx          func() (context.Context, context.CancelFunc)
+		exp          Report
+	}{
+		{
+			name:         "NoDependencies",
+			dependencies: nil,
+			exp:          Report{Status: StatusUp, Dependencies: []DependencyReport{}},
+		},
+		{
+			name:         "Up",
+			dependencies: []Dependency{{Name: "a", Check: up}, {Name: "b", Check: up}},
+			exp: Report{Status: StatusUp, Dependencies: []DependencyReport{
+				{Name: "a", Status: StatusUp},
+				{Name: "b", Status: StatusUp},
+			}},
+		},
+		{
+			name:         "Down",
+			dependencies: []Dependency{{Name: "a", Check: up}, {Name: "b", Check: down}},
+			exp: Report{Status: StatusDown, Dependencies: []DependencyReport{
+				{Name: "a", Status: StatusUp},
+				{Name: "b", Status: StatusDown, Error: "connection refused"},
+			}},
+		},
+		{
+			name:         "TimedOut",
+			dependencies: []Dependency{{Name: "a", Check: hanging}},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(ctx, time.Millisecond)
+			},
+			exp: Report{Status: StatusDown, Dependencies: []DependencyReport{
+				{Name: "a", Status: StatusDown, Error: "check timed out: context deadline exceeded"},
+			}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := ctx
+			if testCase.ctx != nil {
+				var cancel context.CancelFunc
+				ctx, cancel = testCase.ctx()
+				defer cancel()
+			}
+
+			report := NewChecker(testCase.dependencies...).Ready(ctx)
+			assert.Equal(t, testCase.exp, report)
+			assert.Equal(t, testCase.exp.Status == StatusUp, report.Up())
+		})
+	}
+}
@@ -33,11 +33,17 @@ func Debug(ctx context.Context, message string, args ...Args) {
 func print(severity string, ctx context.Context, message string, argsArr []Args) {
 	currentTime := time.Now()
 	userId := qqcontext.GetUserIdValue(ctx)
+	requestId := qqcontext.GetRequestIdValue(ctx)
 
 	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
 
-	log.Printf("%v [%s] %s: %s\n",
-		currentTime.Format("2006.01.02 15:04:05.000"), severity, userId, message)
+	if requestId != "" {
+		log.Printf("%v [%s] %s (%s): %s\n",
+			currentTime.Format("2006.01.02 15:04:05.000"), severity, userId, requestId, message)
+	} else {
+		log.Printf("%v [%s] %s: %s\n",
+			currentTime.Format("2006.01.02 15:04:05.000"), severity, userId, message)
+	}
 
 	for _, args := range argsArr {
 		for k, v := range args {
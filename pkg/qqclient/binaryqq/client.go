@@ -0,0 +1,261 @@
+package binaryqq
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	"qq/pkg/qqclient"
+	"qq/pkg/qqcontext"
+	"time"
+)
+
+const (
+	DefaultPoolSize    = 4
+	DefaultDialTimeout = 5 * time.Second
+)
+
+type Client interface {
+	qqclient.Client
+	Close() error
+}
+
+type Options struct {
+	// ServerURL is the address of the server, BinaryServerURL by default
+	ServerURL string
+	// Credentials authenticate every connection when set
+	Credentials *auth.Credentials
+	// PoolSize is the number of connections the requests are spread over,
+	// DefaultPoolSize by default
+	PoolSize int
+	// DialTimeout is DefaultDialTimeout by default
+	DialTimeout time.Duration
+}
+
+type client struct {
+	pool *pool
+}
+
+var _ Client = client{}
+
+func NewClient(ctx context.Context) Client {
+	return NewClientWithOptions(ctx, Options{})
+}
+
+// NewClientWithOptions does not connect, the connections being dialed by the
+// first requests
+func NewClientWithOptions(ctx context.Context, options Options) Client {
+	if options.ServerURL == "" {
+		options.ServerURL = BinaryServerURL
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultPoolSize
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = DefaultDialTimeout
+	}
+
+	log.Debug(ctx, "create new binary client", log.Args{"server URL": options.ServerURL, "pool size": options.PoolSize})
+
+	return client{
+		pool: newPool(options.PoolSize, func(ctx context.Context) (*conn, error) {
+			return dial(ctx, options)
+		}),
+	}
+}
+
+func dial(ctx context.Context, options Options) (*conn, error) {
+	network, address := ParseAddress(options.ServerURL)
+
+	dialer := net.Dialer{Timeout: options.DialTimeout}
+
+	netConn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	c := newConn(netConn)
+
+	if options.Credentials == nil {
+		return c, nil
+	}
+
+	var encoder Encoder
+	encoder.String(options.Credentials.String())
+
+	frame, err := c.roundTrip(ctx, OpAuth, encoder.Payload)
+	if err == nil {
+		err = statusError(frame)
+	}
+	if err != nil {
+		_ = c.close()
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	return c, nil
+}
+
+// call sends a request with the user id and request id of ctx, and returns
+// a decoder of the result
+func (c client) call(ctx context.Context, op byte, encode func(encoder *Encoder)) (*Decoder, error) {
+	log.Debug(ctx, "binary client", log.Args{"op": op})
+
+	conn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoder Encoder
+	encoder.String(qqcontext.GetUserIdValue(ctx))
+	encoder.String(qqcontext.GetRequestIdValue(ctx))
+	encode(&encoder)
+
+	frame, err := conn.roundTrip(ctx, op, encoder.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	err = statusError(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Decoder{Payload: frame.Payload}, nil
+}
+
+func statusError(frame Frame) error {
+	if frame.Code == StatusOK {
+		return nil
+	}
+
+	decoder := Decoder{Payload: frame.Payload}
+
+	return &StatusError{Status: frame.Code, Message: decoder.String()}
+}
+
+func (c client) Add(ctx context.Context, entity qqclient.Entity) (bool, error) {
+	decoder, err := c.call(ctx, OpAdd, func(encoder *Encoder) {
+		encoder.String(entity.Key)
+		encoder.String(entity.Value)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to add: %w", err)
+	}
+
+	added := decoder.Bool()
+
+	return added, decoder.Err()
+}
+
+func (c client) Remove(ctx context.Context, key string) (bool, error) {
+	decoder, err := c.call(ctx, OpRemove, func(encoder *Encoder) {
+		encoder.String(key)
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to remove: %w", err)
+	}
+
+	removed := decoder.Bool()
+
+	return removed, decoder.Err()
+}
+
+func (c client) Get(ctx context.Context, key string) (*qqclient.Entity, error) {
+	decoder, err := c.call(ctx, OpGet, func(encoder *Encoder) {
+		encoder.String(key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get: %w", err)
+	}
+
+	if !decoder.Bool() {
+		return nil, decoder.Err()
+	}
+
+	entity := &qqclient.Entity{Key: key, Value: decoder.String()}
+
+	err = decoder.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (c client) GetAsync(ctx context.Context, key string) (chan qqclient.AsyncReply[*qqclient.Entity], error) {
+	ch := make(chan qqclient.AsyncReply[*qqclient.Entity], 1)
+
+	go func() {
+		result, err := c.Get(ctx, key)
+		if err != nil {
+			ch <- qqclient.AsyncReply[*qqclient.Entity]{
+				Err: fmt.Errorf("failed to get key %s: %w", key, err),
+			}
+
+			return
+		}
+
+		ch <- qqclient.AsyncReply[*qqclient.Entity]{
+			Result: result,
+		}
+	}()
+
+	return ch, nil
+}
+
+func (c client) GetAll(ctx context.Context) ([]qqclient.Entity, error) {
+	var entities []qqclient.Entity
+	after := ""
+
+	for {
+		page, next, err := c.getPage(ctx, after)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get all: %w", err)
+		}
+
+		entities = append(entities, page...)
+
+		if next == "" {
+			return entities, nil
+		}
+
+		after = next
+	}
+}
+
+// getPage returns the entities following the key after, and the key the
+// next page continues after
+func (c client) getPage(ctx context.Context, after string) ([]qqclient.Entity, string, error) {
+	decoder, err := c.call(ctx, OpGetAll, func(encoder *Encoder) {
+		encoder.String(after)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	count := decoder.Uvarint()
+
+	// each entity takes at least two bytes
+	if count > uint64(len(decoder.Payload))/2 {
+		return nil, "", fmt.Errorf("%w: %d entities in %d bytes", ErrMalformedFrame, count, len(decoder.Payload))
+	}
+
+	entities := make([]qqclient.Entity, 0, count)
+	for i := uint64(0); i < count; i++ {
+		entities = append(entities, qqclient.Entity{Key: decoder.String(), Value: decoder.String()})
+	}
+
+	next := decoder.String()
+
+	err = decoder.Err()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entities, next, nil
+}
+
+func (c client) Close() error {
+	return c.pool.close()
+}
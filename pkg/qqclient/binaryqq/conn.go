@@ -0,0 +1,196 @@
+package binaryqq
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// conn pipelines requests: any number of them may be waiting for their
+// response, which the server may send in any order
+type conn struct {
+	netConn net.Conn
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	nextId uint64
+
+	mu      sync.Mutex
+	pending map[uint64]chan Frame
+	err     error
+	done    chan struct{}
+}
+
+func newConn(netConn net.Conn) *conn {
+	c := &conn{
+		netConn: netConn,
+		writer:  bufio.NewWriter(netConn),
+		pending: map[uint64]chan Frame{},
+		done:    make(chan struct{}),
+	}
+
+	go c.readLoop(bufio.NewReader(netConn))
+
+	return c
+}
+
+func (c *conn) readLoop(reader *bufio.Reader) {
+	for {
+		frame, err := ReadFrame(reader)
+		if err != nil {
+			c.fail(fmt.Errorf("failed to read response: %w", err))
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[frame.Id]
+		delete(c.pending, frame.Id)
+		c.mu.Unlock()
+
+		// the request has been given up on
+		if !ok {
+			continue
+		}
+
+		ch <- frame
+	}
+}
+
+// fail breaks the connection for good; the requests waiting on it return err
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	close(c.done)
+	_ = c.netConn.Close()
+}
+
+func (c *conn) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *conn) close() error {
+	c.fail(errConnClosed)
+	return nil
+}
+
+func (c *conn) roundTrip(ctx context.Context, code byte, payload []byte) (Frame, error) {
+	id := atomic.AddUint64(&c.nextId, 1)
+	ch := make(chan Frame, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return Frame{}, c.err
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := WriteFrame(c.writer, Frame{Id: id, Code: code, Payload: payload})
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	c.writeMu.Unlock()
+
+	if err != nil {
+		c.forget(id)
+
+		if errors.Is(err, ErrMalformedFrame) {
+			return Frame{}, err
+		}
+
+		c.fail(fmt.Errorf("failed to write request: %w", err))
+		return Frame{}, err
+	}
+
+	select {
+	case frame := <-ch:
+		return frame, nil
+	case <-c.done:
+		return Frame{}, c.err
+	case <-ctx.Done():
+		c.forget(id)
+		return Frame{}, ctx.Err()
+	}
+}
+
+func (c *conn) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// pool spreads the requests over a fixed number of connections, which are
+// dialed on first use and dialed again once broken
+type pool struct {
+	size  int
+	next  uint64
+	slots []poolSlot
+	dial  func(ctx context.Context) (*conn, error)
+}
+
+type poolSlot struct {
+	mu   sync.Mutex
+	conn *conn
+}
+
+func newPool(size int, dial func(ctx context.Context) (*conn, error)) *pool {
+	return &pool{
+		size:  size,
+		slots: make([]poolSlot, size),
+		dial:  dial,
+	}
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	slot := &p.slots[atomic.AddUint64(&p.next, 1)%uint64(p.size)]
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	if slot.conn != nil && !slot.conn.broken() {
+		return slot.conn, nil
+	}
+
+	c, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	slot.conn = c
+
+	return c, nil
+}
+
+func (p *pool) close() error {
+	for i := range p.slots {
+		slot := &p.slots[i]
+
+		slot.mu.Lock()
+		if slot.conn != nil {
+			_ = slot.conn.close()
+			slot.conn = nil
+		}
+		slot.mu.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package binaryqq
+
+import "strings"
+
+// BinaryServerURL is a TCP address; "unix://" followed by a path is a Unix
+// domain socket, e.g. "unix:///run/qq.sock"
+const BinaryServerURL = "localhost:7070"
+const ClientType = "binary"
+
+const unixScheme = "unix://"
+
+// ParseAddress returns the network and address to dial or listen on
+func ParseAddress(serverURL string) (string, string) {
+	if strings.HasPrefix(serverURL, unixScheme) {
+		return "unix", strings.TrimPrefix(serverURL, unixScheme)
+	}
+
+	return "tcp", serverURL
+}
+
+// Every frame is
+//
+//	length  uint32, big endian, of the rest of the frame
+//	id      uint64, big endian, chosen by the client and echoed in the response
+//	code    byte, an opcode in requests and a status in responses
+//	payload
+//
+// Strings in payloads are a uvarint length followed by the bytes, and
+// booleans are a byte. Requests, apart from OpAuth, start with the user id
+// and the request id, which may be empty.
+const (
+	OpAuth   byte = 1
+	OpGet    byte = 2
+	OpAdd    byte = 3
+	OpRemove byte = 4
+	OpGetAll byte = 5
+)
+
+// OpGetAll pages through the keys: its request carries the key to continue
+// after, empty for the first page, and its result is a uvarint count of keys
+// and values followed by the key the next page continues after, which is
+// empty after the last page.
+//
+// The payload of StatusOK is the result of the request: nothing for OpAuth,
+// a boolean followed by the value when it is true for OpGet, a boolean for
+// OpAdd and OpRemove, and a page for OpGetAll.
+// The payload of the other statuses is the error message.
+const (
+	StatusOK               byte = 0
+	StatusBadRequest       byte = 1
+	StatusUnauthorized     byte = 2
+	StatusPermissionDenied byte = 3
+	StatusRateLimited      byte = 4
+	StatusQuotaExceeded    byte = 5
+	StatusInternalError    byte = 6
+)
+
+// MaxFrameLength bounds the length field, so that a corrupt length does not
+// make the reader allocate gigabytes
+const MaxFrameLength = 64 * 1024 * 1024
+
+// MaxPayloadLength is the longest payload a frame can carry
+const MaxPayloadLength = MaxFrameLength - (headerLength - 4)
+
+const headerLength = 4 + 8 + 1
@@ -0,0 +1,45 @@
+package binaryqq
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBadRequest       = errors.New("bad request")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+	ErrInternalError    = errors.New("internal server error")
+)
+
+var statusErrors = map[byte]error{
+	StatusBadRequest:       ErrBadRequest,
+	StatusUnauthorized:     ErrUnauthorized,
+	StatusPermissionDenied: ErrPermissionDenied,
+	StatusRateLimited:      ErrRateLimited,
+	StatusQuotaExceeded:    ErrQuotaExceeded,
+	StatusInternalError:    ErrInternalError,
+}
+
+// StatusError is returned by the client for errors reported by the server,
+// and matches the corresponding ErrBadRequest, ... with errors.Is
+type StatusError struct {
+	Status  byte
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	err, ok := statusErrors[e.Status]
+	if !ok {
+		return fmt.Sprintf("status %d: %s", e.Status, e.Message)
+	}
+
+	return fmt.Sprintf("%v: %s", err, e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	err, ok := statusErrors[e.Status]
+	return ok && err == target
+}
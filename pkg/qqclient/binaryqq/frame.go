@@ -0,0 +1,159 @@
+package binaryqq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrMalformedFrame = errors.New("malformed frame")
+
+type Frame struct {
+	Id      uint64
+	Code    byte
+	Payload []byte
+}
+
+func ReadFrame(reader *bufio.Reader) (Frame, error) {
+	var header [headerLength]byte
+
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < headerLength-4 || length > MaxFrameLength {
+		return Frame{}, fmt.Errorf("%w: length %d", ErrMalformedFrame, length)
+	}
+
+	frame := Frame{
+		Id:      binary.BigEndian.Uint64(header[4:12]),
+		Code:    header[12],
+		Payload: make([]byte, int(length)-(headerLength-4)),
+	}
+
+	_, err = io.ReadFull(reader, frame.Payload)
+	// io.EOF only ends the stream between frames
+	if errors.Is(err, io.EOF) {
+		return Frame{}, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return frame, nil
+}
+
+// WriteFrame writes frame to the buffer of writer, which the caller flushes
+func WriteFrame(writer *bufio.Writer, frame Frame) error {
+	length := headerLength - 4 + len(frame.Payload)
+	if length > MaxFrameLength {
+		return fmt.Errorf("%w: length %d", ErrMalformedFrame, length)
+	}
+
+	var header [headerLength]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(length))
+	binary.BigEndian.PutUint64(header[4:12], frame.Id)
+	header[12] = frame.Code
+
+	_, err := writer.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(frame.Payload)
+	return err
+}
+
+// Encoder appends the fields of a payload
+type Encoder struct {
+	Payload []byte
+}
+
+func (e *Encoder) String(value string) {
+	e.Uvarint(uint64(len(value)))
+	e.Payload = append(e.Payload, value...)
+}
+
+func (e *Encoder) Bool(value bool) {
+	if value {
+		e.Payload = append(e.Payload, 1)
+		return
+	}
+
+	e.Payload = append(e.Payload, 0)
+}
+
+func (e *Encoder) Uvarint(value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	e.Payload = append(e.Payload, buf[:n]...)
+}
+
+// Decoder reads the fields of a payload; after the first malformed field
+// the others are zero and Err returns the error
+type Decoder struct {
+	Payload []byte
+	err     error
+}
+
+func (d *Decoder) Uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Uvarint(d.Payload)
+	if n <= 0 {
+		d.err = fmt.Errorf("%w: invalid uvarint", ErrMalformedFrame)
+		return 0
+	}
+
+	d.Payload = d.Payload[n:]
+
+	return value
+}
+
+func (d *Decoder) String() string {
+	length := d.Uvarint()
+	if d.err != nil {
+		return ""
+	}
+
+	if length > uint64(len(d.Payload)) {
+		d.err = fmt.Errorf("%w: string longer than payload", ErrMalformedFrame)
+		return ""
+	}
+
+	value := string(d.Payload[:length])
+	d.Payload = d.Payload[length:]
+
+	return value
+}
+
+func (d *Decoder) Bool() bool {
+	if d.err != nil {
+		return false
+	}
+
+	if len(d.Payload) == 0 {
+		d.err = fmt.Errorf("%w: missing boolean", ErrMalformedFrame)
+		return false
+	}
+
+	value := d.Payload[0] != 0
+	d.Payload = d.Payload[1:]
+
+	return value
+}
+
+// Err also reports the bytes left over after the last field
+func (d *Decoder) Err() error {
+	if d.err == nil && len(d.Payload) > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformedFrame, len(d.Payload))
+	}
+
+	return d.err
+}
@@ -0,0 +1,139 @@
+package binaryqq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+	var encoder Encoder
+	encoder.String("key")
+	encoder.Bool(true)
+	encoder.Uvarint(300)
+
+	frames := []Frame{
+		{Id: 1, Code: OpGet, Payload: encoder.Payload},
+		{Id: 1 << 40, Code: StatusOK, Payload: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+
+	for _, frame := range frames {
+		require.NoError(t, WriteFrame(writer, frame))
+	}
+	require.NoError(t, writer.Flush())
+
+	reader := bufio.NewReader(&buf)
+
+	for _, exp := range frames {
+		frame, err := ReadFrame(reader)
+		require.NoError(t, err)
+		assert.Equal(t, exp, frame)
+	}
+
+	_, err := ReadFrame(reader)
+	assert.ErrorIs(t, err, io.EOF)
+
+	decoder := Decoder{Payload: frames[0].Payload}
+	assert.Equal(t, "key", decoder.String())
+	assert.True(t, decoder.Bool())
+	assert.Equal(t, uint64(300), decoder.Uvarint())
+	assert.NoError(t, decoder.Err())
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	header := func(length uint32) []byte {
+		buf := make([]byte, headerLength)
+		binary.BigEndian.PutUint32(buf, length)
+		return buf
+	}
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		expErr error
+	}{
+		{
+			name:   "length shorter than the header",
+			data:   header(3),
+			expErr: ErrMalformedFrame,
+		},
+		{
+			name:   "length over MaxFrameLength",
+			data:   header(MaxFrameLength + 1),
+			expErr: ErrMalformedFrame,
+		},
+		{
+			name:   "truncated header",
+			data:   header(9)[:5],
+			expErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated payload",
+			data:   header(12),
+			expErr: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := ReadFrame(bufio.NewReader(bytes.NewReader(testCase.data)))
+			assert.ErrorIs(t, err, testCase.expErr)
+		})
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload []byte
+		decode  func(decoder *Decoder)
+	}{
+		{
+			name:    "string longer than payload",
+			payload: []byte{5, 'a'},
+			decode:  func(decoder *Decoder) { _ = decoder.String() },
+		},
+		{
+			name:    "missing boolean",
+			payload: []byte{},
+			decode:  func(decoder *Decoder) { decoder.Bool() },
+		},
+		{
+			name:    "invalid uvarint",
+			payload: []byte{0x80},
+			decode:  func(decoder *Decoder) { decoder.Uvarint() },
+		},
+		{
+			name:    "trailing bytes",
+			payload: []byte{1, 1},
+			decode:  func(decoder *Decoder) { decoder.Bool() },
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			decoder := Decoder{Payload: testCase.payload}
+			testCase.decode(&decoder)
+
+			assert.ErrorIs(t, decoder.Err(), ErrMalformedFrame)
+		})
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	network, address := ParseAddress("unix:///run/qq.sock")
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/qq.sock", address)
+
+	network, address = ParseAddress(BinaryServerURL)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, BinaryServerURL, address)
+}
@@ -0,0 +1,169 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	"qq/pkg/qqclient"
+	"qq/pkg/qqcontext"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+type Client interface {
+	qqclient.Client
+	// Scan is GetAll without holding all entities in memory
+	Scan(ctx context.Context) (EntityIterator, error)
+	// Watch streams the changes of the keys starting with prefix, made after
+	// the call, until ctx is done or the iterator is closed
+	Watch(ctx context.Context, prefix string) (ChangeIterator, error)
+	Close() error
+}
+
+type Options struct {
+	// ServerURL is the address of the server, GRPCServerURL by default
+	ServerURL string
+	// Credentials are sent in the authorization metadata of every call when set
+	Credentials *auth.Credentials
+	// TLS is used for the connection when set, otherwise it is plaintext
+	TLS *tls.Config
+	// DialOptions are appended to the options of the client, e.g. to dial
+	// an in-process listener
+	DialOptions []grpc.DialOption
+}
+
+type client struct {
+	conn        *grpc.ClientConn
+	credentials *auth.Credentials
+}
+
+var _ Client = client{}
+
+func NewClient(ctx context.Context) (Client, error) {
+	return NewClientWithOptions(ctx, Options{})
+}
+
+// NewClientWithOptions does not wait for the connection, which is made by
+// the first call
+func NewClientWithOptions(ctx context.Context, options Options) (Client, error) {
+	if options.ServerURL == "" {
+		options.ServerURL = GRPCServerURL
+	}
+
+	log.Debug(ctx, "create new grpc client", log.Args{"server URL": options.ServerURL})
+
+	transportCredentials := insecure.NewCredentials()
+	if options.TLS != nil {
+		transportCredentials = credentials.NewTLS(options.TLS)
+	}
+
+	dialOptions := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(transportCredentials),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec{})),
+	}, options.DialOptions...)
+
+	conn, err := grpc.DialContext(ctx, options.ServerURL, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	return client{
+		conn:        conn,
+		credentials: options.Credentials,
+	}, nil
+}
+
+// outgoing passes the user id, request id and credentials as metadata
+func (c client) outgoing(ctx context.Context) context.Context {
+	pairs := []string{UserIdMetadataKey, qqcontext.GetUserIdValue(ctx)}
+
+	requestId := qqcontext.GetRequestIdValue(ctx)
+	if requestId != "" {
+		pairs = append(pairs, RequestIdMetadataKey, requestId)
+	}
+
+	if c.credentials != nil {
+		pairs = append(pairs, AuthorizationMetadataKey, c.credentials.String())
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+func invoke[Request any, Reply any](ctx context.Context, c client, method string, request *Request) (*Reply, error) {
+	log.Debug(ctx, "grpc client", log.Args{"method": method, "request": request})
+
+	var reply Reply
+
+	err := c.conn.Invoke(c.outgoing(ctx), FullMethod(method), request, &reply)
+	if err != nil {
+		return nil, fmt.Errorf("failed to invoke %s: %w", method, err)
+	}
+
+	return &reply, nil
+}
+
+func (c client) Add(ctx context.Context, entity qqclient.Entity) (bool, error) {
+	reply, err := invoke[AddRequest, AddReply](ctx, c, AddMethodName, &AddRequest{Entity: entity})
+	if err != nil {
+		return false, err
+	}
+
+	return reply.Added, nil
+}
+
+func (c client) Remove(ctx context.Context, key string) (bool, error) {
+	reply, err := invoke[RemoveRequest, RemoveReply](ctx, c, RemoveMethodName, &RemoveRequest{Key: key})
+	if err != nil {
+		return false, err
+	}
+
+	return reply.Removed, nil
+}
+
+func (c client) Get(ctx context.Context, key string) (*qqclient.Entity, error) {
+	reply, err := invoke[GetRequest, GetReply](ctx, c, GetMethodName, &GetRequest{Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Entity, nil
+}
+
+func (c client) GetAsync(ctx context.Context, key string) (chan qqclient.AsyncReply[*qqclient.Entity], error) {
+	ch := make(chan qqclient.AsyncReply[*qqclient.Entity], 1)
+
+	go func() {
+		result, err := c.Get(ctx, key)
+		if err != nil {
+			ch <- qqclient.AsyncReply[*qqclient.Entity]{
+				Err: fmt.Errorf("failed to get key %s: %w", key, err),
+			}
+
+			return
+		}
+
+		ch <- qqclient.AsyncReply[*qqclient.Entity]{
+			Result: result,
+		}
+	}()
+
+	return ch, nil
+}
+
+func (c client) GetAll(ctx context.Context) ([]qqclient.Entity, error) {
+	reply, err := invoke[GetAllRequest, GetAllReply](ctx, c, GetAllMethodName, &GetAllRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Entities, nil
+}
+
+func (c client) Close() error {
+	return c.conn.Close()
+}
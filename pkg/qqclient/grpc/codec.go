@@ -0,0 +1,30 @@
+package grpc
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// CodecName is the content subtype of the requests: application/grpc+qq-json
+const CodecName = "qq-json"
+
+// Codec encodes the messages as JSON, like the other transports, so that no
+// protobuf code has to be generated. It is not registered globally, which
+// would replace the codec of every other "json" user in the process: the
+// client and the server pass it in their options instead.
+type Codec struct{}
+
+var _ encoding.Codec = Codec{}
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (Codec) Name() string {
+	return CodecName
+}
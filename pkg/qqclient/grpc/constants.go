@@ -0,0 +1,31 @@
+package grpc
+
+const GRPCServerURL = "localhost:9090"
+const ClientType = "grpc"
+
+// ServiceName is the gRPC service; there is no .proto for it, the messages
+// being JSON encoded with Codec
+const ServiceName = "qq.QQ"
+
+const (
+	AddMethodName          = "Add"
+	RemoveMethodName       = "Remove"
+	GetMethodName          = "Get"
+	GetAllMethodName       = "GetAll"
+	GetAllStreamMethodName = "GetAllStream"
+	WatchMethodName        = "Watch"
+)
+
+// FullMethod is the path of a method, e.g. "/qq.QQ/Get"
+func FullMethod(name string) string {
+	return "/" + ServiceName + "/" + name
+}
+
+// metadata keys are lowercase in gRPC
+const (
+	UserIdMetadataKey    = "user-id"
+	RequestIdMetadataKey = "x-request-id"
+	// AuthorizationMetadataKey carries the same value as the HTTP
+	// Authorization header
+	AuthorizationMetadataKey = "authorization"
+)
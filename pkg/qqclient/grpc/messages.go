@@ -0,0 +1,49 @@
+package grpc
+
+import "qq/pkg/qqclient"
+
+type AddRequest struct {
+	Entity qqclient.Entity `json:"entity"`
+}
+
+type AddReply struct {
+	Added bool `json:"added"`
+}
+
+type RemoveRequest struct {
+	Key string `json:"key"`
+}
+
+type RemoveReply struct {
+	Removed bool `json:"removed"`
+}
+
+type GetRequest struct {
+	Key string `json:"key"`
+}
+
+type GetReply struct {
+	Entity *qqclient.Entity `json:"entity"`
+}
+
+type GetAllRequest struct{}
+
+type GetAllReply struct {
+	Entities []qqclient.Entity `json:"entities"`
+}
+
+type WatchRequest struct {
+	Prefix string `json:"prefix"`
+}
+
+const (
+	ChangePut    = "put"
+	ChangeRemove = "remove"
+)
+
+// Change is streamed by Watch; Entity is nil when the key was removed
+type Change struct {
+	Type   string           `json:"type"`
+	Key    string           `json:"key"`
+	Entity *qqclient.Entity `json:"entity,omitempty"`
+}
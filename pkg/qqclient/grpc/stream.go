@@ -0,0 +1,142 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"qq/pkg/log"
+	"qq/pkg/qqclient"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EntityIterator receives entities one at a time as they arrive:
+//
+//	for iterator.Next() {
+//		entity := iterator.Entity()
+//	}
+//	err := iterator.Err()
+//
+// Close must be called when the iteration is stopped early
+type EntityIterator interface {
+	Next() bool
+	Entity() qqclient.Entity
+	Err() error
+	Close() error
+}
+
+// ChangeIterator is iterated like EntityIterator; Next blocks until the next
+// change, and returns false once the iterator is closed
+type ChangeIterator interface {
+	Next() bool
+	Change() Change
+	Err() error
+	Close() error
+}
+
+// streamIterator receives the messages of a server stream
+type streamIterator[Message any] struct {
+	stream  grpc.ClientStream
+	cancel  context.CancelFunc
+	message Message
+	err     error
+	done    bool
+}
+
+var (
+	_ EntityIterator = &streamIterator[qqclient.Entity]{}
+	_ ChangeIterator = &streamIterator[Change]{}
+)
+
+func openStream[Request any, Message any](ctx context.Context, c client, method string, request *Request) (*streamIterator[Message], error) {
+	log.Debug(ctx, "grpc client", log.Args{"method": method, "request": request})
+
+	ctx, cancel := context.WithCancel(c.outgoing(ctx))
+
+	desc := &grpc.StreamDesc{StreamName: method, ServerStreams: true}
+
+	stream, err := c.conn.NewStream(ctx, desc, FullMethod(method))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to open %s stream: %w", method, err)
+	}
+
+	err = stream.SendMsg(request)
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to send %s request: %w", method, err)
+	}
+
+	return &streamIterator[Message]{
+		stream: stream,
+		cancel: cancel,
+	}, nil
+}
+
+func (c client) Scan(ctx context.Context) (EntityIterator, error) {
+	return openStream[GetAllRequest, qqclient.Entity](ctx, c, GetAllStreamMethodName, &GetAllRequest{})
+}
+
+// Watch returns once the server watches the changes, which it tells by
+// sending the header
+func (c client) Watch(ctx context.Context, prefix string) (ChangeIterator, error) {
+	iterator, err := openStream[WatchRequest, Change](ctx, c, WatchMethodName, &WatchRequest{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iterator.stream.Header()
+	if err != nil {
+		iterator.cancel()
+		return nil, fmt.Errorf("failed to watch: %w", err)
+	}
+
+	return iterator, nil
+}
+
+func (i *streamIterator[Message]) Next() bool {
+	if i.done {
+		return false
+	}
+
+	var message Message
+
+	err := i.stream.RecvMsg(&message)
+	if err != nil {
+		i.done = true
+		i.cancel()
+
+		if !errors.Is(err, io.EOF) && status.Code(err) != codes.Canceled {
+			i.err = fmt.Errorf("failed to receive: %w", err)
+		}
+
+		return false
+	}
+
+	i.message = message
+	return true
+}
+
+func (i *streamIterator[Message]) Entity() Message {
+	return i.message
+}
+
+func (i *streamIterator[Message]) Change() Message {
+	return i.message
+}
+
+func (i *streamIterator[Message]) Err() error {
+	return i.err
+}
+
+func (i *streamIterator[Message]) Close() error {
+	i.done = true
+	i.cancel()
+	return nil
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"qq/pkg/log"
+	"strconv"
+	"time"
+)
+
+func (c client) quotasURL() string {
+	return fmt.Sprintf("%s/admin/quotas", c.baseURL())
+}
+
+func (c client) auditURL() string {
+	return fmt.Sprintf("%s/admin/audit", c.baseURL())
+}
+
+func (c client) QuotaUsage(ctx context.Context) ([]QuotaUsage, error) {
+	method := http.MethodGet
+	requestURL := c.quotasURL()
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+
+	responce, _, err := getResponce[any, QuotaUsageResponce](ctx, c, nil, method, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get responce: %w", err)
+	}
+
+	return responce.Quotas, nil
+}
+
+// AuditQuery matches the records with all of its non-zero fields; Since is
+// inclusive and Until exclusive, and Limit keeps the latest records
+type AuditQuery struct {
+	Key    string
+	UserId string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (q AuditQuery) values() url.Values {
+	values := url.Values{}
+
+	if q.Key != "" {
+		values.Set("key", q.Key)
+	}
+	if q.UserId != "" {
+		values.Set("user_id", q.UserId)
+	}
+	if !q.Since.IsZero() {
+		values.Set("since", q.Since.Format(time.RFC3339Nano))
+	}
+	if !q.Until.IsZero() {
+		values.Set("until", q.Until.Format(time.RFC3339Nano))
+	}
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	return values
+}
+
+func (c client) Audit(ctx context.Context, query AuditQuery) ([]AuditRecord, error) {
+	method := http.MethodGet
+	requestURL := c.auditURL()
+
+	values := query.values()
+	if len(values) > 0 {
+		requestURL += "?" + values.Encode()
+	}
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+
+	responce, _, err := getResponce[any, AuditResponce](ctx, c, nil, method, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get responce: %w", err)
+	}
+
+	return responce.Records, nil
+}
+
+func (c client) VerifyAudit(ctx context.Context) (*AuditVerification, error) {
+	method := http.MethodGet
+	requestURL := c.auditURL() + "/verify"
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+
+	responce, _, err := getResponce[any, AuditVerifyResponce](ctx, c, nil, method, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get responce: %w", err)
+	}
+
+	return &responce.Verification, nil
+}
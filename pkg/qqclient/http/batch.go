@@ -0,0 +1,98 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"qq/pkg/log"
+	"qq/pkg/qqclient"
+)
+
+func (c client) GetBatch(ctx context.Context, keys []string) ([]BatchGetResult, error) {
+	results := make([]BatchGetResult, 0, len(keys))
+
+	for _, chunk := range chunks(keys) {
+		request := BatchGetRequest{
+			Keys: chunk,
+		}
+
+		responce, err := postBatch[BatchGetRequest, BatchGetResponce](ctx, c, &request, c.batchURL("batchGet"))
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, responce.Results...)
+	}
+
+	return results, nil
+}
+
+func (c client) AddBatch(ctx context.Context, entities []qqclient.Entity) ([]BatchPutResult, error) {
+	results := make([]BatchPutResult, 0, len(entities))
+
+	for _, chunk := range chunks(entities) {
+		request := BatchPutRequest{
+			Entities: chunk,
+		}
+
+		responce, err := postBatch[BatchPutRequest, BatchPutResponce](ctx, c, &request, c.batchURL("batchPut"))
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, responce.Results...)
+	}
+
+	return results, nil
+}
+
+func (c client) RemoveBatch(ctx context.Context, keys []string) ([]BatchDeleteResult, error) {
+	results := make([]BatchDeleteResult, 0, len(keys))
+
+	for _, chunk := range chunks(keys) {
+		request := BatchDeleteRequest{
+			Keys: chunk,
+		}
+
+		responce, err := postBatch[BatchDeleteRequest, BatchDeleteResponce](ctx, c, &request, c.batchURL("batchDelete"))
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, responce.Results...)
+	}
+
+	return results, nil
+}
+
+func (c client) batchURL(method string) string {
+	return fmt.Sprintf("%s:%s", c.entitiesURL(), method)
+}
+
+func postBatch[Request any, Responce any](ctx context.Context, c client, request *Request, requestURL string) (*Responce, error) {
+	method := http.MethodPost
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+
+	responce, _, err := getResponce[Request, Responce](ctx, c, request, method, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get responce: %w", err)
+	}
+
+	return responce, nil
+}
+
+func chunks[Item any](items []Item) [][]Item {
+	var result [][]Item
+
+	for len(items) > MaxBatchSize {
+		result = append(result, items[:MaxBatchSize])
+		items = items[MaxBatchSize:]
+	}
+
+	if len(items) > 0 {
+		result = append(result, items)
+	}
+
+	return result
+}
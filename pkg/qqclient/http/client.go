@@ -3,27 +3,141 @@ package http
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"qq/pkg/auth"
+	"qq/pkg/health"
 	"qq/pkg/log"
 	"qq/pkg/qqclient"
 	"qq/pkg/qqcontext"
+	"strings"
 )
 
+type Client interface {
+	qqclient.Client
+	Put(ctx context.Context, entity qqclient.Entity) (bool, error)
+	Patch(ctx context.Context, key string, patch []byte) (*qqclient.Entity, error)
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// conditional variants return ErrNotModified or an Error matching
+	// ErrPreconditionFailed when the conditions do not hold, and the ETag of
+	// the entity when known
+	GetConditional(ctx context.Context, key string, conditions Conditions) (*qqclient.Entity, string, error)
+	PutConditional(ctx context.Context, entity qqclient.Entity, conditions Conditions) (string, error)
+	PatchConditional(ctx context.Context, key string, patch []byte, conditions Conditions) (*qqclient.Entity, string, error)
+	RemoveConditional(ctx context.Context, key string, conditions Conditions) (bool, error)
+
+	// batch variants return one result per key or entity, in the same order,
+	// and send batches larger than MaxBatchSize in several requests
+	GetBatch(ctx context.Context, keys []string) ([]BatchGetResult, error)
+	AddBatch(ctx context.Context, entities []qqclient.Entity) ([]BatchPutResult, error)
+	RemoveBatch(ctx context.Context, keys []string) ([]BatchDeleteResult, error)
+
+	// Scan is GetAll without holding all entities in memory
+	Scan(ctx context.Context) (EntityIterator, error)
+
+	// Health returns the readiness report of the server, which is down when
+	// any of its dependencies is
+	Health(ctx context.Context) (*health.Report, error)
+
+	// QuotaUsage returns the storage used by every namespace and user, and
+	// requires the admin permission
+	QuotaUsage(ctx context.Context) ([]QuotaUsage, error)
+
+	// Audit returns the audit records matching query, oldest first, and
+	// VerifyAudit checks the hash chain of the audit log; both require the
+	// admin permission
+	Audit(ctx context.Context, query AuditQuery) ([]AuditRecord, error)
+	VerifyAudit(ctx context.Context) (*AuditVerification, error)
+}
+
+// AnyETag matches any existing entity: If-None-Match: * creates an entity
+// only when it does not exist yet
+const AnyETag = "*"
+
+type Conditions struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+func (c Conditions) header() http.Header {
+	header := http.Header{}
+
+	if c.IfMatch != "" {
+		header.Set("If-Match", c.IfMatch)
+	}
+	if c.IfNoneMatch != "" {
+		header.Set("If-None-Match", c.IfNoneMatch)
+	}
+
+	return header
+}
+
+type Options struct {
+	// ServerURL defaults to HTTPServerURL
+	ServerURL  string
+	HTTPClient *http.Client
+	// Credentials are sent in the Authorization header when set
+	Credentials *auth.Credentials
+	// TLS configures HTTPS connections when HTTPClient is not set, e.g. with
+	// qqtls.ClientConfig for a private CA or a client certificate
+	TLS *tls.Config
+}
+
 type client struct {
-	client *http.Client
+	client      *http.Client
+	serverURL   string
+	credentials *auth.Credentials
+}
+
+var _ Client = &client{}
+
+func NewClient(ctx context.Context) Client {
+	return NewClientWithOptions(ctx, Options{})
 }
 
-var _ qqclient.Client = &client{}
+func NewClientWithOptions(ctx context.Context, options Options) Client {
+	log.Debug(ctx, "create new http client", log.Args{"server URL": options.ServerURL})
 
-func NewClient(ctx context.Context) qqclient.Client {
-	log.Debug(ctx, "create new http client")
+	httpClient := options.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+
+		if options.TLS != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = options.TLS
+			httpClient.Transport = transport
+		}
+	}
 
 	return client{
-		client: &http.Client{},
+		client:      httpClient,
+		serverURL:   strings.TrimSuffix(options.ServerURL, "/"),
+		credentials: options.Credentials,
+	}
+}
+
+func (c client) baseURL() string {
+	if c.serverURL == "" {
+		return HTTPServerURL
 	}
+
+	return c.serverURL
+}
+
+func (c client) entitiesURL() string {
+	return fmt.Sprintf("%s/entities", c.baseURL())
+}
+
+// entityURL escapes the key so that any string, including one with '/', '?',
+// '#' or '%', is sent as a single path segment
+func (c client) entityURL(key string) string {
+	return fmt.Sprintf("%s/%s", c.entitiesURL(), url.PathEscape(key))
 }
 
 func (c client) Add(ctx context.Context, entity qqclient.Entity) (bool, error) {
@@ -32,56 +146,141 @@ func (c client) Add(ctx context.Context, entity qqclient.Entity) (bool, error) {
 	}
 
 	method := http.MethodPost
-	requestURL := fmt.Sprintf("%s/entities", HTTPServerURL)
+	requestURL := c.entitiesURL()
 
 	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
 
-	responce, statusCode, err := getResponce[PostRequest, PostResponce](ctx, c, &request, method, requestURL)
+	responce, _, err := getResponce[PostRequest, PostResponce](ctx, c, &request, method, requestURL, nil)
 	if err != nil {
 		return false, fmt.Errorf("failed to get responce: %w", err)
 	}
 
-	if statusCode != http.StatusCreated {
-		return false, fmt.Errorf(responce.Status)
-	}
-
 	return responce.Added, nil
 }
 
 func (c client) Remove(ctx context.Context, key string) (bool, error) {
+	return c.RemoveConditional(ctx, key, Conditions{})
+}
+
+func (c client) RemoveConditional(ctx context.Context, key string, conditions Conditions) (bool, error) {
 	method := http.MethodDelete
-	requestURL := fmt.Sprintf("%s/entities/%s", HTTPServerURL, key)
+	requestURL := c.entityURL(key)
 
-	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL, "conditions": conditions})
 
-	responce, statusCode, err := getResponce[any, DeleteResponce](ctx, c, nil, method, requestURL)
+	responce, _, err := getResponce[any, DeleteResponce](ctx, c, nil, method, requestURL, conditions.header())
 	if err != nil {
 		return false, fmt.Errorf("failed to get responce: %w", err)
 	}
 
-	if statusCode != http.StatusOK {
-		return false, fmt.Errorf(responce.Status)
-	}
-
 	return responce.Removed, nil
 }
 
 func (c client) Get(ctx context.Context, key string) (*qqclient.Entity, error) {
+	entity, _, err := c.GetConditional(ctx, key, Conditions{})
+	return entity, err
+}
+
+func (c client) GetConditional(ctx context.Context, key string, conditions Conditions) (*qqclient.Entity, string, error) {
 	method := http.MethodGet
-	requestURL := fmt.Sprintf("%s/entities/%s", HTTPServerURL, key)
+	requestURL := c.entityURL(key)
 
-	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL, "conditions": conditions})
 
-	responce, statusCode, err := getResponce[any, GetResponce](ctx, c, nil, method, requestURL)
+	responce, resp, err := getResponce[any, GetResponce](ctx, c, nil, method, requestURL, conditions.header())
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get responce: %w", err)
+		return nil, "", fmt.Errorf("failed to get responce: %w", err)
+	}
+
+	etag := resp.Header.Get("ETag")
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, ErrNotModified
+	}
+
+	return responce.Entity, etag, nil
+}
+
+func (c client) Put(ctx context.Context, entity qqclient.Entity) (bool, error) {
+	_, err := c.PutConditional(ctx, entity, Conditions{})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (c client) PutConditional(ctx context.Context, entity qqclient.Entity, conditions Conditions) (string, error) {
+	request := PutRequest{
+		Value: entity.Value,
+	}
+
+	method := http.MethodPut
+	requestURL := c.entityURL(entity.Key)
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL, "conditions": conditions})
+
+	responce, resp, err := getResponce[PutRequest, PutResponce](ctx, c, &request, method, requestURL, conditions.header())
+	if err != nil {
+		return "", fmt.Errorf("failed to get responce: %w", err)
+	}
+
+	if !responce.Added {
+		return "", fmt.Errorf("entity was not added")
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c client) Patch(ctx context.Context, key string, patch []byte) (*qqclient.Entity, error) {
+	entity, _, err := c.PatchConditional(ctx, key, patch, Conditions{})
+	return entity, err
+}
+
+func (c client) PatchConditional(ctx context.Context, key string, patch []byte, conditions Conditions) (*qqclient.Entity, string, error) {
+	method := http.MethodPatch
+	requestURL := c.entityURL(key)
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL, "conditions": conditions})
+
+	request := json.RawMessage(patch)
+	header := conditions.header()
+	header.Set("Content-Type", MergePatchContentType)
+
+	responce, resp, err := getResponce[json.RawMessage, PatchResponce](ctx, c, &request, method, requestURL, header)
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get responce: %w", err)
 	}
 
-	if statusCode != http.StatusOK && statusCode != http.StatusNotFound {
-		return nil, fmt.Errorf(responce.Status)
+	return responce.Entity, resp.Header.Get("ETag"), nil
+}
+
+func (c client) Exists(ctx context.Context, key string) (bool, error) {
+	method := http.MethodHead
+	requestURL := c.entityURL(key)
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+
+	resp, err := doRequest(ctx, c, method, requestURL, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to get responce: %w", err)
 	}
+	defer resp.Body.Close()
 
-	return responce.Entity, nil
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, decodeError(resp, nil)
+	}
 }
 
 func (c client) GetAsync(ctx context.Context, key string) (chan qqclient.AsyncReply[*qqclient.Entity], error) {
@@ -107,19 +306,15 @@ func (c client) GetAsync(ctx context.Context, key string) (chan qqclient.AsyncRe
 
 func (c client) GetAll(ctx context.Context) ([]qqclient.Entity, error) {
 	method := http.MethodGet
-	requestURL := fmt.Sprintf("%s/entities", HTTPServerURL)
+	requestURL := c.entitiesURL()
 
 	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
 
-	responce, statusCode, err := getResponce[any, GetAllResponce](ctx, c, nil, method, requestURL)
+	responce, _, err := getResponce[any, GetAllResponce](ctx, c, nil, method, requestURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get responce: %w", err)
 	}
 
-	if statusCode != http.StatusOK {
-		return nil, fmt.Errorf(responce.Status)
-	}
-
 	return responce.Entities, nil
 }
 
@@ -129,45 +324,84 @@ func getResponce[Request any, Responce any](
 	request *Request,
 	method string,
 	requestURL string,
-) (*Responce, int, error) {
-	bodyReader := &bytes.Reader{}
+	header http.Header,
+) (*Responce, *http.Response, error) {
+	var body []byte
 	if request != nil {
 		jsonRequest, err := json.Marshal(request)
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to produce JSON: %w", err)
+			return nil, nil, fmt.Errorf("failed to produce JSON: %w", err)
 		}
 
-		bodyReader = bytes.NewReader(jsonRequest)
+		body = jsonRequest
 	}
 
-	req, err := http.NewRequestWithContext(ctx, method, requestURL, bodyReader)
+	resp, err := doRequest(ctx, c, method, requestURL, body, header)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to produce request: %w", err)
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 
-	userId := qqcontext.GetUserIdValue(ctx)
-	req.Header.Add("UserId", userId)
+	var responce Responce
 
-	resp, err := c.client.Do(req)
+	if resp.StatusCode == http.StatusNotModified {
+		return &responce, resp, nil
+	}
+
+	responceBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to do request: %w", err)
+		return nil, nil, fmt.Errorf("failed to read responce body: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusInternalServerError {
-		return nil, 0, fmt.Errorf("internal server error")
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, resp, decodeError(resp, responceBody)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(responceBody, &responce)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to read responce body: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse JSON: %w", err)
 	}
 
-	var responce Responce
-	err = json.Unmarshal(body, &responce)
+	return &responce, resp, nil
+}
+
+func doRequest(
+	ctx context.Context,
+	c client,
+	method string,
+	requestURL string,
+	body []byte,
+	header http.Header,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to produce request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	userId := qqcontext.GetUserIdValue(ctx)
+	req.Header.Add("UserId", userId)
+
+	if c.credentials != nil {
+		req.Header.Set(auth.AuthorizationHeader, c.credentials.String())
+	}
+
+	requestId := qqcontext.GetRequestIdValue(ctx)
+	if requestId != "" {
+		req.Header.Set(RequestIdHeader, requestId)
+	}
+
+	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to parse JSON: %w", err)
+		return nil, fmt.Errorf("failed to do request: %w", err)
 	}
 
-	return &responce, resp.StatusCode, nil
+	return resp, nil
 }
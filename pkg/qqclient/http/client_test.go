@@ -34,6 +34,17 @@ func TestAdd(t *testing.T) {
 	})
 	require.NoError(t, err)
 
+	testBadRequestResponseJson, err := json.Marshal(ErrorResponce{
+		Error: &Error{
+			Code:      ErrorCodeBadRequest,
+			Message:   "invalid JSON",
+			RequestId: "1",
+			Details:   map[string]string{"error": "unexpected EOF"},
+		},
+		Status: http.StatusText(http.StatusBadRequest),
+	})
+	require.NoError(t, err)
+
 	unmarshal := func(req *http.Request) (qqclient.Entity, error) {
 		defer req.Body.Close()
 
@@ -90,8 +101,30 @@ func TestAdd(t *testing.T) {
 					StatusCode: http.StatusInternalServerError,
 				}
 			}),
-			exp:    false,
-			expErr: fmt.Errorf("failed to get responce: %w", fmt.Errorf("internal server error")),
+			exp: false,
+			expErr: fmt.Errorf("failed to get responce: %w", &Error{
+				StatusCode: http.StatusInternalServerError,
+				Code:       ErrorCodeInternal,
+				Message:    http.StatusText(http.StatusInternalServerError),
+			}),
+		},
+		{
+			name:   "BadRequest",
+			entity: qqclient.Entity{Key: "a", Value: "b"},
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Body:       ioutil.NopCloser(bytes.NewReader(testBadRequestResponseJson)),
+				}
+			}),
+			exp: false,
+			expErr: fmt.Errorf("failed to get responce: %w", &Error{
+				StatusCode: http.StatusBadRequest,
+				Code:       ErrorCodeBadRequest,
+				Message:    "invalid JSON",
+				RequestId:  "1",
+				Details:    map[string]string{"error": "unexpected EOF"},
+			}),
 		},
 	}
 
@@ -314,3 +347,546 @@ func TestGetAsync(t *testing.T) {
 		})
 	}
 }
+
+func TestPut(t *testing.T) {
+	ctx := context.Background()
+
+	testSuccessResponseJson, err := json.Marshal(PutResponce{
+		Added: true,
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		entity     qqclient.Entity
+		httpClient *http.Client
+		exp        bool
+		expErr     error
+	}{
+		{
+			name:   "HappyRun",
+			entity: qqclient.Entity{Key: "a", Value: "b"},
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				assert.Equal(t, "http://localhost:8080/entities/a", req.URL.String())
+				assert.Equal(t, http.MethodPut, req.Method)
+
+				body, err := ioutil.ReadAll(req.Body)
+				assert.NoError(t, err)
+				assert.JSONEq(t, `{"value":"b"}`, string(body))
+
+				return &http.Response{
+					StatusCode: http.StatusCreated,
+					Body:       ioutil.NopCloser(bytes.NewReader(testSuccessResponseJson)),
+				}
+			}),
+			exp:    true,
+			expErr: nil,
+		},
+		{
+			name:   "Replaced",
+			entity: qqclient.Entity{Key: "a", Value: "b"},
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader(testSuccessResponseJson)),
+				}
+			}),
+			exp:    true,
+			expErr: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			client := client{
+				client: testCase.httpClient,
+			}
+
+			added, err := client.Put(ctx, testCase.entity)
+			assert.Equal(t, testCase.exp, added)
+			assert.Equal(t, testCase.expErr, err)
+		})
+	}
+}
+
+func TestPatch(t *testing.T) {
+	ctx := context.Background()
+
+	testSuccessResponseJson, err := json.Marshal(PatchResponce{
+		Entity: &qqclient.Entity{Key: "a", Value: `{"b":1}`},
+	})
+	require.NoError(t, err)
+
+	testConflictResponseJson, err := json.Marshal(PatchResponce{
+		Status: http.StatusText(http.StatusConflict),
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		key        string
+		patch      []byte
+		httpClient *http.Client
+		exp        *qqclient.Entity
+		expErr     error
+	}{
+		{
+			name:  "HappyRun",
+			key:   "a",
+			patch: []byte(`{"b":1}`),
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				assert.Equal(t, "http://localhost:8080/entities/a", req.URL.String())
+				assert.Equal(t, http.MethodPatch, req.Method)
+				assert.Equal(t, MergePatchContentType, req.Header.Get("Content-Type"))
+
+				body, err := ioutil.ReadAll(req.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, `{"b":1}`, string(body))
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader(testSuccessResponseJson)),
+				}
+			}),
+			exp:    &qqclient.Entity{Key: "a", Value: `{"b":1}`},
+			expErr: nil,
+		},
+		{
+			name:  "Conflict",
+			key:   "a",
+			patch: []byte(`{"b":1}`),
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusConflict,
+					Body:       ioutil.NopCloser(bytes.NewReader(testConflictResponseJson)),
+				}
+			}),
+			exp: nil,
+			expErr: fmt.Errorf("failed to get responce: %w", &Error{
+				StatusCode: http.StatusConflict,
+				Code:       ErrorCodeConflict,
+				Message:    http.StatusText(http.StatusConflict),
+			}),
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			client := client{
+				client: testCase.httpClient,
+			}
+
+			entity, err := client.Patch(ctx, testCase.key, testCase.patch)
+			assert.Equal(t, testCase.exp, entity)
+			assert.Equal(t, testCase.expErr, err)
+		})
+	}
+}
+
+func TestExists(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name       string
+		key        string
+		httpClient *http.Client
+		exp        bool
+		expErr     error
+	}{
+		{
+			name: "HappyRun",
+			key:  "a",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				assert.Equal(t, "http://localhost:8080/entities/a", req.URL.String())
+				assert.Equal(t, http.MethodHead, req.Method)
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       http.NoBody,
+				}
+			}),
+			exp:    true,
+			expErr: nil,
+		},
+		{
+			name: "NotFound",
+			key:  "a",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Body:       http.NoBody,
+				}
+			}),
+			exp:    false,
+			expErr: nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			client := client{
+				client: testCase.httpClient,
+			}
+
+			exists, err := client.Exists(ctx, testCase.key)
+			assert.Equal(t, testCase.exp, exists)
+			assert.Equal(t, testCase.expErr, err)
+		})
+	}
+}
+
+func TestGetConditional(t *testing.T) {
+	ctx := context.Background()
+
+	testSuccessResponseJson, err := json.Marshal(GetResponce{
+		Entity: &qqclient.Entity{Key: "a", Value: "b"},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		conditions Conditions
+		httpClient *http.Client
+		exp        *qqclient.Entity
+		expETag    string
+		expErr     error
+	}{
+		{
+			name:       "HappyRun",
+			conditions: Conditions{IfNoneMatch: `"1"`},
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				assert.Equal(t, `"1"`, req.Header.Get("If-None-Match"))
+				assert.Empty(t, req.Header.Get("If-Match"))
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Etag": []string{`"2"`}},
+					Body:       ioutil.NopCloser(bytes.NewReader(testSuccessResponseJson)),
+				}
+			}),
+			exp:     &qqclient.Entity{Key: "a", Value: "b"},
+			expETag: `"2"`,
+			expErr:  nil,
+		},
+		{
+			name:       "NotModified",
+			conditions: Conditions{IfNoneMatch: `"1"`},
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusNotModified,
+					Header:     http.Header{"Etag": []string{`"1"`}},
+					Body:       http.NoBody,
+				}
+			}),
+			exp:     nil,
+			expETag: `"1"`,
+			expErr:  ErrNotModified,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			client := client{
+				client: testCase.httpClient,
+			}
+
+			entity, etag, err := client.GetConditional(ctx, "a", testCase.conditions)
+			assert.Equal(t, testCase.exp, entity)
+			assert.Equal(t, testCase.expETag, etag)
+			assert.Equal(t, testCase.expErr, err)
+		})
+	}
+}
+
+func TestPutConditional(t *testing.T) {
+	ctx := context.Background()
+
+	testSuccessResponseJson, err := json.Marshal(PutResponce{
+		Added: true,
+	})
+	require.NoError(t, err)
+
+	testFailedResponseJson, err := json.Marshal(PutResponce{
+		Status: http.StatusText(http.StatusPreconditionFailed),
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		conditions Conditions
+		httpClient *http.Client
+		expETag    string
+		expErr     error
+	}{
+		{
+			name:       "HappyRun",
+			conditions: Conditions{IfMatch: `"1"`},
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				assert.Equal(t, `"1"`, req.Header.Get("If-Match"))
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Etag": []string{`"2"`}},
+					Body:       ioutil.NopCloser(bytes.NewReader(testSuccessResponseJson)),
+				}
+			}),
+			expETag: `"2"`,
+			expErr:  nil,
+		},
+		{
+			name:       "PreconditionFailed",
+			conditions: Conditions{IfNoneMatch: AnyETag},
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				assert.Equal(t, "*", req.Header.Get("If-None-Match"))
+
+				return &http.Response{
+					StatusCode: http.StatusPreconditionFailed,
+					Body:       ioutil.NopCloser(bytes.NewReader(testFailedResponseJson)),
+				}
+			}),
+			expETag: "",
+			expErr:  ErrPreconditionFailed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			client := client{
+				client: testCase.httpClient,
+			}
+
+			etag, err := client.PutConditional(ctx, qqclient.Entity{Key: "a", Value: "b"}, testCase.conditions)
+			assert.Equal(t, testCase.expETag, etag)
+			if testCase.expErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, testCase.expErr)
+			}
+		})
+	}
+}
+
+func TestEntityURL(t *testing.T) {
+	testCases := []struct {
+		name      string
+		serverURL string
+		key       string
+		exp       string
+	}{
+		{
+			name: "HappyRun",
+			key:  "a",
+			exp:  "http://localhost:8080/entities/a",
+		},
+		{
+			name: "Reserved",
+			key:  "a/b?c#d%e f",
+			exp:  "http://localhost:8080/entities/a%2Fb%3Fc%23d%25e%20f",
+		},
+		{
+			name: "Unicode",
+			key:  "ключ",
+			exp:  "http://localhost:8080/entities/%D0%BA%D0%BB%D1%8E%D1%87",
+		},
+		{
+			name:      "ServerURL",
+			serverURL: "http://example.com:8081/",
+			key:       "..",
+			exp:       "http://example.com:8081/entities/..",
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			client := NewClientWithOptions(context.Background(), Options{ServerURL: testCase.serverURL}).(client)
+
+			assert.Equal(t, testCase.exp, client.entityURL(testCase.key))
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	testCases := []struct {
+		name      string
+		resp      *http.Response
+		body      string
+		exp       *Error
+		expString string
+		expIs     error
+	}{
+		{
+			name: "Envelope",
+			resp: &http.Response{StatusCode: http.StatusPreconditionFailed},
+			body: `{"error":{"code":"precondition_failed","message":"precondition failed","request_id":"1"}}`,
+			exp: &Error{
+				StatusCode: http.StatusPreconditionFailed,
+				Code:       ErrorCodePreconditionFailed,
+				Message:    "precondition failed",
+				RequestId:  "1",
+			},
+			expString: "precondition_failed: precondition failed (request id 1)",
+			expIs:     ErrPreconditionFailed,
+		},
+		{
+			name: "NoEnvelope",
+			resp: &http.Response{StatusCode: http.StatusBadGateway},
+			body: "<html>Bad Gateway</html>",
+			exp: &Error{
+				StatusCode: http.StatusBadGateway,
+				Code:       "http_502",
+				Message:    http.StatusText(http.StatusBadGateway),
+			},
+			expString: "http_502: Bad Gateway",
+			expIs:     nil,
+		},
+		{
+			name: "NotFound",
+			resp: &http.Response{StatusCode: http.StatusNotFound},
+			body: `{"status":"Not Found"}`,
+			exp: &Error{
+				StatusCode: http.StatusNotFound,
+				Code:       ErrorCodeNotFound,
+				Message:    http.StatusText(http.StatusNotFound),
+			},
+			expString: "not_found: Not Found",
+			expIs:     ErrNotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			err := decodeError(testCase.resp, []byte(testCase.body))
+			assert.Equal(t, testCase.exp, err)
+			assert.Equal(t, testCase.expString, err.Error())
+
+			if testCase.expIs != nil {
+				assert.ErrorIs(t, fmt.Errorf("failed to get responce: %w", err), testCase.expIs)
+			}
+			assert.NotErrorIs(t, err, ErrInternal)
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+
+	testJsonResponseJson, err := json.Marshal(GetAllResponce{
+		Entities: []qqclient.Entity{{Key: "a", Value: "b"}, {Key: "c", Value: "d"}},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		httpClient *http.Client
+		exp        []qqclient.Entity
+		expErr     error
+		expIterErr bool
+	}{
+		{
+			name: "Stream",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				assert.Equal(t, "http://localhost:8080/entities", req.URL.String())
+				assert.Equal(t, NDJSONContentType, req.Header.Get("Accept"))
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{NDJSONContentType}},
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte("{\"key\":\"a\",\"value\":\"b\"}\n{\"key\":\"c\",\"value\":\"d\"}\n{\"done\":true,\"count\":2}\n"))),
+				}
+			}),
+			exp: []qqclient.Entity{{Key: "a", Value: "b"}, {Key: "c", Value: "d"}},
+		},
+		{
+			name: "NoTrailer",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{NDJSONContentType}},
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte("{\"key\":\"a\",\"value\":\"b\"}\n"))),
+				}
+			}),
+			exp:        []qqclient.Entity{{Key: "a", Value: "b"}},
+			expIterErr: true,
+		},
+		{
+			name: "TrailerCountMismatch",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{NDJSONContentType}},
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte("{\"key\":\"a\",\"value\":\"b\"}\n{\"done\":true,\"count\":2}\n"))),
+				}
+			}),
+			exp:        []qqclient.Entity{{Key: "a", Value: "b"}},
+			expIterErr: true,
+		},
+		{
+			name: "NotStreamed",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader(testJsonResponseJson)),
+				}
+			}),
+			exp: []qqclient.Entity{{Key: "a", Value: "b"}, {Key: "c", Value: "d"}},
+		},
+		{
+			name: "Truncated",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{NDJSONContentType}},
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte("{\"key\":\"a\",\"value\":\"b\"}\n{\"key\":\"c\","))),
+				}
+			}),
+			exp:        []qqclient.Entity{{Key: "a", Value: "b"}},
+			expIterErr: true,
+		},
+		{
+			name: "ServerError",
+			httpClient: NewTestClient(func(req *http.Request) *http.Response {
+				return &http.Response{
+					StatusCode: http.StatusInternalServerError,
+					Body:       http.NoBody,
+				}
+			}),
+			expErr: fmt.Errorf("failed to get responce: %w", &Error{
+				StatusCode: http.StatusInternalServerError,
+				Code:       ErrorCodeInternal,
+				Message:    http.StatusText(http.StatusInternalServerError),
+			}),
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			client := client{
+				client: testCase.httpClient,
+			}
+
+			iterator, err := client.Scan(ctx)
+			assert.Equal(t, testCase.expErr, err)
+			if err != nil {
+				return
+			}
+			defer iterator.Close()
+
+			var entities []qqclient.Entity
+			for iterator.Next() {
+				entities = append(entities, iterator.Entity())
+			}
+
+			assert.Equal(t, testCase.exp, entities)
+			assert.Equal(t, testCase.expIterErr, iterator.Err() != nil)
+			assert.False(t, iterator.Next())
+		})
+	}
+}
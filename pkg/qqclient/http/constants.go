@@ -2,3 +2,22 @@ package http
 
 const HTTPServerURL = "http://localhost:8080"
 const ClientType = "http"
+
+const MergePatchContentType = "application/merge-patch+json"
+
+const RequestIdHeader = "X-Request-Id"
+
+// MaxBatchSize is the largest number of items the server accepts in a batch
+// request; the client splits larger batches
+const MaxBatchSize = 1000
+
+// NDJSONContentType streams GET /entities as one JSON entity per line
+const NDJSONContentType = "application/x-ndjson"
+
+// The WebSocket endpoint takes the names of the rabbitqq messages, "add",
+// "remove", "get" and "get all", and these; changes are pushed to watchers
+const (
+	WatchMessageName   = "watch"
+	UnwatchMessageName = "unwatch"
+	ChangeMessageName  = "change"
+)
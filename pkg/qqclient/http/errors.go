@@ -0,0 +1,119 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	ErrorCodeBadRequest           = "bad_request"
+	ErrorCodeUnauthorized         = "unauthorized"
+	ErrorCodePermissionDenied     = "permission_denied"
+	ErrorCodeRateLimited          = "rate_limited"
+	ErrorCodeQuotaExceeded        = "quota_exceeded"
+	ErrorCodeNotFound             = "not_found"
+	ErrorCodeMethodNotAllowed     = "method_not_allowed"
+	ErrorCodeConflict             = "conflict"
+	ErrorCodePreconditionFailed   = "precondition_failed"
+	ErrorCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrorCodeInternal             = "internal"
+	// ErrorCodeFellBehind ends a watch of the WebSocket endpoint whose
+	// changes were not read fast enough
+	ErrorCodeFellBehind = "fell_behind"
+)
+
+var (
+	ErrNotModified          = errors.New("not modified")
+	ErrBadRequest           = errors.New("bad request")
+	ErrUnauthorized         = errors.New("unauthorized")
+	ErrPermissionDenied     = errors.New("permission denied")
+	ErrRateLimited          = errors.New("rate limited")
+	ErrQuotaExceeded        = errors.New("quota exceeded")
+	ErrNotFound             = errors.New("not found")
+	ErrMethodNotAllowed     = errors.New("method not allowed")
+	ErrConflict             = errors.New("conflict")
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	ErrInternal             = errors.New("internal server error")
+	ErrFellBehind           = errors.New("fell behind")
+	// ErrStreamTruncated is returned by EntityIterator.Err when the stream
+	// ended before its StreamTrailer
+	ErrStreamTruncated = errors.New("stream truncated")
+)
+
+var codeErrors = map[string]error{
+	ErrorCodeBadRequest:           ErrBadRequest,
+	ErrorCodeUnauthorized:         ErrUnauthorized,
+	ErrorCodePermissionDenied:     ErrPermissionDenied,
+	ErrorCodeRateLimited:          ErrRateLimited,
+	ErrorCodeQuotaExceeded:        ErrQuotaExceeded,
+	ErrorCodeNotFound:             ErrNotFound,
+	ErrorCodeMethodNotAllowed:     ErrMethodNotAllowed,
+	ErrorCodeConflict:             ErrConflict,
+	ErrorCodePreconditionFailed:   ErrPreconditionFailed,
+	ErrorCodeUnsupportedMediaType: ErrUnsupportedMediaType,
+	ErrorCodeInternal:             ErrInternal,
+	ErrorCodeFellBehind:           ErrFellBehind,
+}
+
+// statusCodes are used for responses without an error body, e.g. from a proxy
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           ErrorCodeBadRequest,
+	http.StatusUnauthorized:         ErrorCodeUnauthorized,
+	http.StatusForbidden:            ErrorCodePermissionDenied,
+	http.StatusTooManyRequests:      ErrorCodeRateLimited,
+	http.StatusInsufficientStorage:  ErrorCodeQuotaExceeded,
+	http.StatusNotFound:             ErrorCodeNotFound,
+	http.StatusMethodNotAllowed:     ErrorCodeMethodNotAllowed,
+	http.StatusConflict:             ErrorCodeConflict,
+	http.StatusPreconditionFailed:   ErrorCodePreconditionFailed,
+	http.StatusUnsupportedMediaType: ErrorCodeUnsupportedMediaType,
+	http.StatusInternalServerError:  ErrorCodeInternal,
+}
+
+// Error is returned by the client for every error reported by the server, and
+// matches the corresponding ErrNotFound, ErrPreconditionFailed, ... with errors.Is
+type Error struct {
+	StatusCode int               `json:"-"`
+	Code       string            `json:"code"`
+	Message    string            `json:"message"`
+	RequestId  string            `json:"request_id,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestId == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s (request id %s)", e.Code, e.Message, e.RequestId)
+}
+
+func (e *Error) Is(target error) bool {
+	err, ok := codeErrors[e.Code]
+	return ok && err == target
+}
+
+func decodeError(resp *http.Response, body []byte) *Error {
+	var responce ErrorResponce
+
+	err := json.Unmarshal(body, &responce)
+	if err == nil && responce.Error != nil && responce.Error.Code != "" {
+		responce.Error.StatusCode = resp.StatusCode
+		return responce.Error
+	}
+
+	code, ok := statusCodes[resp.StatusCode]
+	if !ok {
+		code = fmt.Sprintf("http_%d", resp.StatusCode)
+	}
+
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Code:       code,
+		Message:    http.StatusText(resp.StatusCode),
+		RequestId:  resp.Header.Get(RequestIdHeader),
+	}
+}
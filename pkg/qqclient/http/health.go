@@ -0,0 +1,48 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"qq/pkg/health"
+	"qq/pkg/log"
+)
+
+func (c client) healthURL() string {
+	return fmt.Sprintf("%s/readyz", c.baseURL())
+}
+
+// Health reads the report from 503 responces as well, they carry the
+// status of every dependency
+func (c client) Health(ctx context.Context) (*health.Report, error) {
+	method := http.MethodGet
+	requestURL := c.healthURL()
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL})
+
+	resp, err := doRequest(ctx, c, method, requestURL, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get responce: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read responce body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("failed to get responce: %w", decodeError(resp, body))
+	}
+
+	var report health.Report
+
+	err = json.Unmarshal(body, &report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	return &report, nil
+}
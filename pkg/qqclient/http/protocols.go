@@ -2,6 +2,7 @@ package http
 
 import (
 	"qq/pkg/qqclient"
+	"time"
 )
 
 type PostRequest struct {
@@ -13,6 +14,25 @@ type PostResponce struct {
 	Status string `json:"status"`
 }
 
+type PutRequest struct {
+	Value string `json:"value"`
+}
+
+type PutResponce struct {
+	Added  bool   `json:"added"`
+	Status string `json:"status"`
+}
+
+type PatchResponce struct {
+	Entity *qqclient.Entity `json:"entity"`
+	Status string           `json:"status"`
+}
+
+type ErrorResponce struct {
+	Error  *Error `json:"error"`
+	Status string `json:"status"`
+}
+
 type DeleteResponce struct {
 	Removed bool   `json:"removed"`
 	Status  string `json:"status"`
@@ -27,3 +47,161 @@ type GetAllResponce struct {
 	Entities []qqclient.Entity `json:"entities"`
 	Status   string            `json:"status"`
 }
+
+// StreamTrailer is the last line of an NDJSON stream of entities; a stream
+// without it was cut short
+type StreamTrailer struct {
+	Done  bool `json:"done"`
+	Count int  `json:"count"`
+}
+
+// batch results carry a per-item Error instead of failing the whole batch
+
+type BatchGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type BatchGetResult struct {
+	Key    string           `json:"key"`
+	Entity *qqclient.Entity `json:"entity,omitempty"`
+	Error  *Error           `json:"error,omitempty"`
+}
+
+type BatchGetResponce struct {
+	Results []BatchGetResult `json:"results"`
+	Status  string           `json:"status"`
+}
+
+type BatchPutRequest struct {
+	Entities []qqclient.Entity `json:"entities"`
+}
+
+type BatchPutResult struct {
+	Key   string `json:"key"`
+	Added bool   `json:"added"`
+	Error *Error `json:"error,omitempty"`
+}
+
+type BatchPutResponce struct {
+	Results []BatchPutResult `json:"results"`
+	Status  string           `json:"status"`
+}
+
+type BatchDeleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type BatchDeleteResult struct {
+	Key     string `json:"key"`
+	Removed bool   `json:"removed"`
+	Error   *Error `json:"error,omitempty"`
+}
+
+type BatchDeleteResponce struct {
+	Results []BatchDeleteResult `json:"results"`
+	Status  string              `json:"status"`
+}
+
+// QuotaUsage is the usage of a namespace, or of a user when User is set
+type QuotaUsage struct {
+	Namespace string `json:"namespace"`
+	User      string `json:"user,omitempty"`
+	Keys      int    `json:"keys"`
+	Bytes     int    `json:"bytes"`
+	MaxKeys   int    `json:"max_keys,omitempty"`
+	MaxBytes  int    `json:"max_bytes,omitempty"`
+}
+
+type QuotaUsageResponce struct {
+	Quotas []QuotaUsage `json:"quotas"`
+	Status string       `json:"status"`
+}
+
+type AuditRecord struct {
+	Sequence  uint64    `json:"sequence"`
+	Time      time.Time `json:"time"`
+	UserId    string    `json:"user_id"`
+	Transport string    `json:"transport,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	OldHash   string    `json:"old_hash,omitempty"`
+	NewHash   string    `json:"new_hash,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+type AuditResponce struct {
+	Records []AuditRecord `json:"records"`
+	Status  string        `json:"status"`
+}
+
+type AuditVerification struct {
+	Records  int    `json:"records"`
+	Valid    bool   `json:"valid"`
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type AuditVerifyResponce struct {
+	Verification AuditVerification `json:"verification"`
+	Status       string            `json:"status"`
+}
+
+// WebSocketRequest is every command sent over the WebSocket endpoint; the
+// fields used depend on Name
+type WebSocketRequest struct {
+	// Id correlates the reply with the request; it is also the request id
+	// when valid
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Prefix selects the keys of a watch
+	Prefix string `json:"prefix,omitempty"`
+	// Watch is the id of the watch request to end
+	Watch string `json:"watch,omitempty"`
+	// After is the key a get all continues after, empty for the first page
+	After string `json:"after,omitempty"`
+}
+
+// WebSocketReply is the reply to watch and unwatch, and the reply to any
+// request the server refuses
+type WebSocketReply struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Error *Error `json:"error,omitempty"`
+}
+
+type WebSocketAddReply struct {
+	WebSocketReply
+	Added bool `json:"added"`
+}
+
+type WebSocketRemoveReply struct {
+	WebSocketReply
+	Removed bool `json:"removed"`
+}
+
+type WebSocketGetReply struct {
+	WebSocketReply
+	Value *string `json:"value"`
+}
+
+// WebSocketGetAllReply is a page of the entities; Next is the key the next
+// page continues after, and is empty after the last page
+type WebSocketGetAllReply struct {
+	WebSocketReply
+	Entities []qqclient.Entity `json:"entities"`
+	Next     string            `json:"next,omitempty"`
+}
+
+// WebSocketChange is pushed for every change of a watch, whose id is Id;
+// Type is "put" or "remove", and Value is nil on removal
+type WebSocketChange struct {
+	Id    string  `json:"id"`
+	Name  string  `json:"name"`
+	Type  string  `json:"type"`
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
+}
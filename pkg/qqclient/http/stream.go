@@ -0,0 +1,158 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"qq/pkg/log"
+	"qq/pkg/qqclient"
+)
+
+// EntityIterator decodes entities one at a time as they arrive:
+//
+//	for iterator.Next() {
+//		entity := iterator.Entity()
+//	}
+//	err := iterator.Err()
+//
+// Close must be called when the iteration is stopped early
+type EntityIterator interface {
+	Next() bool
+	Entity() qqclient.Entity
+	Err() error
+	Close() error
+}
+
+// entityIterator decodes body, or walks entities when the server did not stream
+type entityIterator struct {
+	body     io.ReadCloser
+	decoder  *json.Decoder
+	entities []qqclient.Entity
+	entity   qqclient.Entity
+	count    int
+	err      error
+}
+
+// streamLine is either an entity or the StreamTrailer
+type streamLine struct {
+	qqclient.Entity
+	StreamTrailer
+}
+
+var _ EntityIterator = &entityIterator{}
+
+// Scan streams all entities as NDJSON, ended by a StreamTrailer; a server
+// that does not support streaming answers with a regular responce, which is
+// iterated in memory
+func (c client) Scan(ctx context.Context) (EntityIterator, error) {
+	method := http.MethodGet
+	requestURL := c.entitiesURL()
+
+	log.Debug(ctx, "http client", log.Args{"method": method, "request URL": requestURL, "accept": NDJSONContentType})
+
+	header := http.Header{}
+	header.Set("Accept", NDJSONContentType)
+
+	resp, err := doRequest(ctx, c, method, requestURL, nil, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get responce: %w", err)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read responce body: %w", err)
+		}
+
+		return nil, fmt.Errorf("failed to get responce: %w", decodeError(resp, body))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == NDJSONContentType {
+		return &entityIterator{
+			body:    resp.Body,
+			decoder: json.NewDecoder(resp.Body),
+		}, nil
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read responce body: %w", err)
+	}
+
+	var responce GetAllResponce
+
+	err = json.Unmarshal(body, &responce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	return &entityIterator{
+		body:     http.NoBody,
+		entities: responce.Entities,
+	}, nil
+}
+
+func (i *entityIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+
+	if i.decoder == nil {
+		if len(i.entities) == 0 {
+			return false
+		}
+
+		i.entity, i.entities = i.entities[0], i.entities[1:]
+		return true
+	}
+
+	var line streamLine
+
+	err := i.decoder.Decode(&line)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		i.err = fmt.Errorf("%w: %d entities without trailer", ErrStreamTruncated, i.count)
+		return false
+	}
+	if err != nil {
+		i.err = fmt.Errorf("failed to parse JSON: %w", err)
+		return false
+	}
+
+	if line.Done {
+		i.decoder = nil
+		i.entities = nil
+
+		if line.Count != i.count {
+			i.err = fmt.Errorf("%w: %d entities, trailer counts %d", ErrStreamTruncated, i.count, line.Count)
+		}
+		return false
+	}
+
+	i.entity = line.Entity
+	i.count++
+	return true
+}
+
+func (i *entityIterator) Entity() qqclient.Entity {
+	return i.entity
+}
+
+func (i *entityIterator) Err() error {
+	return i.err
+}
+
+func (i *entityIterator) Close() error {
+	i.decoder = nil
+	i.entities = nil
+	return i.body.Close()
+}
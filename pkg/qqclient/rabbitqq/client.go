@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"qq/pkg/auth"
+	"qq/pkg/health"
 	"qq/pkg/log"
 	"qq/pkg/qqclient"
 	"qq/pkg/qqcontext"
@@ -15,19 +17,34 @@ import (
 
 const CallbackQueue = "callback_queue"
 
+type Client interface {
+	qqclient.Client
+	Health(ctx context.Context) (*health.Report, error)
+}
+
+type Options struct {
+	// Credentials are sent in the Authorization header of every message when set
+	Credentials *auth.Credentials
+}
+
 type client struct {
 	queue         string
 	channel       *amqp.Channel
 	msgs          <-chan amqp.Delivery
 	mu            sync.Mutex
 	callbackQueue map[string]callback
+	credentials   *auth.Credentials
 }
 
-var _ qqclient.Client = &client{}
+var _ Client = &client{}
 
 type callback func([]byte)
 
-func NewClient(ctx context.Context, queue string) (cl qqclient.Client, err error) {
+func NewClient(ctx context.Context, queue string) (cl Client, err error) {
+	return NewClientWithOptions(ctx, queue, Options{})
+}
+
+func NewClientWithOptions(ctx context.Context, queue string, options Options) (cl Client, err error) {
 	log.Debug(ctx, "create new rabbitmq client", log.Args{"queue": queue})
 
 	ch, msgs, err := connect(queue)
@@ -40,6 +57,7 @@ func NewClient(ctx context.Context, queue string) (cl qqclient.Client, err error
 		channel:       ch,
 		msgs:          msgs,
 		callbackQueue: make(map[string]callback),
+		credentials:   options.Credentials,
 	}
 
 	go client.dispatch(ctx)
@@ -202,6 +220,30 @@ func (c *client) GetAll(ctx context.Context) ([]qqclient.Entity, error) {
 	return asyncReply.Result, asyncReply.Err
 }
 
+func (c *client) Health(ctx context.Context) (*health.Report, error) {
+	message := HealthMessage{
+		BaseMessage: BaseMessage{Name: HealthMessageName},
+	}
+
+	log.Debug(ctx, "rabbitmq client", log.Args{"message": message})
+
+	proc := func(reply HealthReplyMessage) *health.Report {
+		return &reply.Health
+	}
+
+	asyncReplyCh, err := sendMessage(ctx, c, message, proc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %+v: %w", message, err)
+	}
+
+	select {
+	case asyncReply := <-asyncReplyCh:
+		return asyncReply.Result, asyncReply.Err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to get health reply: %w", ctx.Err())
+	}
+}
+
 func sendMessage[Message any, Reply any, Result any](
 	ctx context.Context,
 	c *client,
@@ -211,8 +253,15 @@ func sendMessage[Message any, Reply any, Result any](
 	ch := make(chan qqclient.AsyncReply[Result], 1)
 
 	callback := func(body []byte) {
+		var baseReply BaseReplyMessage
+		err := json.Unmarshal(body, &baseReply)
+		if err == nil && baseReply.Error != nil {
+			ch <- qqclient.AsyncReply[Result]{Err: baseReply.Error}
+			return
+		}
+
 		var reply Reply
-		err := json.Unmarshal(body, &reply)
+		err = json.Unmarshal(body, &reply)
 		if err != nil {
 			err = fmt.Errorf("failed to parse JSON: %w", err)
 		}
@@ -237,13 +286,18 @@ func sendMessage[Message any, Reply any, Result any](
 		return nil, fmt.Errorf("failed to produce JSON: %w", err)
 	}
 
+	headers := amqp.Table{"UserId": userId}
+	if c.credentials != nil {
+		headers[auth.AuthorizationHeader] = c.credentials.String()
+	}
+
 	err = c.channel.PublishWithContext(ctx,
 		"",
 		c.queue,
 		false,
 		false,
 		amqp.Publishing{
-			Headers:       amqp.Table{"UserId": userId},
+			Headers:       headers,
 			ContentType:   "application/json",
 			CorrelationId: corrId,
 			ReplyTo:       CallbackQueue,
@@ -13,6 +13,7 @@ const (
 	RemoveMessageName string = "remove"
 	GetMessageName    string = "get"
 	GetAllMessageName string = "get all"
+	HealthMessageName string = "health"
 )
 
 const ClientType = "rabbitmq"
@@ -0,0 +1,43 @@
+package rabbitqq
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	ErrorCodeUnauthorized     = "unauthorized"
+	ErrorCodePermissionDenied = "permission_denied"
+	ErrorCodeRateLimited      = "rate_limited"
+	ErrorCodeQuotaExceeded    = "quota_exceeded"
+)
+
+var (
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+)
+
+var codeErrors = map[string]error{
+	ErrorCodeUnauthorized:     ErrUnauthorized,
+	ErrorCodePermissionDenied: ErrPermissionDenied,
+	ErrorCodeRateLimited:      ErrRateLimited,
+	ErrorCodeQuotaExceeded:    ErrQuotaExceeded,
+}
+
+// ReplyError is returned by the client for errors reported by the server, and
+// matches the corresponding ErrUnauthorized, ... with errors.Is
+type ReplyError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *ReplyError) Is(target error) bool {
+	err, ok := codeErrors[e.Code]
+	return ok && err == target
+}
@@ -1,6 +1,7 @@
 package rabbitqq
 
 import (
+	"qq/pkg/health"
 	"qq/pkg/qqclient"
 )
 
@@ -8,8 +9,11 @@ type BaseMessage struct {
 	Name string `json:"name"`
 }
 
+// BaseReplyMessage carries Error instead of the reply fields when the server
+// refuses the message
 type BaseReplyMessage struct {
-	Name string `json:"name"`
+	Name  string      `json:"name"`
+	Error *ReplyError `json:"error,omitempty"`
 }
 
 type AddMessage struct {
@@ -32,6 +36,10 @@ type GetAllMessage struct {
 	BaseMessage
 }
 
+type HealthMessage struct {
+	BaseMessage
+}
+
 type AddReplyMessage struct {
 	BaseReplyMessage
 	Added bool `json:"added"`
@@ -51,3 +59,8 @@ type GetAllReplyMessage struct {
 	BaseReplyMessage
 	Entities []qqclient.Entity `json:"entities"`
 }
+
+type HealthReplyMessage struct {
+	BaseReplyMessage
+	Health health.Report `json:"health"`
+}
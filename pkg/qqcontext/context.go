@@ -2,11 +2,17 @@ package qqcontext
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
 )
 
 const UserIdKey string = "userId"
 const DefaultUserIdValue string = ""
 
+const RequestIdKey string = "requestId"
+
 func WithUserIdValue(ctx context.Context, value string) context.Context {
 	return context.WithValue(ctx, UserIdKey, value)
 }
@@ -18,3 +24,78 @@ func GetUserIdValue(ctx context.Context) string {
 	}
 	return value
 }
+
+const maxRequestIdLength = 128
+
+// ValidRequestId rejects ids sent by clients that would break the log lines
+func ValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > maxRequestIdLength {
+		return false
+	}
+
+	for _, c := range requestId {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewRequestId is used by the servers when the client did not send a
+// request id
+func NewRequestId() string {
+	id := make([]byte, 16)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+func WithRequestIdValue(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, RequestIdKey, value)
+}
+
+func GetRequestIdValue(ctx context.Context) string {
+	value, ok := ctx.Value(RequestIdKey).(string)
+	if !ok {
+		return ""
+	}
+	return value
+}
+
+const TransportKey string = "transport"
+
+func WithTransportValue(ctx context.Context, value string) context.Context {
+	return context.WithValue(ctx, TransportKey, value)
+}
+
+func GetTransportValue(ctx context.Context) string {
+	value, ok := ctx.Value(TransportKey).(string)
+	if !ok {
+		return ""
+	}
+	return value
+}
+
+const IdentityKey string = "identity"
+
+// Identity is the user verified by authentication, unlike the user id
+// claimed by the client
+type Identity struct {
+	UserId string
+	// Method is the authentication scheme the identity was verified with
+	Method string
+}
+
+func WithIdentityValue(ctx context.Context, value Identity) context.Context {
+	return context.WithValue(ctx, IdentityKey, value)
+}
+
+func GetIdentityValue(ctx context.Context) (Identity, bool) {
+	value, ok := ctx.Value(IdentityKey).(Identity)
+	return value, ok
+}
@@ -0,0 +1,119 @@
+package qqtls
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"qq/pkg/log"
+	"sync"
+	"time"
+)
+
+const CertificateReloadInterval = time.Minute
+
+// CertificateFile reloads the certificate when the certificate or the key
+// file changes; a pair that fails to load is logged and the previous
+// certificate is kept
+type CertificateFile struct {
+	certPath    string
+	keyPath     string
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func LoadCertificateFile(certPath string, keyPath string) (*CertificateFile, error) {
+	f := &CertificateFile{certPath: certPath, keyPath: keyPath}
+
+	_, err := f.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *CertificateFile) Certificate() *tls.Certificate {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.certificate
+}
+
+// GetCertificate is used as tls.Config.GetCertificate by servers
+func (f *CertificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f.Certificate(), nil
+}
+
+// GetClientCertificate is used as tls.Config.GetClientCertificate by clients
+func (f *CertificateFile) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return f.Certificate(), nil
+}
+
+// Run checks the files for changes every interval until ctx is done
+func (f *CertificateFile) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := f.reload()
+			if err != nil {
+				log.Error(ctx, "failed to reload certificate", log.Args{"path": f.certPath, "error": err})
+				continue
+			}
+
+			if reloaded {
+				log.Info(ctx, "reloaded certificate", log.Args{"path": f.certPath})
+			}
+		}
+	}
+}
+
+func (f *CertificateFile) reload() (bool, error) {
+	modTime, err := latestModTime(f.certPath, f.keyPath)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.RLock()
+	unchanged := modTime.Equal(f.modTime)
+	f.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to load key pair: %w", err)
+	}
+
+	f.mu.Lock()
+	f.certificate = &certificate
+	f.modTime = modTime
+	f.mu.Unlock()
+
+	return true, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,88 @@
+package qqtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+type ServerOptions struct {
+	Certificate *CertificateFile
+	// ClientCAFile enables client certificate verification against the CA
+	// bundle; certificates are optional unless RequireClientCert is set
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+func ServerConfig(options ServerOptions) (*tls.Config, error) {
+	if options.Certificate == nil {
+		return nil, fmt.Errorf("server certificate is required")
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: options.Certificate.GetCertificate,
+	}
+
+	if options.ClientCAFile != "" {
+		pool, err := LoadCertPool(options.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if options.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if options.RequireClientCert {
+		return nil, fmt.Errorf("client CA is required to verify client certificates")
+	}
+
+	return config, nil
+}
+
+type ClientOptions struct {
+	// CAFile replaces the system roots when set
+	CAFile string
+	// Certificate is presented to servers that ask for a client certificate
+	Certificate *CertificateFile
+	ServerName  string
+}
+
+func ClientConfig(options ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: options.ServerName,
+	}
+
+	if options.CAFile != "" {
+		pool, err := LoadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	}
+
+	if options.Certificate != nil {
+		config.GetClientCertificate = options.Certificate.GetClientCertificate
+	}
+
+	return config, nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
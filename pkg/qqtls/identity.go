@@ -0,0 +1,23 @@
+package qqtls
+
+import (
+	"crypto/tls"
+	"qq/pkg/qqcontext"
+)
+
+const MethodClientCertificate = "ClientCertificate"
+
+// Identity maps the subject common name of a verified client certificate
+// to the user id; unverified certificates are ignored
+func Identity(state *tls.ConnectionState) (qqcontext.Identity, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return qqcontext.Identity{}, false
+	}
+
+	userId := state.VerifiedChains[0][0].Subject.CommonName
+	if userId == "" {
+		return qqcontext.Identity{}, false
+	}
+
+	return qqcontext.Identity{UserId: userId, Method: MethodClientCertificate}, true
+}
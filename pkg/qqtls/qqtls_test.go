@@ -0,0 +1,71 @@
+package qqtls
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"qq/pkg/qqtls/qqtlstest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func commonName(t *testing.T, f *CertificateFile) string {
+	certificate, err := x509.ParseCertificate(f.Certificate().Certificate[0])
+	require.NoError(t, err)
+
+	return certificate.Subject.CommonName
+}
+
+func TestCertificateFileReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca := qqtlstest.NewCA(t)
+	dir := t.TempDir()
+
+	certPath, keyPath := ca.Issue(t, dir, "server")
+
+	certificateFile, err := LoadCertificateFile(certPath, keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, "server", commonName(t, certificateFile))
+
+	go certificateFile.Run(ctx, time.Millisecond)
+
+	renewedCertPath, renewedKeyPath := ca.Issue(t, t.TempDir(), "renewed")
+
+	for from, to := range map[string]string{renewedCertPath: certPath, renewedKeyPath: keyPath} {
+		data, err := ioutil.ReadFile(from)
+		require.NoError(t, err)
+
+		err = ioutil.WriteFile(to, data, 0o600)
+		require.NoError(t, err)
+
+		require.NoError(t, os.Chtimes(to, time.Now(), time.Now().Add(time.Second)))
+	}
+
+	assert.Eventually(t, func() bool {
+		return commonName(t, certificateFile) == "renewed"
+	}, time.Second, time.Millisecond)
+}
+
+func TestServerConfig(t *testing.T) {
+	ca := qqtlstest.NewCA(t)
+	certPath, keyPath := ca.Issue(t, t.TempDir(), "server")
+
+	certificateFile, err := LoadCertificateFile(certPath, keyPath)
+	require.NoError(t, err)
+
+	_, err = ServerConfig(ServerOptions{Certificate: certificateFile, RequireClientCert: true})
+	assert.Error(t, err)
+
+	_, err = ServerConfig(ServerOptions{Certificate: certificateFile, ClientCAFile: keyPath})
+	assert.Error(t, err)
+
+	config, err := ServerConfig(ServerOptions{Certificate: certificateFile, ClientCAFile: ca.CertPath})
+	require.NoError(t, err)
+	assert.NotNil(t, config.ClientCAs)
+}
@@ -0,0 +1,49 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// set at build time, e.g.
+//
+//	go build -ldflags "-X qq/pkg/version.Version=1.2.0 -X qq/pkg/version.Commit=$(git rev-parse HEAD)"
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildTime = ""
+)
+
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get falls back to the VCS information embedded by the Go toolchain when
+// the commit and build time were not set at build time
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	for _, setting := range buildInfo.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = setting.Value
+		case setting.Key == "vcs.time" && info.BuildTime == "":
+			info.BuildTime = setting.Value
+		}
+	}
+
+	return info
+}
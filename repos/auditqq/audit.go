@@ -0,0 +1,108 @@
+package auditqq
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type Operation string
+
+const (
+	OperationAdd    Operation = "add"
+	OperationRemove Operation = "remove"
+	OperationUpdate Operation = "update"
+)
+
+// Record describes one mutation. Values are not kept, only their hashes, so
+// that the log does not leak the data it audits.
+type Record struct {
+	Sequence  uint64    `json:"sequence"`
+	Time      time.Time `json:"time"`
+	UserId    string    `json:"user_id"`
+	Transport string    `json:"transport,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+	Operation Operation `json:"operation"`
+	Key       string    `json:"key"`
+	// OldHash and NewHash are empty when the entity did not or does not exist
+	OldHash string `json:"old_hash,omitempty"`
+	NewHash string `json:"new_hash,omitempty"`
+	// PrevHash is the Hash of the previous record, empty for the first one
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+func ValueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// hash covers every field of the record but Hash itself, PrevHash included,
+// so that changing, removing or reordering records breaks the chain. It is
+// an HMAC keyed with the secret of the log: without the key, the hashes of
+// a changed record and of the records following it cannot be recomputed.
+func (r Record) hash(key []byte) (string, error) {
+	r.Hash = ""
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Query matches the records with all of its non-zero fields; Since is
+// inclusive and Until exclusive
+type Query struct {
+	Key    string
+	UserId string
+	Since  time.Time
+	Until  time.Time
+	// Limit keeps only the latest records when positive
+	Limit int
+}
+
+func (q Query) matches(record Record) bool {
+	if q.Key != "" && record.Key != q.Key {
+		return false
+	}
+
+	if q.UserId != "" && record.UserId != q.UserId {
+		return false
+	}
+
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return false
+	}
+
+	if !q.Until.IsZero() && !record.Time.Before(q.Until) {
+		return false
+	}
+
+	return true
+}
+
+type Verification struct {
+	Records int  `json:"records"`
+	Valid   bool `json:"valid"`
+	// BrokenAt is the sequence of the first record that does not belong to
+	// the chain
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type Log interface {
+	// Append chains the record to the log, filling in its Sequence,
+	// PrevHash and Hash, and returns it
+	Append(record Record) (Record, error)
+	// Query returns the matching records, oldest first
+	Query(query Query) ([]Record, error)
+	Verify() (Verification, error)
+	Close() error
+}
@@ -0,0 +1,253 @@
+package auditqq
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxLineSize bounds a record, which holds hashes instead of values
+const maxLineSize = 1 << 20
+
+// ErrNoKey is returned for an empty key, which would make the chain a plain
+// hash anyone could recompute
+var ErrNoKey = errors.New("audit log key is empty")
+
+// FileLog appends the records to a file as JSON lines
+type FileLog struct {
+	path     string
+	key      []byte
+	mu       sync.Mutex
+	file     *os.File
+	sequence uint64
+	lastHash string
+}
+
+var _ Log = &FileLog{}
+
+// OpenFileLog continues the chain of the file, which is created if missing,
+// with key; a file that fails verification is not appended to
+func OpenFileLog(path string, key []byte) (*FileLog, error) {
+	verification, err := VerifyFile(path, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verification.Valid {
+		return nil, fmt.Errorf("audit log is broken at record %d: %s", verification.BrokenAt, verification.Reason)
+	}
+
+	l := &FileLog{path: path, key: key}
+
+	err = scanFile(path, func(record Record) error {
+		l.sequence = record.Sequence
+		l.lastHash = record.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	return l, nil
+}
+
+func (l *FileLog) Append(record Record) (Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	record.Time = record.Time.UTC()
+	record.Sequence = l.sequence + 1
+	record.PrevHash = l.lastHash
+
+	hash, err := record.hash(l.key)
+	if err != nil {
+		return Record{}, err
+	}
+
+	record.Hash = hash
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	_, err = l.file.Write(append(data, '\n'))
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	err = l.file.Sync()
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to sync audit log: %w", err)
+	}
+
+	l.sequence = record.Sequence
+	l.lastHash = record.Hash
+
+	return record, nil
+}
+
+func (l *FileLog) Query(query Query) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return QueryFile(l.path, query)
+}
+
+func (l *FileLog) Verify() (Verification, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return VerifyFile(l.path, l.key)
+}
+
+func (l *FileLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.file.Sync()
+	if err != nil {
+		_ = l.file.Close()
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+
+	return l.file.Close()
+}
+
+// QueryFile reads the records of a log without opening it for writing
+func QueryFile(path string, query Query) ([]Record, error) {
+	records := []Record{}
+
+	err := scanFile(path, func(record Record) error {
+		if !query.matches(record) {
+			return nil
+		}
+
+		records = append(records, record)
+		if query.Limit > 0 && len(records) > query.Limit {
+			records = records[1:]
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// VerifyFile recomputes the chain of a log with the key it was written with;
+// an error is only returned when the file cannot be read or the key is
+// empty, a missing file being an empty valid log
+func VerifyFile(path string, key []byte) (Verification, error) {
+	if len(key) == 0 {
+		return Verification{}, ErrNoKey
+	}
+
+	verification := Verification{Valid: true}
+
+	previous := Record{}
+
+	err := scanLines(path, func(line []byte) error {
+		expected := previous.Sequence + 1
+
+		var record Record
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			return broken(&verification, expected, fmt.Sprintf("malformed record: %v", err))
+		}
+
+		if record.Sequence != expected {
+			return broken(&verification, expected, fmt.Sprintf("found sequence %d", record.Sequence))
+		}
+
+		if record.PrevHash != previous.Hash {
+			return broken(&verification, expected, "previous hash does not match")
+		}
+
+		hash, err := record.hash(key)
+		if err != nil {
+			return err
+		}
+
+		if record.Hash != hash {
+			return broken(&verification, expected, "hash does not match")
+		}
+
+		verification.Records++
+		previous = record
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBroken) {
+		return Verification{}, err
+	}
+
+	return verification, nil
+}
+
+// errBroken stops the scan at the first broken record
+var errBroken = errors.New("broken chain")
+
+func broken(verification *Verification, sequence uint64, reason string) error {
+	verification.Valid = false
+	verification.BrokenAt = sequence
+	verification.Reason = reason
+
+	return errBroken
+}
+
+func scanFile(path string, visit func(record Record) error) error {
+	return scanLines(path, func(line []byte) error {
+		var record Record
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			return fmt.Errorf("failed to parse audit record: %w", err)
+		}
+
+		return visit(record)
+	})
+}
+
+func scanLines(path string, visit func(line []byte) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	for scanner.Scan() {
+		err = visit(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	return nil
+}
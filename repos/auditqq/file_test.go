@@ -0,0 +1,188 @@
+package auditqq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("secret")
+
+// rechain recomputes the hashes of lines with key, as someone who can write
+// the file would
+func rechain(t *testing.T, lines []string, key []byte) []string {
+	previous := ""
+
+	for i, line := range lines {
+		var record Record
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+
+		record.PrevHash = previous
+
+		hash, err := record.hash(key)
+		require.NoError(t, err)
+		record.Hash = hash
+
+		data, err := json.Marshal(record)
+		require.NoError(t, err)
+
+		lines[i] = string(data)
+		previous = hash
+	}
+
+	return lines
+}
+
+func appendRecords(t *testing.T, l Log, start time.Time) {
+	records := []Record{
+		{UserId: "alice", Operation: OperationAdd, Key: "a", NewHash: ValueHash("1")},
+		{UserId: "bob", Operation: OperationAdd, Key: "b", NewHash: ValueHash("2")},
+		{UserId: "alice", Operation: OperationRemove, Key: "a", OldHash: ValueHash("1")},
+	}
+
+	for i, record := range records {
+		record.Time = start.Add(time.Duration(i) * time.Minute)
+
+		_, err := l.Append(record)
+		require.NoError(t, err)
+	}
+}
+
+func TestFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l, err := OpenFileLog(path, testKey)
+	require.NoError(t, err)
+
+	appendRecords(t, l, start)
+	require.NoError(t, l.Close())
+
+	l, err = OpenFileLog(path, testKey)
+	require.NoError(t, err)
+	defer l.Close()
+
+	record, err := l.Append(Record{Time: start.Add(time.Hour), UserId: "bob", Operation: OperationUpdate, Key: "b"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), record.Sequence, "reopened log restarted the chain")
+
+	verification, err := l.Verify()
+	require.NoError(t, err)
+	assert.Equal(t, Verification{Records: 4, Valid: true}, verification)
+
+	testCases := []struct {
+		name  string
+		query Query
+		exp   []uint64
+	}{
+		{name: "All", query: Query{}, exp: []uint64{1, 2, 3, 4}},
+		{name: "Key", query: Query{Key: "a"}, exp: []uint64{1, 3}},
+		{name: "User", query: Query{UserId: "bob"}, exp: []uint64{2, 4}},
+		{name: "TimeRange", query: Query{Since: start.Add(time.Minute), Until: start.Add(time.Hour)}, exp: []uint64{2, 3}},
+		{name: "Limit", query: Query{Limit: 2}, exp: []uint64{3, 4}},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			records, err := l.Query(testCase.query)
+			require.NoError(t, err)
+
+			sequences := []uint64{}
+			for _, record := range records {
+				sequences = append(sequences, record.Sequence)
+			}
+			assert.Equal(t, testCase.exp, sequences)
+		})
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	testCases := []struct {
+		name   string
+		tamper func(t *testing.T, lines []string) []string
+		exp    Verification
+	}{
+		{
+			name:   "Intact",
+			tamper: func(t *testing.T, lines []string) []string { return lines },
+			exp:    Verification{Records: 3, Valid: true},
+		},
+		{
+			name: "ChangedRecord",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"user_id":"bob"`, `"user_id":"eve"`, 1)
+				return lines
+			},
+			exp: Verification{Records: 1, BrokenAt: 2, Reason: "hash does not match"},
+		},
+		{
+			name: "RechainedRecord",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"user_id":"bob"`, `"user_id":"eve"`, 1)
+				return rechain(t, lines, []byte("guessed"))
+			},
+			exp: Verification{Records: 0, BrokenAt: 1, Reason: "hash does not match"},
+		},
+		{
+			name: "RemovedRecord",
+			tamper: func(t *testing.T, lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			exp: Verification{Records: 1, BrokenAt: 2, Reason: "found sequence 3"},
+		},
+		{
+			name: "MalformedRecord",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[2] = "{"
+				return lines
+			},
+			exp: Verification{Records: 2, BrokenAt: 3, Reason: "malformed record: unexpected end of JSON input"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+
+			l, err := OpenFileLog(path, testKey)
+			require.NoError(t, err)
+
+			appendRecords(t, l, time.Now())
+			require.NoError(t, l.Close())
+
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+
+			lines := testCase.tamper(t, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+
+			err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+			require.NoError(t, err)
+
+			verification, err := VerifyFile(path, testKey)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.exp, verification)
+
+			_, err = OpenFileLog(path, testKey)
+			assert.Equal(t, testCase.exp.Valid, err == nil)
+		})
+	}
+}
+
+func TestVerifyMissingFile(t *testing.T) {
+	verification, err := VerifyFile(filepath.Join(t.TempDir(), "missing.log"), testKey)
+	require.NoError(t, err)
+	assert.Equal(t, Verification{Valid: true}, verification)
+}
+
+func TestOpenFileLogWithoutKey(t *testing.T) {
+	_, err := OpenFileLog(filepath.Join(t.TempDir(), "audit.log"), nil)
+	assert.ErrorIs(t, err, ErrNoKey)
+}
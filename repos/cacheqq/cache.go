@@ -12,69 +12,136 @@ import (
 
 const Expiration = 10 * time.Minute
 
+// GetEntity returns a nil entity when the entity is cached as missing, and
+// the time left until the entry expires. SetEntity uses Expiration, or
+// NegativeExpiration for a missing entity, when expiration is not positive.
+// FillEntity caches an entity read from the database like SetEntity, but
+// does not announce a change to other instances.
+// Ping reports whether the cache server is reachable.
 type Cache interface {
-	GetEntity(ctx context.Context, key string) (*models.Entity, error)
-	SetEntity(ctx context.Context, key string, entity *models.Entity) error
+	GetEntity(ctx context.Context, key string) (*models.Entity, time.Duration, error)
+	SetEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error
+	FillEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error
 	DeleteEntity(ctx context.Context, key string) error
+	Ping(ctx context.Context) error
+}
+
+type RedisOptions struct {
+	// PublishInvalidations announces every write and removal to other
+	// instances sharing the Redis server, see InvalidationSubscriber
+	PublishInvalidations bool
+	Origin               string
 }
 
 type cache struct {
 	redisClient *redis.Client
+	options     RedisOptions
 }
 
 var _ Cache = cache{}
 
-func NewRedisCache() Cache {
-	redisClient := redis.NewClient(&redis.Options{
+func NewRedisCache(options RedisOptions) Cache {
+	return cache{
+		redisClient: newRedisClient(),
+		options:     options,
+	}
+}
+
+func newRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Addr:     rabbitqq.RedisServerAddr,
 		Password: rabbitqq.RedisServerPassword,
 		DB:       0,
 	})
-
-	return cache{
-		redisClient: redisClient,
-	}
 }
 
-func (c cache) GetEntity(ctx context.Context, key string) (*models.Entity, error) {
+func (c cache) GetEntity(ctx context.Context, key string) (*models.Entity, time.Duration, error) {
 	value, err := c.redisClient.Get(ctx, key).Result()
 
 	if err == redis.Nil {
-		return nil, fmt.Errorf("key %s does not exist", key)
+		return nil, 0, fmt.Errorf("key %s does not exist", key)
 
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get key %s: %w", key, err)
+		return nil, 0, fmt.Errorf("failed to get key %s: %w", key, err)
 	}
 
-	if value == "" {
-		return nil, nil
+	record, err := decodeRecord(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode key %s: %w", key, err)
 	}
 
-	return &models.Entity{Key: key, Value: value}, nil
+	return record.entity(), time.Until(record.ExpiresAt), nil
+}
+
+func (c cache) SetEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error {
+	return c.set(ctx, key, entity, expiration, c.options.PublishInvalidations)
 }
 
-func (c cache) SetEntity(ctx context.Context, key string, entity *models.Entity) error {
-	var value string
+func (c cache) FillEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error {
+	return c.set(ctx, key, entity, expiration, false)
+}
+
+func (c cache) set(ctx context.Context, key string, entity *models.Entity, expiration time.Duration, publish bool) error {
+	expiration = entryExpiration(entity, expiration, Expiration, NegativeExpiration)
+
+	value, err := encodeRecord(newRecord(entity, time.Now().Add(expiration)))
+	if err != nil {
+		return fmt.Errorf("failed to encode key %s: %w", key, err)
+	}
 
-	if entity != nil {
-		value = entity.Value
+	if !publish {
+		err := c.redisClient.Set(ctx, key, value, expiration).Err()
+		if err != nil {
+			return fmt.Errorf("failed to set key %s: %w", key, err)
+		}
+
+		return nil
 	}
 
-	err := c.redisClient.Set(ctx, key, value, Expiration).Err()
+	pipe := c.redisClient.TxPipeline()
+	pipe.Set(ctx, key, value, expiration)
+	versionCmd := incrVersion(ctx, pipe, key)
 
+	_, err = pipe.Exec(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to set key %s, value %s", key, value)
+		return fmt.Errorf("failed to set key %s: %w", key, err)
 	}
 
+	c.publishInvalidation(ctx, key, versionCmd.Val())
+
 	return nil
 }
 
 func (c cache) DeleteEntity(ctx context.Context, key string) error {
-	err := c.redisClient.Del(ctx, key).Err()
+	if !c.options.PublishInvalidations {
+		err := c.redisClient.Del(ctx, key).Err()
+
+		if err != nil {
+			return fmt.Errorf("failed to delete key %s: %w", key, err)
+		}
+
+		return nil
+	}
+
+	pipe := c.redisClient.TxPipeline()
+	pipe.Del(ctx, key)
+	versionCmd := incrVersion(ctx, pipe, key)
+
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete key %s: %w", key, err)
+	}
+
+	c.publishInvalidation(ctx, key, versionCmd.Val())
+
+	return nil
+}
 
+func (c cache) Ping(ctx context.Context) error {
+	err := c.redisClient.Ping(ctx).Err()
 	if err != nil {
-		return fmt.Errorf("failed to delete key %s", key)
+		return fmt.Errorf("failed to ping redis: %w", err)
 	}
 
 	return nil
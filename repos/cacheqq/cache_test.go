@@ -0,0 +1,99 @@
+package cacheqq
+
+import (
+	"context"
+	"qq/models"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name          string
+		entity        *models.Entity
+		expiration    time.Duration
+		exp           *models.Entity
+		expExpiration time.Duration
+	}{
+		{
+			name:          "HappyRun",
+			entity:        &models.Entity{Key: "a", Value: "b", Version: 3},
+			expiration:    0,
+			exp:           &models.Entity{Key: "a", Value: "b", Version: 3},
+			expExpiration: Expiration,
+		},
+		{
+			name:          "EmptyValue",
+			entity:        &models.Entity{Key: "a", Value: ""},
+			expiration:    time.Hour,
+			exp:           &models.Entity{Key: "a", Value: ""},
+			expExpiration: time.Hour,
+		},
+		{
+			name:          "Tombstone",
+			entity:        nil,
+			expiration:    time.Hour,
+			exp:           nil,
+			expExpiration: NegativeExpiration,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			redisServer := miniredis.RunT(t)
+			cache := cache{
+				redisClient: redis.NewClient(&redis.Options{Addr: redisServer.Addr()}),
+			}
+
+			require.NoError(t, cache.SetEntity(ctx, "a", testCase.entity, testCase.expiration))
+			assert.Equal(t, testCase.expExpiration, redisServer.TTL("a"))
+
+			entity, ttl, err := cache.GetEntity(ctx, "a")
+			require.NoError(t, err)
+			assert.Equal(t, testCase.exp, entity)
+			assert.InDelta(t, testCase.expExpiration, ttl, float64(time.Second))
+		})
+	}
+}
+
+func TestRedisCacheMissed(t *testing.T) {
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	cache := cache{
+		redisClient: redis.NewClient(&redis.Options{Addr: redisServer.Addr()}),
+	}
+
+	_, _, err := cache.GetEntity(ctx, "a")
+	assert.Error(t, err)
+
+	require.NoError(t, redisServer.Set("a", "value in a legacy format"))
+
+	_, _, err = cache.GetEntity(ctx, "a")
+	assert.Error(t, err)
+}
+
+func TestRedisCachePing(t *testing.T) {
+	ctx := context.Background()
+
+	redisServer := miniredis.RunT(t)
+	cache := cache{
+		redisClient: redis.NewClient(&redis.Options{Addr: redisServer.Addr()}),
+	}
+
+	assert.NoError(t, cache.Ping(ctx))
+	assert.NoError(t, NewTieredCache(NewLRUCache(LRUOptions{}), cache).Ping(ctx))
+
+	redisServer.Close()
+
+	assert.Error(t, cache.Ping(ctx))
+	assert.Error(t, NewTieredCache(NewLRUCache(LRUOptions{}), cache).Ping(ctx))
+}
@@ -0,0 +1,267 @@
+package cacheqq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"qq/pkg/log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const InvalidationChannel = "qq:invalidations"
+
+const versionKeyPrefix = "qq:version:"
+
+// a version counter outlives the cached value so that its numbering never
+// restarts while subscribers may still remember the previous versions
+const versionExpiration = 2 * Expiration
+
+const (
+	minSubscribeBackoff = 100 * time.Millisecond
+	maxSubscribeBackoff = 30 * time.Second
+)
+
+var errNotSubscribed = errors.New("not subscribed to invalidations")
+
+type Invalidation struct {
+	Key     string `json:"key"`
+	Version int64  `json:"version"`
+	Origin  string `json:"origin"`
+}
+
+func NewOrigin() string {
+	bytes := make([]byte, 8)
+	_, _ = rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func incrVersion(ctx context.Context, pipe redis.Pipeliner, key string) *redis.IntCmd {
+	versionKey := versionKeyPrefix + key
+
+	versionCmd := pipe.Incr(ctx, versionKey)
+	pipe.Expire(ctx, versionKey, versionExpiration)
+
+	return versionCmd
+}
+
+func (c cache) publishInvalidation(ctx context.Context, key string, version int64) {
+	invalidation := Invalidation{
+		Key:     key,
+		Version: version,
+		Origin:  c.options.Origin,
+	}
+
+	message, err := json.Marshal(invalidation)
+	if err != nil {
+		log.Warning(ctx, "failed to produce invalidation JSON", log.Args{"error": err})
+		return
+	}
+
+	err = c.redisClient.Publish(ctx, InvalidationChannel, message).Err()
+	if err != nil {
+		log.Warning(ctx, "failed to publish invalidation", log.Args{"key": key, "error": err})
+	}
+}
+
+type seenVersion struct {
+	version int64
+	seenAt  time.Time
+}
+
+// InvalidationSubscriber evicts keys changed by other instances from the
+// local caches, dropping invalidations older than one already applied
+type InvalidationSubscriber struct {
+	redisClient *redis.Client
+	origin      string
+	caches      []Cache
+	mu          sync.Mutex
+	versions    map[string]seenVersion
+	err         error
+	now         func() time.Time
+}
+
+func NewInvalidationSubscriber(origin string, caches ...Cache) *InvalidationSubscriber {
+	return newInvalidationSubscriber(newRedisClient(), origin, caches...)
+}
+
+func newInvalidationSubscriber(redisClient *redis.Client, origin string, caches ...Cache) *InvalidationSubscriber {
+	return &InvalidationSubscriber{
+		redisClient: redisClient,
+		origin:      origin,
+		caches:      caches,
+		versions:    map[string]seenVersion{},
+		err:         errNotSubscribed,
+		now:         time.Now,
+	}
+}
+
+// Run subscribes until ctx is done, subscribing again with a backoff
+// whenever the subscription fails. Invalidations published while it is not
+// subscribed are lost, so the local caches are cleared on every new
+// subscription after the first
+func (s *InvalidationSubscriber) Run(ctx context.Context) error {
+	backoff := minSubscribeBackoff
+	first := true
+
+	for {
+		subscribed, err := s.subscribe(ctx, first)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		s.setErr(err)
+
+		if subscribed {
+			first = false
+			backoff = minSubscribeBackoff
+		}
+
+		log.Warning(ctx, "invalidation subscriber failed, subscribing again", log.Args{"error": err, "backoff": backoff})
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxSubscribeBackoff {
+			backoff = maxSubscribeBackoff
+		}
+	}
+}
+
+// Ping reports whether the subscriber currently receives invalidations
+func (s *InvalidationSubscriber) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *InvalidationSubscriber) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+// subscribe receives invalidations until the subscription fails, and
+// reports whether it succeeded to subscribe
+func (s *InvalidationSubscriber) subscribe(ctx context.Context, first bool) (bool, error) {
+	pubsub := s.redisClient.Subscribe(ctx, InvalidationChannel)
+	defer pubsub.Close()
+
+	// receiving ignores the cancellation of ctx, closing does not
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = pubsub.Close()
+		case <-done:
+		}
+	}()
+
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to subscribe to %s: %w", InvalidationChannel, err)
+	}
+
+	if !first {
+		s.clear(ctx)
+	}
+	s.setErr(nil)
+
+	prunedAt := s.now()
+
+	for {
+		// the timeout only wakes the loop up to prune
+		message, err := pubsub.ReceiveTimeout(ctx, Expiration)
+
+		if s.now().Sub(prunedAt) >= Expiration {
+			s.prune()
+			prunedAt = s.now()
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
+		if err != nil {
+			return true, fmt.Errorf("failed to receive from %s: %w", InvalidationChannel, err)
+		}
+
+		redisMessage, ok := message.(*redis.Message)
+		if !ok {
+			continue
+		}
+
+		var invalidation Invalidation
+		err = json.Unmarshal([]byte(redisMessage.Payload), &invalidation)
+		if err != nil {
+			log.Warning(ctx, "failed to parse invalidation JSON", log.Args{"error": err})
+			continue
+		}
+
+		s.handle(ctx, invalidation)
+	}
+}
+
+// clear empties the local caches which support it
+func (s *InvalidationSubscriber) clear(ctx context.Context) {
+	log.Info(ctx, "clear local caches after missing invalidations")
+
+	for _, cache := range s.caches {
+		if clearer, ok := cache.(interface{ Clear() }); ok {
+			clearer.Clear()
+		}
+	}
+}
+
+func (s *InvalidationSubscriber) handle(ctx context.Context, invalidation Invalidation) bool {
+	if invalidation.Origin == s.origin {
+		return false
+	}
+
+	s.mu.Lock()
+	seen, present := s.versions[invalidation.Key]
+	if present && seen.version >= invalidation.Version {
+		s.mu.Unlock()
+		log.Debug(ctx, "drop outdated invalidation", log.Args{"invalidation": invalidation, "seen version": seen.version})
+		return false
+	}
+	s.versions[invalidation.Key] = seenVersion{version: invalidation.Version, seenAt: s.now()}
+	s.mu.Unlock()
+
+	log.Debug(ctx, "invalidate", log.Args{"invalidation": invalidation})
+
+	for _, cache := range s.caches {
+		err := cache.DeleteEntity(ctx, invalidation.Key)
+		if err != nil {
+			log.Warning(ctx, "failed to invalidate", log.Args{"key": invalidation.Key, "error": err})
+		}
+	}
+
+	return true
+}
+
+// prune forgets versions which can no longer be reordered with a new
+// invalidation, keeping the map bounded by the recently written keys
+func (s *InvalidationSubscriber) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, seen := range s.versions {
+		if s.now().Sub(seen.seenAt) > Expiration {
+			delete(s.versions, key)
+		}
+	}
+}
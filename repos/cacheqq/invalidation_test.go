@@ -0,0 +1,186 @@
+package cacheqq
+
+import (
+	"context"
+	"qq/models"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidationSubscriberHandle(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name          string
+		invalidations []Invalidation
+		exp           []bool
+	}{
+		{
+			name:          "HappyRun",
+			invalidations: []Invalidation{{Key: "a", Version: 1, Origin: "remote"}},
+			exp:           []bool{true},
+		},
+		{
+			name:          "OwnOrigin",
+			invalidations: []Invalidation{{Key: "a", Version: 1, Origin: "local"}},
+			exp:           []bool{false},
+		},
+		{
+			name: "OutOfOrder",
+			invalidations: []Invalidation{
+				{Key: "a", Version: 2, Origin: "remote"},
+				{Key: "a", Version: 1, Origin: "remote"},
+				{Key: "b", Version: 1, Origin: "remote"},
+				{Key: "a", Version: 3, Origin: "remote"},
+			},
+			exp: []bool{true, false, true, true},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			l1 := newLRUCache(LRUOptions{})
+			subscriber := newInvalidationSubscriber(nil, "local", l1)
+
+			for i, invalidation := range testCase.invalidations {
+				require.NoError(t, l1.SetEntity(ctx, invalidation.Key, &models.Entity{Key: invalidation.Key}, 0))
+
+				assert.Equal(t, testCase.exp[i], subscriber.handle(ctx, invalidation))
+
+				_, _, err := l1.GetEntity(ctx, invalidation.Key)
+				assert.Equal(t, testCase.exp[i], err != nil)
+			}
+		})
+	}
+}
+
+func TestInvalidationSubscriberPrune(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	subscriber := newInvalidationSubscriber(nil, "local")
+	subscriber.now = func() time.Time { return now }
+
+	assert.True(t, subscriber.handle(ctx, Invalidation{Key: "a", Version: 5, Origin: "remote"}))
+
+	now = now.Add(Expiration + time.Second)
+	subscriber.prune()
+
+	assert.Empty(t, subscriber.versions)
+}
+
+func TestInvalidationAcrossInstances(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	redisServer := miniredis.RunT(t)
+
+	newInstance := func(origin string) (Cache, Cache, *InvalidationSubscriber) {
+		l1 := newLRUCache(LRUOptions{})
+		l2 := cache{
+			redisClient: redis.NewClient(&redis.Options{Addr: redisServer.Addr()}),
+			options:     RedisOptions{PublishInvalidations: true, Origin: origin},
+		}
+		subscriber := newInvalidationSubscriber(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}), origin, l1)
+
+		return NewTieredCache(l1, l2), l1, subscriber
+	}
+
+	cacheA, _, subscriberA := newInstance("a")
+	cacheB, l1B, subscriberB := newInstance("b")
+
+	go func() { _ = subscriberA.Run(ctx) }()
+	go func() { _ = subscriberB.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		return len(redisServer.PubSubNumSub(InvalidationChannel)) > 0 &&
+			redisServer.PubSubNumSub(InvalidationChannel)[InvalidationChannel] == 2
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, cacheA.SetEntity(ctx, "k", &models.Entity{Key: "k", Value: "1"}, 0))
+
+	entity, _, err := cacheB.GetEntity(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, &models.Entity{Key: "k", Value: "1"}, entity)
+
+	require.NoError(t, cacheA.SetEntity(ctx, "k", &models.Entity{Key: "k", Value: "2"}, 0))
+
+	require.Eventually(t, func() bool {
+		_, _, err := l1B.GetEntity(ctx, "k")
+		return err != nil
+	}, time.Second, time.Millisecond)
+
+	entity, _, err = cacheB.GetEntity(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, &models.Entity{Key: "k", Value: "2"}, entity)
+
+	version, err := redisServer.Get(versionKeyPrefix + "k")
+	require.NoError(t, err)
+	assert.Equal(t, "2", version)
+
+	// a fill from the database is not a change, B keeps its L1 entry
+	require.NoError(t, cacheA.FillEntity(ctx, "k", &models.Entity{Key: "k", Value: "2"}, 0))
+
+	version, err = redisServer.Get(versionKeyPrefix + "k")
+	require.NoError(t, err)
+	assert.Equal(t, "2", version)
+
+	_, _, err = l1B.GetEntity(ctx, "k")
+	assert.NoError(t, err)
+}
+
+func TestInvalidationSubscriberResubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	redisServer := miniredis.RunT(t)
+	addr := redisServer.Addr()
+
+	l1 := newLRUCache(LRUOptions{})
+	subscriber := newInvalidationSubscriber(redis.NewClient(&redis.Options{Addr: addr}), "local", l1)
+
+	assert.ErrorIs(t, subscriber.Ping(ctx), errNotSubscribed)
+
+	stopped := make(chan struct{})
+	go func() {
+		_ = subscriber.Run(ctx)
+		close(stopped)
+	}()
+
+	require.Eventually(t, func() bool { return subscriber.Ping(ctx) == nil }, time.Second, time.Millisecond)
+
+	require.NoError(t, l1.SetEntity(ctx, "k", &models.Entity{Key: "k", Value: "1"}, 0))
+
+	redisServer.Close()
+
+	require.Eventually(t, func() bool { return subscriber.Ping(ctx) != nil }, time.Second, time.Millisecond)
+
+	// an invalidation of k is missed here
+	require.NoError(t, redisServer.StartAddr(addr))
+
+	require.Eventually(t, func() bool { return subscriber.Ping(ctx) == nil }, 5*time.Second, time.Millisecond)
+
+	_, _, err := l1.GetEntity(ctx, "k")
+	assert.Error(t, err)
+
+	redisServer.Publish(InvalidationChannel, `{"key":"k","version":1,"origin":"remote"}`)
+	assert.Eventually(t, func() bool {
+		subscriber.mu.Lock()
+		defer subscriber.mu.Unlock()
+		return subscriber.versions["k"].version == 1
+	}, time.Second, time.Millisecond)
+
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after ctx was done")
+	}
+}
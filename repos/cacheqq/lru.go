@@ -0,0 +1,176 @@
+package cacheqq
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"qq/models"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLRUMaxEntries = 10000
+	DefaultLRUMaxBytes   = 64 << 20
+	DefaultLRUExpiration = time.Minute
+)
+
+// approximate memory used by an entry besides its key and value
+const entryOverhead = 128
+
+type LRUOptions struct {
+	MaxEntries         int
+	MaxBytes           int64
+	Expiration         time.Duration
+	NegativeExpiration time.Duration
+}
+
+type lruEntry struct {
+	key       string
+	entity    *models.Entity
+	expiresAt time.Time
+	size      int64
+}
+
+type lruCache struct {
+	mu      sync.Mutex
+	options LRUOptions
+	items   map[string]*list.Element
+	order   *list.List
+	size    int64
+	now     func() time.Time
+}
+
+var _ Cache = &lruCache{}
+
+func NewLRUCache(options LRUOptions) Cache {
+	return newLRUCache(options)
+}
+
+func newLRUCache(options LRUOptions) *lruCache {
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = DefaultLRUMaxEntries
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultLRUMaxBytes
+	}
+	if options.Expiration <= 0 {
+		options.Expiration = DefaultLRUExpiration
+	}
+	if options.NegativeExpiration <= 0 {
+		options.NegativeExpiration = NegativeExpiration
+	}
+	if options.NegativeExpiration > options.Expiration {
+		options.NegativeExpiration = options.Expiration
+	}
+
+	return &lruCache{
+		options: options,
+		items:   map[string]*list.Element{},
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *lruCache) GetEntity(ctx context.Context, key string) (*models.Entity, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, present := c.items[key]
+	if !present {
+		return nil, 0, fmt.Errorf("key %s does not exist", key)
+	}
+
+	entry := element.Value.(*lruEntry)
+	ttl := entry.expiresAt.Sub(c.now())
+	if ttl <= 0 {
+		c.removeElement(element)
+		return nil, 0, fmt.Errorf("key %s does not exist", key)
+	}
+
+	c.order.MoveToFront(element)
+
+	if entry.entity == nil {
+		return nil, ttl, nil
+	}
+
+	entity := *entry.entity
+	return &entity, ttl, nil
+}
+
+// FillEntity is SetEntity: the cache is local to the instance
+func (c *lruCache) FillEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error {
+	return c.SetEntity(ctx, key, entity, expiration)
+}
+
+func (c *lruCache) SetEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error {
+	expiration = entryExpiration(entity, expiration, c.options.Expiration, c.options.NegativeExpiration)
+	if expiration > c.options.Expiration {
+		expiration = c.options.Expiration
+	}
+
+	entry := &lruEntry{
+		key:       key,
+		expiresAt: c.now().Add(expiration),
+		size:      int64(len(key)) + entryOverhead,
+	}
+
+	if entity != nil {
+		entityCopy := *entity
+		entry.entity = &entityCopy
+		entry.size += int64(len(entity.Key) + len(entity.Value))
+	}
+
+	if entry.size > c.options.MaxBytes {
+		return fmt.Errorf("failed to set key %s: entry of %d bytes exceeds cache size", key, entry.size)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, present := c.items[key]; present {
+		c.removeElement(element)
+	}
+
+	c.items[key] = c.order.PushFront(entry)
+	c.size += entry.size
+
+	for len(c.items) > c.options.MaxEntries || c.size > c.options.MaxBytes {
+		c.removeElement(c.order.Back())
+	}
+
+	return nil
+}
+
+func (c *lruCache) DeleteEntity(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, present := c.items[key]; present {
+		c.removeElement(element)
+	}
+
+	return nil
+}
+
+// Clear removes every entry
+func (c *lruCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+	c.size = 0
+}
+
+func (c *lruCache) removeElement(element *list.Element) {
+	entry := element.Value.(*lruEntry)
+
+	c.order.Remove(element)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
+
+func (c *lruCache) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,181 @@
+package cacheqq
+
+import (
+	"context"
+	"fmt"
+	"qq/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCacheGetEntity(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name      string
+		set       map[string]*models.Entity
+		key       string
+		exp       *models.Entity
+		expMissed bool
+	}{
+		{
+			name:      "HappyRun",
+			set:       map[string]*models.Entity{"a": {Key: "a", Value: "b"}},
+			key:       "a",
+			exp:       &models.Entity{Key: "a", Value: "b"},
+			expMissed: false,
+		},
+		{
+			name:      "Missed",
+			set:       map[string]*models.Entity{"a": {Key: "a", Value: "b"}},
+			key:       "c",
+			exp:       nil,
+			expMissed: true,
+		},
+		{
+			name:      "CachedNil",
+			set:       map[string]*models.Entity{"a": nil},
+			key:       "a",
+			exp:       nil,
+			expMissed: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			cache := newLRUCache(LRUOptions{})
+
+			for key, entity := range testCase.set {
+				require.NoError(t, cache.SetEntity(ctx, key, entity, 0))
+			}
+
+			entity, _, err := cache.GetEntity(ctx, testCase.key)
+			assert.Equal(t, testCase.exp, entity)
+			assert.Equal(t, testCase.expMissed, err != nil)
+		})
+	}
+}
+
+func TestLRUCacheExpiration(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	cache := newLRUCache(LRUOptions{Expiration: time.Minute})
+	cache.now = func() time.Time { return now }
+
+	require.NoError(t, cache.SetEntity(ctx, "a", &models.Entity{Key: "a", Value: "b"}, 0))
+
+	now = now.Add(59 * time.Second)
+	_, ttl, err := cache.GetEntity(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, ttl)
+
+	now = now.Add(time.Second)
+	_, _, err = cache.GetEntity(ctx, "a")
+	assert.Error(t, err)
+	assert.Equal(t, 0, cache.order.Len())
+	assert.Equal(t, int64(0), cache.size)
+}
+
+func TestLRUCacheNegativeExpiration(t *testing.T) {
+	ctx := context.Background()
+
+	cache := newLRUCache(LRUOptions{Expiration: time.Hour, NegativeExpiration: time.Minute})
+
+	require.NoError(t, cache.SetEntity(ctx, "a", nil, 0))
+	require.NoError(t, cache.SetEntity(ctx, "b", &models.Entity{Key: "b"}, 0))
+
+	_, ttl, err := cache.GetEntity(ctx, "a")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, ttl, float64(time.Second))
+
+	_, ttl, err = cache.GetEntity(ctx, "b")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour, ttl, float64(time.Second))
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("MaxEntries", func(t *testing.T) {
+		cache := newLRUCache(LRUOptions{MaxEntries: 2})
+
+		require.NoError(t, cache.SetEntity(ctx, "a", &models.Entity{Key: "a"}, 0))
+		require.NoError(t, cache.SetEntity(ctx, "b", &models.Entity{Key: "b"}, 0))
+
+		_, _, err := cache.GetEntity(ctx, "a")
+		require.NoError(t, err)
+
+		require.NoError(t, cache.SetEntity(ctx, "c", &models.Entity{Key: "c"}, 0))
+
+		_, _, err = cache.GetEntity(ctx, "b")
+		assert.Error(t, err)
+
+		_, _, err = cache.GetEntity(ctx, "a")
+		assert.NoError(t, err)
+
+		_, _, err = cache.GetEntity(ctx, "c")
+		assert.NoError(t, err)
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		cache := newLRUCache(LRUOptions{MaxBytes: 3 * (entryOverhead + 10)})
+
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("k%d", i)
+			require.NoError(t, cache.SetEntity(ctx, key, &models.Entity{Key: key, Value: "vvvvvv"}, 0))
+		}
+
+		assert.Equal(t, 3, cache.order.Len())
+		assert.LessOrEqual(t, cache.size, cache.options.MaxBytes)
+
+		_, _, err := cache.GetEntity(ctx, "k1")
+		assert.Error(t, err)
+
+		_, _, err = cache.GetEntity(ctx, "k4")
+		assert.NoError(t, err)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		cache := newLRUCache(LRUOptions{MaxBytes: entryOverhead})
+
+		err := cache.SetEntity(ctx, "a", &models.Entity{Key: "a", Value: "b"}, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+
+	l1 := newLRUCache(LRUOptions{})
+	l2 := newLRUCache(LRUOptions{})
+	cache := NewTieredCache(l1, l2)
+
+	require.NoError(t, l2.SetEntity(ctx, "a", &models.Entity{Key: "a", Value: "b"}, 0))
+
+	entity, _, err := cache.GetEntity(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, &models.Entity{Key: "a", Value: "b"}, entity)
+
+	entity, _, err = l1.GetEntity(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, &models.Entity{Key: "a", Value: "b"}, entity)
+
+	require.NoError(t, cache.SetEntity(ctx, "a", &models.Entity{Key: "a", Value: "c"}, 0))
+
+	entity, _, err = l1.GetEntity(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, &models.Entity{Key: "a", Value: "c"}, entity)
+
+	require.NoError(t, cache.DeleteEntity(ctx, "a"))
+
+	_, _, err = l1.GetEntity(ctx, "a")
+	assert.Error(t, err)
+
+	_, _, err = l2.GetEntity(ctx, "a")
+	assert.Error(t, err)
+}
@@ -0,0 +1,81 @@
+package cacheqq
+
+import (
+	"encoding/json"
+	"fmt"
+	"qq/models"
+	"time"
+)
+
+const NegativeExpiration = time.Minute
+
+// record is how an entity is stored in Redis; a tombstone remembers that the
+// entity does not exist, which is different from an entity with an empty value
+type record struct {
+	Tombstone bool      `json:"tombstone,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Value     string    `json:"value,omitempty"`
+	Version   uint64    `json:"version,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newRecord(entity *models.Entity, expiresAt time.Time) record {
+	if entity == nil {
+		return record{
+			Tombstone: true,
+			ExpiresAt: expiresAt,
+		}
+	}
+
+	return record{
+		Key:       entity.Key,
+		Value:     entity.Value,
+		Version:   entity.Version,
+		ExpiresAt: expiresAt,
+	}
+}
+
+func (r record) entity() *models.Entity {
+	if r.Tombstone {
+		return nil
+	}
+
+	return &models.Entity{
+		Key:     r.Key,
+		Value:   r.Value,
+		Version: r.Version,
+	}
+}
+
+func encodeRecord(r record) (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to produce JSON: %w", err)
+	}
+
+	return string(data), nil
+}
+
+func decodeRecord(data string) (record, error) {
+	var r record
+
+	err := json.Unmarshal([]byte(data), &r)
+	if err != nil {
+		return r, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	return r, nil
+}
+
+// entryExpiration caps the expiration of tombstones at negativeExpiration
+func entryExpiration(entity *models.Entity, expiration time.Duration, defaultExpiration time.Duration, negativeExpiration time.Duration) time.Duration {
+	if entity == nil && (expiration <= 0 || expiration > negativeExpiration) {
+		return negativeExpiration
+	}
+
+	if expiration <= 0 {
+		return defaultExpiration
+	}
+
+	return expiration
+}
@@ -0,0 +1,94 @@
+package cacheqq
+
+import (
+	"context"
+	"fmt"
+	"qq/models"
+	"qq/pkg/log"
+	"time"
+)
+
+type tieredCache struct {
+	l1 Cache
+	l2 Cache
+}
+
+var _ Cache = tieredCache{}
+
+// l1 never keeps a value l2 has not accepted: a failed l2 write drops the key from l1
+func NewTieredCache(l1 Cache, l2 Cache) Cache {
+	return tieredCache{
+		l1: l1,
+		l2: l2,
+	}
+}
+
+func (c tieredCache) GetEntity(ctx context.Context, key string) (*models.Entity, time.Duration, error) {
+	entity, ttl, err := c.l1.GetEntity(ctx, key)
+	if err == nil {
+		return entity, ttl, nil
+	}
+
+	entity, ttl, err = c.l2.GetEntity(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = c.l1.SetEntity(ctx, key, entity, ttl)
+	if err != nil {
+		log.Warning(ctx, "failed to set to l1 cache", log.Args{"key": key, "error": err})
+	}
+
+	return entity, ttl, nil
+}
+
+func (c tieredCache) SetEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error {
+	return c.set(ctx, key, entity, expiration, c.l2.SetEntity)
+}
+
+func (c tieredCache) FillEntity(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error {
+	return c.set(ctx, key, entity, expiration, c.l2.FillEntity)
+}
+
+// set writes to l2 with setL2, then to l1
+func (c tieredCache) set(ctx context.Context, key string, entity *models.Entity, expiration time.Duration, setL2 func(ctx context.Context, key string, entity *models.Entity, expiration time.Duration) error) error {
+	err := setL2(ctx, key, entity, expiration)
+	if err != nil {
+		c.invalidate(ctx, key)
+		return err
+	}
+
+	err = c.l1.SetEntity(ctx, key, entity, expiration)
+	if err != nil {
+		c.invalidate(ctx, key)
+	}
+
+	return nil
+}
+
+func (c tieredCache) DeleteEntity(ctx context.Context, key string) error {
+	c.invalidate(ctx, key)
+
+	err := c.l2.DeleteEntity(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete key %s from l2 cache: %w", key, err)
+	}
+
+	return nil
+}
+
+func (c tieredCache) invalidate(ctx context.Context, key string) {
+	err := c.l1.DeleteEntity(ctx, key)
+	if err != nil {
+		log.Warning(ctx, "failed to delete from l1 cache", log.Args{"key": key, "error": err})
+	}
+}
+
+func (c tieredCache) Ping(ctx context.Context) error {
+	err := c.l1.Ping(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.l2.Ping(ctx)
+}
@@ -1,16 +1,39 @@
 package qq
 
-import "qq/models"
+import (
+	"qq/models"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Database interface {
 	Add(entity models.Entity) bool
 	Remove(key string) bool
 	Get(key string) *models.Entity
 	GetAll() []models.Entity
+	// Scan returns up to limit entities in key order, starting after the key
+	// after; an empty after starts from the first key
+	Scan(after string, limit int) []models.Entity
+	NextVersion() uint64
+	Ping() error
+	Stats() Stats
+}
+
+// Stats counts the bytes of keys and values, not the memory held by the database
+type Stats struct {
+	Keys  int
+	Bytes int
 }
 
 type database struct {
+	mu       sync.RWMutex
 	entities map[string]models.Entity
+	// keys holds the keys of entities in order, for Scan
+	keys    []string
+	bytes   int
+	version uint64
 }
 
 var _ Database = &database{}
@@ -18,22 +41,50 @@ var _ Database = &database{}
 func NewDatabase() (Database, error) {
 	return &database{
 		entities: map[string]models.Entity{},
+		version:  uint64(time.Now().UnixNano()),
 	}, nil
 }
 
 func (d *database) Add(entity models.Entity) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	previous, present := d.entities[entity.Key]
+	if present {
+		d.bytes -= entitySize(previous)
+	} else {
+		i := sort.SearchStrings(d.keys, entity.Key)
+		d.keys = append(d.keys, "")
+		copy(d.keys[i+1:], d.keys[i:])
+		d.keys[i] = entity.Key
+	}
+
 	d.entities[entity.Key] = entity
+	d.bytes += entitySize(entity)
 
 	return true
 }
 
 func (d *database) Remove(key string) bool {
-	delete(d.entities, key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entity, present := d.entities[key]
+	if present {
+		d.bytes -= entitySize(entity)
+		delete(d.entities, key)
+
+		i := sort.SearchStrings(d.keys, key)
+		d.keys = append(d.keys[:i], d.keys[i+1:]...)
+	}
 
 	return true
 }
 
 func (d *database) Get(key string) *models.Entity {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	entity, present := d.entities[key]
 	if !present {
 		return nil
@@ -41,7 +92,16 @@ func (d *database) Get(key string) *models.Entity {
 	return &entity
 }
 
+// NextVersion starts from the creation time so that versions are not reused
+// after a restart even though the entities are not persisted
+func (d *database) NextVersion() uint64 {
+	return atomic.AddUint64(&d.version, 1)
+}
+
 func (d *database) GetAll() []models.Entity {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
 	entities := make([]models.Entity, 0, len(d.entities))
 	for _, entity := range d.entities {
 		entities = append(entities, entity)
@@ -49,3 +109,45 @@ func (d *database) GetAll() []models.Entity {
 
 	return entities
 }
+
+func (d *database) Scan(after string, limit int) []models.Entity {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	i := sort.SearchStrings(d.keys, after)
+	if i < len(d.keys) && d.keys[i] == after {
+		i++
+	}
+
+	end := len(d.keys)
+	if limit < end-i {
+		end = i + limit
+	}
+
+	entities := make([]models.Entity, 0, end-i)
+	for _, key := range d.keys[i:end] {
+		entities = append(entities, d.entities[key])
+	}
+
+	return entities
+}
+
+// Ping always succeeds: the entities are held in memory, so the database is
+// ready as soon as NewDatabase returns
+func (d *database) Ping() error {
+	return nil
+}
+
+func (d *database) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return Stats{
+		Keys:  len(d.entities),
+		Bytes: d.bytes,
+	}
+}
+
+func entitySize(entity models.Entity) int {
+	return len(entity.Key) + len(entity.Value)
+}
@@ -2,16 +2,33 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	netHttp "net/http"
 	"os"
+	"os/signal"
+	"qq/pkg/auth"
+	"qq/pkg/health"
 	"qq/pkg/log"
+	"qq/pkg/qqclient/binaryqq"
 	"qq/pkg/qqclient/rabbitqq"
+	"qq/pkg/qqtls"
+	"qq/repos/auditqq"
 	"qq/repos/cacheqq"
 	"qq/repos/qq"
 	"qq/server/qqserver"
+	binaryqqSrv "qq/server/qqserver/binaryqq"
+	grpcSrv "qq/server/qqserver/grpc"
 	"qq/server/qqserver/http"
+	memcacheqqSrv "qq/server/qqserver/memcacheqq"
+	"qq/server/qqserver/metrics"
 	rabbitqqSrv "qq/server/qqserver/rabbitqq"
+	redisqqSrv "qq/server/qqserver/redisqq"
 	qqServ "qq/services/qq"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -19,7 +36,49 @@ const (
 	HTTPServerType = "http"
 )
 
-const RabbitMQServerType = "rabbitmq"
+const (
+	RabbitMQServerType = "rabbitmq"
+	// RabbitMQMetricsURL serves /metrics next to the servers that have no
+	// HTTP listener of their own
+	RabbitMQMetricsURL = "localhost:9091"
+)
+
+const (
+	GRPCServerURL  = "localhost:9090"
+	GRPCServerType = "grpc"
+)
+
+// RedisServerURL is not the port of Redis itself, which the cache uses
+const (
+	RedisServerURL  = "localhost:6380"
+	RedisServerType = "redis"
+)
+
+const (
+	MemcachedServerURL  = "localhost:11211"
+	MemcachedServerType = "memcached"
+)
+
+// BinaryServerURL may also be a Unix domain socket, e.g. "unix:///tmp/qq.sock"
+const (
+	BinaryServerURL  = binaryqq.BinaryServerURL
+	BinaryServerType = "binary"
+)
+
+// Secrets are read from the environment rather than from flags, which are
+// visible in the process list
+const (
+	APIKeysEnv   = "QQ_API_KEYS"
+	JWTSecretEnv = "QQ_JWT_SECRET"
+	// AuditKeyEnv keys the hash chain of the audit log
+	AuditKeyEnv = "QQ_AUDIT_KEY"
+)
+
+const (
+	RedisCacheType  = "redis"
+	MemoryCacheType = "memory"
+	TieredCacheType = "tiered"
+)
 
 func main() {
 	ctx := context.Background()
@@ -30,31 +89,244 @@ func main() {
 		panic(fmt.Errorf("failed to create new qq database: %w", err))
 	}
 
-	cache := cacheqq.NewRedisCache()
+	if len(os.Args) < 2 {
+		errText := "server type is required"
+		log.Critical(ctx, errText)
+		panic(fmt.Errorf(errText))
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	cacheType := flags.String("cache", RedisCacheType, "Cache type")
+	writePolicyValue := flags.String("write_policy", string(qqServ.WriteThrough), "Write policy")
+	keyPolicyValue := flags.String("key_policy", string(qqServ.ExactKeys), "Key policy")
+	metricsURL := flags.String("metrics_url", RabbitMQMetricsURL, "Metrics URL of the servers other than HTTP")
+	jwtIssuer := flags.String("jwt_issuer", "", "Expected issuer of JWT bearer tokens")
+	jwtAudience := flags.String("jwt_audience", "", "Expected audience of JWT bearer tokens")
+	policyPath := flags.String("policy", "", "Access control policy file, reloaded on change")
+	limitsPath := flags.String("limits", "", "Rate limits and quotas file")
+	auditLogPath := flags.String("audit_log", "", "Hash-chained audit log file of all writes")
+	tlsCert := flags.String("tls_cert", "", "TLS certificate file of the server, reloaded on change")
+	tlsKey := flags.String("tls_key", "", "TLS key file of the server, reloaded on change")
+	tlsClientCA := flags.String("tls_client_ca", "", "CA bundle to verify client certificates against")
+	binaryURL := flags.String("binary_url", BinaryServerURL, "Address of the binary server, a TCP address or unix://<path>")
+	webSocketOrigins := flags.String("websocket_origins", "", "Comma separated origins whose pages may connect to /ws besides the pages of the server")
+	tlsRequireClientCert := flags.Bool("tls_require_client_cert", false, "Reject clients without a verified certificate")
+	_ = flags.Parse(os.Args[2:])
+
+	var cache cacheqq.Cache
+	var subscriber *cacheqq.InvalidationSubscriber
+
+	switch *cacheType {
+	case RedisCacheType:
+		cache = cacheqq.NewRedisCache(cacheqq.RedisOptions{})
+	case MemoryCacheType:
+		cache = cacheqq.NewLRUCache(cacheqq.LRUOptions{Expiration: cacheqq.Expiration})
+	case TieredCacheType:
+		origin := cacheqq.NewOrigin()
+		l1 := cacheqq.NewLRUCache(cacheqq.LRUOptions{})
+		l2 := cacheqq.NewRedisCache(cacheqq.RedisOptions{PublishInvalidations: true, Origin: origin})
+		cache = cacheqq.NewTieredCache(l1, l2)
+
+		subscriber = cacheqq.NewInvalidationSubscriber(origin, l1)
+		go func() {
+			_ = subscriber.Run(ctx)
+		}()
+	default:
+		errText := "invalid cache type"
+		log.Critical(ctx, errText)
+		panic(fmt.Errorf(errText))
+	}
+
+	writePolicy, err := qqServ.ParseWritePolicy(*writePolicyValue)
+	if err != nil {
+		log.Critical(ctx, "invalid write policy", log.Args{"error": err})
+		panic(fmt.Errorf("invalid write policy: %w", err))
+	}
 
-	service, err := qqServ.NewService(database, cache)
+	keyPolicy, err := qqServ.ParseKeyPolicy(*keyPolicyValue)
+	if err != nil {
+		log.Critical(ctx, "invalid key policy", log.Args{"error": err})
+		panic(fmt.Errorf("invalid key policy: %w", err))
+	}
+
+	authenticator, err := newAuthenticator(*jwtIssuer, *jwtAudience)
+	if err != nil {
+		log.Critical(ctx, "invalid authentication settings", log.Args{"error": err})
+		panic(fmt.Errorf("invalid authentication settings: %w", err))
+	}
+
+	var policy qqServ.PolicySource
+
+	if *policyPath != "" {
+		policyFile, err := qqServ.LoadPolicyFile(*policyPath)
+		if err != nil {
+			log.Critical(ctx, "failed to load policy", log.Args{"error": err})
+			panic(fmt.Errorf("failed to load policy: %w", err))
+		}
+
+		go policyFile.Run(ctx, qqServ.PolicyReloadInterval)
+
+		policy = policyFile
+	}
+
+	var limits *qqServ.Limits
+
+	if *limitsPath != "" {
+		limits, err = qqServ.LoadLimits(*limitsPath)
+		if err != nil {
+			log.Critical(ctx, "failed to load limits", log.Args{"error": err})
+			panic(fmt.Errorf("failed to load limits: %w", err))
+		}
+	}
+
+	var auditLog auditqq.Log
+
+	if *auditLogPath != "" {
+		auditFile, err := auditqq.OpenFileLog(*auditLogPath, []byte(os.Getenv(AuditKeyEnv)))
+		if err != nil {
+			log.Critical(ctx, "failed to open audit log", log.Args{"error": err})
+			panic(fmt.Errorf("failed to open audit log: %w", err))
+		}
+
+		auditLog = auditFile
+	}
+
+	serviceMetrics := qqServ.NewMetrics()
+
+	service, err := qqServ.NewService(database, cache, qqServ.Options{
+		KeyPolicy:         keyPolicy,
+		WritePolicy:       writePolicy,
+		EarlyRefreshBeta:  1,
+		EarlyRefreshDelta: 100 * time.Millisecond,
+		ExpirationJitter:  0.1,
+		Metrics:           serviceMetrics,
+		Policy:            policy,
+		Limits:            limits,
+		Audit:             auditLog,
+	})
 	if err != nil {
 		log.Critical(ctx, "failed to create new qq service", log.Args{"error": err})
 		panic(fmt.Errorf("failed to create new qq service: %w", err))
 	}
 
+	go closeOnSignal(ctx, service, auditLog)
+
+	healthDependencies := []health.Dependency{
+		{Name: "database", Check: func(ctx context.Context) error { return database.Ping() }},
+	}
+	if *cacheType != MemoryCacheType {
+		healthDependencies = append(healthDependencies, health.Dependency{Name: "redis", Check: cache.Ping})
+	}
+	if subscriber != nil {
+		healthDependencies = append(healthDependencies, health.Dependency{Name: "invalidations", Check: subscriber.Ping})
+	}
+
+	serverMetrics := metrics.New(serviceMetrics, database)
+
 	serverType := os.Args[1]
 	var server qqserver.Server
 
 	switch serverType {
 	case HTTPServerType:
-		server, err = http.NewServer(ctx, HTTPServerURL, service)
+		tlsConfig, err := newTLSConfig(ctx, *tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			log.Critical(ctx, "invalid TLS settings", log.Args{"error": err})
+			panic(fmt.Errorf("invalid TLS settings: %w", err))
+		}
+
+		server, err = http.NewServer(ctx, HTTPServerURL, service, http.Options{
+			HealthDependencies: healthDependencies,
+			Metrics:            serverMetrics,
+			Authenticator:      authenticator,
+			TLS:                tlsConfig,
+			WebSocketOrigins:   splitList(*webSocketOrigins),
+		})
 		if err != nil {
 			log.Critical(ctx, "failed to create new http server", log.Args{"error": err})
 			panic(fmt.Errorf("failed to create new http server: %w", err))
 		}
 	case RabbitMQServerType:
-		server, err = rabbitqqSrv.NewServer(ctx, rabbitqq.RpcQueue, service)
+		server, err = rabbitqqSrv.NewServer(ctx, rabbitqq.RpcQueue, service, rabbitqqSrv.Options{
+			HealthDependencies: healthDependencies,
+			Metrics:            serverMetrics,
+			Authenticator:      authenticator,
+		})
 		if err != nil {
 			log.Critical(ctx, "failed to create new RabbitMQ server", log.Args{"error": err})
 			panic(fmt.Errorf("failed to create new RabbitMQ server: %w", err))
 		}
 
+		go serveMetrics(ctx, *metricsURL, serverMetrics)
+
+	case GRPCServerType:
+		tlsConfig, err := newTLSConfig(ctx, *tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			log.Critical(ctx, "invalid TLS settings", log.Args{"error": err})
+			panic(fmt.Errorf("invalid TLS settings: %w", err))
+		}
+
+		server, err = grpcSrv.NewServer(ctx, GRPCServerURL, service, grpcSrv.Options{
+			Metrics:       serverMetrics,
+			Authenticator: authenticator,
+			TLS:           tlsConfig,
+		})
+		if err != nil {
+			log.Critical(ctx, "failed to create new gRPC server", log.Args{"error": err})
+			panic(fmt.Errorf("failed to create new gRPC server: %w", err))
+		}
+
+		go serveMetrics(ctx, *metricsURL, serverMetrics)
+
+	case RedisServerType:
+		tlsConfig, err := newTLSConfig(ctx, *tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			log.Critical(ctx, "invalid TLS settings", log.Args{"error": err})
+			panic(fmt.Errorf("invalid TLS settings: %w", err))
+		}
+
+		server, err = redisqqSrv.NewServer(ctx, RedisServerURL, service, redisqqSrv.Options{
+			Metrics:       serverMetrics,
+			Authenticator: authenticator,
+			TLS:           tlsConfig,
+		})
+		if err != nil {
+			log.Critical(ctx, "failed to create new Redis server", log.Args{"error": err})
+			panic(fmt.Errorf("failed to create new Redis server: %w", err))
+		}
+
+		go serveMetrics(ctx, *metricsURL, serverMetrics)
+
+	case MemcachedServerType:
+		tlsConfig, err := newTLSConfig(ctx, *tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			log.Critical(ctx, "invalid TLS settings", log.Args{"error": err})
+			panic(fmt.Errorf("invalid TLS settings: %w", err))
+		}
+
+		server, err = memcacheqqSrv.NewServer(ctx, MemcachedServerURL, service, memcacheqqSrv.Options{
+			Metrics:       serverMetrics,
+			Authenticator: authenticator,
+			TLS:           tlsConfig,
+		})
+		if err != nil {
+			log.Critical(ctx, "failed to create new memcached server", log.Args{"error": err})
+			panic(fmt.Errorf("failed to create new memcached server: %w", err))
+		}
+
+		go serveMetrics(ctx, *metricsURL, serverMetrics)
+
+	case BinaryServerType:
+		server, err = binaryqqSrv.NewServer(ctx, *binaryURL, service, binaryqqSrv.Options{
+			Metrics:       serverMetrics,
+			Authenticator: authenticator,
+		})
+		if err != nil {
+			log.Critical(ctx, "failed to create new binary server", log.Args{"error": err})
+			panic(fmt.Errorf("failed to create new binary server: %w", err))
+		}
+
+		go serveMetrics(ctx, *metricsURL, serverMetrics)
+
 	default:
 		errText := "invalid server type"
 		log.Critical(ctx, errText)
@@ -63,7 +335,120 @@ func main() {
 
 	err = server.Serve()
 	if err != nil {
+		closeService(ctx, service, auditLog)
 		log.Critical(ctx, "failed to serve", log.Args{"error": err})
 		panic(fmt.Errorf("failed to serve: %w", err))
 	}
 }
+
+// closeOnSignal flushes the writes pending under write-behind, and then the
+// audit log, before the process exits on SIGINT or SIGTERM
+func closeOnSignal(ctx context.Context, service qqServ.Service, auditLog auditqq.Log) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	received := <-signals
+	log.Info(ctx, "shutting down", log.Args{"signal": received.String()})
+
+	closeService(ctx, service, auditLog)
+	os.Exit(0)
+}
+
+// closeService closes the audit log after the service, whose last writes
+// it records
+func closeService(ctx context.Context, service qqServ.Service, auditLog auditqq.Log) {
+	err := service.Close()
+	if err != nil {
+		log.Error(ctx, "failed to close qq service", log.Args{"error": err})
+	}
+
+	if auditLog == nil {
+		return
+	}
+
+	err = auditLog.Close()
+	if err != nil {
+		log.Error(ctx, "failed to close audit log", log.Args{"error": err})
+	}
+}
+
+// serveMetrics serves /metrics for the servers without an HTTP listener
+func serveMetrics(ctx context.Context, url string, serverMetrics metrics.Metrics) {
+	mux := netHttp.NewServeMux()
+	mux.Handle(metrics.Path, serverMetrics.Handler())
+
+	err := netHttp.ListenAndServe(url, mux)
+	if err != nil {
+		log.Error(ctx, "failed to serve metrics", log.Args{"error": err})
+	}
+}
+
+// newAuthenticator accepts the API keys and JWT secret set in the
+// environment; requests are not authenticated when neither is set
+func newAuthenticator(jwtIssuer string, jwtAudience string) (auth.Authenticator, error) {
+	schemes := auth.Schemes{}
+
+	apiKeys := os.Getenv(APIKeysEnv)
+	if apiKeys != "" {
+		keys, err := auth.ParseAPIKeys(apiKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", APIKeysEnv, err)
+		}
+
+		schemes[auth.SchemeAPIKey] = auth.NewAPIKeys(keys)
+	}
+
+	jwtSecret := os.Getenv(JWTSecretEnv)
+	if jwtSecret != "" {
+		schemes[auth.SchemeBearer] = auth.JWT{
+			Secret:   []byte(jwtSecret),
+			Issuer:   jwtIssuer,
+			Audience: jwtAudience,
+			Leeway:   time.Minute,
+		}
+	}
+
+	if len(schemes) == 0 {
+		return nil, nil
+	}
+
+	return schemes, nil
+}
+
+// newTLSConfig returns nil, serving without TLS, when no certificate is set
+func newTLSConfig(ctx context.Context, certPath string, keyPath string, clientCAPath string, requireClientCert bool) (*tls.Config, error) {
+	if certPath == "" && keyPath == "" {
+		if clientCAPath != "" || requireClientCert {
+			return nil, fmt.Errorf("client certificates require a server certificate")
+		}
+
+		return nil, nil
+	}
+
+	certificate, err := qqtls.LoadCertificateFile(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	go certificate.Run(ctx, qqtls.CertificateReloadInterval)
+
+	return qqtls.ServerConfig(qqtls.ServerOptions{
+		Certificate:       certificate,
+		ClientCAFile:      clientCAPath,
+		RequireClientCert: requireClientCert,
+	})
+}
+
+// splitList returns the non-empty items of a comma separated list
+func splitList(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,105 @@
+package binaryqq
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"qq/models"
+	"qq/pkg/qqclient"
+	binaryClient "qq/pkg/qqclient/binaryqq"
+	httpClient "qq/pkg/qqclient/http"
+	httpServer "qq/server/qqserver/http"
+	"qq/services/qq/qqtest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// freeAddress returns a loopback address nothing listens on
+func freeAddress(b *testing.B) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+
+	address := listener.Addr().String()
+	require.NoError(b, listener.Close())
+
+	return address
+}
+
+// benchmarkClients serves the same service over both protocols, and returns
+// a client of each
+func benchmarkClients(b *testing.B) map[string]qqclient.Client {
+	ctx := context.Background()
+
+	service := qqtest.NewService(b)
+	service.Add(ctx, models.Entity{Key: "key", Value: "value"})
+
+	binaryListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+
+	s := newServer(binaryListener.Addr().String(), service, Options{})
+	go func() {
+		_ = s.serve(binaryListener)
+	}()
+	b.Cleanup(func() { _ = binaryListener.Close() })
+
+	binary := binaryClient.NewClientWithOptions(ctx, binaryClient.Options{ServerURL: binaryListener.Addr().String()})
+	b.Cleanup(func() { _ = binary.Close() })
+
+	httpAddress := freeAddress(b)
+
+	server, err := httpServer.NewServer(ctx, httpAddress, service, httpServer.Options{})
+	require.NoError(b, err)
+
+	go func() {
+		_ = server.Serve()
+	}()
+
+	http := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: "http://" + httpAddress})
+
+	require.Eventually(b, func() bool {
+		_, err := http.Get(ctx, "key")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return map[string]qqclient.Client{
+		"binary": binary,
+		"http":   http,
+	}
+}
+
+// BenchmarkGet compares the protocols, one request at a time and with
+// concurrent requests, which the binary client pipelines
+func BenchmarkGet(b *testing.B) {
+	clients := benchmarkClients(b)
+
+	for _, name := range []string{"binary", "http"} {
+		client := clients[name]
+
+		b.Run(fmt.Sprintf("%s/sequential", name), func(b *testing.B) {
+			ctx := context.Background()
+
+			for i := 0; i < b.N; i++ {
+				_, err := client.Get(ctx, "key")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("%s/parallel", name), func(b *testing.B) {
+			ctx := context.Background()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := client.Get(ctx, "key")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package binaryqq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	"qq/pkg/qqclient/binaryqq"
+	"qq/pkg/qqcontext"
+	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+)
+
+// connectionOperation is the operation of OpAuth, which is not admitted
+const connectionOperation = "connection"
+
+var (
+	errUnknownOp            = fmt.Errorf("%w: unknown op", binaryqq.ErrBadRequest)
+	errEmptyKey             = fmt.Errorf("%w: key is empty", binaryqq.ErrBadRequest)
+	errUnauthenticated      = fmt.Errorf("%w: OpAuth must be sent first", binaryqq.ErrUnauthorized)
+	errAuthenticationFailed = fmt.Errorf("%w: invalid credentials", binaryqq.ErrUnauthorized)
+	errInternal             = fmt.Errorf("%w: panicked", binaryqq.ErrInternalError)
+	errEntityTooLarge       = fmt.Errorf("%w: entity does not fit in a frame", binaryqq.ErrInternalError)
+)
+
+type handler struct {
+	operation string
+	// handle decodes the fields following the metadata from decoder, and
+	// encodes the result to encoder
+	handle func(s *server, ctx context.Context, decoder *binaryqq.Decoder, encoder *binaryqq.Encoder) error
+}
+
+var handlers = map[byte]handler{
+	binaryqq.OpGet:    {operation: "get", handle: (*server).get},
+	binaryqq.OpAdd:    {operation: "add", handle: (*server).add},
+	binaryqq.OpRemove: {operation: "remove", handle: (*server).remove},
+	binaryqq.OpGetAll: {operation: "get_all", handle: (*server).getAll},
+}
+
+// toStatus maps the errors of the handlers and of the service to statuses
+func toStatus(err error) byte {
+	switch {
+	case errors.Is(err, binaryqq.ErrBadRequest), errors.Is(err, binaryqq.ErrMalformedFrame):
+		return binaryqq.StatusBadRequest
+	case errors.Is(err, binaryqq.ErrUnauthorized):
+		return binaryqq.StatusUnauthorized
+	case errors.Is(err, qq.ErrPermissionDenied):
+		return binaryqq.StatusPermissionDenied
+	case errors.Is(err, qq.ErrRateLimited):
+		return binaryqq.StatusRateLimited
+	case errors.Is(err, qq.ErrQuotaExceeded):
+		return binaryqq.StatusQuotaExceeded
+	default:
+		return binaryqq.StatusInternalError
+	}
+}
+
+// request describes a request of operation to the shared pipeline
+func (s *server) request(operation string) qqserver.Request {
+	return qqserver.Request{
+		Transport: metrics.TransportBinary,
+		Operation: operation,
+		Name:      operation,
+		Metrics:   s.metrics,
+		Internal:  errInternal,
+	}
+}
+
+// respond replies to the request id with payload, or with err when set
+func (c *connection) respond(ctx context.Context, id uint64, payload []byte, err error) {
+	if err != nil {
+		var encoder binaryqq.Encoder
+		encoder.String(err.Error())
+
+		c.reply(ctx, id, toStatus(err), encoder.Payload)
+		return
+	}
+
+	c.reply(ctx, id, binaryqq.StatusOK, payload)
+}
+
+// handleAuth authenticates the connection with the credentials of the
+// payload; it is called by the read loop, before the next request is read
+func (s *server) handleAuth(c *connection, frame binaryqq.Frame) {
+	ctx := qqcontext.WithTransportValue(c.ctx, metrics.TransportBinary)
+
+	err := qqserver.Handle(ctx, s.request(connectionOperation), func(ctx context.Context) error {
+		return s.authenticate(ctx, c, frame)
+	})
+
+	c.respond(ctx, frame.Id, nil, err)
+}
+
+func (s *server) authenticate(ctx context.Context, c *connection, frame binaryqq.Frame) error {
+	decoder := binaryqq.Decoder{Payload: frame.Payload}
+	authorization := decoder.String()
+
+	err := decoder.Err()
+	if err != nil {
+		return err
+	}
+
+	// without an authenticator there is nothing to verify
+	if s.authenticator == nil {
+		return nil
+	}
+
+	credentials, err := auth.ParseCredentials(authorization)
+	if err != nil {
+		return errAuthenticationFailed
+	}
+
+	identity, err := s.authenticator.Authenticate(ctx, credentials)
+	if err != nil {
+		log.Warning(ctx, "failed to authenticate", log.Args{"error": err})
+		return errAuthenticationFailed
+	}
+
+	c.ctx = qqcontext.WithIdentityValue(c.ctx, identity)
+	c.ctx = qqcontext.WithUserIdValue(c.ctx, identity.UserId)
+	c.authenticated = true
+
+	return nil
+}
+
+// handleFrame runs a request with the authenticated and admitted context.
+// ctx is the context of the connection when the request was read.
+func (s *server) handleFrame(ctx context.Context, c *connection, authenticated bool, frame binaryqq.Frame) {
+	h, ok := handlers[frame.Code]
+
+	operation := "unknown"
+	if ok {
+		operation = h.operation
+	}
+
+	decoder := binaryqq.Decoder{Payload: frame.Payload}
+	userId := decoder.String()
+	requestId := decoder.String()
+
+	if !qqcontext.ValidRequestId(requestId) {
+		requestId = qqcontext.NewRequestId()
+	}
+
+	ctx = qqcontext.WithTransportValue(ctx, metrics.TransportBinary)
+	ctx = qqcontext.WithRequestIdValue(ctx, requestId)
+
+	// the claimed user id is trusted when there is no authenticator
+	if s.authenticator == nil {
+		ctx = qqcontext.WithUserIdValue(ctx, userId)
+	}
+
+	var encoder binaryqq.Encoder
+
+	err := qqserver.Handle(ctx, s.request(operation), func(ctx context.Context) error {
+		if !ok {
+			return errUnknownOp
+		}
+
+		if !authenticated {
+			return errUnauthenticated
+		}
+
+		err := qqserver.Admit(ctx, s.service, h.operation)
+		if err != nil {
+			return err
+		}
+
+		return h.handle(s, ctx, &decoder, &encoder)
+	})
+
+	c.respond(ctx, frame.Id, encoder.Payload, err)
+}
+
+func validKey(key string) error {
+	if key == "" {
+		return errEmptyKey
+	}
+
+	return nil
+}
+
+func (s *server) get(ctx context.Context, decoder *binaryqq.Decoder, encoder *binaryqq.Encoder) error {
+	key := decoder.String()
+
+	err := decoder.Err()
+	if err != nil {
+		return err
+	}
+
+	err = validKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = s.service.Authorize(ctx, qq.ActionRead, key)
+	if err != nil {
+		return err
+	}
+
+	entity := s.service.Get(ctx, key)
+	if entity == nil {
+		encoder.Bool(false)
+		return nil
+	}
+
+	encoder.Bool(true)
+	encoder.String(entity.Value)
+
+	return nil
+}
+
+func (s *server) add(ctx context.Context, decoder *binaryqq.Decoder, encoder *binaryqq.Encoder) error {
+	entity := models.Entity{Key: decoder.String(), Value: decoder.String()}
+
+	err := decoder.Err()
+	if err != nil {
+		return err
+	}
+
+	err = validKey(entity.Key)
+	if err != nil {
+		return err
+	}
+
+	err = s.service.Authorize(ctx, qq.ActionWrite, entity.Key)
+	if err != nil {
+		return err
+	}
+
+	err = s.service.CheckQuota(ctx, entity)
+	if err != nil {
+		return err
+	}
+
+	encoder.Bool(s.service.Add(ctx, entity))
+
+	return nil
+}
+
+func (s *server) remove(ctx context.Context, decoder *binaryqq.Decoder, encoder *binaryqq.Encoder) error {
+	key := decoder.String()
+
+	err := decoder.Err()
+	if err != nil {
+		return err
+	}
+
+	err = validKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = s.service.Authorize(ctx, qq.ActionWrite, key)
+	if err != nil {
+		return err
+	}
+
+	encoder.Bool(s.service.Remove(ctx, key))
+
+	return nil
+}
+
+// getAllPageSize is the number of keys scanned for one OpGetAll request
+const getAllPageSize = 1000
+
+// maxPageLength bounds the entities of a page to half a payload, which
+// leaves room for the count and the key the next page continues after
+const maxPageLength = binaryqq.MaxPayloadLength / 2
+
+func (s *server) getAll(ctx context.Context, decoder *binaryqq.Decoder, encoder *binaryqq.Encoder) error {
+	after := decoder.String()
+
+	err := decoder.Err()
+	if err != nil {
+		return err
+	}
+
+	entities, next := s.service.Scan(ctx, after, getAllPageSize)
+
+	// a page that would not fit in a frame ends at the last entity that does
+	var page binaryqq.Encoder
+	count := 0
+
+	for _, entity := range entities {
+		length := len(page.Payload)
+		page.String(entity.Key)
+		page.String(entity.Value)
+
+		if len(page.Payload) > maxPageLength {
+			if count == 0 {
+				return fmt.Errorf("%w: key %s", errEntityTooLarge, entity.Key)
+			}
+
+			page.Payload = page.Payload[:length]
+			next = entities[count-1].Key
+			break
+		}
+
+		count++
+	}
+
+	encoder.Uvarint(uint64(count))
+	encoder.Payload = append(encoder.Payload, page.Payload...)
+	encoder.String(next)
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package binaryqq
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	"qq/pkg/qqclient/binaryqq"
+	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"sync"
+)
+
+// MaxInFlight bounds the requests of a connection handled at once; the
+// connection is not read while they are all in flight
+const MaxInFlight = 128
+
+type Options struct {
+	// Metrics are recorded when set; they are served by the metrics server
+	Metrics metrics.Metrics
+	// Authenticator verifies the credentials of OpAuth, which must then be
+	// the first request of every connection; connections are not
+	// authenticated when it is nil
+	Authenticator auth.Authenticator
+}
+
+type server struct {
+	address       string
+	service       qq.Service
+	metrics       metrics.Metrics
+	authenticator auth.Authenticator
+}
+
+var _ qqserver.Server = &server{}
+
+// NewServer listens on a TCP address, or on a Unix domain socket when
+// address starts with "unix://"
+func NewServer(ctx context.Context, address string, service qq.Service, options Options) (qqserver.Server, error) {
+	log.Debug(ctx, "create new binary server", log.Args{"address": address})
+
+	return newServer(address, service, options), nil
+}
+
+func newServer(address string, service qq.Service, options Options) *server {
+	return &server{
+		address:       address,
+		service:       service,
+		metrics:       options.Metrics,
+		authenticator: options.Authenticator,
+	}
+}
+
+func (s *server) Serve() error {
+	network, address := binaryqq.ParseAddress(s.address)
+
+	if network == "unix" {
+		err := removeStaleSocket(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	return s.serve(listener)
+}
+
+// removeStaleSocket removes the socket left behind by a previous run, which
+// would make listening fail; any other file is left alone
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat socket: %w", err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	return nil
+}
+
+// serve returns nil once listener is closed
+func (s *server) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept: %w", err)
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+// connection is written by the handlers of its requests at once; ctx and
+// authenticated are only touched by the read loop, which handles OpAuth
+type connection struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+	// ctx carries the identity authenticated by OpAuth
+	ctx           context.Context
+	authenticated bool
+}
+
+// reply writes the response of the request with id; a connection that
+// cannot be written to is closed, which ends its read loop
+func (c *connection) reply(ctx context.Context, id uint64, status byte, payload []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err := binaryqq.WriteFrame(c.writer, binaryqq.Frame{Id: id, Code: status, Payload: payload})
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	if err != nil {
+		log.Warning(ctx, "failed to write response", log.Args{"error": err, "id": id})
+		_ = c.conn.Close()
+	}
+}
+
+// handleConnection reads the requests one after the other, and handles
+// them concurrently; OpAuth is handled before the next request is read
+func (s *server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	c := &connection{
+		conn:   conn,
+		writer: bufio.NewWriter(conn),
+		ctx:    context.Background(),
+	}
+
+	reader := bufio.NewReader(conn)
+	inFlight := make(chan struct{}, MaxInFlight)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		frame, err := binaryqq.ReadFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warning(c.ctx, "failed to read request", log.Args{"error": err, "remote": conn.RemoteAddr().String()})
+			}
+
+			return
+		}
+
+		if frame.Code == binaryqq.OpAuth {
+			s.handleAuth(c, frame)
+			continue
+		}
+
+		ctx := c.ctx
+		authenticated := c.authenticated || s.authenticator == nil
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+
+			s.handleFrame(ctx, c, authenticated, frame)
+		}()
+	}
+}
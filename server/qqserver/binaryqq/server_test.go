@@ -0,0 +1,369 @@
+package binaryqq
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/qqclient"
+	binaryClient "qq/pkg/qqclient/binaryqq"
+	"qq/pkg/qqcontext"
+	"qq/services/qq"
+	"qq/services/qq/qqtest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listen serves service on listener and returns the URL clients dial
+func listen(t *testing.T, listener net.Listener, service qq.Service, options Options) string {
+	s := newServer(listener.Addr().String(), service, options)
+	go func() {
+		_ = s.serve(listener)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	if listener.Addr().Network() == "unix" {
+		return "unix://" + listener.Addr().String()
+	}
+
+	return listener.Addr().String()
+}
+
+func listenTCP(t *testing.T, service qq.Service, options Options) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	return listen(t, listener, service, options)
+}
+
+func newClient(t *testing.T, options binaryClient.Options) binaryClient.Client {
+	client := binaryClient.NewClientWithOptions(context.Background(), options)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func TestRoundTrip(t *testing.T) {
+	tcp := func(t *testing.T, service qq.Service) string {
+		return listenTCP(t, service, Options{})
+	}
+	unix := func(t *testing.T, service qq.Service) string {
+		listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "qq.sock"))
+		require.NoError(t, err)
+
+		return listen(t, listener, service, Options{})
+	}
+
+	testCases := []struct {
+		name   string
+		listen func(t *testing.T, service qq.Service) string
+	}{
+		{name: "tcp", listen: tcp},
+		{name: "unix", listen: unix},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := newClient(t, binaryClient.Options{ServerURL: testCase.listen(t, qqtest.NewService(t))})
+
+			added, err := client.Add(ctx, qqclient.Entity{Key: "a", Value: "1"})
+			require.NoError(t, err)
+			assert.True(t, added)
+
+			_, err = client.Add(ctx, qqclient.Entity{Key: "b", Value: ""})
+			require.NoError(t, err)
+
+			entity, err := client.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.Equal(t, &qqclient.Entity{Key: "a", Value: "1"}, entity)
+
+			entity, err = client.Get(ctx, "missing")
+			require.NoError(t, err)
+			assert.Nil(t, entity)
+
+			reply, err := client.GetAsync(ctx, "b")
+			require.NoError(t, err)
+			result := <-reply
+			require.NoError(t, result.Err)
+			assert.Equal(t, &qqclient.Entity{Key: "b", Value: ""}, result.Result)
+
+			entities, err := client.GetAll(ctx)
+			require.NoError(t, err)
+			sort.Slice(entities, func(i, j int) bool { return entities[i].Key < entities[j].Key })
+			assert.Equal(t, []qqclient.Entity{{Key: "a", Value: "1"}, {Key: "b", Value: ""}}, entities)
+
+			removed, err := client.Remove(ctx, "a")
+			require.NoError(t, err)
+			assert.True(t, removed)
+
+			entity, err = client.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.Nil(t, entity)
+		})
+	}
+}
+
+func TestGetAllPages(t *testing.T) {
+	ctx := context.Background()
+
+	// more keys than a page scans
+	service := qqtest.NewService(t)
+	for i := 0; i < 2*getAllPageSize+1; i++ {
+		service.Add(ctx, models.Entity{Key: fmt.Sprintf("key-%04d", i), Value: "1"})
+	}
+
+	client := newClient(t, binaryClient.Options{ServerURL: listenTCP(t, service, Options{})})
+
+	entities, err := client.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Len(t, entities, 2*getAllPageSize+1)
+
+	// entities too long to share a frame
+	service = qqtest.NewService(t)
+	value := strings.Repeat("v", maxPageLength*2/3)
+	service.Add(ctx, models.Entity{Key: "a", Value: value})
+	service.Add(ctx, models.Entity{Key: "b", Value: value})
+
+	client = newClient(t, binaryClient.Options{ServerURL: listenTCP(t, service, Options{})})
+
+	entities, err = client.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []qqclient.Entity{{Key: "a", Value: value}, {Key: "b", Value: value}}, entities)
+}
+
+// slowService holds the gets of "slow" until release is closed
+type slowService struct {
+	qq.Service
+	release chan struct{}
+}
+
+func (s slowService) Get(ctx context.Context, key string) *models.Entity {
+	if key == "slow" {
+		<-s.release
+	}
+
+	return s.Service.Get(ctx, key)
+}
+
+// TestPipelining sends concurrent requests over a single connection, whose
+// slow requests must not hold back the others
+func TestPipelining(t *testing.T) {
+	release := make(chan struct{})
+	service := slowService{Service: qqtest.NewService(t), release: release}
+
+	for _, key := range []string{"slow", "a", "b", "c"} {
+		service.Add(context.Background(), models.Entity{Key: key, Value: key})
+	}
+
+	ctx := context.Background()
+	client := newClient(t, binaryClient.Options{ServerURL: listenTCP(t, service, Options{}), PoolSize: 1})
+
+	slow, err := client.GetAsync(ctx, "slow")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		key := []string{"a", "b", "c"}[i%3]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			entity, err := client.Get(ctx, key)
+			assert.NoError(t, err)
+			assert.Equal(t, &qqclient.Entity{Key: key, Value: key}, entity)
+		}()
+	}
+	wg.Wait()
+
+	close(release)
+
+	result := <-slow
+	require.NoError(t, result.Err)
+	assert.Equal(t, "slow", result.Result.Value)
+}
+
+func TestContext(t *testing.T) {
+	var userId, requestId string
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			userId = qqcontext.GetUserIdValue(ctx)
+			requestId = qqcontext.GetRequestIdValue(ctx)
+			return nil
+		},
+	}
+
+	client := newClient(t, binaryClient.Options{ServerURL: listenTCP(t, &service, Options{})})
+
+	ctx := qqcontext.WithUserIdValue(context.Background(), "alice")
+	ctx = qqcontext.WithRequestIdValue(ctx, "request-1")
+
+	_, err := client.Get(ctx, "a")
+	require.NoError(t, err)
+
+	assert.Equal(t, "alice", userId)
+	assert.Equal(t, "request-1", requestId)
+}
+
+func TestAuthentication(t *testing.T) {
+	var userId string
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			userId = qqcontext.GetUserIdValue(ctx)
+			return nil
+		},
+	}
+
+	address := listenTCP(t, &service, Options{Authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"})})
+
+	testCases := []struct {
+		name        string
+		credentials *auth.Credentials
+		expErr      error
+		expUserId   string
+	}{
+		{
+			name:   "no credentials",
+			expErr: binaryClient.ErrUnauthorized,
+		},
+		{
+			name:        "invalid credentials",
+			credentials: &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: "wrong"},
+			expErr:      binaryClient.ErrUnauthorized,
+		},
+		{
+			name:        "valid credentials",
+			credentials: &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: "key"},
+			expUserId:   "alice",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			userId = ""
+
+			client := newClient(t, binaryClient.Options{ServerURL: address, Credentials: testCase.credentials})
+
+			// the claimed user id is ignored
+			ctx := qqcontext.WithUserIdValue(context.Background(), "mallory")
+
+			_, err := client.Get(ctx, "a")
+			if testCase.expErr != nil {
+				assert.ErrorIs(t, err, testCase.expErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expUserId, userId)
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	service := qq.ServiceMock{
+		AuthorizeMock: func(ctx context.Context, action qq.Action, key string) error {
+			if key == "denied" {
+				return qq.ErrPermissionDenied
+			}
+			return nil
+		},
+		AdmitMock: func(ctx context.Context, operation string) error {
+			if operation == "remove" {
+				return &qq.RateLimitError{}
+			}
+			return nil
+		},
+		CheckQuotaMock: func(ctx context.Context, entity models.Entity) error {
+			return qq.ErrQuotaExceeded
+		},
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			panic("get")
+		},
+	}
+
+	ctx := context.Background()
+	client := newClient(t, binaryClient.Options{ServerURL: listenTCP(t, &service, Options{})})
+
+	_, err := client.Get(ctx, "denied")
+	assert.ErrorIs(t, err, binaryClient.ErrPermissionDenied)
+
+	_, err = client.Remove(ctx, "a")
+	assert.ErrorIs(t, err, binaryClient.ErrRateLimited)
+
+	_, err = client.Add(ctx, qqclient.Entity{Key: "a", Value: "1"})
+	assert.ErrorIs(t, err, binaryClient.ErrQuotaExceeded)
+
+	_, err = client.Get(ctx, "")
+	assert.ErrorIs(t, err, binaryClient.ErrBadRequest)
+
+	_, err = client.Get(ctx, "a")
+	assert.ErrorIs(t, err, binaryClient.ErrInternalError)
+
+	// the connection survives the errors
+	_, err = client.Add(ctx, qqclient.Entity{Key: "", Value: "1"})
+	assert.ErrorIs(t, err, binaryClient.ErrBadRequest)
+}
+
+// TestMalformedRequests writes frames by hand, which the client would not send
+func TestMalformedRequests(t *testing.T) {
+	conn, err := net.Dial("tcp", listenTCP(t, qqtest.NewService(t), Options{}))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	testCases := []struct {
+		name      string
+		frame     binaryClient.Frame
+		expStatus byte
+	}{
+		{
+			name:      "unknown op",
+			frame:     binaryClient.Frame{Id: 1, Code: 42},
+			expStatus: binaryClient.StatusBadRequest,
+		},
+		{
+			name:      "truncated payload",
+			frame:     binaryClient.Frame{Id: 2, Code: binaryClient.OpGet, Payload: []byte{0, 0, 5, 'a'}},
+			expStatus: binaryClient.StatusBadRequest,
+		},
+		{
+			name:      "trailing bytes",
+			frame:     binaryClient.Frame{Id: 3, Code: binaryClient.OpGetAll, Payload: []byte{0, 0, 0, 1}},
+			expStatus: binaryClient.StatusBadRequest,
+		},
+		{
+			name:      "valid",
+			frame:     binaryClient.Frame{Id: 4, Code: binaryClient.OpGet, Payload: []byte{0, 0, 1, 'a'}},
+			expStatus: binaryClient.StatusOK,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.NoError(t, binaryClient.WriteFrame(writer, testCase.frame))
+			require.NoError(t, writer.Flush())
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+			reply, err := binaryClient.ReadFrame(reader)
+			require.NoError(t, err)
+
+			assert.Equal(t, testCase.frame.Id, reply.Id)
+			assert.Equal(t, testCase.expStatus, reply.Code)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package grpc
+
+import (
+	"qq/models"
+	"qq/pkg/qqclient"
+	grpcClient "qq/pkg/qqclient/grpc"
+	"qq/services/qq"
+)
+
+func FromAddRequest(request grpcClient.AddRequest) models.Entity {
+	return models.Entity{
+		Key:   request.Entity.Key,
+		Value: request.Entity.Value,
+	}
+}
+
+func toEntity(entity *models.Entity) *qqclient.Entity {
+	if entity == nil {
+		return nil
+	}
+
+	return &qqclient.Entity{
+		Key:   entity.Key,
+		Value: entity.Value,
+	}
+}
+
+func ToGetReply(entity *models.Entity) *grpcClient.GetReply {
+	return &grpcClient.GetReply{
+		Entity: toEntity(entity),
+	}
+}
+
+func ToGetAllReply(entities []models.Entity) *grpcClient.GetAllReply {
+	replyEntities := make([]qqclient.Entity, 0, len(entities))
+
+	for i := range entities {
+		replyEntities = append(replyEntities, *toEntity(&entities[i]))
+	}
+
+	return &grpcClient.GetAllReply{
+		Entities: replyEntities,
+	}
+}
+
+func ToChange(change qq.Change) *grpcClient.Change {
+	return &grpcClient.Change{
+		Type:   string(change.Type),
+		Key:    change.Key,
+		Entity: toEntity(change.Entity),
+	}
+}
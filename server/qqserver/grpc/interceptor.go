@@ -0,0 +1,181 @@
+package grpc
+
+import (
+	"context"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	grpcClient "qq/pkg/qqclient/grpc"
+	"qq/pkg/qqcontext"
+	"qq/pkg/qqtls"
+	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// operations name the methods for metrics and rate limits after the
+// operations of the other transports
+var operations = map[string]string{
+	grpcClient.FullMethod(grpcClient.AddMethodName):          "add",
+	grpcClient.FullMethod(grpcClient.RemoveMethodName):       "remove",
+	grpcClient.FullMethod(grpcClient.GetMethodName):          "get",
+	grpcClient.FullMethod(grpcClient.GetAllMethodName):       "get_all",
+	grpcClient.FullMethod(grpcClient.GetAllStreamMethodName): "get_all",
+	grpcClient.FullMethod(grpcClient.WatchMethodName):        "watch",
+}
+
+func operation(fullMethod string) string {
+	operation, ok := operations[fullMethod]
+	if !ok {
+		return "unknown"
+	}
+
+	return operation
+}
+
+func (s *server) unaryInterceptor(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var reply any
+
+	err := s.call(ctx, info.FullMethod, func(ctx context.Context) error {
+		var err error
+		reply, err = handler(ctx, request)
+		return err
+	})
+
+	return reply, err
+}
+
+func (s *server) streamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return s.call(stream.Context(), info.FullMethod, func(ctx context.Context) error {
+		return handler(srv, &serverStream{ServerStream: stream, ctx: ctx})
+	})
+}
+
+// serverStream passes the context of the call to the stream handlers
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// call runs handle with the authenticated and admitted context
+func (s *server) call(ctx context.Context, fullMethod string, handle func(ctx context.Context) error) error {
+	ctx = s.requestContext(ctx)
+
+	request := qqserver.Request{
+		Transport: metrics.TransportGRPC,
+		Operation: operation(fullMethod),
+		Name:      fullMethod,
+		Metrics:   s.metrics,
+		Status: func(err error) string {
+			return status.Code(err).String()
+		},
+		Internal: status.Error(codes.Internal, "internal server error"),
+	}
+
+	return qqserver.Handle(ctx, request, func(ctx context.Context) error {
+		ctx, err := s.authenticate(ctx)
+		if err != nil {
+			log.Warning(ctx, "failed to authenticate", log.Args{"error": err, "method": fullMethod})
+			return status.Error(codes.Unauthenticated, "unauthorized")
+		}
+
+		err = qqserver.Admit(ctx, s.service, request.Operation)
+		if err != nil {
+			return toStatus(err)
+		}
+
+		return handle(ctx)
+	})
+}
+
+func metadataValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// requestContext keeps the request id sent by the client or generates a new
+// one, and sends it back in the header
+func (s *server) requestContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	requestId := metadataValue(md, grpcClient.RequestIdMetadataKey)
+	if !qqcontext.ValidRequestId(requestId) {
+		requestId = qqcontext.NewRequestId()
+	}
+
+	_ = grpc.SetHeader(ctx, metadata.Pairs(grpcClient.RequestIdMetadataKey, requestId))
+
+	ctx = qqcontext.WithTransportValue(ctx, metrics.TransportGRPC)
+	ctx = qqcontext.WithRequestIdValue(ctx, requestId)
+
+	return ctx
+}
+
+// authenticate takes the identity from a verified client certificate or
+// from the credentials in the metadata, or the claimed user id when there is
+// no authenticator
+func (s *server) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	identity, verified := peerIdentity(ctx)
+	if verified {
+		ctx = qqcontext.WithIdentityValue(ctx, identity)
+		ctx = qqcontext.WithUserIdValue(ctx, identity.UserId)
+	}
+
+	authorization := metadataValue(md, grpcClient.AuthorizationMetadataKey)
+
+	if s.authenticator == nil {
+		if !verified {
+			ctx = qqcontext.WithUserIdValue(ctx, metadataValue(md, grpcClient.UserIdMetadataKey))
+		}
+
+		return ctx, nil
+	}
+
+	if verified && authorization == "" {
+		return ctx, nil
+	}
+
+	clientCredentials, err := auth.ParseCredentials(authorization)
+	if err != nil {
+		return ctx, err
+	}
+
+	identity, err = s.authenticator.Authenticate(ctx, clientCredentials)
+	if err != nil {
+		return ctx, err
+	}
+
+	ctx = qqcontext.WithIdentityValue(ctx, identity)
+	ctx = qqcontext.WithUserIdValue(ctx, identity.UserId)
+
+	return ctx, nil
+}
+
+func peerIdentity(ctx context.Context) (qqcontext.Identity, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return qqcontext.Identity{}, false
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return qqcontext.Identity{}, false
+	}
+
+	return qqtls.Identity(&tlsInfo.State)
+}
@@ -0,0 +1,291 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	"qq/pkg/qqclient"
+	grpcClient "qq/pkg/qqclient/grpc"
+	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type Options struct {
+	// Metrics are recorded when set; they are served by the metrics server
+	Metrics metrics.Metrics
+	// Authenticator verifies the credentials in the authorization metadata
+	// of every call; calls are not authenticated when it is nil
+	Authenticator auth.Authenticator
+	// TLS serves over TLS when set; a verified client certificate
+	// authenticates the call as the subject common name
+	TLS *tls.Config
+}
+
+type server struct {
+	address       string
+	server        *grpc.Server
+	service       qq.Service
+	metrics       metrics.Metrics
+	authenticator auth.Authenticator
+}
+
+var _ qqserver.Server = &server{}
+
+func NewServer(ctx context.Context, address string, service qq.Service, options Options) (qqserver.Server, error) {
+	log.Debug(ctx, "create new grpc server", log.Args{"address": address})
+
+	return newServer(address, service, options), nil
+}
+
+func newServer(address string, service qq.Service, options Options) *server {
+	s := &server{
+		address:       address,
+		service:       service,
+		metrics:       options.Metrics,
+		authenticator: options.Authenticator,
+	}
+
+	serverOptions := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcClient.Codec{}),
+		grpc.ChainUnaryInterceptor(s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.streamInterceptor),
+	}
+	if options.TLS != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(options.TLS)))
+	}
+
+	s.server = grpc.NewServer(serverOptions...)
+	s.server.RegisterService(&serviceDesc, s)
+
+	return s
+}
+
+func (s *server) Serve() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	return s.serve(listener)
+}
+
+func (s *server) serve(listener net.Listener) error {
+	err := s.server.Serve(listener)
+	if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return fmt.Errorf("failed to run grpc server: %w", err)
+	}
+
+	return nil
+}
+
+// qqServer is the handler type of serviceDesc, written by hand in place of
+// generated code
+type qqServer interface {
+	add(ctx context.Context, request *grpcClient.AddRequest) (*grpcClient.AddReply, error)
+	remove(ctx context.Context, request *grpcClient.RemoveRequest) (*grpcClient.RemoveReply, error)
+	get(ctx context.Context, request *grpcClient.GetRequest) (*grpcClient.GetReply, error)
+	getAll(ctx context.Context, request *grpcClient.GetAllRequest) (*grpcClient.GetAllReply, error)
+	getAllStream(request *grpcClient.GetAllRequest, stream grpc.ServerStream) error
+	watch(request *grpcClient.WatchRequest, stream grpc.ServerStream) error
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: grpcClient.ServiceName,
+	HandlerType: (*qqServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod(grpcClient.AddMethodName, qqServer.add),
+		unaryMethod(grpcClient.RemoveMethodName, qqServer.remove),
+		unaryMethod(grpcClient.GetMethodName, qqServer.get),
+		unaryMethod(grpcClient.GetAllMethodName, qqServer.getAll),
+	},
+	Streams: []grpc.StreamDesc{
+		streamMethod(grpcClient.GetAllStreamMethodName, qqServer.getAllStream),
+		streamMethod(grpcClient.WatchMethodName, qqServer.watch),
+	},
+}
+
+func unaryMethod[Request any, Reply any](name string, handle func(qqServer, context.Context, *Request) (*Reply, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			var request Request
+
+			err := dec(&request)
+			if err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, request any) (any, error) {
+				return handle(srv.(qqServer), ctx, request.(*Request))
+			}
+
+			if interceptor == nil {
+				return handler(ctx, &request)
+			}
+
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: grpcClient.FullMethod(name)}
+
+			return interceptor(ctx, &request, info, handler)
+		},
+	}
+}
+
+func streamMethod[Request any](name string, handle func(qqServer, *Request, grpc.ServerStream) error) grpc.StreamDesc {
+	return grpc.StreamDesc{
+		StreamName:    name,
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			var request Request
+
+			err := stream.RecvMsg(&request)
+			if err != nil {
+				return err
+			}
+
+			return handle(srv.(qqServer), &request, stream)
+		},
+	}
+}
+
+func (s *server) add(ctx context.Context, request *grpcClient.AddRequest) (*grpcClient.AddReply, error) {
+	entity := FromAddRequest(*request)
+
+	err := validKey(entity.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.service.Authorize(ctx, qq.ActionWrite, entity.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	err = s.service.CheckQuota(ctx, entity)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &grpcClient.AddReply{Added: s.service.Add(ctx, entity)}, nil
+}
+
+func (s *server) remove(ctx context.Context, request *grpcClient.RemoveRequest) (*grpcClient.RemoveReply, error) {
+	err := validKey(request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.service.Authorize(ctx, qq.ActionWrite, request.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &grpcClient.RemoveReply{Removed: s.service.Remove(ctx, request.Key)}, nil
+}
+
+func (s *server) get(ctx context.Context, request *grpcClient.GetRequest) (*grpcClient.GetReply, error) {
+	err := validKey(request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.service.Authorize(ctx, qq.ActionRead, request.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return ToGetReply(s.service.Get(ctx, request.Key)), nil
+}
+
+func (s *server) getAll(ctx context.Context, request *grpcClient.GetAllRequest) (*grpcClient.GetAllReply, error) {
+	return ToGetAllReply(s.service.GetAll(ctx)), nil
+}
+
+// streamPageEntities is how many entities getAllStream reads at a time
+const streamPageEntities = 100
+
+// getAllStream sends one qqclient.Entity per message, reading them a page at
+// a time instead of holding them all in memory
+func (s *server) getAllStream(request *grpcClient.GetAllRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	after := ""
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+
+		entities, next := s.service.Scan(ctx, after, streamPageEntities)
+
+		for _, entity := range entities {
+			err = stream.SendMsg(&qqclient.Entity{Key: entity.Key, Value: entity.Value})
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		after = next
+	}
+}
+
+// watch ends with ResourceExhausted when the client reads the changes too
+// slowly for the service to keep them
+func (s *server) watch(request *grpcClient.WatchRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+
+	changes := s.service.Watch(ctx, request.Prefix)
+
+	// the header tells the client that the changes from now on are watched
+	err := stream.SendHeader(metadata.MD{})
+	if err != nil {
+		return err
+	}
+
+	for change := range changes {
+		err := stream.SendMsg(ToChange(change))
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+
+	return status.Error(codes.ResourceExhausted, "watcher fell behind")
+}
+
+func validKey(key string) error {
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "key is empty")
+	}
+
+	return nil
+}
+
+// toStatus maps the errors of the service to gRPC codes; both limits are
+// ResourceExhausted, told apart by the message
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, qq.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, qq.ErrRateLimited), errors.Is(err, qq.ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.Internal, "internal server error")
+	}
+}
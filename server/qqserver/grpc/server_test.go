@@ -0,0 +1,205 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/qqclient"
+	grpcClient "qq/pkg/qqclient/grpc"
+	"qq/pkg/qqcontext"
+	"qq/services/qq"
+	"qq/services/qq/qqtest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves service over an in-process listener
+func newTestClient(t *testing.T, service qq.Service, serverOptions Options, clientOptions grpcClient.Options) grpcClient.Client {
+	listener := bufconn.Listen(1 << 20)
+
+	s := newServer("bufconn", service, serverOptions)
+	go func() {
+		_ = s.serve(listener)
+	}()
+	t.Cleanup(s.server.Stop)
+
+	clientOptions.ServerURL = "bufconn"
+	clientOptions.DialOptions = append(clientOptions.DialOptions, grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}))
+
+	client, err := grpcClient.NewClientWithOptions(context.Background(), clientOptions)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t, qqtest.NewService(t), Options{}, grpcClient.Options{})
+
+	// the codec is passed to the client and the server, not registered
+	assert.Nil(t, encoding.GetCodec(grpcClient.CodecName))
+
+	added, err := client.Add(ctx, qqclient.Entity{Key: "a", Value: "1"})
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = client.Add(ctx, qqclient.Entity{Key: "b", Value: "2"})
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	entity, err := client.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, &qqclient.Entity{Key: "a", Value: "1"}, entity)
+
+	asyncReplyCh, err := client.GetAsync(ctx, "missing")
+	require.NoError(t, err)
+	asyncReply := <-asyncReplyCh
+	require.NoError(t, asyncReply.Err)
+	assert.Nil(t, asyncReply.Result)
+
+	entities, err := client.GetAll(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []qqclient.Entity{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, entities)
+
+	iterator, err := client.Scan(ctx)
+	require.NoError(t, err)
+
+	scanned := []qqclient.Entity{}
+	for iterator.Next() {
+		scanned = append(scanned, iterator.Entity())
+	}
+	require.NoError(t, iterator.Err())
+	assert.ElementsMatch(t, entities, scanned)
+
+	removed, err := client.Remove(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, removed)
+
+	entity, err = client.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Nil(t, entity)
+
+	_, err = client.Get(ctx, "")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestScanPages(t *testing.T) {
+	ctx := context.Background()
+
+	service := qqtest.NewService(t)
+	for i := 0; i < 2*streamPageEntities+1; i++ {
+		service.Add(ctx, models.Entity{Key: fmt.Sprintf("key-%03d", i), Value: "1"})
+	}
+
+	client := newTestClient(t, service, Options{}, grpcClient.Options{})
+
+	iterator, err := client.Scan(ctx)
+	require.NoError(t, err)
+
+	count := 0
+	for iterator.Next() {
+		assert.Equal(t, fmt.Sprintf("key-%03d", count), iterator.Entity().Key)
+		count++
+	}
+	require.NoError(t, iterator.Err())
+	assert.Equal(t, 2*streamPageEntities+1, count)
+}
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t, qqtest.NewService(t), Options{}, grpcClient.Options{})
+
+	iterator, err := client.Watch(ctx, "team-a/")
+	require.NoError(t, err)
+	defer iterator.Close()
+
+	_, err = client.Add(ctx, qqclient.Entity{Key: "team-b/x", Value: "1"})
+	require.NoError(t, err)
+	_, err = client.Add(ctx, qqclient.Entity{Key: "team-a/x", Value: "2"})
+	require.NoError(t, err)
+	_, err = client.Remove(ctx, "team-a/x")
+	require.NoError(t, err)
+
+	require.True(t, iterator.Next())
+	assert.Equal(t, grpcClient.Change{Type: grpcClient.ChangePut, Key: "team-a/x", Entity: &qqclient.Entity{Key: "team-a/x", Value: "2"}}, iterator.Change())
+
+	require.True(t, iterator.Next())
+	assert.Equal(t, grpcClient.Change{Type: grpcClient.ChangeRemove, Key: "team-a/x"}, iterator.Change())
+
+	require.NoError(t, iterator.Close())
+	assert.False(t, iterator.Next())
+	assert.NoError(t, iterator.Err())
+}
+
+func TestAuthentication(t *testing.T) {
+	ctx := qqcontext.WithUserIdValue(context.Background(), "mallory")
+
+	var userId string
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			userId = qqcontext.GetUserIdValue(ctx)
+			return nil
+		},
+	}
+
+	options := Options{Authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"})}
+
+	client := newTestClient(t, &service, options, grpcClient.Options{})
+
+	_, err := client.Get(ctx, "a")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	client = newTestClient(t, &service, options, grpcClient.Options{
+		Credentials: &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: "key"},
+	})
+
+	_, err = client.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", userId)
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+
+	service := qq.ServiceMock{
+		AuthorizeMock: func(ctx context.Context, action qq.Action, key string) error {
+			if action == qq.ActionWrite {
+				return qq.ErrPermissionDenied
+			}
+			return nil
+		},
+		AdmitMock: func(ctx context.Context, operation string) error {
+			if operation == "get_all" {
+				return &qq.RateLimitError{}
+			}
+			return nil
+		},
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			panic("get")
+		},
+	}
+
+	client := newTestClient(t, &service, Options{}, grpcClient.Options{})
+
+	_, err := client.Add(ctx, qqclient.Entity{Key: "a", Value: "1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.GetAll(ctx)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = client.Get(ctx, "a")
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
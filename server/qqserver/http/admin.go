@@ -0,0 +1,121 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"qq/pkg/log"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/repos/auditqq"
+	"qq/services/qq"
+	"strconv"
+	"time"
+)
+
+const (
+	QuotasPath      = "/admin/quotas"
+	AuditPath       = "/admin/audit"
+	AuditVerifyPath = "/admin/audit/verify"
+)
+
+var adminMethods = []string{http.MethodGet}
+
+// admin serves handle to the users with the admin permission, which the
+// policy grants on the empty key
+func (s server) admin(name string, handle func(w http.ResponseWriter, req *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		if req.Method != http.MethodGet {
+			err := handleMethodNotAllowed(w, adminMethods)
+			if err != nil {
+				log.Error(ctx, "failed to handle not allowed method", log.Args{"error": err, "method": req.Method})
+			}
+			return
+		}
+
+		err := s.service.Authorize(ctx, qq.ActionAdmin, "")
+		if err != nil {
+			err = writePermissionDeniedResponce(w, "")
+			if err != nil {
+				log.Error(ctx, "failed to handle permission denied", log.Args{"error": err})
+			}
+			return
+		}
+
+		err = handle(w, req)
+		if err != nil {
+			log.Error(ctx, fmt.Sprintf("failed to handle %s request", name), log.Args{"error": err})
+		}
+	}
+}
+
+func (s server) quotas(w http.ResponseWriter, req *http.Request) error {
+	return writeJsonResponce(w, ToQuotaUsageResponce(s.service.QuotaUsage(req.Context())), http.StatusOK)
+}
+
+func (s server) audit(w http.ResponseWriter, req *http.Request) error {
+	query, err := parseAuditQuery(req.URL.Query())
+	if err != nil {
+		return writeErrorResponce(w, http.StatusBadRequest, httpClient.ErrorCodeBadRequest, "invalid audit query", map[string]string{"error": err.Error()})
+	}
+
+	records, err := s.service.Audit(req.Context(), query)
+	if errors.Is(err, qq.ErrAuditDisabled) {
+		return writeAuditDisabledResponce(w)
+	}
+	if err != nil {
+		return writeInternalErrorResponce(w, err)
+	}
+
+	return writeJsonResponce(w, ToAuditResponce(records), http.StatusOK)
+}
+
+func (s server) auditVerify(w http.ResponseWriter, req *http.Request) error {
+	verification, err := s.service.VerifyAudit(req.Context())
+	if errors.Is(err, qq.ErrAuditDisabled) {
+		return writeAuditDisabledResponce(w)
+	}
+	if err != nil {
+		return writeInternalErrorResponce(w, err)
+	}
+
+	return writeJsonResponce(w, ToAuditVerifyResponce(verification), http.StatusOK)
+}
+
+func parseAuditQuery(values url.Values) (auditqq.Query, error) {
+	query := auditqq.Query{
+		Key:    values.Get("key"),
+		UserId: values.Get("user_id"),
+	}
+
+	var err error
+
+	if since := values.Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return auditqq.Query{}, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+
+	if until := values.Get("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339Nano, until)
+		if err != nil {
+			return auditqq.Query{}, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 0 {
+			return auditqq.Query{}, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+
+	return query, nil
+}
+
+func writeAuditDisabledResponce(w http.ResponseWriter) error {
+	return writeErrorResponce(w, http.StatusNotFound, httpClient.ErrorCodeNotFound, "audit log is disabled", nil)
+}
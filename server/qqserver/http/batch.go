@@ -0,0 +1,139 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"qq/pkg/log"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/services/qq"
+	"strconv"
+)
+
+const (
+	batchGetPath    = "/entities:batchGet"
+	batchPutPath    = "/entities:batchPut"
+	batchDeletePath = "/entities:batchDelete"
+)
+
+var batchMethods = []string{http.MethodPost}
+
+type batchHandler func(ctx context.Context, w http.ResponseWriter, req *http.Request, service qq.Service) error
+
+func (s server) batch(name string, handle batchHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		if req.Method != http.MethodPost {
+			err := handleMethodNotAllowed(w, batchMethods)
+			if err != nil {
+				log.Error(ctx, "failed to handle not allowed method", log.Args{"error": err, "method": req.Method})
+			}
+			return
+		}
+
+		err := handle(ctx, w, req, s.service)
+		if err != nil {
+			log.Error(ctx, "failed to handle "+name+" request", log.Args{"error": err})
+		}
+	}
+}
+
+func handleBatchGetRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, service qq.Service) error {
+	var request httpClient.BatchGetRequest
+
+	err := readJsonRequest(req, &request)
+	if err != nil {
+		return writeBadJsonResponce(w, err)
+	}
+
+	if len(request.Keys) > httpClient.MaxBatchSize {
+		return writeBatchTooLargeResponce(w, len(request.Keys))
+	}
+
+	entities := service.GetBatch(ctx, request.Keys)
+	responce := ToBatchGetResponce(request.Keys, entities)
+
+	for i := range responce.Results {
+		result := &responce.Results[i]
+
+		permissionErr := permissionError(ctx, service, qq.ActionRead, result.Key)
+		if permissionErr != nil {
+			result.Entity = nil
+			result.Error = permissionErr
+		}
+	}
+
+	return writeJsonResponce(w, responce, http.StatusOK)
+}
+
+func handleBatchPutRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, service qq.Service) error {
+	var request httpClient.BatchPutRequest
+
+	err := readJsonRequest(req, &request)
+	if err != nil {
+		return writeBadJsonResponce(w, err)
+	}
+
+	if len(request.Entities) > httpClient.MaxBatchSize {
+		return writeBatchTooLargeResponce(w, len(request.Entities))
+	}
+
+	entities := FromBatchPutRequest(request)
+	added := service.AddBatch(ctx, entities)
+	responce := ToBatchPutResponce(request.Entities, added)
+
+	for i := range responce.Results {
+		result := &responce.Results[i]
+		result.Error = permissionError(ctx, service, qq.ActionWrite, result.Key)
+
+		// the batch only adds, so an entity refused for its quota is still
+		// over it after the batch
+		if result.Error == nil && !result.Added && service.CheckQuota(ctx, entities[i]) != nil {
+			result.Error = &httpClient.Error{Code: httpClient.ErrorCodeQuotaExceeded, Message: "quota exceeded"}
+		}
+	}
+
+	return writeJsonResponce(w, responce, http.StatusOK)
+}
+
+func handleBatchDeleteRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, service qq.Service) error {
+	var request httpClient.BatchDeleteRequest
+
+	err := readJsonRequest(req, &request)
+	if err != nil {
+		return writeBadJsonResponce(w, err)
+	}
+
+	if len(request.Keys) > httpClient.MaxBatchSize {
+		return writeBatchTooLargeResponce(w, len(request.Keys))
+	}
+
+	removed := service.RemoveBatch(ctx, request.Keys)
+	responce := ToBatchDeleteResponce(request.Keys, removed)
+
+	for i := range responce.Results {
+		result := &responce.Results[i]
+		result.Error = permissionError(ctx, service, qq.ActionWrite, result.Key)
+	}
+
+	return writeJsonResponce(w, responce, http.StatusOK)
+}
+
+// permissionError reports the batch items the service has skipped because
+// the identity may not access them
+func permissionError(ctx context.Context, service qq.Service, action qq.Action, key string) *httpClient.Error {
+	if service.Authorize(ctx, action, key) == nil {
+		return nil
+	}
+
+	return &httpClient.Error{Code: httpClient.ErrorCodePermissionDenied, Message: "permission denied"}
+}
+
+func writeBatchTooLargeResponce(w http.ResponseWriter, size int) error {
+	details := map[string]string{
+		"size":           strconv.Itoa(size),
+		"max_batch_size": strconv.Itoa(httpClient.MaxBatchSize),
+	}
+
+	return writeErrorResponce(w, http.StatusBadRequest, httpClient.ErrorCodeBadRequest, "batch is too large", details)
+}
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"qq/pkg/qqclient"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/repos/cacheqq"
+	qqRepo "qq/repos/qq"
+	"qq/services/qq"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	database, err := qqRepo.NewDatabase()
+	require.NoError(t, err)
+
+	service, err := qq.NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), qq.Options{})
+	require.NoError(t, err)
+
+	var requests int
+
+	mux := newMux(&server{service: service})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		mux.ServeHTTP(w, req)
+	}))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	entities := make([]qqclient.Entity, 0, httpClient.MaxBatchSize+1)
+	keys := make([]string, 0, httpClient.MaxBatchSize+2)
+
+	for i := 0; i <= httpClient.MaxBatchSize; i++ {
+		entity := qqclient.Entity{Key: fmt.Sprintf("a/%d", i), Value: fmt.Sprintf("b%d", i)}
+		entities = append(entities, entity)
+		keys = append(keys, entity.Key)
+	}
+	keys = append(keys, "missing")
+
+	putResults, err := client.AddBatch(ctx, entities)
+	require.NoError(t, err)
+	require.Len(t, putResults, len(entities))
+	assert.Equal(t, httpClient.BatchPutResult{Key: "a/0", Added: true}, putResults[0])
+	assert.Equal(t, 2, requests)
+
+	getResults, err := client.GetBatch(ctx, keys)
+	require.NoError(t, err)
+	require.Len(t, getResults, len(keys))
+
+	for i, entity := range entities {
+		assert.Equal(t, httpClient.BatchGetResult{Key: entity.Key, Entity: &entities[i]}, getResults[i])
+	}
+
+	missing := getResults[len(keys)-1]
+	assert.Equal(t, "missing", missing.Key)
+	assert.Nil(t, missing.Entity)
+	assert.True(t, errors.Is(missing.Error, httpClient.ErrNotFound))
+
+	deleteResults, err := client.RemoveBatch(ctx, keys[:2])
+	require.NoError(t, err)
+	assert.Equal(t, []httpClient.BatchDeleteResult{{Key: "a/0", Removed: true}, {Key: "a/1", Removed: true}}, deleteResults)
+
+	entity, err := client.Get(ctx, "a/0")
+	require.NoError(t, err)
+	assert.Nil(t, entity)
+}
+
+func TestBatchErrors(t *testing.T) {
+	tooLarge := fmt.Sprintf(`{"keys":[%s""]}`, strings.Repeat(`"a",`, httpClient.MaxBatchSize))
+
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		expErr        *httpClient.Error
+		expAllow      string
+		expStatusCode int
+	}{
+		{
+			name: "TooLarge",
+			req:  httptest.NewRequest(http.MethodPost, "http://localhost:8080/entities:batchGet", strings.NewReader(tooLarge)),
+			expErr: &httpClient.Error{
+				Code:    httpClient.ErrorCodeBadRequest,
+				Message: "batch is too large",
+				Details: map[string]string{"size": "1001", "max_batch_size": "1000"},
+			},
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "BadJson",
+			req:  httptest.NewRequest(http.MethodPost, "http://localhost:8080/entities:batchDelete", strings.NewReader(`{"keys":"a"}`)),
+			expErr: &httpClient.Error{
+				Code:    httpClient.ErrorCodeBadRequest,
+				Message: "invalid JSON",
+				Details: map[string]string{"error": "failed to parse JSON: json: cannot unmarshal string into Go struct field BatchDeleteRequest.keys of type []string"},
+			},
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "MethodNotAllowed",
+			req:  httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities:batchPut", nil),
+			expErr: &httpClient.Error{
+				Code:    httpClient.ErrorCodeMethodNotAllowed,
+				Message: "method not allowed",
+				Details: map[string]string{"allow": "POST"},
+			},
+			expAllow:      "POST",
+			expStatusCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			server := server{
+				service: &qq.ServiceMock{},
+			}
+
+			w := httptest.NewRecorder()
+
+			mux := newMux(&server)
+			mux.ServeHTTP(w, testCase.req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+
+			var responce httpClient.ErrorResponce
+
+			err = json.Unmarshal(body, &responce)
+			assert.NoError(t, err)
+
+			assert.Equal(t, testCase.expErr, responce.Error)
+			assert.Equal(t, testCase.expAllow, resp.Header.Get("Allow"))
+			assert.Equal(t, testCase.expStatusCode, resp.StatusCode)
+		})
+	}
+}
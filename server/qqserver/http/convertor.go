@@ -4,6 +4,8 @@ import (
 	"qq/models"
 	"qq/pkg/qqclient"
 	"qq/pkg/qqclient/http"
+	"qq/repos/auditqq"
+	"qq/services/qq"
 )
 
 func FromPostRequest(request http.PostRequest) models.Entity {
@@ -19,6 +21,25 @@ func ToPostResponce(added bool) http.PostResponce {
 	}
 }
 
+func FromPutRequest(key string, request http.PutRequest) models.Entity {
+	return models.Entity{
+		Key:   key,
+		Value: request.Value,
+	}
+}
+
+func ToPutResponce(added bool) http.PutResponce {
+	return http.PutResponce{
+		Added: added,
+	}
+}
+
+func ToPatchResponce(entity *models.Entity) http.PatchResponce {
+	return http.PatchResponce{
+		Entity: &qqclient.Entity{Key: entity.Key, Value: entity.Value},
+	}
+}
+
 func ToDeleteResponce(removed bool) http.DeleteResponce {
 	return http.DeleteResponce{
 		Removed: removed,
@@ -48,3 +69,123 @@ func ToGetAllResponce(entities []models.Entity) http.GetAllResponce {
 		Entities: data,
 	}
 }
+
+func ToBatchGetResponce(keys []string, entities []*models.Entity) http.BatchGetResponce {
+	results := make([]http.BatchGetResult, 0, len(keys))
+
+	for i, key := range keys {
+		result := http.BatchGetResult{
+			Key: key,
+		}
+
+		entity := entities[i]
+		if entity != nil {
+			result.Entity = &qqclient.Entity{Key: entity.Key, Value: entity.Value}
+		} else {
+			result.Error = &http.Error{Code: http.ErrorCodeNotFound, Message: "entity not found"}
+		}
+
+		results = append(results, result)
+	}
+
+	return http.BatchGetResponce{
+		Results: results,
+	}
+}
+
+func FromBatchPutRequest(request http.BatchPutRequest) []models.Entity {
+	entities := make([]models.Entity, 0, len(request.Entities))
+
+	for _, entity := range request.Entities {
+		entities = append(entities, models.Entity{
+			Key:   entity.Key,
+			Value: entity.Value,
+		})
+	}
+
+	return entities
+}
+
+func ToBatchPutResponce(entities []qqclient.Entity, added []bool) http.BatchPutResponce {
+	results := make([]http.BatchPutResult, 0, len(entities))
+
+	for i, entity := range entities {
+		results = append(results, http.BatchPutResult{
+			Key:   entity.Key,
+			Added: added[i],
+		})
+	}
+
+	return http.BatchPutResponce{
+		Results: results,
+	}
+}
+
+func ToBatchDeleteResponce(keys []string, removed []bool) http.BatchDeleteResponce {
+	results := make([]http.BatchDeleteResult, 0, len(keys))
+
+	for i, key := range keys {
+		results = append(results, http.BatchDeleteResult{
+			Key:     key,
+			Removed: removed[i],
+		})
+	}
+
+	return http.BatchDeleteResponce{
+		Results: results,
+	}
+}
+
+func ToQuotaUsageResponce(usages []qq.QuotaUsage) http.QuotaUsageResponce {
+	quotas := make([]http.QuotaUsage, 0, len(usages))
+
+	for _, usage := range usages {
+		quotas = append(quotas, http.QuotaUsage{
+			Namespace: usage.Namespace,
+			User:      usage.User,
+			Keys:      usage.Keys,
+			Bytes:     usage.Bytes,
+			MaxKeys:   usage.MaxKeys,
+			MaxBytes:  usage.MaxBytes,
+		})
+	}
+
+	return http.QuotaUsageResponce{
+		Quotas: quotas,
+	}
+}
+
+func ToAuditResponce(records []auditqq.Record) http.AuditResponce {
+	auditRecords := make([]http.AuditRecord, 0, len(records))
+
+	for _, record := range records {
+		auditRecords = append(auditRecords, http.AuditRecord{
+			Sequence:  record.Sequence,
+			Time:      record.Time,
+			UserId:    record.UserId,
+			Transport: record.Transport,
+			RequestId: record.RequestId,
+			Operation: string(record.Operation),
+			Key:       record.Key,
+			OldHash:   record.OldHash,
+			NewHash:   record.NewHash,
+			PrevHash:  record.PrevHash,
+			Hash:      record.Hash,
+		})
+	}
+
+	return http.AuditResponce{
+		Records: auditRecords,
+	}
+}
+
+func ToAuditVerifyResponce(verification auditqq.Verification) http.AuditVerifyResponce {
+	return http.AuditVerifyResponce{
+		Verification: http.AuditVerification{
+			Records:  verification.Records,
+			Valid:    verification.Valid,
+			BrokenAt: verification.BrokenAt,
+			Reason:   verification.Reason,
+		},
+	}
+}
@@ -0,0 +1,71 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"qq/models"
+	"strings"
+)
+
+var (
+	errPreconditionFailed = errors.New("precondition failed")
+	errNotFound           = errors.New("not found")
+)
+
+// ETag is derived from the entity version, falling back to a content hash for
+// entities stored without one
+func ETag(entity *models.Entity) string {
+	if entity.Version != 0 {
+		return fmt.Sprintf(`"%x"`, entity.Version)
+	}
+
+	hash := sha256.Sum256([]byte(entity.Key + "\x00" + entity.Value))
+	return fmt.Sprintf(`"h%s"`, hex.EncodeToString(hash[:8]))
+}
+
+// matchETag reports whether the If-Match or If-None-Match header value lists
+// etag; weak comparison ignores the W/ prefix
+func matchETag(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkWritePreconditions evaluates If-Match and If-None-Match of a write
+// request against the current entity, which is nil when it does not exist
+func checkWritePreconditions(req *http.Request, current *models.Entity) error {
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch != "" {
+		if current == nil || !matchETag(ifMatch, ETag(current), false) {
+			return errPreconditionFailed
+		}
+	}
+
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && current != nil && matchETag(ifNoneMatch, ETag(current), true) {
+		return errPreconditionFailed
+	}
+
+	return nil
+}
+
+func hasPreconditions(req *http.Request) bool {
+	return req.Header.Get("If-Match") != "" || req.Header.Get("If-None-Match") != ""
+}
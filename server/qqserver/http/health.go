@@ -0,0 +1,68 @@
+package http
+
+import (
+	"net/http"
+	"qq/pkg/health"
+	"qq/pkg/log"
+	"qq/pkg/version"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	VersionPath = "/version"
+)
+
+var probeMethods = []string{http.MethodGet, http.MethodHead}
+
+// healthz only tells that the process serves requests, dependencies are
+// checked by readyz
+func (s server) healthz(w http.ResponseWriter, req *http.Request) {
+	s.probe(w, req, func() (any, int) {
+		return health.Report{Status: health.StatusUp, Dependencies: []health.DependencyReport{}}, http.StatusOK
+	})
+}
+
+func (s server) readyz(w http.ResponseWriter, req *http.Request) {
+	s.probe(w, req, func() (any, int) {
+		report := s.health.Ready(req.Context())
+		if !report.Up() {
+			log.Warning(req.Context(), "server is not ready", log.Args{"report": report})
+			return report, http.StatusServiceUnavailable
+		}
+
+		return report, http.StatusOK
+	})
+}
+
+func (s server) version(w http.ResponseWriter, req *http.Request) {
+	s.probe(w, req, func() (any, int) {
+		return version.Get(), http.StatusOK
+	})
+}
+
+func (s server) probe(w http.ResponseWriter, req *http.Request, handle func() (any, int)) {
+	ctx := req.Context()
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		err := handleMethodNotAllowed(w, probeMethods)
+		if err != nil {
+			log.Error(ctx, "failed to handle not allowed method", log.Args{"error": err, "method": req.Method})
+		}
+		return
+	}
+
+	responce, statusCode := handle()
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if req.Method == http.MethodHead {
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	err := writeJsonResponce(w, responce, statusCode)
+	if err != nil {
+		log.Error(ctx, "failed to handle probe request", log.Args{"error": err, "path": req.URL.Path})
+	}
+}
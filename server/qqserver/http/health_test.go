@@ -0,0 +1,141 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"qq/pkg/health"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/pkg/version"
+	"qq/services/qq"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbes(t *testing.T) {
+	redisUp := true
+	dependencies := []health.Dependency{
+		{Name: "database", Check: func(ctx context.Context) error { return nil }},
+		{Name: "redis", Check: func(ctx context.Context) error {
+			if !redisUp {
+				return errors.New("connection refused")
+			}
+			return nil
+		}},
+	}
+
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		redisUp       bool
+		exp           string
+		expStatusCode int
+	}{
+		{
+			name:          "Healthz",
+			req:           httptest.NewRequest(http.MethodGet, "http://localhost:8080/healthz", nil),
+			redisUp:       false,
+			exp:           `{"status":"up","dependencies":[]}`,
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "Ready",
+			req:           httptest.NewRequest(http.MethodGet, "http://localhost:8080/readyz", nil),
+			redisUp:       true,
+			exp:           `{"status":"up","dependencies":[{"name":"database","status":"up"},{"name":"redis","status":"up"}]}`,
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "NotReady",
+			req:           httptest.NewRequest(http.MethodGet, "http://localhost:8080/readyz", nil),
+			redisUp:       false,
+			exp:           `{"status":"down","dependencies":[{"name":"database","status":"up"},{"name":"redis","status":"down","error":"connection refused"}]}`,
+			expStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:          "NotReadyHead",
+			req:           httptest.NewRequest(http.MethodHead, "http://localhost:8080/readyz", nil),
+			redisUp:       false,
+			exp:           "",
+			expStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:          "MethodNotAllowed",
+			req:           httptest.NewRequest(http.MethodPost, "http://localhost:8080/healthz", nil),
+			redisUp:       true,
+			exp:           `{"error":{"code":"method_not_allowed","message":"method not allowed","details":{"allow":"GET, HEAD"}},"status":"Method Not Allowed"}`,
+			expStatusCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			redisUp = testCase.redisUp
+
+			server := server{
+				service: &qq.ServiceMock{},
+				health:  health.NewChecker(dependencies...),
+			}
+
+			w := httptest.NewRecorder()
+
+			mux := newMux(&server)
+			mux.ServeHTTP(w, testCase.req)
+
+			assert.Equal(t, testCase.expStatusCode, w.Code)
+			assert.Equal(t, testCase.exp, w.Body.String())
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	mux := newMux(&server{service: &qq.ServiceMock{}})
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080/version", nil))
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var info version.Info
+
+	err = json.Unmarshal(body, &info)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, version.Version, info.Version)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+}
+
+func TestHealthRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	server := server{
+		service: &qq.ServiceMock{},
+		health: health.NewChecker(health.Dependency{Name: "redis", Check: func(ctx context.Context) error {
+			return errors.New("connection refused")
+		}}),
+	}
+
+	testServer := httptest.NewServer(newMux(&server))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	report, err := client.Health(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &health.Report{
+		Status:       health.StatusDown,
+		Dependencies: []health.DependencyReport{{Name: "redis", Status: health.StatusDown, Error: "connection refused"}},
+	}, report)
+}
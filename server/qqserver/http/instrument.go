@@ -0,0 +1,118 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"qq/server/qqserver/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instrument records every request without touching the handlers
+func instrument(m metrics.Metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		done := m.StartRequest(metrics.TransportHTTP)
+		defer done()
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+
+		next.ServeHTTP(recorder, req)
+
+		m.ObserveRequest(metrics.TransportHTTP, operation(req), strconv.Itoa(recorder.statusCode), time.Since(start))
+	})
+}
+
+var (
+	entityOperations = map[string]string{
+		http.MethodDelete: "remove",
+		http.MethodGet:    "get",
+		http.MethodHead:   "exists",
+		http.MethodPatch:  "patch",
+		http.MethodPut:    "put",
+	}
+	entitiesOperations = map[string]string{
+		http.MethodGet:  "get_all",
+		http.MethodPost: "add",
+	}
+	pathOperations = map[string]string{
+		batchGetPath:    "batch_get",
+		batchPutPath:    "batch_put",
+		batchDeletePath: "batch_delete",
+		HealthzPath:     "healthz",
+		ReadyzPath:      "readyz",
+		VersionPath:     "version",
+		metrics.Path:    "metrics",
+		QuotasPath:      "admin_quotas",
+		AuditPath:       "admin_audit",
+		AuditVerifyPath: "admin_audit_verify",
+		WebSocketPath:   "websocket",
+	}
+)
+
+// operation names the request after the route rather than the path, so
+// that keys do not end up in metric labels
+func operation(req *http.Request) string {
+	path := req.URL.EscapedPath()
+
+	var operation string
+	switch {
+	case strings.HasPrefix(path, entityPathPrefix):
+		operation = entityOperations[req.Method]
+	case path == "/entities":
+		operation = entitiesOperations[req.Method]
+	default:
+		operation = pathOperations[path]
+	}
+
+	if operation == "" {
+		return "unknown"
+	}
+
+	return operation
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush keeps streamed responses streaming through the recorder
+func (r *statusRecorder) Flush() {
+	flusher, ok := r.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the WebSocket endpoint take over the connection, which is
+// recorded as switching protocols
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking is not supported")
+	}
+
+	r.statusCode = http.StatusSwitchingProtocols
+	r.wroteHeader = true
+
+	return hijacker.Hijack()
+}
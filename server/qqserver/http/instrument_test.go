@@ -0,0 +1,73 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperation(t *testing.T) {
+	testCases := []struct {
+		name string
+		req  *http.Request
+		exp  string
+	}{
+		{
+			name: "Get",
+			req:  httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities/key%2F1", nil),
+			exp:  "get",
+		},
+		{
+			name: "Add",
+			req:  httptest.NewRequest(http.MethodPost, "http://localhost:8080/entities", nil),
+			exp:  "add",
+		},
+		{
+			name: "BatchGet",
+			req:  httptest.NewRequest(http.MethodPost, "http://localhost:8080/entities:batchGet", nil),
+			exp:  "batch_get",
+		},
+		{
+			name: "Unknown",
+			req:  httptest.NewRequest(http.MethodGet, "http://localhost:8080/unknown", nil),
+			exp:  "unknown",
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.exp, operation(testCase.req))
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := server{
+		service: &qq.ServiceMock{},
+		metrics: metrics.New(nil, nil),
+	}
+
+	handler := newHandler(&server)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost:8080/healthz", nil))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080/metrics", nil))
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.Contains(string(body), `qq_requests_total{operation="healthz",status="200",transport="http"} 1`))
+	assert.True(t, strings.Contains(string(body), `qq_in_flight_requests{transport="http"} 1`))
+}
@@ -0,0 +1,252 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/pkg/qqcontext"
+	"qq/pkg/qqtls"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"strconv"
+	"time"
+)
+
+type Middleware func(next http.Handler) http.Handler
+
+// chain applies the middlewares so that the first one sees the request first
+func chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// newHandler wraps the routes of newMux with the middlewares of the server
+func newHandler(s *server) http.Handler {
+	middlewares := []Middleware{withTransport(metrics.TransportHTTP), withRequestId, withAccessLog}
+
+	if s.metrics != nil {
+		middlewares = append(middlewares, func(next http.Handler) http.Handler {
+			return instrument(s.metrics, next)
+		})
+	}
+
+	middlewares = append(middlewares, withRecovery, withClientCertificate)
+
+	if s.authenticator != nil {
+		middlewares = append(middlewares, withAuthentication(s.authenticator))
+	}
+
+	middlewares = append(middlewares, withRateLimit(s.service))
+
+	return chain(newMux(s), middlewares...)
+}
+
+// withTransport tells the service which transport the request came from,
+// e.g. for the audit log
+func withTransport(transport string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := qqcontext.WithTransportValue(req.Context(), transport)
+
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// withRequestId keeps the request id sent by the client or generates a new
+// one, and passes it to the handlers in the context and to the client in the
+// response header
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(httpClient.RequestIdHeader)
+		if !qqcontext.ValidRequestId(requestId) {
+			requestId = qqcontext.NewRequestId()
+		}
+
+		w.Header().Set(httpClient.RequestIdHeader, requestId)
+
+		ctx := qqcontext.WithRequestIdValue(req.Context(), requestId)
+
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+
+		next.ServeHTTP(recorder, req)
+
+		log.Info(req.Context(), "handled request", log.Args{
+			"method":  req.Method,
+			"path":    req.URL.EscapedPath(),
+			"status":  recorder.statusCode,
+			"latency": time.Since(start),
+		})
+	})
+}
+
+// withRecovery turns a panic in a handler into a 500 instead of a dropped
+// connection; the response is left as is if the handler has already
+// started writing it
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			ctx := req.Context()
+			log.Error(ctx, "handler panicked", log.Args{"panic": recovered, "path": req.URL.EscapedPath()})
+
+			if recorder.wroteHeader {
+				return
+			}
+
+			err := writeErrorResponce(recorder, http.StatusInternalServerError, httpClient.ErrorCodeInternal, "internal server error", nil)
+			if err != nil {
+				log.Error(ctx, "failed to handle panic", log.Args{"error": err})
+			}
+		}()
+
+		next.ServeHTTP(recorder, req)
+	})
+}
+
+// publicPaths are served without authentication, so that probes and
+// scrapers do not need credentials
+var publicPaths = map[string]bool{
+	HealthzPath:  true,
+	ReadyzPath:   true,
+	VersionPath:  true,
+	metrics.Path: true,
+}
+
+// withClientCertificate takes the identity from a verified client
+// certificate, which withAuthentication accepts in place of credentials.
+// WebSocket connections need credentials: the browser presents the
+// certificate to the pages of any origin.
+func withClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := qqtls.Identity(req.TLS)
+		if !ok || req.URL.EscapedPath() == WebSocketPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := qqcontext.WithIdentityValue(req.Context(), identity)
+		ctx = qqcontext.WithUserIdValue(ctx, identity.UserId)
+
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// withAuthentication replaces the user id claimed by the client with the
+// identity verified by authenticator
+func withAuthentication(authenticator auth.Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if publicPaths[req.URL.EscapedPath()] {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			ctx := req.Context()
+
+			authorization := req.Header.Get(auth.AuthorizationHeader)
+
+			// browsers cannot set headers on WebSocket requests
+			if authorization == "" && req.URL.EscapedPath() == WebSocketPath {
+				authorization = req.URL.Query().Get(WebSocketAuthorizationParam)
+			}
+
+			_, verified := qqcontext.GetIdentityValue(ctx)
+			if verified && authorization == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			identity, err := authenticate(ctx, authenticator, authorization)
+			if err != nil {
+				log.Warning(ctx, "failed to authenticate", log.Args{"error": err, "path": req.URL.EscapedPath()})
+
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s realm="qq"`, auth.SchemeBearer))
+
+				err = writeErrorResponce(w, http.StatusUnauthorized, httpClient.ErrorCodeUnauthorized, "unauthorized", nil)
+				if err != nil {
+					log.Error(ctx, "failed to handle unauthorized request", log.Args{"error": err})
+				}
+
+				return
+			}
+
+			ctx = qqcontext.WithIdentityValue(ctx, identity)
+			ctx = qqcontext.WithUserIdValue(ctx, identity.UserId)
+
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+func authenticate(ctx context.Context, authenticator auth.Authenticator, authorization string) (qqcontext.Identity, error) {
+	credentials, err := auth.ParseCredentials(authorization)
+	if err != nil {
+		return qqcontext.Identity{}, err
+	}
+
+	return authenticator.Authenticate(ctx, credentials)
+}
+
+// withRateLimit admits requests by the user and operation after
+// authentication, so that the verified user is charged
+func withRateLimit(service qq.Service) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if publicPaths[req.URL.EscapedPath()] {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			ctx := req.Context()
+
+			err := service.Admit(ctx, operation(req))
+			if err != nil {
+				log.Warning(ctx, "rate limited", log.Args{"error": err, "path": req.URL.EscapedPath()})
+
+				details := map[string]string{}
+
+				var rateLimitErr *qq.RateLimitError
+				if errors.As(err, &rateLimitErr) {
+					retryAfter := strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds())))
+					w.Header().Set("Retry-After", retryAfter)
+					details["retry_after"] = retryAfter
+				}
+
+				err = writeErrorResponce(w, http.StatusTooManyRequests, httpClient.ErrorCodeRateLimited, "rate limited", details)
+				if err != nil {
+					log.Error(ctx, "failed to handle rate limited request", log.Args{"error": err})
+				}
+
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
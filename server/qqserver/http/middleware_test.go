@@ -0,0 +1,337 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"qq/models"
+	"qq/pkg/auth"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/pkg/qqcontext"
+	"qq/pkg/qqtls"
+	"qq/pkg/qqtls/qqtlstest"
+	"qq/services/qq"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+
+	middleware := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls = append(calls, "handler")
+	}), middleware("first"), middleware("second"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost:8080/", nil))
+
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func TestRequestId(t *testing.T) {
+	testCases := []struct {
+		name      string
+		requestId string
+		generated bool
+	}{
+		{
+			name:      "Propagated",
+			requestId: "abc-123",
+		},
+		{
+			name:      "Generated",
+			requestId: "",
+			generated: true,
+		},
+		{
+			name:      "Invalid",
+			requestId: "a b",
+			generated: true,
+		},
+		{
+			name:      "TooLong",
+			requestId: strings.Repeat("a", 129),
+			generated: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			var contextRequestId string
+
+			handler := withRequestId(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				contextRequestId = qqcontext.GetRequestIdValue(req.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities", nil)
+			req.Header.Set(httpClient.RequestIdHeader, testCase.requestId)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			requestId := w.Header().Get(httpClient.RequestIdHeader)
+			assert.Equal(t, requestId, contextRequestId)
+
+			if testCase.generated {
+				assert.Len(t, requestId, 32)
+			} else {
+				assert.Equal(t, testCase.requestId, requestId)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			panic("database is gone")
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities/a", nil)
+	req.Header.Set(httpClient.RequestIdHeader, "1")
+
+	w := httptest.NewRecorder()
+
+	handler := newHandler(&server{service: &service})
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var responce httpClient.ErrorResponce
+
+	err = json.Unmarshal(body, &responce)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, &httpClient.Error{
+		Code:      httpClient.ErrorCodeInternal,
+		Message:   "internal server error",
+		RequestId: "1",
+	}, responce.Error)
+}
+
+func TestRequestIdRoundTrip(t *testing.T) {
+	ctx := qqcontext.WithRequestIdValue(context.Background(), "round-trip")
+
+	var serverRequestId string
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			serverRequestId = qqcontext.GetRequestIdValue(ctx)
+			return &models.Entity{Key: key, Value: "b"}
+		},
+	}
+
+	testServer := httptest.NewServer(newHandler(&server{service: &service}))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	entity, err := client.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "b", entity.Value)
+	assert.Equal(t, "round-trip", serverRequestId)
+}
+
+func TestAuthentication(t *testing.T) {
+	authenticator := auth.Schemes{auth.SchemeAPIKey: auth.NewAPIKeys(map[string]string{"key": "alice"})}
+
+	testCases := []struct {
+		name          string
+		path          string
+		authorization string
+		expUserId     string
+		expStatusCode int
+	}{
+		{
+			name:          "Authenticated",
+			path:          "/entities/a",
+			authorization: "ApiKey key",
+			expUserId:     "alice",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "NoCredentials",
+			path:          "/entities/a",
+			expStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:          "InvalidKey",
+			path:          "/entities/a",
+			authorization: "ApiKey other",
+			expStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:          "PublicPath",
+			path:          "/healthz",
+			expStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			var userId string
+
+			service := qq.ServiceMock{
+				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+					userId = qqcontext.GetUserIdValue(ctx)
+					return &models.Entity{Key: key, Value: "b"}
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080"+testCase.path, nil)
+			req.Header.Set("UserId", "mallory")
+			if testCase.authorization != "" {
+				req.Header.Set(auth.AuthorizationHeader, testCase.authorization)
+			}
+
+			w := httptest.NewRecorder()
+
+			handler := newHandler(&server{service: &service, authenticator: authenticator})
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expStatusCode, w.Code)
+			assert.Equal(t, testCase.expUserId, userId)
+
+			if testCase.expStatusCode == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="qq"`, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAuthenticationRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("secret")
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			return &models.Entity{Key: key, Value: qqcontext.GetUserIdValue(ctx)}
+		},
+	}
+
+	testServer := httptest.NewServer(newHandler(&server{
+		service:       &service,
+		authenticator: auth.Schemes{auth.SchemeBearer: auth.JWT{Secret: secret}},
+	}))
+	defer testServer.Close()
+
+	token, err := auth.SignJWT(secret, auth.Claims{Subject: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{
+		ServerURL:   testServer.URL,
+		Credentials: &auth.Credentials{Scheme: auth.SchemeBearer, Token: token},
+	})
+
+	entity, err := client.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", entity.Value)
+
+	client = httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	_, err = client.Get(ctx, "a")
+	assert.ErrorIs(t, err, httpClient.ErrUnauthorized)
+}
+
+func TestClientCertificateRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	ca := qqtlstest.NewCA(t)
+	serverCertPath, serverKeyPath := ca.Issue(t, t.TempDir(), "localhost")
+	clientCertPath, clientKeyPath := ca.Issue(t, t.TempDir(), "alice")
+
+	serverCertificate, err := qqtls.LoadCertificateFile(serverCertPath, serverKeyPath)
+	require.NoError(t, err)
+
+	tlsConfig, err := qqtls.ServerConfig(qqtls.ServerOptions{Certificate: serverCertificate, ClientCAFile: ca.CertPath})
+	require.NoError(t, err)
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			return &models.Entity{Key: key, Value: qqcontext.GetUserIdValue(ctx)}
+		},
+	}
+
+	testServer := httptest.NewUnstartedServer(newHandler(&server{
+		service:       &service,
+		authenticator: auth.NewAPIKeys(map[string]string{"key": "bob"}),
+	}))
+	// StartTLS replaces a config without Certificates with its own certificate
+	tlsConfig.Certificates = []tls.Certificate{*serverCertificate.Certificate()}
+	testServer.TLS = tlsConfig
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	clientCertificate, err := qqtls.LoadCertificateFile(clientCertPath, clientKeyPath)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name        string
+		certificate *qqtls.CertificateFile
+		credentials *auth.Credentials
+		exp         string
+		expErr      error
+	}{
+		{
+			name:        "ClientCertificate",
+			certificate: clientCertificate,
+			exp:         "alice",
+		},
+		{
+			name:        "CredentialsOverClientCertificate",
+			certificate: clientCertificate,
+			credentials: &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: "key"},
+			exp:         "bob",
+		},
+		{
+			name:   "NoClientCertificate",
+			expErr: httpClient.ErrUnauthorized,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			clientConfig, err := qqtls.ClientConfig(qqtls.ClientOptions{CAFile: ca.CertPath, Certificate: testCase.certificate})
+			require.NoError(t, err)
+
+			client := httpClient.NewClientWithOptions(ctx, httpClient.Options{
+				ServerURL:   testServer.URL,
+				Credentials: testCase.credentials,
+				TLS:         clientConfig,
+			})
+
+			entity, err := client.Get(ctx, "a")
+			if testCase.expErr != nil {
+				assert.ErrorIs(t, err, testCase.expErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.exp, entity.Value)
+		})
+	}
+}
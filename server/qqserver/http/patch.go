@@ -0,0 +1,73 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var errValueNotJson = errors.New("value is not a JSON document")
+
+// mergePatch applies a JSON merge patch (RFC 7386) to a value holding JSON
+func mergePatch(value string, patch []byte) (string, error) {
+	var patchDocument interface{}
+
+	err := decodeJson(patch, &patchDocument)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse patch: %w", err)
+	}
+
+	var document interface{}
+
+	err = decodeJson([]byte(value), &document)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errValueNotJson, err)
+	}
+
+	result, err := json.Marshal(mergeDocuments(document, patchDocument))
+	if err != nil {
+		return "", fmt.Errorf("failed to produce JSON: %w", err)
+	}
+
+	return string(result), nil
+}
+
+func mergeDocuments(document interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	object, ok := document.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+
+		object[key] = mergeDocuments(object[key], value)
+	}
+
+	return object
+}
+
+func decodeJson(data []byte, document *interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	err := decoder.Decode(document)
+	if err != nil {
+		return err
+	}
+
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON document")
+	}
+
+	return nil
+}
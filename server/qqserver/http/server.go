@@ -2,47 +2,136 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/health"
 	"qq/pkg/log"
 	httpClient "qq/pkg/qqclient/http"
 	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
 	"qq/services/qq"
 	"strings"
+	"unicode/utf8"
 )
 
+var (
+	entitiesMethods = []string{http.MethodGet, http.MethodPost}
+	entityMethods   = []string{http.MethodDelete, http.MethodGet, http.MethodHead, http.MethodPatch, http.MethodPut}
+)
+
+var entityActions = map[string]qq.Action{
+	http.MethodDelete: qq.ActionWrite,
+	http.MethodGet:    qq.ActionRead,
+	http.MethodHead:   qq.ActionRead,
+	http.MethodPatch:  qq.ActionWrite,
+	http.MethodPut:    qq.ActionWrite,
+}
+
+type Options struct {
+	// HealthDependencies are checked by /readyz
+	HealthDependencies []health.Dependency
+	// Metrics are served on /metrics when set
+	Metrics metrics.Metrics
+	// Authenticator verifies the credentials of every request but the probes
+	// and /metrics; requests are not authenticated when it is nil
+	Authenticator auth.Authenticator
+	// TLS serves HTTPS when set; a verified client certificate authenticates
+	// the request as the subject common name
+	TLS *tls.Config
+	// WebSocketOrigins are the origins, e.g. "https://app.example.com",
+	// whose pages may connect to /ws besides the pages of the server
+	WebSocketOrigins []string
+}
+
 type server struct {
-	server  http.Server
-	service qq.Service
+	server        *http.Server
+	service       qq.Service
+	health        health.Checker
+	metrics       metrics.Metrics
+	authenticator auth.Authenticator
+	// webSocketOrigins are lower case
+	webSocketOrigins map[string]bool
 }
 
 var _ qqserver.Server = server{}
 
-func NewServer(ctx context.Context, url string, service qq.Service) (qqserver.Server, error) {
+func NewServer(ctx context.Context, url string, service qq.Service, options Options) (qqserver.Server, error) {
 	log.Debug(ctx, "create new http server")
 
 	server := server{
-		service: service,
+		service:          service,
+		health:           health.NewChecker(options.HealthDependencies...),
+		metrics:          options.Metrics,
+		authenticator:    options.Authenticator,
+		webSocketOrigins: map[string]bool{},
 	}
 
-	httpServer := http.Server{
-		Addr:    url,
-		Handler: newMux(&server),
+	for _, origin := range options.WebSocketOrigins {
+		server.webSocketOrigins[strings.ToLower(origin)] = true
 	}
 
-	server.server = httpServer
+	server.server = &http.Server{
+		Addr:      url,
+		Handler:   newHandler(&server),
+		TLSConfig: options.TLS,
+	}
 
 	return server, nil
 }
 
-func newMux(s *server) *http.ServeMux {
+const entityPathPrefix = "/entities/"
+
+// newMux routes entity paths before http.ServeMux sees them, because the mux
+// cleans paths and would redirect keys such as "a/../b" or "a//b"
+func newMux(s *server) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/entities", s.entities)
-	mux.HandleFunc("/entities/", s.entity)
-	return mux
+	mux.HandleFunc(batchGetPath, s.batch("batch get", handleBatchGetRequest))
+	mux.HandleFunc(batchPutPath, s.batch("batch put", handleBatchPutRequest))
+	mux.HandleFunc(batchDeletePath, s.batch("batch delete", handleBatchDeleteRequest))
+	mux.HandleFunc(HealthzPath, s.healthz)
+	mux.HandleFunc(ReadyzPath, s.readyz)
+	mux.HandleFunc(VersionPath, s.version)
+	mux.HandleFunc(QuotasPath, s.admin("quotas", s.quotas))
+	mux.HandleFunc(AuditPath, s.admin("audit", s.audit))
+	mux.HandleFunc(AuditVerifyPath, s.admin("audit verify", s.auditVerify))
+	mux.HandleFunc(WebSocketPath, s.webSocket)
+
+	if s.metrics != nil {
+		mux.Handle(metrics.Path, s.metrics.Handler())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.EscapedPath(), entityPathPrefix) {
+			s.entity(w, req)
+			return
+		}
+
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// entityKey decodes the key from the escaped path so that an escaped '/' in
+// the key is not mistaken for a path separator
+func entityKey(req *http.Request) (string, error) {
+	key, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), entityPathPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to unescape key: %w", err)
+	}
+
+	if !utf8.ValidString(key) {
+		return "", fmt.Errorf("key is not valid UTF-8")
+	}
+
+	return key, nil
 }
 
 func (s server) entities(w http.ResponseWriter, req *http.Request) {
@@ -50,6 +139,16 @@ func (s server) entities(w http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 	case http.MethodGet:
+		w.Header().Add("Vary", "Accept")
+
+		if acceptsNDJSON(req) {
+			err := handleGetAllStreamRequest(ctx, w, s.service)
+			if err != nil {
+				log.Error(ctx, "failed to handle get all stream request", log.Args{"error": err})
+			}
+			return
+		}
+
 		err := handleGetAllRequest(ctx, w, s.service)
 		if err != nil {
 			log.Error(ctx, "failed to handle get all request", log.Args{"error": err})
@@ -60,30 +159,86 @@ func (s server) entities(w http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			log.Error(ctx, "failed to handle post request", log.Args{"error": err})
 		}
+
+	default:
+		err := handleMethodNotAllowed(w, entitiesMethods)
+		if err != nil {
+			log.Error(ctx, "failed to handle not allowed method", log.Args{"error": err, "method": req.Method})
+		}
 	}
 }
 
 func (s server) entity(w http.ResponseWriter, req *http.Request) {
-	key := strings.TrimPrefix(req.URL.Path, "/entities/")
 	ctx := req.Context()
 
+	key, err := entityKey(req)
+	if err != nil {
+		log.Error(ctx, "failed to get key", log.Args{"error": err, "path": req.URL.EscapedPath()})
+
+		err = writeErrorResponce(w, http.StatusBadRequest, httpClient.ErrorCodeBadRequest, "invalid key", map[string]string{"error": err.Error()})
+		if err != nil {
+			log.Error(ctx, "failed to handle bad request", log.Args{"error": err})
+		}
+
+		return
+	}
+
+	action, ok := entityActions[req.Method]
+	if ok {
+		err = s.service.Authorize(ctx, action, key)
+		if err != nil {
+			err = writePermissionDeniedResponce(w, key)
+			if err != nil {
+				log.Error(ctx, "failed to handle permission denied", log.Args{"error": err})
+			}
+
+			return
+		}
+	}
+
 	switch req.Method {
 	case http.MethodGet:
-		err := handleGetRequest(ctx, w, key, s.service)
+		err := handleGetRequest(ctx, w, req, key, s.service)
 		if err != nil {
 			log.Error(ctx, "failed to handle get request", log.Args{"error": err})
 		}
 
+	case http.MethodHead:
+		handleHeadRequest(ctx, w, key, s.service)
+
+	case http.MethodPut:
+		err := handlePutRequest(ctx, w, req, key, s.service)
+		if err != nil {
+			log.Error(ctx, "failed to handle put request", log.Args{"error": err})
+		}
+
+	case http.MethodPatch:
+		err := handlePatchRequest(ctx, w, req, key, s.service)
+		if err != nil {
+			log.Error(ctx, "failed to handle patch request", log.Args{"error": err})
+		}
+
 	case http.MethodDelete:
-		err := handleDeleteRequest(ctx, w, key, s.service)
+		err := handleDeleteRequest(ctx, w, req, key, s.service)
 		if err != nil {
 			log.Error(ctx, "failed to handle delete request", log.Args{"error": err})
 		}
+
+	default:
+		err := handleMethodNotAllowed(w, entityMethods)
+		if err != nil {
+			log.Error(ctx, "failed to handle not allowed method", log.Args{"error": err, "method": req.Method})
+		}
 	}
 }
 
 func (s server) Serve() error {
-	err := s.server.ListenAndServe()
+	var err error
+	if s.server.TLSConfig != nil {
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
 	if err != nil {
 		if !errors.Is(err, http.ErrServerClosed) {
 			return fmt.Errorf("failed to run http server: %w", err)
@@ -95,74 +250,203 @@ func (s server) Serve() error {
 }
 
 func handlePostRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, service qq.Service) error {
-	var responce httpClient.PostResponce
-
-	defer req.Body.Close()
+	var request httpClient.PostRequest
 
-	body, err := ioutil.ReadAll(req.Body)
+	err := readJsonRequest(req, &request)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return fmt.Errorf("failed to read request body: %w", err)
+		return writeBadJsonResponce(w, err)
 	}
 
-	var request httpClient.PostRequest
+	entity := FromPostRequest(request)
+	statusCode := http.StatusOK
+
+	err = service.Authorize(ctx, qq.ActionWrite, entity.Key)
+	if err != nil {
+		return writePermissionDeniedResponce(w, entity.Key)
+	}
 
-	err = json.Unmarshal(body, &request)
+	err = service.CheckQuota(ctx, entity)
 	if err != nil {
-		responce.Status = http.StatusText(http.StatusBadRequest)
+		return writeQuotaExceededResponce(w, err)
+	}
 
-		jsonResponce, err := json.Marshal(responce)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return fmt.Errorf("failed to produce JSON: %w", err)
-		}
+	added := service.Add(ctx, entity)
+	if added {
+		statusCode = http.StatusCreated
+	}
+
+	responce := ToPostResponce(added)
+
+	return writeJsonResponce(w, responce, statusCode)
+}
+
+func handleGetRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, key string, service qq.Service) error {
+	entity := service.Get(ctx, key)
+	responce := ToGetResponce(entity)
+
+	if entity == nil {
+		return writeErrorResponce(w, http.StatusNotFound, httpClient.ErrorCodeNotFound, "entity not found", map[string]string{"key": key})
+	}
+
+	etag := ETag(entity)
+	w.Header().Set("ETag", etag)
+
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && matchETag(ifNoneMatch, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	return writeJsonResponce(w, responce, http.StatusOK)
+}
+
+func handlePutRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, key string, service qq.Service) error {
+	var responce httpClient.PutResponce
 
-		w.WriteHeader(http.StatusBadRequest)
+	var request httpClient.PutRequest
 
-		_, err = w.Write(jsonResponce)
+	err := readJsonRequest(req, &request)
+	if err != nil {
+		return writeBadJsonResponce(w, err)
+	}
+
+	created := false
+
+	entity, err := service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+		err := checkWritePreconditions(req, current)
 		if err != nil {
-			return fmt.Errorf("failed to write response: %w", err)
+			return nil, err
 		}
 
-		return fmt.Errorf("failed to parse JSON: %w", err)
+		created = current == nil
+
+		entity := FromPutRequest(key, request)
+		return &entity, nil
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		return writePreconditionFailedResponce(w)
+	}
+	if errors.Is(err, qq.ErrPermissionDenied) {
+		return writePermissionDeniedResponce(w, key)
+	}
+	if errors.Is(err, qq.ErrQuotaExceeded) {
+		return writeQuotaExceededResponce(w, err)
+	}
+	if err != nil {
+		return writeInternalErrorResponce(w, fmt.Errorf("failed to update: %w", err))
 	}
 
-	entity := FromPostRequest(request)
 	statusCode := http.StatusOK
-
-	added := service.Add(ctx, entity)
-	if added {
+	if created {
 		statusCode = http.StatusCreated
 	}
 
-	responce = ToPostResponce(added)
+	w.Header().Set("ETag", ETag(entity))
+
+	responce = ToPutResponce(true)
 
 	return writeJsonResponce(w, responce, statusCode)
 }
 
-func handleGetRequest(ctx context.Context, w http.ResponseWriter, key string, service qq.Service) error {
-	var responce httpClient.GetResponce
+func handlePatchRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, key string, service qq.Service) error {
+	var responce httpClient.PatchResponce
 
-	entity := service.Get(ctx, key)
-	if entity == nil {
-		entity = service.Get(ctx, strings.ToUpper(key))
+	contentType := req.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != httpClient.MergePatchContentType {
+		details := map[string]string{"content_type": contentType, "expected": httpClient.MergePatchContentType}
+		return writeErrorResponce(w, http.StatusUnsupportedMediaType, httpClient.ErrorCodeUnsupportedMediaType, "unsupported content type", details)
 	}
-	responce = ToGetResponce(entity)
 
-	statusCode := http.StatusOK
+	defer req.Body.Close()
 
+	patch, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return writeErrorResponce(w, http.StatusBadRequest, httpClient.ErrorCodeBadRequest, "failed to read request body", nil)
+	}
+
+	entity, err := service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+		if current == nil {
+			return nil, errNotFound
+		}
+
+		err := checkWritePreconditions(req, current)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := mergePatch(current.Value, patch)
+		if err != nil {
+			return nil, err
+		}
+
+		current.Value = value
+		return current, nil
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotFound):
+		return writeErrorResponce(w, http.StatusNotFound, httpClient.ErrorCodeNotFound, "entity not found", map[string]string{"key": key})
+	case errors.Is(err, errPreconditionFailed):
+		return writePreconditionFailedResponce(w)
+	case errors.Is(err, qq.ErrPermissionDenied):
+		return writePermissionDeniedResponce(w, key)
+	case errors.Is(err, qq.ErrQuotaExceeded):
+		return writeQuotaExceededResponce(w, err)
+	case errors.Is(err, errValueNotJson):
+		return writeErrorResponce(w, http.StatusConflict, httpClient.ErrorCodeConflict, errValueNotJson.Error(), map[string]string{"error": err.Error()})
+	default:
+		return writeErrorResponce(w, http.StatusBadRequest, httpClient.ErrorCodeBadRequest, "invalid merge patch", map[string]string{"error": err.Error()})
+	}
+
+	w.Header().Set("ETag", ETag(entity))
+
+	responce = ToPatchResponce(entity)
+
+	return writeJsonResponce(w, responce, http.StatusOK)
+}
+
+func handleHeadRequest(ctx context.Context, w http.ResponseWriter, key string, service qq.Service) {
+	entity := service.Get(ctx, key)
 	if entity == nil {
-		responce.Status = http.StatusText(http.StatusNotFound)
-		statusCode = http.StatusNotFound
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	return writeJsonResponce(w, responce, statusCode)
+	w.Header().Set("ETag", ETag(entity))
+	w.WriteHeader(http.StatusOK)
 }
 
-func handleDeleteRequest(ctx context.Context, w http.ResponseWriter, key string, service qq.Service) error {
+func handleMethodNotAllowed(w http.ResponseWriter, allowed []string) error {
+	allow := strings.Join(allowed, ", ")
+	w.Header().Set("Allow", allow)
+
+	return writeErrorResponce(w, http.StatusMethodNotAllowed, httpClient.ErrorCodeMethodNotAllowed, "method not allowed", map[string]string{"allow": allow})
+}
+
+func handleDeleteRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, key string, service qq.Service) error {
 	var responce httpClient.DeleteResponce
 
-	responce = ToDeleteResponce(service.Remove(ctx, key))
+	if !hasPreconditions(req) {
+		responce = ToDeleteResponce(service.Remove(ctx, key))
+
+		return writeJsonResponce(w, responce, http.StatusOK)
+	}
+
+	_, err := service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+		return nil, checkWritePreconditions(req, current)
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		return writePreconditionFailedResponce(w)
+	}
+	if errors.Is(err, qq.ErrPermissionDenied) {
+		return writePermissionDeniedResponce(w, key)
+	}
+	if err != nil {
+		return writeInternalErrorResponce(w, fmt.Errorf("failed to update: %w", err))
+	}
+
+	responce = ToDeleteResponce(true)
 
 	return writeJsonResponce(w, responce, http.StatusOK)
 }
@@ -175,11 +459,26 @@ func handleGetAllRequest(ctx context.Context, w http.ResponseWriter, service qq.
 	return writeJsonResponce(w, responce, http.StatusOK)
 }
 
+func readJsonRequest[Request any](req *http.Request, request *Request) error {
+	defer req.Body.Close()
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		return fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	return nil
+}
+
 func writeJsonResponce[Responce any](w http.ResponseWriter, responce Responce, statusCode int) error {
 	jsonResponce, err := json.Marshal(responce)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return fmt.Errorf("failed to produce JSON: %w", err)
+		return writeInternalErrorResponce(w, fmt.Errorf("failed to produce JSON: %w", err))
 	}
 
 	if statusCode != http.StatusOK {
@@ -193,3 +492,46 @@ func writeJsonResponce[Responce any](w http.ResponseWriter, responce Responce, s
 
 	return nil
 }
+
+// writeErrorResponce writes the error envelope shared by all handlers; the
+// request id is taken from the response header set by withRequestId
+func writeErrorResponce(w http.ResponseWriter, statusCode int, code string, message string, details map[string]string) error {
+	responce := httpClient.ErrorResponce{
+		Error: &httpClient.Error{
+			Code:      code,
+			Message:   message,
+			RequestId: w.Header().Get(httpClient.RequestIdHeader),
+			Details:   details,
+		},
+		Status: http.StatusText(statusCode),
+	}
+
+	return writeJsonResponce(w, responce, statusCode)
+}
+
+func writeBadJsonResponce(w http.ResponseWriter, err error) error {
+	return writeErrorResponce(w, http.StatusBadRequest, httpClient.ErrorCodeBadRequest, "invalid JSON", map[string]string{"error": err.Error()})
+}
+
+func writePermissionDeniedResponce(w http.ResponseWriter, key string) error {
+	return writeErrorResponce(w, http.StatusForbidden, httpClient.ErrorCodePermissionDenied, "permission denied", map[string]string{"key": key})
+}
+
+func writeQuotaExceededResponce(w http.ResponseWriter, err error) error {
+	return writeErrorResponce(w, http.StatusInsufficientStorage, httpClient.ErrorCodeQuotaExceeded, "quota exceeded", map[string]string{"error": err.Error()})
+}
+
+func writePreconditionFailedResponce(w http.ResponseWriter) error {
+	return writeErrorResponce(w, http.StatusPreconditionFailed, httpClient.ErrorCodePreconditionFailed, "precondition failed", nil)
+}
+
+// writeInternalErrorResponce keeps the details of err out of the response and
+// returns it to be logged by the caller
+func writeInternalErrorResponce(w http.ResponseWriter, err error) error {
+	writeErr := writeErrorResponce(w, http.StatusInternalServerError, httpClient.ErrorCodeInternal, "internal server error", nil)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return err
+}
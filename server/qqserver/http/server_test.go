@@ -4,14 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"qq/models"
+	"qq/pkg/auth"
 	"qq/pkg/qqclient"
 	httpClient "qq/pkg/qqclient/http"
+	"qq/repos/auditqq"
+	"qq/repos/cacheqq"
+	qqRepo "qq/repos/qq"
 	"qq/services/qq"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -46,46 +55,14 @@ func TestHandleGetRequest(t *testing.T) {
 			req:  httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities/c", nil),
 			service: qq.ServiceMock{
 				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
-					switch counter {
-					case 1:
-						assert.Equal(t, "c", key)
-						return nil
-					case 2:
-						assert.Equal(t, "C", key)
-						return nil
-					default:
-						assert.Fail(t, "unexpected call")
-						return nil
-					}
+					assert.Equal(t, "c", key)
+					return nil
 				},
 			},
 			exp:           nil,
 			expStatus:     http.StatusText(http.StatusNotFound),
 			expStatusCode: http.StatusNotFound,
-			expGetCounter: 2,
-		},
-		{
-			name: "FoundWhenUpper",
-			req:  httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities/a", nil),
-			service: qq.ServiceMock{
-				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
-					switch counter {
-					case 1:
-						assert.Equal(t, "a", key)
-						return nil
-					case 2:
-						assert.Equal(t, "A", key)
-						return &models.Entity{Key: "a", Value: "b"}
-					default:
-						assert.Fail(t, "unexpected call")
-						return nil
-					}
-				},
-			},
-			exp:           &qqclient.Entity{Key: "a", Value: "b"},
-			expStatus:     "",
-			expStatusCode: http.StatusOK,
-			expGetCounter: 2,
+			expGetCounter: 1,
 		},
 	}
 
@@ -318,3 +295,884 @@ func TestHandleGetAllRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlePutRequest(t *testing.T) {
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		service       qq.ServiceMock
+		exp           bool
+		expStatus     string
+		expStatusCode int
+	}{
+		{
+			name: "Created",
+			req:  httptest.NewRequest(http.MethodPut, "http://localhost:8080/entities/a", strings.NewReader(`{"value":"b"}`)),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, nil, &models.Entity{Key: "a", Value: "b"}),
+			},
+			exp:           true,
+			expStatus:     "",
+			expStatusCode: http.StatusCreated,
+		},
+		{
+			name: "Replaced",
+			req:  httptest.NewRequest(http.MethodPut, "http://localhost:8080/entities/a", strings.NewReader(`{"value":"c"}`)),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, &models.Entity{Key: "a", Value: "b"}, &models.Entity{Key: "a", Value: "c"}),
+			},
+			exp:           true,
+			expStatus:     "",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "BadRequest",
+			req:           httptest.NewRequest(http.MethodPut, "http://localhost:8080/entities/a", strings.NewReader(`{"value":`)),
+			service:       qq.ServiceMock{},
+			exp:           false,
+			expStatus:     http.StatusText(http.StatusBadRequest),
+			expStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			server := server{
+				service: &testCase.service,
+			}
+
+			w := httptest.NewRecorder()
+
+			mux := newMux(&server)
+			mux.ServeHTTP(w, testCase.req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+
+			var responce httpClient.PutResponce
+
+			err = json.Unmarshal(body, &responce)
+			assert.NoError(t, err)
+
+			assert.Equal(t, testCase.exp, responce.Added)
+			assert.Equal(t, testCase.expStatus, responce.Status)
+			assert.Equal(t, testCase.expStatusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandlePatchRequest(t *testing.T) {
+	newPatchRequest := func(body string, contentType string) *http.Request {
+		req := httptest.NewRequest(http.MethodPatch, "http://localhost:8080/entities/a", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		service       qq.ServiceMock
+		exp           *qqclient.Entity
+		expStatus     string
+		expStatusCode int
+	}{
+		{
+			name: "HappyRun",
+			req:  newPatchRequest(`{"b":null,"c":{"d":2},"e":[3]}`, httpClient.MergePatchContentType),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t,
+					&models.Entity{Key: "a", Value: `{"a":1,"b":1,"c":{"c":1}}`},
+					&models.Entity{Key: "a", Value: `{"a":1,"c":{"c":1,"d":2},"e":[3]}`}),
+			},
+			exp:           &qqclient.Entity{Key: "a", Value: `{"a":1,"c":{"c":1,"d":2},"e":[3]}`},
+			expStatus:     "",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name: "ContentTypeWithParameters",
+			req:  newPatchRequest(`{"b":2}`, httpClient.MergePatchContentType+"; charset=utf-8"),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t,
+					&models.Entity{Key: "a", Value: `{"b":1}`},
+					&models.Entity{Key: "a", Value: `{"b":2}`}),
+			},
+			exp:           &qqclient.Entity{Key: "a", Value: `{"b":2}`},
+			expStatus:     "",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name: "NotFound",
+			req:  newPatchRequest(`{"b":1}`, httpClient.MergePatchContentType),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, nil, nil),
+			},
+			exp:           nil,
+			expStatus:     http.StatusText(http.StatusNotFound),
+			expStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "ValueNotJson",
+			req:  newPatchRequest(`{"b":1}`, httpClient.MergePatchContentType),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, &models.Entity{Key: "a", Value: "b"}, nil),
+			},
+			exp:           nil,
+			expStatus:     http.StatusText(http.StatusConflict),
+			expStatusCode: http.StatusConflict,
+		},
+		{
+			name: "BadRequest",
+			req:  newPatchRequest(`{"b":`, httpClient.MergePatchContentType),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, &models.Entity{Key: "a", Value: "{}"}, nil),
+			},
+			exp:           nil,
+			expStatus:     http.StatusText(http.StatusBadRequest),
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "UnsupportedMediaType",
+			req:           newPatchRequest(`{"b":1}`, "application/json"),
+			service:       qq.ServiceMock{},
+			exp:           nil,
+			expStatus:     http.StatusText(http.StatusUnsupportedMediaType),
+			expStatusCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			server := server{
+				service: &testCase.service,
+			}
+
+			w := httptest.NewRecorder()
+
+			mux := newMux(&server)
+			mux.ServeHTTP(w, testCase.req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+
+			var responce httpClient.PatchResponce
+
+			err = json.Unmarshal(body, &responce)
+			assert.NoError(t, err)
+
+			assert.Equal(t, testCase.exp, responce.Entity)
+			assert.Equal(t, testCase.expStatus, responce.Status)
+			assert.Equal(t, testCase.expStatusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandleHeadRequest(t *testing.T) {
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		service       qq.ServiceMock
+		expStatusCode int
+	}{
+		{
+			name: "HappyRun",
+			req:  httptest.NewRequest(http.MethodHead, "http://localhost:8080/entities/a", nil),
+			service: qq.ServiceMock{
+				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+					assert.Equal(t, "a", key)
+					return &models.Entity{Key: "a", Value: "b"}
+				},
+			},
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name: "NotFound",
+			req:  httptest.NewRequest(http.MethodHead, "http://localhost:8080/entities/a", nil),
+			service: qq.ServiceMock{
+				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+					return nil
+				},
+			},
+			expStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			server := server{
+				service: &testCase.service,
+			}
+
+			w := httptest.NewRecorder()
+
+			mux := newMux(&server)
+			mux.ServeHTTP(w, testCase.req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, testCase.expStatusCode, resp.StatusCode)
+			assert.Equal(t, 0, w.Body.Len())
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		expAllow      string
+		expStatusCode int
+	}{
+		{
+			name:          "Entities",
+			req:           httptest.NewRequest(http.MethodDelete, "http://localhost:8080/entities", nil),
+			expAllow:      "GET, POST",
+			expStatusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:          "Entity",
+			req:           httptest.NewRequest(http.MethodPost, "http://localhost:8080/entities/a", nil),
+			expAllow:      "DELETE, GET, HEAD, PATCH, PUT",
+			expStatusCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			server := server{
+				service: &qq.ServiceMock{},
+			}
+
+			w := httptest.NewRecorder()
+
+			mux := newMux(&server)
+			mux.ServeHTTP(w, testCase.req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+
+			var responce httpClient.ErrorResponce
+
+			err = json.Unmarshal(body, &responce)
+			assert.NoError(t, err)
+
+			assert.Equal(t, http.StatusText(http.StatusMethodNotAllowed), responce.Status)
+			assert.Equal(t, testCase.expAllow, resp.Header.Get("Allow"))
+			assert.Equal(t, testCase.expStatusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	current := &models.Entity{Key: "a", Value: `{"b":1}`, Version: 0xab}
+	currentETag := `"ab"`
+
+	newRequest := func(method string, body string, header map[string]string) *http.Request {
+		req := httptest.NewRequest(method, "http://localhost:8080/entities/a", strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+
+	getMock := func(ctx context.Context, key string, counter int) *models.Entity {
+		return current
+	}
+
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		service       qq.ServiceMock
+		expETag       string
+		expStatusCode int
+	}{
+		{
+			name:          "GetETag",
+			req:           newRequest(http.MethodGet, "", nil),
+			service:       qq.ServiceMock{GetMock: getMock},
+			expETag:       currentETag,
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "GetNotModified",
+			req:           newRequest(http.MethodGet, "", map[string]string{"If-None-Match": `"x", W/` + currentETag}),
+			service:       qq.ServiceMock{GetMock: getMock},
+			expETag:       currentETag,
+			expStatusCode: http.StatusNotModified,
+		},
+		{
+			name:          "GetModified",
+			req:           newRequest(http.MethodGet, "", map[string]string{"If-None-Match": `"x"`}),
+			service:       qq.ServiceMock{GetMock: getMock},
+			expETag:       currentETag,
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name: "PutIfMatch",
+			req:  newRequest(http.MethodPut, `{"value":"c"}`, map[string]string{"If-Match": currentETag}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, current, &models.Entity{Key: "a", Value: "c"}),
+			},
+			expETag:       `"cd"`,
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name: "PutIfMatchFailed",
+			req:  newRequest(http.MethodPut, `{"value":"c"}`, map[string]string{"If-Match": `"x"`}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, current, nil),
+			},
+			expETag:       "",
+			expStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name: "PutIfMatchMissing",
+			req:  newRequest(http.MethodPut, `{"value":"c"}`, map[string]string{"If-Match": "*"}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, nil, nil),
+			},
+			expETag:       "",
+			expStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name: "PutIfNoneMatchAny",
+			req:  newRequest(http.MethodPut, `{"value":"c"}`, map[string]string{"If-None-Match": "*"}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, nil, &models.Entity{Key: "a", Value: "c"}),
+			},
+			expETag:       `"cd"`,
+			expStatusCode: http.StatusCreated,
+		},
+		{
+			name: "PutIfNoneMatchAnyExists",
+			req:  newRequest(http.MethodPut, `{"value":"c"}`, map[string]string{"If-None-Match": "*"}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, current, nil),
+			},
+			expETag:       "",
+			expStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name: "PatchIfMatchFailed",
+			req: newRequest(http.MethodPatch, `{"b":2}`, map[string]string{
+				"If-Match":     `"x"`,
+				"Content-Type": httpClient.MergePatchContentType,
+			}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, current, nil),
+			},
+			expETag:       "",
+			expStatusCode: http.StatusPreconditionFailed,
+		},
+		{
+			name: "DeleteIfMatch",
+			req:  newRequest(http.MethodDelete, "", map[string]string{"If-Match": currentETag}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, current, nil),
+			},
+			expETag:       "",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name: "DeleteIfMatchFailed",
+			req:  newRequest(http.MethodDelete, "", map[string]string{"If-Match": `"x"`}),
+			service: qq.ServiceMock{
+				UpdateMock: updateMock(t, current, nil),
+			},
+			expETag:       "",
+			expStatusCode: http.StatusPreconditionFailed,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			server := server{
+				service: &testCase.service,
+			}
+
+			w := httptest.NewRecorder()
+
+			mux := newMux(&server)
+			mux.ServeHTTP(w, testCase.req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, testCase.expETag, resp.Header.Get("ETag"))
+			assert.Equal(t, testCase.expStatusCode, resp.StatusCode)
+		})
+	}
+}
+
+// updateMock runs the update against current and checks the entity it wants
+// to store; a successful update is stored with version 0xcd
+func updateMock(t *testing.T, current *models.Entity, exp *models.Entity) func(context.Context, string, func(*models.Entity) (*models.Entity, error)) (*models.Entity, error) {
+	return func(ctx context.Context, key string, update func(*models.Entity) (*models.Entity, error)) (*models.Entity, error) {
+		assert.Equal(t, "a", key)
+
+		var currentCopy *models.Entity
+		if current != nil {
+			entity := *current
+			currentCopy = &entity
+		}
+
+		entity, err := update(currentCopy)
+		if err != nil {
+			return nil, err
+		}
+
+		if entity == nil {
+			assert.Nil(t, exp)
+			return nil, nil
+		}
+
+		stored := *entity
+		stored.Key = key
+		stored.Version = 0
+		assert.Equal(t, exp, &stored)
+
+		stored.Version = 0xcd
+		return &stored, nil
+	}
+}
+
+var roundTripKeys = []string{
+	"a/b",
+	"/leading/and/trailing/",
+	"a//b",
+	"a/../b",
+	"..",
+	".",
+	"a?b=c&d",
+	"a#b",
+	"100%",
+	"%2F",
+	"with space",
+	"plus+sign",
+	"semi;colon,comma",
+	"ключ",
+	"日本語/キー",
+	"emoji 🙂",
+	"control\x00\x01\x1f\x7f",
+	"tab\tand\nnewline",
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	database, err := qqRepo.NewDatabase()
+	require.NoError(t, err)
+
+	service, err := qq.NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), qq.Options{})
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(newMux(&server{service: service}))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	for _, key := range roundTripKeys {
+		key := key
+		t.Run(strconv.Quote(key), func(t *testing.T) {
+			added, err := client.Add(ctx, qqclient.Entity{Key: key, Value: "post"})
+			require.NoError(t, err)
+			assert.True(t, added)
+
+			entity, err := client.Get(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, &qqclient.Entity{Key: key, Value: "post"}, entity)
+
+			_, err = client.Put(ctx, qqclient.Entity{Key: key, Value: "put"})
+			require.NoError(t, err)
+
+			entity, err = client.Get(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, &qqclient.Entity{Key: key, Value: "put"}, entity)
+
+			exists, err := client.Exists(ctx, key)
+			require.NoError(t, err)
+			assert.True(t, exists)
+
+			removed, err := client.Remove(ctx, key)
+			require.NoError(t, err)
+			assert.True(t, removed)
+
+			exists, err = client.Exists(ctx, key)
+			require.NoError(t, err)
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestEntityKey(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target string
+		exp    string
+		expErr bool
+	}{
+		{
+			name:   "HappyRun",
+			target: "/entities/a",
+			exp:    "a",
+		},
+		{
+			name:   "EscapedSlash",
+			target: "/entities/a%2Fb",
+			exp:    "a/b",
+		},
+		{
+			name:   "UnescapedSlash",
+			target: "/entities/a/b",
+			exp:    "a/b",
+		},
+		{
+			name:   "EscapedPercent",
+			target: "/entities/100%25",
+			exp:    "100%",
+		},
+		{
+			name:   "Empty",
+			target: "/entities/",
+			exp:    "",
+		},
+		{
+			name:   "InvalidUTF8",
+			target: "/entities/%FF",
+			expErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			key, err := entityKey(httptest.NewRequest(http.MethodGet, testCase.target, nil))
+			assert.Equal(t, testCase.exp, key)
+			assert.Equal(t, testCase.expErr, err != nil)
+		})
+	}
+}
+
+func TestErrorResponce(t *testing.T) {
+	newRequest := func(method string, target string, body string, header http.Header) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header = header
+		return req
+	}
+
+	testCases := []struct {
+		name          string
+		req           *http.Request
+		service       qq.ServiceMock
+		expErr        *httpClient.Error
+		expStatusCode int
+	}{
+		{
+			name: "BadJson",
+			req:  newRequest(http.MethodPost, "http://localhost:8080/entities", "{", http.Header{"X-Request-Id": []string{"1"}}),
+			expErr: &httpClient.Error{
+				Code:      httpClient.ErrorCodeBadRequest,
+				Message:   "invalid JSON",
+				RequestId: "1",
+				Details:   map[string]string{"error": "failed to parse JSON: unexpected end of JSON input"},
+			},
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "NotFound",
+			req:  newRequest(http.MethodGet, "http://localhost:8080/entities/a", "", http.Header{}),
+			service: qq.ServiceMock{
+				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+					return nil
+				},
+			},
+			expErr: &httpClient.Error{
+				Code:    httpClient.ErrorCodeNotFound,
+				Message: "entity not found",
+				Details: map[string]string{"key": "a"},
+			},
+			expStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "InvalidKey",
+			req:  newRequest(http.MethodGet, "http://localhost:8080/entities/%ff", "", http.Header{"X-Request-Id": []string{"2"}}),
+			expErr: &httpClient.Error{
+				Code:      httpClient.ErrorCodeBadRequest,
+				Message:   "invalid key",
+				RequestId: "2",
+				Details:   map[string]string{"error": "key is not valid UTF-8"},
+			},
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "UnsupportedMediaType",
+			req:  newRequest(http.MethodPatch, "http://localhost:8080/entities/a", "{}", http.Header{"Content-Type": []string{"application/json"}}),
+			expErr: &httpClient.Error{
+				Code:    httpClient.ErrorCodeUnsupportedMediaType,
+				Message: "unsupported content type",
+				Details: map[string]string{"content_type": "application/json", "expected": httpClient.MergePatchContentType},
+			},
+			expStatusCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name: "InternalError",
+			req:  newRequest(http.MethodPut, "http://localhost:8080/entities/a", `{"value":"b"}`, http.Header{}),
+			service: qq.ServiceMock{
+				UpdateMock: func(ctx context.Context, key string, update func(*models.Entity) (*models.Entity, error)) (*models.Entity, error) {
+					return nil, fmt.Errorf("database is down")
+				},
+			},
+			expErr: &httpClient.Error{
+				Code:    httpClient.ErrorCodeInternal,
+				Message: "internal server error",
+			},
+			expStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			server := server{
+				service: &testCase.service,
+			}
+
+			w := httptest.NewRecorder()
+
+			handler := newHandler(&server)
+			handler.ServeHTTP(w, testCase.req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+
+			requestId := resp.Header.Get(httpClient.RequestIdHeader)
+			assert.NotEmpty(t, requestId)
+
+			if testCase.expErr.RequestId == "" {
+				testCase.expErr.RequestId = requestId
+			}
+
+			var responce httpClient.ErrorResponce
+
+			err = json.Unmarshal(body, &responce)
+			assert.NoError(t, err)
+
+			assert.Equal(t, testCase.expErr, responce.Error)
+			assert.Equal(t, http.StatusText(testCase.expStatusCode), responce.Status)
+			assert.Equal(t, testCase.expStatusCode, resp.StatusCode)
+			assert.Equal(t, testCase.expErr.RequestId, requestId)
+		})
+	}
+}
+
+type policySource struct {
+	policy *qq.Policy
+}
+
+func (p policySource) Policy() *qq.Policy {
+	return p.policy
+}
+
+func TestAccessControlRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	policy, err := qq.ParsePolicy([]byte(`{"rules": [
+		{"users": ["reader"], "actions": ["read"]},
+		{"users": ["writer"], "prefix": "team-a/", "actions": ["read", "write"]}
+	]}`))
+	require.NoError(t, err)
+
+	database, err := qqRepo.NewDatabase()
+	require.NoError(t, err)
+
+	service, err := qq.NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), qq.Options{Policy: policySource{policy: policy}})
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(newHandler(&server{
+		service:       service,
+		authenticator: auth.NewAPIKeys(map[string]string{"reader-key": "reader", "writer-key": "writer"}),
+	}))
+	defer testServer.Close()
+
+	newClient := func(apiKey string) httpClient.Client {
+		return httpClient.NewClientWithOptions(ctx, httpClient.Options{
+			ServerURL:   testServer.URL,
+			Credentials: &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: apiKey},
+		})
+	}
+
+	reader := newClient("reader-key")
+	writer := newClient("writer-key")
+
+	added, err := writer.Add(ctx, qqclient.Entity{Key: "team-a/x", Value: "a"})
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	_, err = writer.Add(ctx, qqclient.Entity{Key: "team-b/x", Value: "b"})
+	assert.ErrorIs(t, err, httpClient.ErrPermissionDenied)
+
+	_, err = reader.Put(ctx, qqclient.Entity{Key: "team-a/x", Value: "b"})
+	assert.ErrorIs(t, err, httpClient.ErrPermissionDenied)
+
+	_, err = reader.Remove(ctx, "team-a/x")
+	assert.ErrorIs(t, err, httpClient.ErrPermissionDenied)
+
+	entity, err := reader.Get(ctx, "team-a/x")
+	require.NoError(t, err)
+	assert.Equal(t, "a", entity.Value)
+
+	results, err := writer.AddBatch(ctx, []qqclient.Entity{{Key: "team-a/y", Value: "y"}, {Key: "team-b/y", Value: "y"}})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, httpClient.BatchPutResult{Key: "team-a/y", Added: true}, results[0])
+	assert.False(t, results[1].Added)
+	assert.ErrorIs(t, results[1].Error, httpClient.ErrPermissionDenied)
+	assert.Nil(t, database.Get("team-b/y"))
+}
+
+func TestLimitsRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	// the admin endpoints are denied without a policy
+	policy, err := qq.ParsePolicy([]byte(`{"rules": [{"users": ["*"], "actions": ["read", "write", "admin"]}]}`))
+	require.NoError(t, err)
+
+	database, err := qqRepo.NewDatabase()
+	require.NoError(t, err)
+
+	service, err := qq.NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), qq.Options{
+		Policy: policySource{policy: policy},
+		Limits: &qq.Limits{
+			RateLimits: qq.RateLimits{
+				Operations: map[string]qq.RateLimit{"get": {Rate: 0.001, Burst: 1}},
+			},
+			Quotas: qq.Quotas{
+				Namespaces: map[string]qq.Quota{"team-a": {MaxKeys: 1}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(newHandler(&server{
+		service:       service,
+		authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"}),
+	}))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{
+		ServerURL:   testServer.URL,
+		Credentials: &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: "key"},
+	})
+
+	added, err := client.Add(ctx, qqclient.Entity{Key: "team-a/x", Value: "a"})
+	require.NoError(t, err)
+	assert.True(t, added)
+
+	_, err = client.Add(ctx, qqclient.Entity{Key: "team-a/y", Value: "b"})
+	assert.ErrorIs(t, err, httpClient.ErrQuotaExceeded)
+
+	_, err = client.Put(ctx, qqclient.Entity{Key: "team-a/y", Value: "b"})
+	assert.ErrorIs(t, err, httpClient.ErrQuotaExceeded)
+
+	_, err = client.Get(ctx, "team-a/x")
+	require.NoError(t, err)
+
+	_, err = client.Get(ctx, "team-a/x")
+	assert.ErrorIs(t, err, httpClient.ErrRateLimited)
+
+	req, err := http.NewRequest(http.MethodGet, testServer.URL+"/entities/team-a%2Fx", nil)
+	require.NoError(t, err)
+	req.Header.Set(auth.AuthorizationHeader, "ApiKey key")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1000", resp.Header.Get("Retry-After"))
+
+	usages, err := client.QuotaUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []httpClient.QuotaUsage{
+		{Namespace: "team-a", Keys: 1, Bytes: 9, MaxKeys: 1},
+		{User: "alice", Keys: 1, Bytes: 9},
+	}, usages)
+}
+
+func TestAuditRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	auditLog, err := auditqq.OpenFileLog(filepath.Join(t.TempDir(), "audit.log"), []byte("secret"))
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	policy, err := qq.ParsePolicy([]byte(`{"rules": [{"users": ["alice"], "actions": ["read", "write", "admin"]}]}`))
+	require.NoError(t, err)
+
+	database, err := qqRepo.NewDatabase()
+	require.NoError(t, err)
+
+	service, err := qq.NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), qq.Options{
+		Policy: policySource{policy: policy},
+		Audit:  auditLog,
+	})
+	require.NoError(t, err)
+
+	testServer := httptest.NewServer(newHandler(&server{
+		service:       service,
+		authenticator: auth.NewAPIKeys(map[string]string{"alice-key": "alice"}),
+	}))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{
+		ServerURL:   testServer.URL,
+		Credentials: &auth.Credentials{Scheme: auth.SchemeAPIKey, Token: "alice-key"},
+	})
+
+	_, err = client.Add(ctx, qqclient.Entity{Key: "a", Value: "1"})
+	require.NoError(t, err)
+	_, err = client.Add(ctx, qqclient.Entity{Key: "b", Value: "2"})
+	require.NoError(t, err)
+	_, err = client.Remove(ctx, "a")
+	require.NoError(t, err)
+
+	records, err := client.Audit(ctx, httpClient.AuditQuery{Key: "a", UserId: "alice", Since: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "add", records[0].Operation)
+	assert.Equal(t, "remove", records[1].Operation)
+	assert.Equal(t, "http", records[1].Transport)
+	assert.NotEmpty(t, records[1].RequestId)
+
+	verification, err := client.VerifyAudit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &httpClient.AuditVerification{Records: 3, Valid: true}, verification)
+
+	_, err = client.Audit(ctx, httpClient.AuditQuery{Limit: -1})
+	require.NoError(t, err, "non-positive limit is not sent")
+
+	req, err := http.NewRequest(http.MethodGet, testServer.URL+AuditPath+"?since=yesterday", nil)
+	require.NoError(t, err)
+	req.Header.Set(auth.AuthorizationHeader, "ApiKey alice-key")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
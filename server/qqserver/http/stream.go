@@ -0,0 +1,88 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"qq/pkg/qqclient"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/services/qq"
+	"strconv"
+	"strings"
+)
+
+// streamPageEntities is how many entities are read at a time, and so bounds
+// how many encoded entities are buffered before they are flushed to the client
+const streamPageEntities = 100
+
+// acceptsNDJSON reports whether the Accept header lists NDJSON with a
+// non-zero quality
+func acceptsNDJSON(req *http.Request) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil || mediaType != httpClient.NDJSONContentType {
+				continue
+			}
+
+			quality, err := strconv.ParseFloat(params["q"], 64)
+			if err == nil && quality == 0 {
+				continue
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleGetAllStreamRequest writes one entity per line, reading them a page at
+// a time instead of building the whole responce in memory, and ends with a
+// StreamTrailer. Once the first line is written the status can no longer
+// change, so an interrupted stream is told by the missing trailer.
+func handleGetAllStreamRequest(ctx context.Context, w http.ResponseWriter, service qq.Service) error {
+	w.Header().Set("Content-Type", httpClient.NDJSONContentType)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	count := 0
+	after := ""
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return fmt.Errorf("failed to stream entities: %w", err)
+		}
+
+		entities, next := service.Scan(ctx, after, streamPageEntities)
+
+		for _, entity := range entities {
+			err = encoder.Encode(qqclient.Entity{Key: entity.Key, Value: entity.Value})
+			if err != nil {
+				return fmt.Errorf("failed to write entity: %w", err)
+			}
+		}
+		count += len(entities)
+
+		if next == "" {
+			break
+		}
+		after = next
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	err := encoder.Encode(httpClient.StreamTrailer{Done: true, Count: count})
+	if err != nil {
+		return fmt.Errorf("failed to write trailer: %w", err)
+	}
+
+	return nil
+}
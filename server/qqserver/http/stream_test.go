@@ -0,0 +1,173 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"qq/models"
+	"qq/pkg/qqclient"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/services/qq"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsNDJSON(t *testing.T) {
+	testCases := []struct {
+		name   string
+		accept []string
+		exp    bool
+	}{
+		{
+			name:   "Missing",
+			accept: nil,
+			exp:    false,
+		},
+		{
+			name:   "Json",
+			accept: []string{"application/json"},
+			exp:    false,
+		},
+		{
+			name:   "NDJSON",
+			accept: []string{"application/x-ndjson"},
+			exp:    true,
+		},
+		{
+			name:   "List",
+			accept: []string{"application/json;q=0.5, application/x-ndjson;q=0.9"},
+			exp:    true,
+		},
+		{
+			name:   "SeveralHeaders",
+			accept: []string{"application/json", "application/x-ndjson"},
+			exp:    true,
+		},
+		{
+			name:   "Refused",
+			accept: []string{"application/x-ndjson;q=0, application/json"},
+			exp:    false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities", nil)
+			for _, accept := range testCase.accept {
+				req.Header.Add("Accept", accept)
+			}
+
+			assert.Equal(t, testCase.exp, acceptsNDJSON(req))
+		})
+	}
+}
+
+// scanMock pages through entities, which are in key order
+func scanMock(entities []models.Entity) func(ctx context.Context, after string, limit int) ([]models.Entity, string) {
+	return func(ctx context.Context, after string, limit int) ([]models.Entity, string) {
+		i := sort.Search(len(entities), func(i int) bool { return entities[i].Key > after })
+
+		if len(entities)-i <= limit {
+			return entities[i:], ""
+		}
+
+		page := entities[i : i+limit]
+		return page, page[len(page)-1].Key
+	}
+}
+
+func TestHandleGetAllStreamRequest(t *testing.T) {
+	service := qq.ServiceMock{
+		ScanMock: scanMock([]models.Entity{{Key: "a", Value: "b"}, {Key: "c\nd", Value: "e"}}),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/entities", nil)
+	req.Header.Set("Accept", httpClient.NDJSONContentType)
+
+	w := httptest.NewRecorder()
+
+	mux := newMux(&server{service: &service})
+	mux.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, httpClient.NDJSONContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+	assert.Equal(t, "{\"key\":\"a\",\"value\":\"b\"}\n{\"key\":\"c\\nd\",\"value\":\"e\"}\n{\"done\":true,\"count\":2}\n", w.Body.String())
+}
+
+func TestScanRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	const count = 3 * streamPageEntities / 2
+
+	entities := make([]models.Entity, 0, count)
+	for i := 0; i < count; i++ {
+		entities = append(entities, models.Entity{Key: fmt.Sprintf("a%04d", i), Value: "b"})
+	}
+
+	service := qq.ServiceMock{
+		ScanMock: scanMock(entities),
+	}
+
+	testServer := httptest.NewServer(newMux(&server{service: &service}))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	iterator, err := client.Scan(ctx)
+	require.NoError(t, err)
+	defer iterator.Close()
+
+	var scanned []qqclient.Entity
+	for iterator.Next() {
+		scanned = append(scanned, iterator.Entity())
+	}
+	require.NoError(t, iterator.Err())
+
+	require.Len(t, scanned, count)
+	assert.Equal(t, qqclient.Entity{Key: "a0000", Value: "b"}, scanned[0])
+	assert.Equal(t, qqclient.Entity{Key: fmt.Sprintf("a%04d", count-1), Value: "b"}, scanned[count-1])
+}
+
+func TestScanCutOff(t *testing.T) {
+	ctx := context.Background()
+
+	entities := make([]models.Entity, 0, 2*streamPageEntities)
+	for i := 0; i < 2*streamPageEntities; i++ {
+		entities = append(entities, models.Entity{Key: fmt.Sprintf("a%04d", i), Value: "b"})
+	}
+
+	scan := scanMock(entities)
+
+	// the server fails after the first page is flushed
+	service := qq.ServiceMock{
+		ScanMock: func(ctx context.Context, after string, limit int) ([]models.Entity, string) {
+			if after != "" {
+				panic("scan")
+			}
+			return scan(ctx, after, limit)
+		},
+	}
+
+	testServer := httptest.NewServer(newHandler(&server{service: &service}))
+	defer testServer.Close()
+
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	iterator, err := client.Scan(ctx)
+	require.NoError(t, err)
+	defer iterator.Close()
+
+	scanned := 0
+	for iterator.Next() {
+		scanned++
+	}
+
+	assert.Equal(t, streamPageEntities, scanned)
+	assert.ErrorIs(t, iterator.Err(), httpClient.ErrStreamTruncated)
+}
@@ -0,0 +1,461 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"qq/models"
+	"qq/pkg/log"
+	"qq/pkg/qqclient"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/pkg/qqclient/rabbitqq"
+	"qq/pkg/qqcontext"
+	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+const WebSocketPath = "/ws"
+
+// WebSocketAuthorizationParam carries the credentials of the WebSocket
+// endpoint as in the Authorization header, e.g. "ApiKey <key>", for the
+// browsers that cannot set it
+const WebSocketAuthorizationParam = "authorization"
+
+const (
+	maxWebSocketMessageBytes = 1 << 20
+	maxWebSocketWatches      = 16
+)
+
+var errBadWebSocketRequest = errors.New("bad request")
+
+type webSocketCommand struct {
+	operation string
+	handle    func(session *webSocketSession, ctx context.Context, request httpClient.WebSocketRequest) (any, error)
+}
+
+// webSocketCommands mirror the messages of the RabbitMQ server; operations
+// name them for metrics and rate limits after the other transports
+var webSocketCommands = map[string]webSocketCommand{
+	rabbitqq.AddMessageName:       {operation: "add", handle: (*webSocketSession).add},
+	rabbitqq.RemoveMessageName:    {operation: "remove", handle: (*webSocketSession).remove},
+	rabbitqq.GetMessageName:       {operation: "get", handle: (*webSocketSession).get},
+	rabbitqq.GetAllMessageName:    {operation: "get_all", handle: (*webSocketSession).getAll},
+	httpClient.WatchMessageName:   {operation: "watch", handle: (*webSocketSession).watch},
+	httpClient.UnwatchMessageName: {operation: "unwatch", handle: (*webSocketSession).unwatch},
+}
+
+// webSocket upgrades the request once the middlewares have authenticated and
+// admitted it; the commands are then handled one after the other, while
+// the changes of the watches are pushed as they come
+func (s server) webSocket(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		err := writeErrorResponce(w, http.StatusBadRequest, httpClient.ErrorCodeBadRequest, "expected a WebSocket upgrade", nil)
+		if err != nil {
+			log.Error(ctx, "failed to handle WebSocket request", log.Args{"error": err})
+		}
+		return
+	}
+
+	wsServer := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return s.checkOrigin(req)
+		},
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = maxWebSocketMessageBytes
+
+			session := &webSocketSession{
+				service: s.service,
+				metrics: s.metrics,
+				conn:    conn,
+				watches: map[string]*webSocketWatch{},
+			}
+
+			session.serve(qqcontext.WithTransportValue(ctx, metrics.TransportWebSocket))
+		},
+	}
+
+	wsServer.ServeHTTP(w, req)
+}
+
+// checkOrigin accepts the pages of the server and of the allowed origins,
+// so that other pages cannot connect with the cookies or the client
+// certificate of the browser. Browsers always send an origin; other
+// clients need not.
+func (s server) checkOrigin(req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" || s.webSocketOrigins[strings.ToLower(origin)] {
+		return nil
+	}
+
+	parsed, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(parsed.Host, req.Host) {
+		return nil
+	}
+
+	log.Warning(req.Context(), "rejected WebSocket origin", log.Args{"origin": origin})
+
+	return fmt.Errorf("origin %q is not allowed", origin)
+}
+
+type webSocketWatch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type webSocketSession struct {
+	service qq.Service
+	metrics metrics.Metrics
+	conn    *websocket.Conn
+
+	mu      sync.Mutex
+	watches map[string]*webSocketWatch
+}
+
+func (session *webSocketSession) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	// the watches end before the connection is closed
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	for {
+		var data []byte
+
+		err := websocket.Message.Receive(session.conn, &data)
+		if errors.Is(err, websocket.ErrFrameTooLarge) {
+			session.send(ctx, session.errorReply(ctx, httpClient.WebSocketRequest{}, fmt.Errorf("%w: message too large", errBadWebSocketRequest)))
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			log.Warning(ctx, "failed to read WebSocket message", log.Args{"error": err})
+			return
+		}
+
+		var request httpClient.WebSocketRequest
+
+		err = json.Unmarshal(data, &request)
+		if err != nil {
+			session.send(ctx, session.errorReply(ctx, request, fmt.Errorf("%w: invalid JSON", errBadWebSocketRequest)))
+			continue
+		}
+
+		session.handle(ctx, &wg, request)
+	}
+}
+
+// handle runs a command with the admitted context, and sends its reply
+func (session *webSocketSession) handle(ctx context.Context, wg *sync.WaitGroup, request httpClient.WebSocketRequest) {
+	command, ok := webSocketCommands[request.Name]
+
+	operation := "unknown"
+	if ok {
+		operation = command.operation
+	}
+
+	requestId := request.Id
+	if !qqcontext.ValidRequestId(requestId) {
+		requestId = qqcontext.NewRequestId()
+	}
+
+	ctx = qqcontext.WithRequestIdValue(ctx, requestId)
+
+	handled := qqserver.Request{
+		Transport: metrics.TransportWebSocket,
+		Operation: operation,
+		Name:      request.Name,
+		Metrics:   session.metrics,
+	}
+
+	var reply any
+
+	err := qqserver.Handle(ctx, handled, func(ctx context.Context) error {
+		if !ok {
+			return fmt.Errorf("%w: unknown name %q", errBadWebSocketRequest, request.Name)
+		}
+
+		// ending a watch is always allowed
+		if request.Name != httpClient.UnwatchMessageName {
+			err := qqserver.Admit(ctx, session.service, command.operation)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		reply, err = command.handle(session, ctx, request)
+		return err
+	})
+	if err != nil {
+		reply = session.errorReply(ctx, request, err)
+	}
+
+	session.send(ctx, reply)
+
+	// the changes follow the reply to the watch
+	watch, ok := reply.(webSocketWatchReply)
+	if ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.push(watch)
+		}()
+	}
+}
+
+func (session *webSocketSession) send(ctx context.Context, reply any) {
+	err := websocket.JSON.Send(session.conn, reply)
+	if err != nil {
+		log.Warning(ctx, "failed to write WebSocket message", log.Args{"error": err})
+	}
+}
+
+// errorReply maps the errors of the commands and of the service to the
+// error codes of the other endpoints
+func (session *webSocketSession) errorReply(ctx context.Context, request httpClient.WebSocketRequest, err error) httpClient.WebSocketReply {
+	replyErr := &httpClient.Error{
+		RequestId: qqcontext.GetRequestIdValue(ctx),
+	}
+
+	var rateLimitErr *qq.RateLimitError
+
+	switch {
+	case errors.Is(err, errBadWebSocketRequest):
+		replyErr.Code = httpClient.ErrorCodeBadRequest
+		replyErr.Message = err.Error()
+	case errors.Is(err, qq.ErrPermissionDenied):
+		replyErr.Code = httpClient.ErrorCodePermissionDenied
+		replyErr.Message = "permission denied"
+		replyErr.Details = map[string]string{"key": request.Key}
+	case errors.As(err, &rateLimitErr):
+		replyErr.Code = httpClient.ErrorCodeRateLimited
+		replyErr.Message = "rate limited"
+		replyErr.Details = map[string]string{"retry_after": strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds())))}
+	case errors.Is(err, qq.ErrQuotaExceeded):
+		replyErr.Code = httpClient.ErrorCodeQuotaExceeded
+		replyErr.Message = "quota exceeded"
+		replyErr.Details = map[string]string{"error": err.Error()}
+	default:
+		replyErr.Code = httpClient.ErrorCodeInternal
+		replyErr.Message = "internal server error"
+	}
+
+	return httpClient.WebSocketReply{Id: request.Id, Name: request.Name, Error: replyErr}
+}
+
+func baseReply(request httpClient.WebSocketRequest) httpClient.WebSocketReply {
+	return httpClient.WebSocketReply{Id: request.Id, Name: request.Name}
+}
+
+func validWebSocketKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: key is empty", errBadWebSocketRequest)
+	}
+
+	return nil
+}
+
+func (session *webSocketSession) add(ctx context.Context, request httpClient.WebSocketRequest) (any, error) {
+	err := validWebSocketKey(request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	entity := models.Entity{Key: request.Key, Value: request.Value}
+
+	err = session.service.Authorize(ctx, qq.ActionWrite, entity.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = session.service.CheckQuota(ctx, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	return httpClient.WebSocketAddReply{
+		WebSocketReply: baseReply(request),
+		Added:          session.service.Add(ctx, entity),
+	}, nil
+}
+
+func (session *webSocketSession) remove(ctx context.Context, request httpClient.WebSocketRequest) (any, error) {
+	err := validWebSocketKey(request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = session.service.Authorize(ctx, qq.ActionWrite, request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return httpClient.WebSocketRemoveReply{
+		WebSocketReply: baseReply(request),
+		Removed:        session.service.Remove(ctx, request.Key),
+	}, nil
+}
+
+func (session *webSocketSession) get(ctx context.Context, request httpClient.WebSocketRequest) (any, error) {
+	err := validWebSocketKey(request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = session.service.Authorize(ctx, qq.ActionRead, request.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := httpClient.WebSocketGetReply{WebSocketReply: baseReply(request)}
+
+	entity := session.service.Get(ctx, request.Key)
+	if entity != nil {
+		reply.Value = &entity.Value
+	}
+
+	return reply, nil
+}
+
+// getAll replies with a page of streamPageEntities keys instead of every
+// entity, as the NDJSON stream reads them
+func (session *webSocketSession) getAll(ctx context.Context, request httpClient.WebSocketRequest) (any, error) {
+	entities, next := session.service.Scan(ctx, request.After, streamPageEntities)
+
+	reply := httpClient.WebSocketGetAllReply{
+		WebSocketReply: baseReply(request),
+		Entities:       make([]qqclient.Entity, 0, len(entities)),
+		Next:           next,
+	}
+
+	for _, entity := range entities {
+		reply.Entities = append(reply.Entities, qqclient.Entity{Key: entity.Key, Value: entity.Value})
+	}
+
+	return reply, nil
+}
+
+// webSocketWatchReply is sent as the reply to the watch, and then tells
+// handle to push its changes
+type webSocketWatchReply struct {
+	httpClient.WebSocketReply
+	ctx     context.Context
+	changes <-chan qq.Change
+	watch   *webSocketWatch
+}
+
+func (reply webSocketWatchReply) MarshalJSON() ([]byte, error) {
+	return json.Marshal(reply.WebSocketReply)
+}
+
+func (session *webSocketSession) watch(ctx context.Context, request httpClient.WebSocketRequest) (any, error) {
+	if request.Id == "" {
+		return nil, fmt.Errorf("%w: watch without id", errBadWebSocketRequest)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	_, exists := session.watches[request.Id]
+	if exists {
+		return nil, fmt.Errorf("%w: watch %q exists", errBadWebSocketRequest, request.Id)
+	}
+
+	if len(session.watches) >= maxWebSocketWatches {
+		return nil, fmt.Errorf("%w: more than %d watches", errBadWebSocketRequest, maxWebSocketWatches)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	watch := &webSocketWatch{cancel: cancel, done: make(chan struct{})}
+	session.watches[request.Id] = watch
+
+	return webSocketWatchReply{
+		WebSocketReply: baseReply(request),
+		ctx:            ctx,
+		changes:        session.service.Watch(ctx, request.Prefix),
+		watch:          watch,
+	}, nil
+}
+
+// push sends the changes of a watch until it is ended by unwatch, by the
+// connection closing, or by falling behind, which is sent as an unwatch
+// with ErrorCodeFellBehind
+func (session *webSocketSession) push(reply webSocketWatchReply) {
+	defer close(reply.watch.done)
+
+	for change := range reply.changes {
+		if reply.ctx.Err() != nil {
+			return
+		}
+
+		message := httpClient.WebSocketChange{
+			Id:   reply.Id,
+			Name: httpClient.ChangeMessageName,
+			Type: string(change.Type),
+			Key:  change.Key,
+		}
+		if change.Entity != nil {
+			message.Value = &change.Entity.Value
+		}
+
+		session.send(reply.ctx, message)
+	}
+
+	// the watch may have been ended by unwatch meanwhile
+	session.mu.Lock()
+	current := session.watches[reply.Id]
+	if current == reply.watch {
+		delete(session.watches, reply.Id)
+	}
+	session.mu.Unlock()
+
+	if current != reply.watch || reply.ctx.Err() != nil {
+		return
+	}
+
+	reply.watch.cancel()
+
+	session.send(reply.ctx, httpClient.WebSocketReply{
+		Id:   reply.Id,
+		Name: httpClient.UnwatchMessageName,
+		Error: &httpClient.Error{
+			Code:      httpClient.ErrorCodeFellBehind,
+			Message:   "watcher fell behind",
+			RequestId: qqcontext.GetRequestIdValue(reply.ctx),
+		},
+	})
+}
+
+// unwatch replies once the watch has pushed its last change
+func (session *webSocketSession) unwatch(ctx context.Context, request httpClient.WebSocketRequest) (any, error) {
+	session.mu.Lock()
+	watch, ok := session.watches[request.Watch]
+	delete(session.watches, request.Watch)
+	session.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: no watch %q", errBadWebSocketRequest, request.Watch)
+	}
+
+	watch.cancel()
+	<-watch.done
+
+	return baseReply(request), nil
+}
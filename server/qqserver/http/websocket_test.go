@@ -0,0 +1,468 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/qqclient"
+	httpClient "qq/pkg/qqclient/http"
+	"qq/pkg/qqcontext"
+	"qq/pkg/qqtls"
+	"qq/pkg/qqtls/qqtlstest"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"qq/services/qq/qqtest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+type webSocketTestConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// newWebSocketConfig configures a connection to the WebSocket endpoint of
+// testServer from a page of origin, with query added to the upgrade request
+func newWebSocketConfig(t *testing.T, testServer *httptest.Server, origin string, query url.Values) *websocket.Config {
+	config, err := websocket.NewConfig(strings.Replace(testServer.URL, "http", "ws", 1)+WebSocketPath+"?"+query.Encode(), origin)
+	require.NoError(t, err)
+
+	return config
+}
+
+// dialWebSocket connects to the WebSocket endpoint of testServer with query
+// and header added to the upgrade request
+func dialWebSocket(t *testing.T, testServer *httptest.Server, query url.Values, header http.Header) (*webSocketTestConn, error) {
+	config := newWebSocketConfig(t, testServer, testServer.URL, query)
+	config.Header = header
+
+	return dialWebSocketConfig(t, config)
+}
+
+func dialWebSocketConfig(t *testing.T, config *websocket.Config) (*webSocketTestConn, error) {
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &webSocketTestConn{t: t, conn: conn}, nil
+}
+
+// do sends request and returns the next message, without the request id of
+// its error, which may be generated
+func (c *webSocketTestConn) do(request string) string {
+	c.t.Helper()
+
+	require.NoError(c.t, websocket.Message.Send(c.conn, request))
+
+	return c.receive()
+}
+
+func (c *webSocketTestConn) receive() string {
+	c.t.Helper()
+
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	var message map[string]any
+	require.NoError(c.t, websocket.JSON.Receive(c.conn, &message))
+
+	replyErr, ok := message["error"].(map[string]any)
+	if ok {
+		delete(replyErr, "request_id")
+	}
+
+	data, err := json.Marshal(message)
+	require.NoError(c.t, err)
+
+	return string(data)
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	testServer := httptest.NewServer(newHandler(&server{
+		service: qqtest.NewService(t),
+		metrics: metrics.New(nil, nil),
+	}))
+	defer testServer.Close()
+
+	conn, err := dialWebSocket(t, testServer, nil, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		request  string
+		expReply string
+	}{
+		{
+			name:     "add",
+			request:  `{"id":"1","name":"add","key":"a","value":"1"}`,
+			expReply: `{"id":"1","name":"add","added":true}`,
+		},
+		{
+			name:     "get",
+			request:  `{"id":"2","name":"get","key":"a"}`,
+			expReply: `{"id":"2","name":"get","value":"1"}`,
+		},
+		{
+			name:     "get missing key",
+			request:  `{"id":"3","name":"get","key":"b"}`,
+			expReply: `{"id":"3","name":"get","value":null}`,
+		},
+		{
+			name:     "get all",
+			request:  `{"id":"4","name":"get all"}`,
+			expReply: `{"id":"4","name":"get all","entities":[{"key":"a","value":"1"}]}`,
+		},
+		{
+			name:     "remove",
+			request:  `{"id":"5","name":"remove","key":"a"}`,
+			expReply: `{"id":"5","name":"remove","removed":true}`,
+		},
+		{
+			name:     "empty key",
+			request:  `{"id":"6","name":"get"}`,
+			expReply: `{"id":"6","name":"get","error":{"code":"bad_request","message":"bad request: key is empty"}}`,
+		},
+		{
+			name:     "unknown name",
+			request:  `{"id":"7","name":"health"}`,
+			expReply: `{"id":"7","name":"health","error":{"code":"bad_request","message":"bad request: unknown name \"health\""}}`,
+		},
+		{
+			name:     "invalid JSON",
+			request:  `{"id":`,
+			expReply: `{"id":"","name":"","error":{"code":"bad_request","message":"bad request: invalid JSON"}}`,
+		},
+		{
+			name:     "unknown watch",
+			request:  `{"id":"8","name":"unwatch","watch":"1"}`,
+			expReply: `{"id":"8","name":"unwatch","error":{"code":"bad_request","message":"bad request: no watch \"1\""}}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.JSONEq(t, testCase.expReply, conn.do(testCase.request))
+		})
+	}
+}
+
+func TestWebSocketGetAllPages(t *testing.T) {
+	ctx := context.Background()
+
+	service := qqtest.NewService(t)
+	for i := 0; i < 2*streamPageEntities+1; i++ {
+		service.Add(ctx, models.Entity{Key: fmt.Sprintf("key-%03d", i), Value: "1"})
+	}
+
+	testServer := httptest.NewServer(newHandler(&server{service: service}))
+	defer testServer.Close()
+
+	conn, err := dialWebSocket(t, testServer, nil, nil)
+	require.NoError(t, err)
+
+	var keys []string
+	request := httpClient.WebSocketRequest{Id: "1", Name: "get all"}
+
+	for pages := 1; ; pages++ {
+		require.NoError(t, websocket.JSON.Send(conn.conn, request))
+
+		var reply httpClient.WebSocketGetAllReply
+		require.NoError(t, websocket.JSON.Receive(conn.conn, &reply))
+		require.Nil(t, reply.Error)
+
+		for _, entity := range reply.Entities {
+			keys = append(keys, entity.Key)
+		}
+
+		if reply.Next == "" {
+			assert.Equal(t, 3, pages)
+			break
+		}
+		request.After = reply.Next
+	}
+
+	require.Len(t, keys, 2*streamPageEntities+1)
+	assert.Equal(t, "key-000", keys[0])
+	assert.Equal(t, fmt.Sprintf("key-%03d", 2*streamPageEntities), keys[len(keys)-1])
+}
+
+func TestWebSocketWatch(t *testing.T) {
+	ctx := context.Background()
+
+	testServer := httptest.NewServer(newHandler(&server{service: qqtest.NewService(t)}))
+	defer testServer.Close()
+
+	conn, err := dialWebSocket(t, testServer, nil, nil)
+	require.NoError(t, err)
+
+	// the writes come from another transport
+	client := httpClient.NewClientWithOptions(ctx, httpClient.Options{ServerURL: testServer.URL})
+
+	assert.JSONEq(t, `{"id":"w","name":"watch"}`, conn.do(`{"id":"w","name":"watch","prefix":"a"}`))
+	assert.JSONEq(t,
+		`{"id":"w","name":"watch","error":{"code":"bad_request","message":"bad request: watch \"w\" exists"}}`,
+		conn.do(`{"id":"w","name":"watch","prefix":"b"}`),
+	)
+
+	_, err = client.Add(ctx, qqclient.Entity{Key: "a1", Value: "1"})
+	require.NoError(t, err)
+	_, err = client.Add(ctx, qqclient.Entity{Key: "b1", Value: "1"})
+	require.NoError(t, err)
+	_, err = client.Remove(ctx, "a1")
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"id":"w","name":"change","type":"put","key":"a1","value":"1"}`, conn.receive())
+	assert.JSONEq(t, `{"id":"w","name":"change","type":"remove","key":"a1","value":null}`, conn.receive())
+
+	assert.JSONEq(t, `{"id":"u","name":"unwatch"}`, conn.do(`{"id":"u","name":"unwatch","watch":"w"}`))
+
+	_, err = client.Add(ctx, qqclient.Entity{Key: "a2", Value: "2"})
+	require.NoError(t, err)
+
+	// no change is pushed after the unwatch
+	assert.JSONEq(t, `{"id":"g","name":"get","value":"2"}`, conn.do(`{"id":"g","name":"get","key":"a2"}`))
+}
+
+func TestWebSocketAuthentication(t *testing.T) {
+	var userId string
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			userId = qqcontext.GetUserIdValue(ctx)
+			return nil
+		},
+	}
+
+	testServer := httptest.NewServer(newHandler(&server{
+		service:       &service,
+		authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"}),
+	}))
+	defer testServer.Close()
+
+	testCases := []struct {
+		name      string
+		query     url.Values
+		header    http.Header
+		expFailed bool
+	}{
+		{
+			name:      "no credentials",
+			expFailed: true,
+		},
+		{
+			name:      "invalid credentials",
+			query:     url.Values{WebSocketAuthorizationParam: {"ApiKey wrong"}},
+			expFailed: true,
+		},
+		{
+			name:  "credentials in the query",
+			query: url.Values{WebSocketAuthorizationParam: {"ApiKey key"}},
+		},
+		{
+			name:   "credentials in the header",
+			header: http.Header{auth.AuthorizationHeader: {"ApiKey key"}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			userId = ""
+
+			conn, err := dialWebSocket(t, testServer, testCase.query, testCase.header)
+			if testCase.expFailed {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.JSONEq(t, `{"id":"1","name":"get","value":null}`, conn.do(`{"id":"1","name":"get","key":"a"}`))
+			assert.Equal(t, "alice", userId)
+		})
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	testServer := httptest.NewServer(newHandler(&server{
+		service:          &qq.ServiceMock{},
+		webSocketOrigins: map[string]bool{"https://app.example.com": true},
+	}))
+	defer testServer.Close()
+
+	testCases := []struct {
+		name      string
+		origin    string
+		expFailed bool
+	}{
+		{
+			name:   "same origin",
+			origin: testServer.URL,
+		},
+		{
+			name:   "allowed origin",
+			origin: "https://app.example.com",
+		},
+		{
+			name:   "allowed origin in upper case",
+			origin: "https://APP.example.com",
+		},
+		{
+			name:      "other origin",
+			origin:    "https://evil.example.com",
+			expFailed: true,
+		},
+		{
+			name:      "other port",
+			origin:    "https://app.example.com:8443",
+			expFailed: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := dialWebSocketConfig(t, newWebSocketConfig(t, testServer, testCase.origin, nil))
+			if testCase.expFailed {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestWebSocketClientCertificate(t *testing.T) {
+	ca := qqtlstest.NewCA(t)
+	serverCertPath, serverKeyPath := ca.Issue(t, t.TempDir(), "localhost")
+	clientCertPath, clientKeyPath := ca.Issue(t, t.TempDir(), "alice")
+
+	serverCertificate, err := qqtls.LoadCertificateFile(serverCertPath, serverKeyPath)
+	require.NoError(t, err)
+
+	tlsConfig, err := qqtls.ServerConfig(qqtls.ServerOptions{Certificate: serverCertificate, ClientCAFile: ca.CertPath})
+	require.NoError(t, err)
+
+	var userId string
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			userId = qqcontext.GetUserIdValue(ctx)
+			return nil
+		},
+	}
+
+	testServer := httptest.NewUnstartedServer(newHandler(&server{
+		service:       &service,
+		authenticator: auth.NewAPIKeys(map[string]string{"key": "bob"}),
+	}))
+	tlsConfig.Certificates = []tls.Certificate{*serverCertificate.Certificate()}
+	testServer.TLS = tlsConfig
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	clientCertificate, err := qqtls.LoadCertificateFile(clientCertPath, clientKeyPath)
+	require.NoError(t, err)
+
+	clientConfig, err := qqtls.ClientConfig(qqtls.ClientOptions{CAFile: ca.CertPath, Certificate: clientCertificate})
+	require.NoError(t, err)
+
+	// the certificate alone does not authenticate the connection
+	config := newWebSocketConfig(t, testServer, testServer.URL, nil)
+	config.TlsConfig = clientConfig
+
+	_, err = dialWebSocketConfig(t, config)
+	assert.Error(t, err)
+
+	config = newWebSocketConfig(t, testServer, testServer.URL, url.Values{WebSocketAuthorizationParam: {"ApiKey key"}})
+	config.TlsConfig = clientConfig
+
+	conn, err := dialWebSocketConfig(t, config)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"id":"1","name":"get","value":null}`, conn.do(`{"id":"1","name":"get","key":"a"}`))
+	assert.Equal(t, "bob", userId)
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	service := qq.ServiceMock{
+		AuthorizeMock: func(ctx context.Context, action qq.Action, key string) error {
+			if key == "denied" {
+				return qq.ErrPermissionDenied
+			}
+			return nil
+		},
+		AdmitMock: func(ctx context.Context, operation string) error {
+			if operation == "remove" {
+				return &qq.RateLimitError{RetryAfter: time.Second}
+			}
+			return nil
+		},
+		CheckQuotaMock: func(ctx context.Context, entity models.Entity) error {
+			return qq.ErrQuotaExceeded
+		},
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			panic("get")
+		},
+	}
+
+	testServer := httptest.NewServer(newHandler(&server{service: &service}))
+	defer testServer.Close()
+
+	conn, err := dialWebSocket(t, testServer, nil, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		request  string
+		expReply string
+	}{
+		{
+			name:     "permission denied",
+			request:  `{"id":"1","name":"get","key":"denied"}`,
+			expReply: `{"id":"1","name":"get","error":{"code":"permission_denied","message":"permission denied","details":{"key":"denied"}}}`,
+		},
+		{
+			name:     "rate limited",
+			request:  `{"id":"2","name":"remove","key":"a"}`,
+			expReply: `{"id":"2","name":"remove","error":{"code":"rate_limited","message":"rate limited","details":{"retry_after":"1"}}}`,
+		},
+		{
+			name:     "quota exceeded",
+			request:  `{"id":"3","name":"add","key":"a","value":"1"}`,
+			expReply: `{"id":"3","name":"add","error":{"code":"quota_exceeded","message":"quota exceeded","details":{"error":"quota exceeded"}}}`,
+		},
+		{
+			name:     "panic",
+			request:  `{"id":"4","name":"get","key":"a"}`,
+			expReply: `{"id":"4","name":"get","error":{"code":"internal","message":"internal server error"}}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.JSONEq(t, testCase.expReply, conn.do(testCase.request))
+		})
+	}
+}
+
+func TestWebSocketWithoutUpgrade(t *testing.T) {
+	testServer := httptest.NewServer(newHandler(&server{service: &qq.ServiceMock{}}))
+	defer testServer.Close()
+
+	resp, err := http.Get(testServer.URL + WebSocketPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,330 @@
+package memcacheqq
+
+import (
+	"context"
+	"errors"
+	"math"
+	"qq/models"
+	"qq/pkg/version"
+	"qq/services/qq"
+	"strconv"
+	"time"
+)
+
+// connectionOperation names the commands that manage the connection; they
+// are recorded in the metrics but not rate limited
+const connectionOperation = "connection"
+
+// maxRelativeExpiration is the largest exptime taken as seconds from now;
+// larger ones are Unix times, as in memcached
+const maxRelativeExpiration = 60 * 60 * 24 * 30
+
+type command struct {
+	// operation names the command for metrics and rate limits after the
+	// operations of the other transports
+	operation string
+	// minArgs and maxArgs count the arguments after the name, noreply aside
+	minArgs int
+	maxArgs int
+	// storage commands are followed by a data block
+	storage bool
+	handle  func(s *server, ctx context.Context, c *connection, request request) error
+}
+
+var commands = map[string]command{
+	"get":     {operation: "get", minArgs: 1, maxArgs: math.MaxInt, handle: (*server).get},
+	"gets":    {operation: "get", minArgs: 1, maxArgs: math.MaxInt, handle: (*server).gets},
+	"set":     {operation: "add", minArgs: 4, maxArgs: 4, storage: true, handle: (*server).set},
+	"add":     {operation: "add", minArgs: 4, maxArgs: 4, storage: true, handle: (*server).add},
+	"replace": {operation: "add", minArgs: 4, maxArgs: 4, storage: true, handle: (*server).replace},
+	"cas":     {operation: "add", minArgs: 5, maxArgs: 5, storage: true, handle: (*server).cas},
+	"delete":  {operation: "remove", minArgs: 1, maxArgs: 1, handle: (*server).delete},
+	"touch":   {operation: "touch", minArgs: 2, maxArgs: 2, handle: (*server).touch},
+	"version": {operation: connectionOperation, handle: (*server).version},
+	"quit":    {operation: connectionOperation, handle: (*server).quit},
+}
+
+// the outcomes of a write that are replied as they are, aborting the update
+// of the entity
+var (
+	errNotStored = errors.New("NOT_STORED")
+	errExists    = errors.New("EXISTS")
+	errNotFound  = errors.New("NOT_FOUND")
+)
+
+func isOutcome(err error) bool {
+	return errors.Is(err, errNotStored) || errors.Is(err, errExists) || errors.Is(err, errNotFound)
+}
+
+func (s *server) get(ctx context.Context, c *connection, request request) error {
+	return s.retrieve(ctx, c, request.args, false)
+}
+
+// gets also writes the version of each entity as its cas unique
+func (s *server) gets(ctx context.Context, c *connection, request request) error {
+	return s.retrieve(ctx, c, request.args, true)
+}
+
+// retrieve refuses the whole command when any of the keys may not be read
+func (s *server) retrieve(ctx context.Context, c *connection, keys []string, withCas bool) error {
+	for _, key := range keys {
+		err := validKey(key)
+		if err != nil {
+			return err
+		}
+
+		err = s.service.Authorize(ctx, qq.ActionRead, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, entity := range s.service.GetBatch(ctx, keys) {
+		if entity == nil {
+			continue
+		}
+
+		line := "VALUE " + keys[i] +
+			" " + strconv.FormatUint(uint64(s.items.flags(entity.Key, entity.Version)), 10) +
+			" " + strconv.Itoa(len(entity.Value))
+		if withCas {
+			line += " " + strconv.FormatUint(entity.Version, 10)
+		}
+
+		c.writer.WriteString(line + "\r\n" + entity.Value + "\r\n")
+	}
+
+	c.writer.WriteString("END\r\n")
+
+	return nil
+}
+
+func (s *server) set(ctx context.Context, c *connection, request request) error {
+	return s.store(ctx, c, request, func(current *models.Entity) error {
+		return nil
+	})
+}
+
+func (s *server) add(ctx context.Context, c *connection, request request) error {
+	return s.store(ctx, c, request, func(current *models.Entity) error {
+		if current != nil {
+			return errNotStored
+		}
+
+		return nil
+	})
+}
+
+func (s *server) replace(ctx context.Context, c *connection, request request) error {
+	return s.store(ctx, c, request, func(current *models.Entity) error {
+		if current == nil {
+			return errNotStored
+		}
+
+		return nil
+	})
+}
+
+// cas stores the value only when the entity is still at the version read by
+// gets
+func (s *server) cas(ctx context.Context, c *connection, request request) error {
+	unique, err := strconv.ParseUint(request.args[4], 10, 64)
+	if err != nil {
+		return errBadFormat
+	}
+
+	return s.store(ctx, c, request, func(current *models.Entity) error {
+		if current == nil {
+			return errNotFound
+		}
+
+		if current.Version != unique {
+			return errExists
+		}
+
+		return nil
+	})
+}
+
+// store writes the data of a storage command when condition allows it;
+// a value stored already expired is removed instead
+func (s *server) store(ctx context.Context, c *connection, request request, condition func(current *models.Entity) error) error {
+	key := request.args[0]
+
+	err := validKey(key)
+	if err != nil {
+		return err
+	}
+
+	flags, err := strconv.ParseUint(request.args[1], 10, 32)
+	if err != nil {
+		return errBadFormat
+	}
+
+	ttl, expired, err := parseExpiration(request.args[2])
+	if err != nil {
+		return err
+	}
+
+	entity, err := s.service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+		err := condition(current)
+		if err != nil {
+			return nil, err
+		}
+
+		if expired {
+			return nil, nil
+		}
+
+		return &models.Entity{Key: key, Value: request.data}, nil
+	})
+	if isOutcome(err) {
+		c.reply(request, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the flags of a removed entity are dropped once Watch tells
+	if expired {
+		c.reply(request, "STORED")
+		return nil
+	}
+
+	s.items.store(entity.Key, entity.Version, uint32(flags))
+
+	// writing the entity dropped its previous expiration
+	if ttl != 0 {
+		err = s.service.Expire(ctx, key, entity.Version, ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.reply(request, "STORED")
+
+	return nil
+}
+
+func (s *server) delete(ctx context.Context, c *connection, request request) error {
+	key := request.args[0]
+
+	err := validKey(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+		if current == nil {
+			return nil, errNotFound
+		}
+
+		return nil, nil
+	})
+	if isOutcome(err) {
+		c.reply(request, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.reply(request, "DELETED")
+
+	return nil
+}
+
+// touch replaces the expiration without writing the entity, so its cas
+// unique stays the same
+func (s *server) touch(ctx context.Context, c *connection, request request) error {
+	key := request.args[0]
+
+	err := validKey(key)
+	if err != nil {
+		return err
+	}
+
+	ttl, expired, err := parseExpiration(request.args[1])
+	if err != nil {
+		return err
+	}
+
+	err = s.service.Authorize(ctx, qq.ActionWrite, key)
+	if err != nil {
+		return err
+	}
+
+	entity := s.service.Get(ctx, key)
+	if entity == nil {
+		c.reply(request, errNotFound.Error())
+		return nil
+	}
+
+	if expired {
+		err = s.removeVersion(ctx, key, entity.Version)
+	} else {
+		// the flags belong to the version, which touch keeps
+		err = s.service.Expire(ctx, key, entity.Version, ttl)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.reply(request, "TOUCHED")
+
+	return nil
+}
+
+func (s *server) version(ctx context.Context, c *connection, request request) error {
+	c.reply(request, "VERSION "+version.Get().Version)
+
+	return nil
+}
+
+func (s *server) quit(ctx context.Context, c *connection, request request) error {
+	c.closing = true
+
+	return nil
+}
+
+// parseExpiration returns the TTL of an exptime, zero when it never
+// expires, or whether it has expired already
+func parseExpiration(value string) (time.Duration, bool, error) {
+	exptime, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, errBadFormat
+	}
+
+	switch {
+	case exptime == 0:
+		return 0, false, nil
+	case exptime < 0:
+		return 0, true, nil
+	case exptime <= maxRelativeExpiration:
+		return time.Duration(exptime) * time.Second, false, nil
+	}
+
+	ttl := time.Until(time.Unix(exptime, 0))
+	if ttl <= 0 {
+		return 0, true, nil
+	}
+
+	return ttl, false, nil
+}
+
+// removeVersion removes key unless it has been written since version
+func (s *server) removeVersion(ctx context.Context, key string, version uint64) error {
+	_, err := s.service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+		if current == nil || current.Version != version {
+			return nil, errNotFound
+		}
+
+		return nil, nil
+	})
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,390 @@
+package memcacheqq
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/qqcontext"
+	"qq/services/qq"
+	"qq/services/qq/qqtest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// step sends request and expects the exact reply, which is empty for the
+// requests sent with noreply
+type step struct {
+	request string
+	reply   string
+}
+
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dial serves service on a loopback port and connects to it
+func dial(t *testing.T, service qq.Service, options Options) *testConn {
+	_, conn := serve(t, service, options)
+	return conn
+}
+
+// serve is dial that also returns the server
+func serve(t *testing.T, service qq.Service, options Options) (*server, *testConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := newServer(listener.Addr().String(), service, options)
+	go func() {
+		_ = s.serve(listener)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return s, &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends request and reads a reply of as many bytes as exp
+func (c *testConn) do(request string, exp string) {
+	c.t.Helper()
+
+	_, err := c.conn.Write([]byte(request))
+	require.NoError(c.t, err)
+
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	reply := make([]byte, len(exp))
+	_, err = io.ReadFull(c.reader, reply)
+	require.NoError(c.t, err, "request %q, read %q", request, reply)
+
+	assert.Equal(c.t, exp, string(reply), "request %q", request)
+}
+
+// get returns the whole reply of getting key
+func (c *testConn) get(key string) (string, error) {
+	_, err := c.conn.Write([]byte("get " + key + "\r\n"))
+	if err != nil {
+		return "", err
+	}
+
+	err = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		return "", err
+	}
+
+	var reply string
+
+	for !strings.HasSuffix(reply, "END\r\n") {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		reply += line
+	}
+
+	return reply, nil
+}
+
+// version returns the cas unique of key
+func (c *testConn) version(key string) uint64 {
+	c.t.Helper()
+
+	_, err := c.conn.Write([]byte("gets " + key + "\r\n"))
+	require.NoError(c.t, err)
+
+	line, err := c.reader.ReadString('\n')
+	require.NoError(c.t, err)
+
+	var name string
+	var flags, length int
+	var unique uint64
+
+	_, err = fmt.Sscanf(line, "VALUE %s %d %d %d\r\n", &name, &flags, &length, &unique)
+	require.NoError(c.t, err, line)
+
+	_, err = io.ReadFull(c.reader, make([]byte, length+len("\r\nEND\r\n")))
+	require.NoError(c.t, err)
+
+	return unique
+}
+
+func TestConformance(t *testing.T) {
+	testCases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "SetGet",
+			steps: []step{
+				{"set a 5 0 3\r\nabc\r\n", "STORED\r\n"},
+				{"get a\r\n", "VALUE a 5 3\r\nabc\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "GetMissing",
+			steps: []step{
+				{"get missing\r\n", "END\r\n"},
+			},
+		},
+		{
+			name: "GetMany",
+			steps: []step{
+				{"set a 0 0 1\r\n1\r\n", "STORED\r\n"},
+				{"set b 0 0 1\r\n2\r\n", "STORED\r\n"},
+				{"get a missing b\r\n", "VALUE a 0 1\r\n1\r\nVALUE b 0 1\r\n2\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "EmptyValue",
+			steps: []step{
+				{"set a 0 0 0\r\n\r\n", "STORED\r\n"},
+				{"get a\r\n", "VALUE a 0 0\r\n\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "BinaryValue",
+			steps: []step{
+				{"set a 0 0 4\r\n\r\n\x00\xff\r\n", "STORED\r\n"},
+				{"get a\r\n", "VALUE a 0 4\r\n\r\n\x00\xff\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "Add",
+			steps: []step{
+				{"add a 0 0 1\r\n1\r\n", "STORED\r\n"},
+				{"add a 0 0 1\r\n2\r\n", "NOT_STORED\r\n"},
+				{"get a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "Replace",
+			steps: []step{
+				{"replace a 0 0 1\r\n1\r\n", "NOT_STORED\r\n"},
+				{"set a 0 0 1\r\n1\r\n", "STORED\r\n"},
+				{"replace a 0 0 1\r\n2\r\n", "STORED\r\n"},
+				{"get a\r\n", "VALUE a 0 1\r\n2\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "Delete",
+			steps: []step{
+				{"delete a\r\n", "NOT_FOUND\r\n"},
+				{"set a 0 0 1\r\n1\r\n", "STORED\r\n"},
+				{"delete a\r\n", "DELETED\r\n"},
+				{"get a\r\n", "END\r\n"},
+			},
+		},
+		{
+			name: "CasMissing",
+			steps: []step{
+				{"cas a 0 0 1 1\r\n1\r\n", "NOT_FOUND\r\n"},
+			},
+		},
+		{
+			name: "Touch",
+			steps: []step{
+				{"touch a 10\r\n", "NOT_FOUND\r\n"},
+				{"set a 7 0 1\r\n1\r\n", "STORED\r\n"},
+				{"touch a 10\r\n", "TOUCHED\r\n"},
+				{"get a\r\n", "VALUE a 7 1\r\n1\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "NegativeExpiration",
+			steps: []step{
+				{"set a 0 0 1\r\n1\r\n", "STORED\r\n"},
+				{"set a 0 -1 1\r\n2\r\n", "STORED\r\n"},
+				{"get a\r\n", "END\r\n"},
+			},
+		},
+		{
+			name: "PastUnixExpiration",
+			steps: []step{
+				{"set a 0 2592001 1\r\n1\r\n", "STORED\r\n"},
+				{"get a\r\n", "END\r\n"},
+			},
+		},
+		{
+			name: "Noreply",
+			steps: []step{
+				{"set a 0 0 1 noreply\r\n1\r\n", ""},
+				{"add a 0 0 1 noreply\r\n2\r\n", ""},
+				{"delete b noreply\r\n", ""},
+				{"get a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n"},
+			},
+		},
+		{
+			name: "Pipelined",
+			steps: []step{
+				{"set a 0 0 1\r\n1\r\nget a\r\ndelete a\r\n", "STORED\r\nVALUE a 0 1\r\n1\r\nEND\r\nDELETED\r\n"},
+			},
+		},
+		{
+			name: "UnknownCommand",
+			steps: []step{
+				{"flush_all\r\n", "ERROR\r\n"},
+				{"get\r\n", "CLIENT_ERROR bad command line format\r\n"},
+			},
+		},
+		{
+			name: "BadFormat",
+			steps: []step{
+				{"set a x 0 1\r\n1\r\n", "CLIENT_ERROR bad command line format\r\n"},
+				{"set a 0 0 x\r\n", "CLIENT_ERROR bad command line format\r\n"},
+				{"touch a\r\n", "CLIENT_ERROR bad command line format\r\n"},
+			},
+		},
+		{
+			name: "KeyTooLong",
+			steps: []step{
+				{"get " + strings.Repeat("a", 251) + "\r\n", "CLIENT_ERROR key longer than 250 bytes\r\n"},
+			},
+		},
+		{
+			name: "TooLarge",
+			steps: []step{
+				{"set a 0 0 1048577\r\n" + strings.Repeat("a", 1048577) + "\r\n", "SERVER_ERROR object too large for cache\r\n"},
+				{"get a\r\n", "END\r\n"},
+			},
+		},
+		{
+			name: "BadDataChunk",
+			steps: []step{
+				{"set a 0 0 1\r\n12\r\n", "CLIENT_ERROR bad data chunk\r\n"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			conn := dial(t, qqtest.NewService(t), Options{})
+
+			for _, step := range testCase.steps {
+				conn.do(step.request, step.reply)
+			}
+		})
+	}
+}
+
+func TestCas(t *testing.T) {
+	conn := dial(t, qqtest.NewService(t), Options{})
+
+	conn.do("set a 3 0 1\r\n1\r\n", "STORED\r\n")
+
+	unique := conn.version("a")
+
+	conn.do("touch a 100\r\n", "TOUCHED\r\n")
+	assert.Equal(t, unique, conn.version("a"), "touch changed the cas unique")
+
+	conn.do(fmt.Sprintf("cas a 4 0 1 %d\r\n2\r\n", unique), "STORED\r\n")
+	conn.do(fmt.Sprintf("cas a 0 0 1 %d\r\n3\r\n", unique), "EXISTS\r\n")
+
+	conn.do("get a\r\n", "VALUE a 4 1\r\n2\r\nEND\r\n")
+	assert.NotEqual(t, unique, conn.version("a"))
+}
+
+func TestFlags(t *testing.T) {
+	service := qqtest.NewServiceWithOptions(t, qq.Options{KeyPolicy: qq.CaseInsensitiveKeys})
+
+	s, conn := serve(t, service, Options{})
+
+	// flags follow the key the service normalized to
+	conn.do("set A 5 0 1\r\n1\r\n", "STORED\r\n")
+	conn.do("get a\r\n", "VALUE a 5 1\r\n1\r\nEND\r\n")
+
+	// a write through another transport drops them
+	_, err := service.Update(context.Background(), "a", func(current *models.Entity) (*models.Entity, error) {
+		return &models.Entity{Key: "a", Value: "2"}, nil
+	})
+	require.NoError(t, err)
+	conn.do("get a\r\n", "VALUE a 0 1\r\n2\r\nEND\r\n")
+
+	// and so does a removal, without the key being read again
+	conn.do("set b 7 0 1\r\n1\r\n", "STORED\r\n")
+	assert.True(t, service.Remove(context.Background(), "b"))
+	assert.Eventually(t, func() bool {
+		return len(s.items.keys()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestExpiration(t *testing.T) {
+	conn := dial(t, qqtest.NewService(t), Options{})
+
+	conn.do("set a 0 1 1\r\n1\r\n", "STORED\r\n")
+	conn.do("get a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n")
+
+	assert.Eventually(t, func() bool {
+		reply, err := conn.get("a")
+		return err == nil && reply == "END\r\n"
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// a later set without exptime cancels the expiration
+	conn.do("set b 0 1 1\r\n1\r\n", "STORED\r\n")
+	conn.do("set b 0 0 1\r\n2\r\n", "STORED\r\n")
+	time.Sleep(1200 * time.Millisecond)
+	conn.do("get b\r\n", "VALUE b 0 1\r\n2\r\nEND\r\n")
+}
+
+func TestAuthentication(t *testing.T) {
+	var userId string
+
+	service := qq.ServiceMock{
+		GetBatchMock: func(ctx context.Context, keys []string) []*models.Entity {
+			userId = qqcontext.GetUserIdValue(ctx)
+			return make([]*models.Entity, len(keys))
+		},
+	}
+
+	conn := dial(t, &service, Options{Authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"})})
+
+	conn.do("get a\r\n", "CLIENT_ERROR unauthenticated\r\n")
+	conn.do("set auth 0 0 12\r\nApiKey wrong\r\n", "CLIENT_ERROR authentication failure\r\n")
+	conn.do("set auth 0 0 10\r\nApiKey key\r\n", "STORED\r\n")
+	conn.do("get a\r\n", "END\r\n")
+
+	assert.Equal(t, "alice", userId)
+}
+
+func TestErrors(t *testing.T) {
+	service := qq.ServiceMock{
+		AuthorizeMock: func(ctx context.Context, action qq.Action, key string) error {
+			if key == "denied" {
+				return qq.ErrPermissionDenied
+			}
+			return nil
+		},
+		AdmitMock: func(ctx context.Context, operation string) error {
+			if operation == "remove" {
+				return &qq.RateLimitError{}
+			}
+			return nil
+		},
+		UpdateMock: func(ctx context.Context, key string, update func(current *models.Entity) (*models.Entity, error)) (*models.Entity, error) {
+			return nil, qq.ErrQuotaExceeded
+		},
+		GetBatchMock: func(ctx context.Context, keys []string) []*models.Entity {
+			panic("get")
+		},
+	}
+
+	conn := dial(t, &service, Options{})
+
+	conn.do("get a denied\r\n", "CLIENT_ERROR permission denied\r\n")
+	conn.do("delete a noreply\r\n", "SERVER_ERROR rate limited, retry after 0s\r\n")
+	conn.do("set a 0 0 1\r\n1\r\n", "SERVER_ERROR out of memory storing object: quota exceeded\r\n")
+	conn.do("get a\r\n", "SERVER_ERROR internal server error\r\n")
+	conn.do("version\r\n", "VERSION ")
+}
@@ -0,0 +1,122 @@
+package memcacheqq
+
+import (
+	"context"
+	"qq/services/qq"
+	"sync"
+)
+
+// item holds the client flags of a key, which the service has no room for.
+// They live in this server only, and belong to the version of the entity
+// they were stored with: a write through another transport drops them.
+type item struct {
+	version uint64
+	flags   uint32
+}
+
+// items are keyed by the keys the service returns, which its key policy
+// may have normalized
+type items struct {
+	mu    sync.Mutex
+	items map[string]item
+}
+
+func newItems() *items {
+	return &items{items: map[string]item{}}
+}
+
+// store replaces the flags of key
+func (i *items) store(key string, version uint64, flags uint32) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if flags == 0 {
+		delete(i.items, key)
+		return
+	}
+
+	i.items[key] = item{version: version, flags: flags}
+}
+
+// flags returns the flags key was stored with, or zero when the entity has
+// been written since
+func (i *items) flags(key string, version uint64) uint32 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	current, ok := i.items[key]
+	if !ok {
+		return 0
+	}
+
+	if current.version != version {
+		delete(i.items, key)
+		return 0
+	}
+
+	return current.flags
+}
+
+// drop forgets the flags of key if they still belong to version
+func (i *items) drop(key string, version uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	current, ok := i.items[key]
+	if ok && current.version == version {
+		delete(i.items, key)
+	}
+}
+
+func (i *items) keys() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	keys := make([]string, 0, len(i.items))
+	for key := range i.items {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// check drops the flags of key unless the entity is still at their version;
+// the changes of Watch may arrive out of order with the writes of this
+// server, so the service is asked for the current entity
+func (i *items) check(ctx context.Context, service qq.Service, key string) {
+	i.mu.Lock()
+	current, ok := i.items[key]
+	i.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	entity := service.Get(ctx, key)
+	if entity != nil && entity.Version == current.version {
+		return
+	}
+
+	i.drop(key, current.version)
+}
+
+// watch drops the flags of the keys written, removed or expired through any
+// transport until ctx is done. A watch that fell behind has missed changes,
+// so every key is checked before watching again.
+func (i *items) watch(ctx context.Context, service qq.Service) {
+	ctx = qq.WithSystemIdentity(ctx)
+
+	for {
+		for change := range service.Watch(ctx, "") {
+			i.check(ctx, service, change.Key)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		for _, key := range i.keys() {
+			i.check(ctx, service, key)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package memcacheqq
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"qq/services/qq"
+	"strconv"
+	"strings"
+)
+
+// limits of a request, the same as the defaults of memcached
+const (
+	maxKeyLength   = 250
+	maxLineLength  = 2048
+	maxValueLength = 1024 * 1024
+)
+
+// replyError is sent to the client as is
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+const (
+	errUnknownCommand       replyError = "ERROR"
+	errInternal             replyError = "SERVER_ERROR internal server error"
+	errBadFormat            replyError = "CLIENT_ERROR bad command line format"
+	errBadDataChunk         replyError = "CLIENT_ERROR bad data chunk"
+	errLineTooLong          replyError = "CLIENT_ERROR line too long"
+	errTooLarge             replyError = "SERVER_ERROR object too large for cache"
+	errUnauthenticated      replyError = "CLIENT_ERROR unauthenticated"
+	errAuthenticationFailed replyError = "CLIENT_ERROR authentication failure"
+)
+
+// replyText maps the errors of the service to memcached errors; a full
+// quota is reported like a full memcached
+func replyText(err error) string {
+	var reply replyError
+
+	switch {
+	case errors.As(err, &reply):
+		return reply.Error()
+	case errors.Is(err, qq.ErrPermissionDenied):
+		return "CLIENT_ERROR " + err.Error()
+	case errors.Is(err, qq.ErrRateLimited):
+		return "SERVER_ERROR " + err.Error()
+	case errors.Is(err, qq.ErrQuotaExceeded):
+		return "SERVER_ERROR out of memory storing object: " + err.Error()
+	default:
+		return errInternal.Error()
+	}
+}
+
+type request struct {
+	name    string
+	args    []string
+	noreply bool
+	// data is the data block of the storage commands
+	data string
+	// err is a malformed command line, which is replied without closing
+	// the connection
+	err error
+}
+
+// readRequest reads a command line and, for the storage commands, the data
+// block following it; the returned error closes the connection
+func readRequest(reader *bufio.Reader) (request, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return request{}, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return request{}, nil
+	}
+
+	r := request{name: fields[0], args: fields[1:]}
+
+	if len(r.args) > 0 && r.args[len(r.args)-1] == "noreply" {
+		r.noreply = true
+		r.args = r.args[:len(r.args)-1]
+	}
+
+	cmd, ok := commands[r.name]
+	if !ok || !cmd.storage {
+		return r, nil
+	}
+
+	// <key> <flags> <exptime> <bytes>
+	if len(r.args) < 4 {
+		r.err = errBadFormat
+		return r, nil
+	}
+
+	length, err := strconv.Atoi(r.args[3])
+	if err != nil || length < 0 {
+		r.err = errBadFormat
+		return r, nil
+	}
+
+	// the data of a too large value is swallowed, as memcached does
+	if length > maxValueLength {
+		_, err = io.CopyN(io.Discard, reader, int64(length)+2)
+		if err != nil {
+			return request{}, err
+		}
+
+		r.err = errTooLarge
+		return r, nil
+	}
+
+	data := make([]byte, length+2)
+
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return request{}, err
+	}
+
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return request{}, errBadDataChunk
+	}
+
+	r.data = string(data[:length])
+
+	return r, nil
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// validKey rejects the keys memcached does: too long ones and ones with
+// control characters, which the text protocol cannot carry
+func validKey(key string) error {
+	if len(key) > maxKeyLength {
+		return replyError(fmt.Sprintf("CLIENT_ERROR key longer than %d bytes", maxKeyLength))
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return errBadFormat
+		}
+	}
+
+	return nil
+}
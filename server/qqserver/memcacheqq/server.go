@@ -0,0 +1,273 @@
+package memcacheqq
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	"qq/pkg/qqcontext"
+	"qq/pkg/qqtls"
+	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"strings"
+)
+
+type Options struct {
+	// Metrics are recorded when set; they are served by the metrics server
+	Metrics metrics.Metrics
+	// Authenticator verifies the credentials of the first set of every
+	// connection, as memcached does with ASCII authentication; connections
+	// are not authenticated when it is nil
+	Authenticator auth.Authenticator
+	// TLS serves over TLS when set; a verified client certificate
+	// authenticates the connection as the subject common name
+	TLS *tls.Config
+}
+
+type server struct {
+	address       string
+	service       qq.Service
+	metrics       metrics.Metrics
+	authenticator auth.Authenticator
+	tls           *tls.Config
+	items         *items
+}
+
+var _ qqserver.Server = &server{}
+
+func NewServer(ctx context.Context, address string, service qq.Service, options Options) (qqserver.Server, error) {
+	log.Debug(ctx, "create new memcached server", log.Args{"address": address})
+
+	return newServer(address, service, options), nil
+}
+
+func newServer(address string, service qq.Service, options Options) *server {
+	return &server{
+		address:       address,
+		service:       service,
+		metrics:       options.Metrics,
+		authenticator: options.Authenticator,
+		tls:           options.TLS,
+		items:         newItems(),
+	}
+}
+
+func (s *server) Serve() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	}
+
+	return s.serve(listener)
+}
+
+// serve returns nil once listener is closed
+func (s *server) serve(listener net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.items.watch(ctx, s.service)
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept: %w", err)
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+type connection struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	writer        *bufio.Writer
+	ctx           context.Context
+	authenticated bool
+	closing       bool
+}
+
+func (s *server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// handleCommand recovers on its own, this covers reading the commands
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			log.Error(context.Background(), "connection panicked", log.Args{"panic": recovered, "remote": conn.RemoteAddr().String()})
+		}
+	}()
+
+	c := &connection{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		ctx:    qqcontext.WithTransportValue(context.Background(), metrics.TransportMemcached),
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			log.Warning(c.ctx, "TLS handshake failed", log.Args{"error": err, "remote": conn.RemoteAddr().String()})
+			return
+		}
+
+		state := tlsConn.ConnectionState()
+
+		identity, verified := qqtls.Identity(&state)
+		if verified {
+			c.authenticate(identity)
+		}
+	}
+
+	for !c.closing {
+		request, err := readRequest(c.reader)
+		if err != nil {
+			var reply replyError
+			if errors.As(err, &reply) {
+				c.writer.WriteString(reply.Error() + "\r\n")
+				_ = c.writer.Flush()
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warning(c.ctx, "failed to read command", log.Args{"error": err, "remote": conn.RemoteAddr().String()})
+			}
+
+			return
+		}
+
+		if request.name == "" {
+			continue
+		}
+
+		s.handleCommand(c, request)
+
+		// pipelined commands are answered together
+		if c.reader.Buffered() > 0 {
+			continue
+		}
+
+		err = c.writer.Flush()
+		if err != nil {
+			log.Warning(c.ctx, "failed to write reply", log.Args{"error": err, "remote": conn.RemoteAddr().String()})
+			return
+		}
+	}
+
+	_ = c.writer.Flush()
+}
+
+func (c *connection) authenticate(identity qqcontext.Identity) {
+	c.ctx = qqcontext.WithIdentityValue(c.ctx, identity)
+	c.ctx = qqcontext.WithUserIdValue(c.ctx, identity.UserId)
+	c.authenticated = true
+}
+
+// reply writes a line unless the client asked for no reply
+func (c *connection) reply(request request, line string) {
+	if request.noreply {
+		return
+	}
+
+	c.writer.WriteString(line + "\r\n")
+}
+
+// handleCommand runs a command with the authenticated and admitted context,
+// and replies with its error
+func (s *server) handleCommand(c *connection, request request) {
+	cmd, ok := commands[request.name]
+
+	operation := "unknown"
+	if ok {
+		operation = cmd.operation
+	}
+
+	ctx := qqcontext.WithRequestIdValue(c.ctx, qqcontext.NewRequestId())
+
+	handled := qqserver.Request{
+		Transport: metrics.TransportMemcached,
+		Operation: operation,
+		Name:      request.name,
+		Metrics:   s.metrics,
+		Internal:  errInternal,
+	}
+
+	err := qqserver.Handle(ctx, handled, func(ctx context.Context) error {
+		return s.checkCommand(ctx, c, cmd, ok, request)
+	})
+	// errors are sent even with noreply, as memcached does
+	if err != nil {
+		c.writer.WriteString(replyText(err) + "\r\n")
+	}
+}
+
+func (s *server) checkCommand(ctx context.Context, c *connection, cmd command, ok bool, request request) error {
+	if !ok {
+		return errUnknownCommand
+	}
+
+	if request.err != nil {
+		return request.err
+	}
+
+	if s.authenticator != nil && !c.authenticated && request.name != "quit" {
+		return s.authenticateRequest(ctx, c, request)
+	}
+
+	if len(request.args) < cmd.minArgs || len(request.args) > cmd.maxArgs {
+		return errBadFormat
+	}
+
+	if cmd.operation != connectionOperation {
+		err := qqserver.Admit(ctx, s.service, cmd.operation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cmd.handle(s, ctx, c, request)
+}
+
+// authenticateRequest takes the data of a set as "<username> <password>",
+// which is how memcached authenticates text protocol clients. The password
+// is the token of the credentials and the username their scheme, e.g.
+// "ApiKey <key>".
+func (s *server) authenticateRequest(ctx context.Context, c *connection, request request) error {
+	if request.name != "set" {
+		return errUnauthenticated
+	}
+
+	username, password, found := strings.Cut(strings.TrimSpace(request.data), " ")
+	if !found {
+		return errAuthenticationFailed
+	}
+
+	credentials, err := auth.ParseCredentials(username + " " + password)
+	if err != nil {
+		return errAuthenticationFailed
+	}
+
+	identity, err := s.authenticator.Authenticate(ctx, credentials)
+	if err != nil {
+		log.Warning(ctx, "failed to authenticate", log.Args{"error": err})
+		return errAuthenticationFailed
+	}
+
+	c.authenticate(identity)
+	c.reply(request, "STORED")
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	qqRepo "qq/repos/qq"
+	"qq/services/qq"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceCollector reads the counters the service keeps anyway instead of
+// instrumenting it a second time
+type serviceCollector struct {
+	service        *qq.Metrics
+	cacheHits      *prometheus.Desc
+	cacheMisses    *prometheus.Desc
+	cacheErrors    *prometheus.Desc
+	databaseLoads  *prometheus.Desc
+	coalesced      *prometheus.Desc
+	earlyRefreshes *prometheus.Desc
+}
+
+func newServiceCollector(service *qq.Metrics) prometheus.Collector {
+	return serviceCollector{
+		service:        service,
+		cacheHits:      prometheus.NewDesc("qq_cache_hits_total", "Gets answered from the cache.", nil, nil),
+		cacheMisses:    prometheus.NewDesc("qq_cache_misses_total", "Gets not found in the cache.", nil, nil),
+		cacheErrors:    prometheus.NewDesc("qq_cache_errors_total", "Failed cache writes and deletes.", nil, nil),
+		databaseLoads:  prometheus.NewDesc("qq_database_loads_total", "Entities loaded from the database on a cache miss.", nil, nil),
+		coalesced:      prometheus.NewDesc("qq_coalesced_loads_total", "Gets that waited for a concurrent load of the same key.", nil, nil),
+		earlyRefreshes: prometheus.NewDesc("qq_early_refreshes_total", "Cached entities reloaded before they expired.", nil, nil),
+	}
+}
+
+func (c serviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cacheHits
+	ch <- c.cacheMisses
+	ch <- c.cacheErrors
+	ch <- c.databaseLoads
+	ch <- c.coalesced
+	ch <- c.earlyRefreshes
+}
+
+func (c serviceCollector) Collect(ch chan<- prometheus.Metric) {
+	snapshot := c.service.Snapshot()
+
+	ch <- prometheus.MustNewConstMetric(c.cacheHits, prometheus.CounterValue, float64(snapshot.CacheHits))
+	ch <- prometheus.MustNewConstMetric(c.cacheMisses, prometheus.CounterValue, float64(snapshot.CacheMisses))
+	ch <- prometheus.MustNewConstMetric(c.cacheErrors, prometheus.CounterValue, float64(snapshot.CacheErrors))
+	ch <- prometheus.MustNewConstMetric(c.databaseLoads, prometheus.CounterValue, float64(snapshot.DatabaseLoads))
+	ch <- prometheus.MustNewConstMetric(c.coalesced, prometheus.CounterValue, float64(snapshot.Coalesced))
+	ch <- prometheus.MustNewConstMetric(c.earlyRefreshes, prometheus.CounterValue, float64(snapshot.EarlyRefreshes))
+}
+
+type databaseCollector struct {
+	database qqRepo.Database
+	keys     *prometheus.Desc
+	bytes    *prometheus.Desc
+}
+
+func newDatabaseCollector(database qqRepo.Database) prometheus.Collector {
+	return databaseCollector{
+		database: database,
+		keys:     prometheus.NewDesc("qq_database_keys", "Entities stored in the database.", nil, nil),
+		bytes:    prometheus.NewDesc("qq_database_bytes", "Bytes of keys and values stored in the database.", nil, nil),
+	}
+}
+
+func (c databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.keys
+	ch <- c.bytes
+}
+
+func (c databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.database.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(stats.Keys))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(stats.Bytes))
+}
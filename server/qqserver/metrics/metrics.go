@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+	qqRepo "qq/repos/qq"
+	"qq/services/qq"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const Path = "/metrics"
+
+const (
+	TransportHTTP      = "http"
+	TransportRabbitMQ  = "rabbitmq"
+	TransportGRPC      = "grpc"
+	TransportRedis     = "redis"
+	TransportMemcached = "memcached"
+	TransportBinary    = "binary"
+	TransportWebSocket = "websocket"
+)
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+type Metrics interface {
+	// ObserveRequest records a request handled by transport; status is the
+	// HTTP status code, the gRPC status code or StatusOK/StatusError
+	ObserveRequest(transport string, operation string, status string, duration time.Duration)
+	// StartRequest counts the request as in flight until the returned func is called
+	StartRequest(transport string) func()
+	Handler() http.Handler
+}
+
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        *prometheus.GaugeVec
+}
+
+var _ Metrics = &metrics{}
+
+// New exposes the service metrics and the database size along with the
+// request metrics; service and database may be nil
+func New(service *qq.Metrics, database qqRepo.Database) Metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qq_requests_total",
+			Help: "Requests handled, by transport, operation and status.",
+		}, []string{"transport", "operation", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "qq_request_duration_seconds",
+			Help:    "Request latency, by transport and operation.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"transport", "operation"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qq_in_flight_requests",
+			Help: "Requests being handled, by transport.",
+		}, []string{"transport"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.inFlight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if service != nil {
+		m.registry.MustRegister(newServiceCollector(service))
+	}
+
+	if database != nil {
+		m.registry.MustRegister(newDatabaseCollector(database))
+	}
+
+	return m
+}
+
+func (m *metrics) ObserveRequest(transport string, operation string, status string, duration time.Duration) {
+	m.requests.WithLabelValues(transport, operation, status).Inc()
+	m.requestDuration.WithLabelValues(transport, operation).Observe(duration.Seconds())
+}
+
+func (m *metrics) StartRequest(transport string) func() {
+	gauge := m.inFlight.WithLabelValues(transport)
+	gauge.Inc()
+
+	return gauge.Dec
+}
+
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -2,6 +2,7 @@ package rabbitqq
 
 import (
 	"qq/models"
+	"qq/pkg/health"
 	"qq/pkg/qqclient"
 	"qq/pkg/qqclient/rabbitqq"
 )
@@ -63,3 +64,10 @@ func ToGetAllReplyMessage(entities []models.Entity) rabbitqq.GetAllReplyMessage
 		Entities:         data,
 	}
 }
+
+func ToHealthReplyMessage(report health.Report) rabbitqq.HealthReplyMessage {
+	return rabbitqq.HealthReplyMessage{
+		BaseReplyMessage: rabbitqq.BaseReplyMessage{Name: rabbitqq.HealthMessageName},
+		Health:           report,
+	}
+}
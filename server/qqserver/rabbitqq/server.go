@@ -3,12 +3,17 @@ package rabbitqq
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"qq/pkg/auth"
+	"qq/pkg/health"
 	"qq/pkg/log"
 	"qq/pkg/qqclient/rabbitqq"
 	"qq/pkg/qqcontext"
 	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
 	"qq/services/qq"
+	"strings"
 	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -16,15 +21,34 @@ import (
 
 const ThreadCount = 20
 
+type channel interface {
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	IsClosed() bool
+}
+
+type Options struct {
+	// HealthDependencies are checked by the health message along with the
+	// RabbitMQ channel
+	HealthDependencies []health.Dependency
+	Metrics            metrics.Metrics
+	// Authenticator verifies the Authorization header of every message;
+	// the UserId header is trusted when it is nil
+	Authenticator auth.Authenticator
+}
+
 type server struct {
-	queue   string
-	service qq.Service
-	channel *amqp.Channel
+	queue         string
+	service       qq.Service
+	channel       channel
+	health        health.Checker
+	metrics       metrics.Metrics
+	authenticator auth.Authenticator
 }
 
 var _ qqserver.Server = server{}
 
-func NewServer(ctx context.Context, queue string, service qq.Service) (qqserver.Server, error) {
+func NewServer(ctx context.Context, queue string, service qq.Service, options Options) (qqserver.Server, error) {
 	log.Debug(ctx, "create new rabbitmq server", log.Args{"queue": queue})
 
 	ch, err := connect(queue)
@@ -32,11 +56,26 @@ func NewServer(ctx context.Context, queue string, service qq.Service) (qqserver.
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
-	return &server{
-		queue:   queue,
-		service: service,
-		channel: ch,
-	}, nil
+	s := &server{
+		queue:         queue,
+		service:       service,
+		channel:       ch,
+		metrics:       options.Metrics,
+		authenticator: options.Authenticator,
+	}
+
+	dependencies := append([]health.Dependency{{Name: "rabbitmq", Check: s.checkChannel}}, options.HealthDependencies...)
+	s.health = health.NewChecker(dependencies...)
+
+	return s, nil
+}
+
+func (s server) checkChannel(ctx context.Context) error {
+	if s.channel.IsClosed() {
+		return fmt.Errorf("channel is closed")
+	}
+
+	return nil
 }
 
 func connect(queue string) (*amqp.Channel, error) {
@@ -88,13 +127,7 @@ func (s server) Serve() error {
 			defer wg.Done()
 
 			for msg := range msgs {
-				userId := msg.Headers["UserId"].(string)
-				ctx := qqcontext.WithUserIdValue(context.Background(), userId)
-
-				err = s.handleRawMessage(ctx, msg.Body, msg.CorrelationId, msg.ReplyTo)
-				if err != nil {
-					log.Error(ctx, "failed to handle message", log.Args{"error": err})
-				}
+				s.handleDelivery(msg)
 			}
 		}()
 	}
@@ -104,6 +137,134 @@ func (s server) Serve() error {
 	return nil
 }
 
+var errInternal = errors.New("panicked")
+
+// publicOperations are handled without authentication and rate limits, so
+// that probes do not need credentials
+var publicOperations = map[string]bool{
+	rabbitqq.HealthMessageName: true,
+}
+
+func (s server) handleDelivery(msg amqp.Delivery) {
+	operation := messageOperation(msg.Body)
+
+	ctx := context.Background()
+	var authErr error
+
+	if !publicOperations[operation] {
+		ctx, authErr = s.authenticate(msg.Headers)
+	}
+
+	ctx = qqcontext.WithTransportValue(ctx, metrics.TransportRabbitMQ)
+	ctx = qqcontext.WithRequestIdValue(ctx, msg.CorrelationId)
+
+	request := qqserver.Request{
+		Transport: metrics.TransportRabbitMQ,
+		Operation: operation,
+		Name:      operation,
+		Metrics:   s.metrics,
+		Internal:  errInternal,
+	}
+
+	err := qqserver.Handle(ctx, request, func(ctx context.Context) error {
+		if authErr != nil {
+			return s.handleUnauthorized(ctx, msg.Body, msg.CorrelationId, msg.ReplyTo, authErr)
+		}
+
+		if !publicOperations[operation] {
+			err := qqserver.Admit(ctx, s.service, operation)
+			if err != nil {
+				return s.handleRateLimited(ctx, msg.Body, msg.CorrelationId, msg.ReplyTo, err)
+			}
+		}
+
+		return s.handleRawMessage(ctx, msg.Body, msg.CorrelationId, msg.ReplyTo)
+	})
+	if err != nil {
+		log.Error(ctx, "failed to handle message", log.Args{"error": err})
+	}
+}
+
+// authenticate returns the context of the message with the verified
+// identity, or with the claimed user id when there is no authenticator
+func (s server) authenticate(headers amqp.Table) (context.Context, error) {
+	ctx := context.Background()
+
+	if s.authenticator == nil {
+		userId, _ := headers["UserId"].(string)
+		return qqcontext.WithUserIdValue(ctx, userId), nil
+	}
+
+	authorization, _ := headers[auth.AuthorizationHeader].(string)
+
+	credentials, err := auth.ParseCredentials(authorization)
+	if err != nil {
+		return ctx, err
+	}
+
+	identity, err := s.authenticator.Authenticate(ctx, credentials)
+	if err != nil {
+		return ctx, err
+	}
+
+	ctx = qqcontext.WithIdentityValue(ctx, identity)
+	ctx = qqcontext.WithUserIdValue(ctx, identity.UserId)
+
+	return ctx, nil
+}
+
+func (s server) handleUnauthorized(ctx context.Context, body []byte, corrId string, replyTo string, authErr error) error {
+	var baseMessage rabbitqq.BaseMessage
+	_ = json.Unmarshal(body, &baseMessage)
+
+	err := s.replyError(ctx, baseMessage.Name, corrId, replyTo, rabbitqq.ErrorCodeUnauthorized, "unauthorized")
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("failed to authenticate: %w", authErr)
+}
+
+func (s server) handleRateLimited(ctx context.Context, body []byte, corrId string, replyTo string, admitErr error) error {
+	var baseMessage rabbitqq.BaseMessage
+	_ = json.Unmarshal(body, &baseMessage)
+
+	err := s.replyError(ctx, baseMessage.Name, corrId, replyTo, rabbitqq.ErrorCodeRateLimited, admitErr.Error())
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("failed to admit: %w", admitErr)
+}
+
+func (s server) replyError(ctx context.Context, name string, corrId string, replyTo string, code string, message string) error {
+	replyMessage := rabbitqq.BaseReplyMessage{
+		Name:  name,
+		Error: &rabbitqq.ReplyError{Code: code, Message: message},
+	}
+
+	return s.reply(ctx, corrId, replyTo, replyMessage)
+}
+
+var messageNames = map[string]bool{
+	rabbitqq.AddMessageName:    true,
+	rabbitqq.RemoveMessageName: true,
+	rabbitqq.GetMessageName:    true,
+	rabbitqq.GetAllMessageName: true,
+	rabbitqq.HealthMessageName: true,
+}
+
+// messageOperation names the operation of the message for metrics and rate
+// limits, after the HTTP operations
+func messageOperation(body []byte) string {
+	var baseMessage rabbitqq.BaseMessage
+	if json.Unmarshal(body, &baseMessage) == nil && messageNames[baseMessage.Name] {
+		return strings.ReplaceAll(baseMessage.Name, " ", "_")
+	}
+
+	return "unknown"
+}
+
 func handleMessage[Message any, ReplyMessage any](ctx context.Context, s server, body []byte, corrId string, replyTo string, proc func(message Message) ReplyMessage) error {
 	var message Message
 	err := json.Unmarshal(body, &message)
@@ -113,6 +274,10 @@ func handleMessage[Message any, ReplyMessage any](ctx context.Context, s server,
 
 	replyMessage := proc(message)
 
+	return s.reply(ctx, corrId, replyTo, replyMessage)
+}
+
+func (s server) reply(ctx context.Context, corrId string, replyTo string, replyMessage any) error {
 	jsonReplyMessage, err := json.Marshal(replyMessage)
 	if err != nil {
 		return fmt.Errorf("failed to produce JSON: %w", err)
@@ -135,6 +300,17 @@ func handleMessage[Message any, ReplyMessage any](ctx context.Context, s server,
 	return nil
 }
 
+var messageActions = map[string]qq.Action{
+	rabbitqq.AddMessageName:    qq.ActionWrite,
+	rabbitqq.RemoveMessageName: qq.ActionWrite,
+	rabbitqq.GetMessageName:    qq.ActionRead,
+}
+
+// keyMessage reads the key of any message that has one
+type keyMessage struct {
+	Key string `json:"key"`
+}
+
 func (s server) handleRawMessage(ctx context.Context, body []byte, corrId string, replyTo string) error {
 	var baseMessage rabbitqq.BaseMessage
 	err := json.Unmarshal(body, &baseMessage)
@@ -142,6 +318,33 @@ func (s server) handleRawMessage(ctx context.Context, body []byte, corrId string
 		return fmt.Errorf("failed to parse JSON: %w", err)
 	}
 
+	action, ok := messageActions[baseMessage.Name]
+	if ok {
+		var keyMessage keyMessage
+		err = json.Unmarshal(body, &keyMessage)
+		if err != nil {
+			return fmt.Errorf("failed to parse JSON: %w", err)
+		}
+
+		err = s.service.Authorize(ctx, action, keyMessage.Key)
+		if err != nil {
+			return s.replyError(ctx, baseMessage.Name, corrId, replyTo, rabbitqq.ErrorCodePermissionDenied, "permission denied")
+		}
+	}
+
+	if baseMessage.Name == rabbitqq.AddMessageName {
+		var addMessage rabbitqq.AddMessage
+		err = json.Unmarshal(body, &addMessage)
+		if err != nil {
+			return fmt.Errorf("failed to parse JSON: %w", err)
+		}
+
+		err = s.service.CheckQuota(ctx, FromAddMessage(addMessage))
+		if err != nil {
+			return s.replyError(ctx, baseMessage.Name, corrId, replyTo, rabbitqq.ErrorCodeQuotaExceeded, err.Error())
+		}
+	}
+
 	switch baseMessage.Name {
 	case "add":
 		err = handleMessage(ctx, s, body, corrId, replyTo,
@@ -181,6 +384,15 @@ func (s server) handleRawMessage(ctx context.Context, body []byte, corrId string
 		if err != nil {
 			return fmt.Errorf("failed to handle add message: %w", err)
 		}
+
+	case rabbitqq.HealthMessageName:
+		err = handleMessage(ctx, s, body, corrId, replyTo,
+			func(healthMessage rabbitqq.HealthMessage) rabbitqq.HealthReplyMessage {
+				return ToHealthReplyMessage(s.health.Ready(ctx))
+			})
+		if err != nil {
+			return fmt.Errorf("failed to handle health message: %w", err)
+		}
 	}
 
 	return nil
@@ -0,0 +1,406 @@
+package rabbitqq
+
+import (
+	"context"
+	"encoding/json"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/health"
+	"qq/pkg/qqclient/rabbitqq"
+	"qq/pkg/qqcontext"
+	"qq/services/qq"
+	"strconv"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type channelMock struct {
+	published []amqp.Publishing
+	closed    bool
+}
+
+func (c *channelMock) IsClosed() bool {
+	return c.closed
+}
+
+func (c *channelMock) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return nil, nil
+}
+
+func (c *channelMock) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published = append(c.published, msg)
+	return nil
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	keys := []string{
+		"a/b",
+		"a?b=c&d",
+		"a#b",
+		"100%",
+		"with space",
+		"ключ",
+		"日本語/キー",
+		"emoji 🙂",
+		"control\x00\x01\x1f\x7f",
+		"quote\"and\\backslash",
+	}
+
+	for _, key := range keys {
+		key := key
+		t.Run(strconv.Quote(key), func(t *testing.T) {
+			entities := map[string]models.Entity{}
+
+			service := qq.ServiceMock{
+				AddMock: func(ctx context.Context, entity models.Entity) bool {
+					entities[entity.Key] = entity
+					return true
+				},
+				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+					entity, present := entities[key]
+					if !present {
+						return nil
+					}
+					return &entity
+				},
+				RemoveMock: func(ctx context.Context, key string) bool {
+					delete(entities, key)
+					return true
+				},
+			}
+
+			channel := &channelMock{}
+			s := server{
+				service: &service,
+				channel: channel,
+			}
+
+			send := func(message any) []byte {
+				body, err := json.Marshal(message)
+				require.NoError(t, err)
+
+				err = s.handleRawMessage(ctx, body, "corr", "reply")
+				require.NoError(t, err)
+
+				require.NotEmpty(t, channel.published)
+				reply := channel.published[len(channel.published)-1]
+				assert.Equal(t, "corr", reply.CorrelationId)
+
+				return reply.Body
+			}
+
+			send(rabbitqq.AddMessage{
+				BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.AddMessageName},
+				Key:         key,
+				Value:       "b",
+			})
+			assert.Contains(t, entities, key)
+
+			var getReply rabbitqq.GetReplyMessage
+			err := json.Unmarshal(send(rabbitqq.GetMessage{
+				BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.GetMessageName},
+				Key:         key,
+			}), &getReply)
+			require.NoError(t, err)
+			require.NotNil(t, getReply.Value)
+			assert.Equal(t, "b", *getReply.Value)
+
+			send(rabbitqq.RemoveMessage{
+				BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.RemoveMessageName},
+				Key:         key,
+			})
+			assert.NotContains(t, entities, key)
+		})
+	}
+}
+
+func TestHealthMessage(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name   string
+		closed bool
+		exp    health.Report
+	}{
+		{
+			name:   "Up",
+			closed: false,
+			exp: health.Report{Status: health.StatusUp, Dependencies: []health.DependencyReport{
+				{Name: "rabbitmq", Status: health.StatusUp},
+			}},
+		},
+		{
+			name:   "ChannelClosed",
+			closed: true,
+			exp: health.Report{Status: health.StatusDown, Dependencies: []health.DependencyReport{
+				{Name: "rabbitmq", Status: health.StatusDown, Error: "channel is closed"},
+			}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			channel := &channelMock{closed: testCase.closed}
+			s := server{
+				service: &qq.ServiceMock{},
+				channel: channel,
+			}
+			s.health = health.NewChecker(health.Dependency{Name: "rabbitmq", Check: s.checkChannel})
+
+			body, err := json.Marshal(rabbitqq.HealthMessage{
+				BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.HealthMessageName},
+			})
+			require.NoError(t, err)
+
+			err = s.handleRawMessage(ctx, body, "corr", "reply")
+			require.NoError(t, err)
+			require.Len(t, channel.published, 1)
+
+			var reply rabbitqq.HealthReplyMessage
+
+			err = json.Unmarshal(channel.published[0].Body, &reply)
+			require.NoError(t, err)
+
+			assert.Equal(t, rabbitqq.HealthMessageName, reply.Name)
+			assert.Equal(t, testCase.exp, reply.Health)
+		})
+	}
+}
+
+// TestPublicHealthMessage sends the health message without credentials to a
+// server that rate limits every other message
+func TestPublicHealthMessage(t *testing.T) {
+	service := qq.ServiceMock{
+		AdmitMock: func(ctx context.Context, operation string) error {
+			return &qq.RateLimitError{RetryAfter: time.Second}
+		},
+	}
+
+	channel := &channelMock{}
+	s := server{
+		service:       &service,
+		channel:       channel,
+		authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"}),
+	}
+	s.health = health.NewChecker(health.Dependency{Name: "rabbitmq", Check: s.checkChannel})
+
+	body, err := json.Marshal(rabbitqq.HealthMessage{
+		BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.HealthMessageName},
+	})
+	require.NoError(t, err)
+
+	s.handleDelivery(amqp.Delivery{Body: body, CorrelationId: "corr", ReplyTo: "reply"})
+	require.Len(t, channel.published, 1)
+
+	var reply rabbitqq.HealthReplyMessage
+	err = json.Unmarshal(channel.published[0].Body, &reply)
+	require.NoError(t, err)
+
+	assert.Nil(t, reply.Error)
+	assert.Equal(t, health.StatusUp, reply.Health.Status)
+}
+
+func TestPanic(t *testing.T) {
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			panic("get")
+		},
+	}
+
+	channel := &channelMock{}
+	s := server{
+		service: &service,
+		channel: channel,
+	}
+
+	body, err := json.Marshal(rabbitqq.GetMessage{
+		BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.GetMessageName},
+		Key:         "a",
+	})
+	require.NoError(t, err)
+
+	assert.NotPanics(t, func() {
+		s.handleDelivery(amqp.Delivery{Body: body, CorrelationId: "corr", ReplyTo: "reply"})
+	})
+	assert.Empty(t, channel.published)
+}
+
+func TestAuthentication(t *testing.T) {
+	body, err := json.Marshal(rabbitqq.GetMessage{
+		BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.GetMessageName},
+		Key:         "a",
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		authenticator auth.Authenticator
+		headers       amqp.Table
+		expUserId     string
+		expErr        *rabbitqq.ReplyError
+	}{
+		{
+			name:      "NoAuthenticator",
+			headers:   amqp.Table{"UserId": "alice"},
+			expUserId: "alice",
+		},
+		{
+			name:      "NoAuthenticatorNoHeaders",
+			headers:   nil,
+			expUserId: "",
+		},
+		{
+			name:          "Authenticated",
+			authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"}),
+			headers:       amqp.Table{"UserId": "mallory", auth.AuthorizationHeader: "ApiKey key"},
+			expUserId:     "alice",
+		},
+		{
+			name:          "Unauthenticated",
+			authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"}),
+			headers:       amqp.Table{"UserId": "alice"},
+			expErr:        &rabbitqq.ReplyError{Code: rabbitqq.ErrorCodeUnauthorized, Message: "unauthorized"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			var userId string
+
+			service := qq.ServiceMock{
+				GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+					userId = qqcontext.GetUserIdValue(ctx)
+					return nil
+				},
+			}
+
+			channel := &channelMock{}
+			s := server{
+				service:       &service,
+				channel:       channel,
+				authenticator: testCase.authenticator,
+			}
+
+			s.handleDelivery(amqp.Delivery{Headers: testCase.headers, Body: body, CorrelationId: "corr", ReplyTo: "reply"})
+
+			require.Len(t, channel.published, 1)
+
+			var reply rabbitqq.BaseReplyMessage
+			err := json.Unmarshal(channel.published[0].Body, &reply)
+			require.NoError(t, err)
+
+			assert.Equal(t, testCase.expErr, reply.Error)
+			assert.Equal(t, testCase.expUserId, userId)
+		})
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	ctx := context.Background()
+
+	service := qq.ServiceMock{
+		AuthorizeMock: func(ctx context.Context, action qq.Action, key string) error {
+			if action == qq.ActionWrite {
+				return qq.ErrPermissionDenied
+			}
+			return nil
+		},
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			return &models.Entity{Key: key, Value: "b"}
+		},
+	}
+
+	channel := &channelMock{}
+	s := server{
+		service: &service,
+		channel: channel,
+	}
+
+	send := func(message any) rabbitqq.BaseReplyMessage {
+		body, err := json.Marshal(message)
+		require.NoError(t, err)
+
+		err = s.handleRawMessage(ctx, body, "corr", "reply")
+		require.NoError(t, err)
+
+		var reply rabbitqq.BaseReplyMessage
+		err = json.Unmarshal(channel.published[len(channel.published)-1].Body, &reply)
+		require.NoError(t, err)
+
+		return reply
+	}
+
+	reply := send(rabbitqq.AddMessage{
+		BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.AddMessageName},
+		Key:         "a",
+		Value:       "b",
+	})
+	assert.Equal(t, &rabbitqq.ReplyError{Code: rabbitqq.ErrorCodePermissionDenied, Message: "permission denied"}, reply.Error)
+
+	reply = send(rabbitqq.GetMessage{
+		BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.GetMessageName},
+		Key:         "a",
+	})
+	assert.Nil(t, reply.Error)
+}
+
+func TestLimits(t *testing.T) {
+	var operations []string
+
+	service := qq.ServiceMock{
+		AdmitMock: func(ctx context.Context, operation string) error {
+			operations = append(operations, operation)
+			if operation == "get" {
+				return &qq.RateLimitError{RetryAfter: time.Second}
+			}
+			return nil
+		},
+		CheckQuotaMock: func(ctx context.Context, entity models.Entity) error {
+			return qq.ErrQuotaExceeded
+		},
+	}
+
+	channel := &channelMock{}
+	s := server{
+		service: &service,
+		channel: channel,
+	}
+
+	send := func(message any) rabbitqq.BaseReplyMessage {
+		body, err := json.Marshal(message)
+		require.NoError(t, err)
+
+		s.handleDelivery(amqp.Delivery{Body: body, CorrelationId: "corr", ReplyTo: "reply"})
+
+		var reply rabbitqq.BaseReplyMessage
+		err = json.Unmarshal(channel.published[len(channel.published)-1].Body, &reply)
+		require.NoError(t, err)
+
+		return reply
+	}
+
+	reply := send(rabbitqq.GetMessage{
+		BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.GetMessageName},
+		Key:         "a",
+	})
+	require.NotNil(t, reply.Error)
+	assert.Equal(t, rabbitqq.ErrorCodeRateLimited, reply.Error.Code)
+
+	reply = send(rabbitqq.AddMessage{
+		BaseMessage: rabbitqq.BaseMessage{Name: rabbitqq.AddMessageName},
+		Key:         "a",
+		Value:       "b",
+	})
+	require.NotNil(t, reply.Error)
+	assert.Equal(t, rabbitqq.ErrorCodeQuotaExceeded, reply.Error.Code)
+
+	assert.Equal(t, []string{"get", "add"}, operations)
+}
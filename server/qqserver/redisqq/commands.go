@@ -0,0 +1,580 @@
+package redisqq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"qq/models"
+	"qq/pkg/version"
+	"qq/services/qq"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redisVersion is reported by HELLO and INFO; clients choose the commands
+// they send by it
+const redisVersion = "7.0.0"
+
+// defaultUsername is the user of AUTH and HELLO when no username is given
+const defaultUsername = "default"
+
+// connectionOperation names the commands that manage the connection; they
+// are recorded in the metrics but not rate limited
+const connectionOperation = "connection"
+
+const defaultScanCount = 10
+
+// keysPageLength is how many keys KEYS reads at a time
+const keysPageLength = 1000
+
+type command struct {
+	// operation names the command for metrics and rate limits after the
+	// operations of the other transports
+	operation string
+	// arity counts the command name; a negative arity is the minimum
+	arity int
+	// beforeAuth commands may be sent before the connection is authenticated
+	beforeAuth bool
+	handle     func(s *server, ctx context.Context, c *connection, args []string) error
+}
+
+var commands = map[string]command{
+	"ping":   {operation: connectionOperation, arity: -1, handle: (*server).ping},
+	"quit":   {operation: connectionOperation, arity: 1, beforeAuth: true, handle: (*server).quit},
+	"auth":   {operation: connectionOperation, arity: -2, beforeAuth: true, handle: (*server).auth},
+	"hello":  {operation: connectionOperation, arity: -1, beforeAuth: true, handle: (*server).hello},
+	"select": {operation: connectionOperation, arity: 2, handle: (*server).selectDB},
+	"info":   {operation: "info", arity: -1, handle: (*server).info},
+	"get":    {operation: "get", arity: 2, handle: (*server).get},
+	"mget":   {operation: "get", arity: -2, handle: (*server).mget},
+	"exists": {operation: "get", arity: -2, handle: (*server).exists},
+	"set":    {operation: "add", arity: -3, handle: (*server).set},
+	"mset":   {operation: "add", arity: -3, handle: (*server).mset},
+	"del":    {operation: "remove", arity: -2, handle: (*server).del},
+	"keys":   {operation: "get_all", arity: 2, handle: (*server).keys},
+	"scan":   {operation: "get_all", arity: -2, handle: (*server).scan},
+}
+
+// errNotSet aborts an update that finds the key in another state than the
+// command expects, e.g. SET NX finding it set
+var errNotSet = errors.New("condition not met")
+
+func (s *server) ping(ctx context.Context, c *connection, args []string) error {
+	switch len(args) {
+	case 0:
+		c.writer.simple("PONG")
+	case 1:
+		c.writer.bulk(args[0])
+	default:
+		return wrongArgumentsError("ping")
+	}
+
+	return nil
+}
+
+func (s *server) quit(ctx context.Context, c *connection, args []string) error {
+	c.closing = true
+	c.writer.simple("OK")
+
+	return nil
+}
+
+// auth takes either a password or a username and a password
+func (s *server) auth(ctx context.Context, c *connection, args []string) error {
+	username, password := defaultUsername, args[0]
+
+	switch len(args) {
+	case 1:
+	case 2:
+		username, password = args[0], args[1]
+	default:
+		return errSyntax
+	}
+
+	err := s.authenticateCredentials(ctx, c, username, password)
+	if err != nil {
+		return err
+	}
+
+	c.writer.simple("OK")
+
+	return nil
+}
+
+// hello switches the connection to RESP3 or back to RESP2, authenticating
+// it on the way when AUTH is given
+func (s *server) hello(ctx context.Context, c *connection, args []string) error {
+	protocol := c.writer.protocol
+
+	if len(args) > 0 {
+		var err error
+
+		protocol, err = strconv.Atoi(args[0])
+		if err != nil {
+			return replyError("ERR Protocol version is not an integer or out of range")
+		}
+
+		if protocol != 2 && protocol != 3 {
+			return errNoProto
+		}
+	}
+
+	var credentials []string
+	name := c.name
+
+	for i := 1; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "auth") && i+2 < len(args):
+			credentials = args[i+1 : i+3]
+			i += 2
+		case strings.EqualFold(args[i], "setname") && i+1 < len(args):
+			name = args[i+1]
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	if credentials != nil {
+		err := s.authenticateCredentials(ctx, c, credentials[0], credentials[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.authenticator != nil && !c.authenticated {
+		return errNoAuth
+	}
+
+	c.writer.protocol = protocol
+	c.name = name
+
+	c.writer.mapHeader(7)
+	c.writer.bulk("server")
+	c.writer.bulk("redis")
+	c.writer.bulk("version")
+	c.writer.bulk(redisVersion)
+	c.writer.bulk("proto")
+	c.writer.integer(int64(protocol))
+	c.writer.bulk("id")
+	c.writer.integer(c.id)
+	c.writer.bulk("mode")
+	c.writer.bulk("standalone")
+	c.writer.bulk("role")
+	c.writer.bulk("master")
+	c.writer.bulk("modules")
+	c.writer.array(0)
+
+	return nil
+}
+
+// selectDB accepts only the database 0, the only one there is
+func (s *server) selectDB(ctx context.Context, c *connection, args []string) error {
+	index, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errNotInteger
+	}
+
+	if index != 0 {
+		return errDBOutOfRange
+	}
+
+	c.writer.simple("OK")
+
+	return nil
+}
+
+// info writes the server, clients and keyspace sections, or those of them
+// that are asked for
+func (s *server) info(ctx context.Context, c *connection, args []string) error {
+	sections := map[string]bool{}
+	for _, arg := range args {
+		sections[strings.ToLower(arg)] = true
+	}
+
+	all := len(args) == 0 || sections["default"] || sections["all"] || sections["everything"]
+
+	var lines []string
+
+	if all || sections["server"] {
+		lines = append(lines,
+			"# Server",
+			"redis_version:"+redisVersion,
+			"redis_mode:standalone",
+			"qq_version:"+version.Get().Version,
+			"process_id:"+strconv.Itoa(os.Getpid()),
+			"uptime_in_seconds:"+strconv.FormatInt(int64(time.Since(s.started)/time.Second), 10),
+			"",
+		)
+	}
+
+	if all || sections["clients"] {
+		lines = append(lines,
+			"# Clients",
+			"connected_clients:"+strconv.FormatInt(atomic.LoadInt64(&s.connections), 10),
+			"",
+		)
+	}
+
+	if all || sections["keyspace"] {
+		lines = append(lines, "# Keyspace")
+
+		keys := s.service.Keys(ctx)
+		if keys > 0 {
+			lines = append(lines, fmt.Sprintf("db0:keys=%d,expires=%d,avg_ttl=0", keys, s.service.ExpiringKeys(ctx)))
+		}
+
+		lines = append(lines, "")
+	}
+
+	c.writer.verbatim(strings.Join(lines, "\r\n"))
+
+	return nil
+}
+
+func validKeys(keys ...string) error {
+	for _, key := range keys {
+		if key == "" {
+			return errEmptyKey
+		}
+	}
+
+	return nil
+}
+
+// authorize checks all keys up front, so that a command touching a key it
+// may not is refused as a whole, as Redis does
+func (s *server) authorize(ctx context.Context, action qq.Action, keys ...string) error {
+	err := validKeys(keys...)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := s.service.Authorize(ctx, action, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *server) get(ctx context.Context, c *connection, args []string) error {
+	err := s.authorize(ctx, qq.ActionRead, args[0])
+	if err != nil {
+		return err
+	}
+
+	entity := s.service.Get(ctx, args[0])
+	if entity == nil {
+		c.writer.null()
+		return nil
+	}
+
+	c.writer.bulk(entity.Value)
+
+	return nil
+}
+
+func (s *server) mget(ctx context.Context, c *connection, args []string) error {
+	err := s.authorize(ctx, qq.ActionRead, args...)
+	if err != nil {
+		return err
+	}
+
+	entities := s.service.GetBatch(ctx, args)
+
+	c.writer.array(len(entities))
+	for _, entity := range entities {
+		if entity == nil {
+			c.writer.null()
+			continue
+		}
+
+		c.writer.bulk(entity.Value)
+	}
+
+	return nil
+}
+
+// exists counts a key as many times as it is given
+func (s *server) exists(ctx context.Context, c *connection, args []string) error {
+	err := s.authorize(ctx, qq.ActionRead, args...)
+	if err != nil {
+		return err
+	}
+
+	count := int64(0)
+	for _, entity := range s.service.GetBatch(ctx, args) {
+		if entity != nil {
+			count++
+		}
+	}
+
+	c.writer.integer(count)
+
+	return nil
+}
+
+// set supports the EX, PX, NX and XX options; a SET whose condition does
+// not hold replies null
+func (s *server) set(ctx context.Context, c *connection, args []string) error {
+	key, value := args[0], args[1]
+
+	err := validKeys(key)
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	var nx, xx bool
+
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); option {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if ttl != 0 || i+1 == len(args) {
+				return errSyntax
+			}
+
+			ttl, err = parseTTL(args[i+1], option)
+			if err != nil {
+				return err
+			}
+
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	if nx && xx {
+		return errSyntax
+	}
+
+	entity, err := s.service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+		if (nx && current != nil) || (xx && current == nil) {
+			return nil, errNotSet
+		}
+
+		return &models.Entity{Key: key, Value: value}, nil
+	})
+	if errors.Is(err, errNotSet) {
+		c.writer.null()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// writing the entity dropped its previous TTL
+	if ttl != 0 {
+		err = s.service.Expire(ctx, key, entity.Version, ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.writer.simple("OK")
+
+	return nil
+}
+
+func parseTTL(value string, option string) (time.Duration, error) {
+	unit := time.Second
+	if option == "px" {
+		unit = time.Millisecond
+	}
+
+	ttl, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+
+	if ttl <= 0 || ttl > math.MaxInt64/int64(unit) {
+		return 0, errInvalidExpire
+	}
+
+	return time.Duration(ttl) * unit, nil
+}
+
+// mset replies an error when any of the keys could not be set; the others
+// stay set
+func (s *server) mset(ctx context.Context, c *connection, args []string) error {
+	if len(args)%2 != 0 {
+		return wrongArgumentsError("mset")
+	}
+
+	entities := make([]models.Entity, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		entities = append(entities, models.Entity{Key: args[i], Value: args[i+1]})
+	}
+
+	for _, entity := range entities {
+		err := s.authorize(ctx, qq.ActionWrite, entity.Key)
+		if err != nil {
+			return err
+		}
+
+		err = s.service.CheckQuota(ctx, entity)
+		if err != nil {
+			return err
+		}
+	}
+
+	added := s.service.AddBatch(ctx, entities)
+
+	for _, ok := range added {
+		if !ok {
+			return errPartialSuccess
+		}
+	}
+
+	c.writer.simple("OK")
+
+	return nil
+}
+
+// del counts only the keys that existed
+func (s *server) del(ctx context.Context, c *connection, args []string) error {
+	err := s.authorize(ctx, qq.ActionWrite, args...)
+	if err != nil {
+		return err
+	}
+
+	count := int64(0)
+
+	for _, key := range args {
+		// the service reports every removal as done, so the keys that exist
+		// are told apart by removing them in an update
+		_, err := s.service.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+			if current == nil {
+				return nil, errNotSet
+			}
+
+			return nil, nil
+		})
+		if errors.Is(err, errNotSet) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		count++
+	}
+
+	c.writer.integer(count)
+
+	return nil
+}
+
+func (s *server) keys(ctx context.Context, c *connection, args []string) error {
+	var matched []string
+
+	after := ""
+	for {
+		entities, next := s.service.Scan(ctx, after, keysPageLength)
+
+		for _, entity := range entities {
+			if matchGlob(args[0], entity.Key) {
+				matched = append(matched, entity.Key)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	c.writer.array(len(matched))
+	for _, key := range matched {
+		c.writer.bulk(key)
+	}
+
+	return nil
+}
+
+// scan walks the keys in order, its cursor standing for the last key read:
+// keys added or removed during the scan do not move the others, and a key
+// present from the start to the end of the scan is returned exactly once
+func (s *server) scan(ctx context.Context, c *connection, args []string) error {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errInvalidCursor
+	}
+
+	after := ""
+	if cursor != 0 {
+		var ok bool
+
+		after, ok = s.cursors.get(cursor)
+		if !ok {
+			return errInvalidCursor
+		}
+	}
+
+	pattern := "*"
+	count := uint64(defaultScanCount)
+	keyType := "string"
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errSyntax
+		}
+
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if count == 0 {
+				return errSyntax
+			}
+		case "type":
+			keyType = strings.ToLower(args[i+1])
+		default:
+			return errSyntax
+		}
+	}
+
+	if count > math.MaxInt32 {
+		count = math.MaxInt32
+	}
+
+	entities, last := s.service.Scan(ctx, after, int(count))
+
+	var matched []string
+	for _, entity := range entities {
+		// all values are strings
+		if keyType == "string" && matchGlob(pattern, entity.Key) {
+			matched = append(matched, entity.Key)
+		}
+	}
+
+	next := uint64(0)
+	if last != "" {
+		next = s.cursors.add(last)
+	}
+
+	c.writer.array(2)
+	c.writer.bulk(strconv.FormatUint(next, 10))
+	c.writer.array(len(matched))
+	for _, key := range matched {
+		c.writer.bulk(key)
+	}
+
+	return nil
+}
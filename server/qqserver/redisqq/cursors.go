@@ -0,0 +1,48 @@
+package redisqq
+
+import (
+	"sync"
+	"time"
+)
+
+// maxScanCursors bounds the cursors a server remembers; a scan whose cursor
+// was forgotten fails with errInvalidCursor and has to start again
+const maxScanCursors = 4096
+
+// scanCursors maps the cursors of SCAN, which clients parse as integers, to
+// the last key read. They are shared by the connections since a client may
+// continue a scan on another connection of its pool.
+type scanCursors struct {
+	mu   sync.Mutex
+	last uint64
+	keys map[uint64]string
+}
+
+// newScanCursors starts from the creation time so that a cursor from before
+// a restart is not mistaken for a new one
+func newScanCursors() *scanCursors {
+	return &scanCursors{
+		last: uint64(time.Now().UnixNano()),
+		keys: map[uint64]string{},
+	}
+}
+
+// add returns a new cursor resuming after key, and forgets the oldest one
+func (c *scanCursors) add(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.last++
+	c.keys[c.last] = key
+	delete(c.keys, c.last-maxScanCursors)
+
+	return c.last
+}
+
+func (c *scanCursors) get(cursor uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.keys[cursor]
+	return key, ok
+}
@@ -0,0 +1,63 @@
+package redisqq
+
+import (
+	"errors"
+	"fmt"
+	"qq/services/qq"
+	"strings"
+)
+
+// replyError is sent to the client as is; its first word is the error code,
+// as in Redis
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+const (
+	errInternal       replyError = "ERR internal server error"
+	errSyntax         replyError = "ERR syntax error"
+	errNotInteger     replyError = "ERR value is not an integer or out of range"
+	errInvalidExpire  replyError = "ERR invalid expire time in 'set' command"
+	errEmptyKey       replyError = "ERR empty keys are not supported"
+	errInvalidCursor  replyError = "ERR invalid cursor"
+	errDBOutOfRange   replyError = "ERR DB index is out of range"
+	errNoAuth         replyError = "NOAUTH Authentication required."
+	errWrongPass      replyError = "WRONGPASS invalid username-password pair or user is disabled."
+	errNoPassword     replyError = "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"
+	errNoProto        replyError = "NOPROTO unsupported protocol version"
+	errPartialSuccess replyError = "ERR some of the keys were not set"
+)
+
+func wrongArgumentsError(name string) replyError {
+	return replyError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+}
+
+func unknownCommandError(name string, args []string) replyError {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, "'"+arg+"'")
+	}
+
+	return replyError(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", name, strings.Join(quoted, " ")))
+}
+
+// replyText maps the errors of the service to the error codes Redis uses for
+// the same conditions: NOPERM for access control and OOM for a full quota
+func replyText(err error) string {
+	var reply replyError
+
+	switch {
+	case errors.As(err, &reply):
+		return reply.Error()
+	case errors.Is(err, qq.ErrPermissionDenied):
+		return "NOPERM " + err.Error()
+	case errors.Is(err, qq.ErrRateLimited):
+		return "ERR " + err.Error()
+	case errors.Is(err, qq.ErrQuotaExceeded):
+		return "OOM " + err.Error()
+	default:
+		return errInternal.Error()
+	}
+}
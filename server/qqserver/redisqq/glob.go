@@ -0,0 +1,100 @@
+package redisqq
+
+// matchGlob matches key against a pattern of KEYS and SCAN MATCH as Redis
+// does: * and ? match any characters, including '/', [abc], [^abc] and [a-z]
+// match sets of characters, and \ escapes the next character
+func matchGlob(pattern string, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(key); i++ {
+				if matchGlob(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+
+			return false
+
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+
+			key = key[1:]
+			pattern = pattern[1:]
+
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+
+			var matched bool
+			matched, pattern = matchSet(pattern[1:], key[0])
+			if !matched {
+				return false
+			}
+
+			key = key[1:]
+
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+
+			key = key[1:]
+			pattern = pattern[1:]
+		}
+	}
+
+	return len(key) == 0
+}
+
+// matchSet matches c against the set at the start of pattern, which follows
+// the '[', and returns the rest of the pattern after the closing ']'
+func matchSet(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			low, high := pattern[0], pattern[2]
+			if low > high {
+				low, high = high, low
+			}
+
+			matched = matched || (c >= low && c <= high)
+			pattern = pattern[3:]
+
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+
+	return matched != negate, pattern
+}
@@ -0,0 +1,197 @@
+package redisqq
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// limits of a request, the same as the defaults of Redis
+const (
+	maxArguments    = 1024 * 1024
+	maxBulkLength   = 512 * 1024 * 1024
+	maxInlineLength = 64 * 1024
+)
+
+// the lengths announced by a request are only allocated up to these, the
+// rest grows as the data actually arrives
+const (
+	preallocArguments  = 1024
+	preallocBulkLength = 64 * 1024
+)
+
+// errProtocol closes the connection, as Redis does after a malformed request
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads a command sent either as an array of bulk strings, as
+// clients do, or inline, as typed into telnet
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	prefix, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix[0] != '*' {
+		line, err := readLine(reader, maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+
+		return strings.Fields(line), nil
+	}
+
+	line, err := readLine(reader, maxInlineLength)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxArguments {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+
+	args := make([]string, 0, minInt(count, preallocArguments))
+
+	for i := 0; i < count; i++ {
+		line, err := readLine(reader, maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "" || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+
+		bulk, err := readBulk(reader, length)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, bulk)
+	}
+
+	return args, nil
+}
+
+// readBulk reads a bulk string of length bytes and its CRLF
+func readBulk(reader *bufio.Reader, length int) (string, error) {
+	var bulk strings.Builder
+	bulk.Grow(minInt(length, preallocBulkLength))
+
+	_, err := io.CopyN(&bulk, reader, int64(length))
+	if errors.Is(err, io.EOF) {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var terminator [2]byte
+
+	_, err = io.ReadFull(reader, terminator[:])
+	if errors.Is(err, io.EOF) {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if terminator != [2]byte{'\r', '\n'} {
+		return "", fmt.Errorf("%w: bulk string is not terminated", errProtocol)
+	}
+
+	return bulk.String(), nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readLine reads a line terminated by CRLF, or by LF alone in inline commands
+func readLine(reader *bufio.Reader, maxLength int) (string, error) {
+	var line []byte
+
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+
+		line = append(line, chunk...)
+		if len(line) > maxLength {
+			return "", fmt.Errorf("%w: too big request", errProtocol)
+		}
+
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// writer writes the replies in the protocol chosen by HELLO; RESP2 has no
+// null, map or verbatim types and falls back to their RESP2 equivalents
+type writer struct {
+	*bufio.Writer
+	protocol int
+}
+
+func (w writer) simple(value string) {
+	w.WriteString("+" + value + "\r\n")
+}
+
+func (w writer) error(value string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(value) + "\r\n")
+}
+
+func (w writer) integer(value int64) {
+	w.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+}
+
+func (w writer) bulk(value string) {
+	w.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+// null is the reply of a missing key
+func (w writer) null() {
+	if w.protocol == 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(length int) {
+	w.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+// mapHeader is followed by length keys and values
+func (w writer) mapHeader(length int) {
+	if w.protocol == 3 {
+		w.WriteString("%" + strconv.Itoa(length) + "\r\n")
+		return
+	}
+
+	w.array(length * 2)
+}
+
+// verbatim is the reply of INFO, text that is meant to be shown as is
+func (w writer) verbatim(value string) {
+	if w.protocol == 3 {
+		w.WriteString("=" + strconv.Itoa(len(value)+4) + "\r\ntxt:" + value + "\r\n")
+		return
+	}
+
+	w.bulk(value)
+}
@@ -0,0 +1,270 @@
+package redisqq
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"qq/pkg/auth"
+	"qq/pkg/log"
+	"qq/pkg/qqcontext"
+	"qq/pkg/qqtls"
+	"qq/server/qqserver"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Options struct {
+	// Metrics are recorded when set; they are served by the metrics server
+	Metrics metrics.Metrics
+	// Authenticator verifies the password of AUTH and HELLO; connections
+	// are not authenticated when it is nil
+	Authenticator auth.Authenticator
+	// TLS serves over TLS when set; a verified client certificate
+	// authenticates the connection as the subject common name
+	TLS *tls.Config
+}
+
+type server struct {
+	address       string
+	service       qq.Service
+	metrics       metrics.Metrics
+	authenticator auth.Authenticator
+	tls           *tls.Config
+	cursors       *scanCursors
+	connections   int64
+	lastId        int64
+	started       time.Time
+}
+
+var _ qqserver.Server = &server{}
+
+func NewServer(ctx context.Context, address string, service qq.Service, options Options) (qqserver.Server, error) {
+	log.Debug(ctx, "create new redis server", log.Args{"address": address})
+
+	return newServer(address, service, options), nil
+}
+
+func newServer(address string, service qq.Service, options Options) *server {
+	return &server{
+		address:       address,
+		service:       service,
+		metrics:       options.Metrics,
+		authenticator: options.Authenticator,
+		tls:           options.TLS,
+		cursors:       newScanCursors(),
+		started:       time.Now(),
+	}
+}
+
+func (s *server) Serve() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	}
+
+	return s.serve(listener)
+}
+
+// serve returns nil once listener is closed
+func (s *server) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept: %w", err)
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+// connection is the state RESP keeps per connection: the protocol chosen by
+// HELLO and the identity authenticated by AUTH
+type connection struct {
+	id            int64
+	conn          net.Conn
+	reader        *bufio.Reader
+	writer        writer
+	ctx           context.Context
+	authenticated bool
+	name          string
+	closing       bool
+}
+
+func (s *server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// handleCommand recovers on its own, this covers reading the commands
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			log.Error(context.Background(), "connection panicked", log.Args{"panic": recovered, "remote": conn.RemoteAddr().String()})
+		}
+	}()
+
+	atomic.AddInt64(&s.connections, 1)
+	defer atomic.AddInt64(&s.connections, -1)
+
+	c := &connection{
+		id:     atomic.AddInt64(&s.lastId, 1),
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: writer{Writer: bufio.NewWriter(conn), protocol: 2},
+		ctx:    qqcontext.WithTransportValue(context.Background(), metrics.TransportRedis),
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			log.Warning(c.ctx, "TLS handshake failed", log.Args{"error": err, "remote": conn.RemoteAddr().String()})
+			return
+		}
+
+		state := tlsConn.ConnectionState()
+
+		identity, verified := qqtls.Identity(&state)
+		if verified {
+			c.authenticate(identity)
+		}
+	}
+
+	for !c.closing {
+		args, err := readCommand(c.reader)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.writer.error("ERR " + err.Error())
+				_ = c.writer.Flush()
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warning(c.ctx, "failed to read command", log.Args{"error": err, "remote": conn.RemoteAddr().String()})
+			}
+
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		s.handleCommand(c, args)
+
+		// pipelined commands are answered together
+		if c.reader.Buffered() > 0 {
+			continue
+		}
+
+		err = c.writer.Flush()
+		if err != nil {
+			log.Warning(c.ctx, "failed to write reply", log.Args{"error": err, "remote": conn.RemoteAddr().String()})
+			return
+		}
+	}
+
+	_ = c.writer.Flush()
+}
+
+func (c *connection) authenticate(identity qqcontext.Identity) {
+	c.ctx = qqcontext.WithIdentityValue(c.ctx, identity)
+	c.ctx = qqcontext.WithUserIdValue(c.ctx, identity.UserId)
+	c.authenticated = true
+}
+
+// handleCommand runs a command with the authenticated and admitted context,
+// and replies with its error
+func (s *server) handleCommand(c *connection, args []string) {
+	name := strings.ToLower(args[0])
+
+	cmd, ok := commands[name]
+
+	operation := "unknown"
+	if ok {
+		operation = cmd.operation
+	}
+
+	ctx := qqcontext.WithRequestIdValue(c.ctx, qqcontext.NewRequestId())
+
+	request := qqserver.Request{
+		Transport: metrics.TransportRedis,
+		Operation: operation,
+		Name:      name,
+		Metrics:   s.metrics,
+		Internal:  errInternal,
+	}
+
+	err := qqserver.Handle(ctx, request, func(ctx context.Context) error {
+		err := s.checkCommand(ctx, c, name, cmd, ok, args)
+		if err != nil {
+			return err
+		}
+
+		return cmd.handle(s, ctx, c, args[1:])
+	})
+	if err != nil {
+		c.writer.error(replyText(err))
+	}
+}
+
+func (s *server) checkCommand(ctx context.Context, c *connection, name string, cmd command, ok bool, args []string) error {
+	if !ok {
+		return unknownCommandError(name, args[1:])
+	}
+
+	if s.authenticator != nil && !c.authenticated && !cmd.beforeAuth {
+		return errNoAuth
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		return wrongArgumentsError(name)
+	}
+
+	if cmd.operation == connectionOperation {
+		return nil
+	}
+
+	return qqserver.Admit(ctx, s.service, cmd.operation)
+}
+
+// authenticateCredentials maps the username and password of AUTH to the
+// credentials of the other transports: the password is the token, and the
+// username its scheme, where "default", the user of AUTH without a username,
+// stands for an API key
+func (s *server) authenticateCredentials(ctx context.Context, c *connection, username string, password string) error {
+	if s.authenticator == nil {
+		return errNoPassword
+	}
+
+	credentials := auth.Credentials{Scheme: auth.SchemeAPIKey, Token: password}
+
+	if username != defaultUsername {
+		parsed, err := auth.ParseCredentials(username + " " + password)
+		if err != nil {
+			return errWrongPass
+		}
+
+		credentials = parsed
+	}
+
+	identity, err := s.authenticator.Authenticate(ctx, credentials)
+	if err != nil {
+		log.Warning(ctx, "failed to authenticate", log.Args{"error": err})
+		return errWrongPass
+	}
+
+	c.authenticate(identity)
+
+	return nil
+}
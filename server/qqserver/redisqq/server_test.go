@@ -0,0 +1,380 @@
+package redisqq
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"qq/models"
+	"qq/pkg/auth"
+	"qq/pkg/qqcontext"
+	"qq/services/qq"
+	"qq/services/qq/qqtest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer serves service on a loopback port and returns its address
+func newTestServer(t *testing.T, service qq.Service, options Options) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := newServer(listener.Addr().String(), service, options)
+	go func() {
+		_ = s.serve(listener)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return listener.Addr().String()
+}
+
+func newTestClient(t *testing.T, address string, password string) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: address, Password: password})
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t, newTestServer(t, qqtest.NewService(t), Options{}), "")
+
+	assert.Equal(t, "PONG", client.Ping(ctx).Val())
+
+	require.NoError(t, client.Set(ctx, "a", "1", 0).Err())
+
+	value, err := client.Get(ctx, "a").Result()
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+
+	_, err = client.Get(ctx, "missing").Result()
+	assert.ErrorIs(t, err, redis.Nil)
+
+	err = client.SetArgs(ctx, "a", "2", redis.SetArgs{Mode: "NX"}).Err()
+	assert.ErrorIs(t, err, redis.Nil)
+
+	set, err := client.SetXX(ctx, "missing", "2", 0).Result()
+	require.NoError(t, err)
+	assert.False(t, set)
+
+	set, err = client.SetXX(ctx, "a", "2", 0).Result()
+	require.NoError(t, err)
+	assert.True(t, set)
+
+	require.NoError(t, client.MSet(ctx, "team-a/x", "3", "team-b/x", "4").Err())
+
+	values, err := client.MGet(ctx, "a", "missing", "team-a/x").Result()
+	require.NoError(t, err)
+	assert.Equal(t, []any{"2", nil, "3"}, values)
+
+	exists, err := client.Exists(ctx, "a", "missing", "a").Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), exists)
+
+	keys, err := client.Keys(ctx, "team-*/x").Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"team-a/x", "team-b/x"}, keys)
+
+	scanned := []string{}
+	iterator := client.Scan(ctx, 0, "team-*", 1).Iterator()
+	for iterator.Next(ctx) {
+		scanned = append(scanned, iterator.Val())
+	}
+	require.NoError(t, iterator.Err())
+	assert.Equal(t, []string{"team-a/x", "team-b/x"}, scanned)
+
+	removed, err := client.Del(ctx, "a", "missing").Result()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), removed)
+
+	info, err := client.Info(ctx, "keyspace").Result()
+	require.NoError(t, err)
+	assert.Contains(t, info, "db0:keys=2,")
+
+	require.NoError(t, client.Set(ctx, "expiring", "5", 50*time.Millisecond).Err())
+	assert.Equal(t, int64(1), client.Exists(ctx, "expiring").Val())
+	assert.Eventually(t, func() bool {
+		return client.Exists(ctx, "expiring").Val() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.Set(ctx, "expiring", "6", 50*time.Millisecond).Err())
+	require.NoError(t, client.Set(ctx, "expiring", "7", 0).Err())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "7", client.Get(ctx, "expiring").Val())
+}
+
+// TestRESP2 talks to the server as the clients that never send HELLO do
+func TestScanWithRemovals(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t, newTestServer(t, qqtest.NewService(t), Options{}), "")
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.Set(ctx, fmt.Sprintf("k%d", i), "v", 0).Err())
+	}
+
+	keys, cursor, err := client.Scan(ctx, 0, "", 3).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k0", "k1", "k2"}, keys)
+
+	// removing keys already returned and keys still ahead moves no other key
+	require.NoError(t, client.Del(ctx, "k0", "k1", "k4").Err())
+
+	for cursor != 0 {
+		var page []string
+		page, cursor, err = client.Scan(ctx, cursor, "", 3).Result()
+		require.NoError(t, err)
+		keys = append(keys, page...)
+	}
+
+	assert.Equal(t, []string{"k0", "k1", "k2", "k3", "k5", "k6", "k7", "k8", "k9"}, keys)
+
+	err = client.Scan(ctx, 12345, "", 3).Err()
+	assert.EqualError(t, err, string(errInvalidCursor))
+}
+
+func TestRESP2(t *testing.T) {
+	conn, err := net.Dial("tcp", newTestServer(t, qqtest.NewService(t), Options{}))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	testCases := []struct {
+		name    string
+		request string
+		exp     []string
+	}{
+		{
+			name:    "Inline",
+			request: "PING\r\n",
+			exp:     []string{"+PONG"},
+		},
+		{
+			name:    "MissingKey",
+			request: "*2\r\n$3\r\nGET\r\n$1\r\nx\r\n",
+			exp:     []string{"$-1"},
+		},
+		{
+			name:    "Pipelined",
+			request: "*3\r\n$3\r\nSET\r\n$1\r\nx\r\n$3\r\na\nb\r\n*2\r\n$3\r\nget\r\n$1\r\nx\r\n",
+			exp:     []string{"+OK", "$3", "a\nb"},
+		},
+		{
+			name:    "Hello",
+			request: "HELLO 2\r\n",
+			exp:     []string{"*14", "$6", "server", "$5", "redis", "$7", "version", "$5", "7.0.0", "$5", "proto", ":2"},
+		},
+		{
+			name:    "UnknownCommand",
+			request: "FLUSHALL ASYNC\r\n",
+			exp:     []string{"-ERR unknown command 'flushall', with args beginning with: 'ASYNC'"},
+		},
+		{
+			name:    "WrongArguments",
+			request: "GET\r\n",
+			exp:     []string{"-ERR wrong number of arguments for 'get' command"},
+		},
+		{
+			name:    "Syntax",
+			request: "SET x y NX XX\r\n",
+			exp:     []string{"-ERR syntax error"},
+		},
+		{
+			name:    "InvalidExpire",
+			request: "SET x y EX 0\r\n",
+			exp:     []string{"-ERR invalid expire time in 'set' command"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, err := conn.Write([]byte(testCase.request))
+		require.NoError(t, err, testCase.name)
+
+		for _, exp := range testCase.exp {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err, testCase.name)
+
+			// the value "a\nb" is read in two lines
+			if exp == "a\nb" {
+				rest, err := reader.ReadString('\n')
+				require.NoError(t, err, testCase.name)
+				line += rest
+			}
+
+			assert.Equal(t, exp+"\r\n", line, testCase.name)
+		}
+
+		// the rest of HELLO
+		if testCase.name == "Hello" {
+			for i := 0; i < 14; i++ {
+				_, err := reader.ReadString('\n')
+				require.NoError(t, err)
+			}
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request string
+		exp     []string
+		expErr  error
+	}{
+		{
+			name:    "Multibulk",
+			request: "*2\r\n$3\r\nGET\r\n$1\r\nx\r\n",
+			exp:     []string{"GET", "x"},
+		},
+		{
+			name:    "Inline",
+			request: "GET  x\n",
+			exp:     []string{"GET", "x"},
+		},
+		{
+			name:    "NegativeCount",
+			request: "*-1\r\n",
+			expErr:  errProtocol,
+		},
+		{
+			name:    "OversizedCount",
+			request: "*1048577\r\n",
+			expErr:  errProtocol,
+		},
+		{
+			name:    "HugeCountWithoutArguments",
+			request: "*1048576\r\n",
+			expErr:  io.EOF,
+		},
+		{
+			name:    "NegativeBulkLength",
+			request: "*1\r\n$-1\r\n",
+			expErr:  errProtocol,
+		},
+		{
+			name:    "OversizedBulkLength",
+			request: "*1\r\n$536870913\r\n",
+			expErr:  errProtocol,
+		},
+		{
+			name:    "HugeBulkLengthWithoutData",
+			request: "*1\r\n$536870912\r\nabc",
+			expErr:  io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "UnterminatedBulk",
+			request: "*1\r\n$3\r\nGETxx",
+			expErr:  errProtocol,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			args, err := readCommand(bufio.NewReader(strings.NewReader(testCase.request)))
+			assert.ErrorIs(t, err, testCase.expErr)
+			assert.Equal(t, testCase.exp, args)
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ctx := context.Background()
+
+	var userId string
+
+	service := qq.ServiceMock{
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			userId = qqcontext.GetUserIdValue(ctx)
+			return nil
+		},
+	}
+
+	address := newTestServer(t, &service, Options{Authenticator: auth.NewAPIKeys(map[string]string{"key": "alice"})})
+
+	err := newTestClient(t, address, "").Get(ctx, "a").Err()
+	assert.EqualError(t, err, string(errNoAuth))
+
+	err = newTestClient(t, address, "wrong").Get(ctx, "a").Err()
+	assert.EqualError(t, err, string(errWrongPass))
+
+	err = newTestClient(t, address, "key").Get(ctx, "a").Err()
+	assert.ErrorIs(t, err, redis.Nil)
+	assert.Equal(t, "alice", userId)
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+
+	service := qq.ServiceMock{
+		AuthorizeMock: func(ctx context.Context, action qq.Action, key string) error {
+			if action == qq.ActionWrite && key == "denied" {
+				return qq.ErrPermissionDenied
+			}
+			return nil
+		},
+		AdmitMock: func(ctx context.Context, operation string) error {
+			if operation == "get_all" {
+				return &qq.RateLimitError{}
+			}
+			return nil
+		},
+		CheckQuotaMock: func(ctx context.Context, entity models.Entity) error {
+			return qq.ErrQuotaExceeded
+		},
+		GetMock: func(ctx context.Context, key string, counter int) *models.Entity {
+			panic("get")
+		},
+	}
+
+	client := newTestClient(t, newTestServer(t, &service, Options{}), "")
+
+	err := client.Del(ctx, "a", "denied").Err()
+	assert.EqualError(t, err, "NOPERM permission denied")
+
+	err = client.Keys(ctx, "*").Err()
+	assert.ErrorContains(t, err, "ERR rate limited")
+
+	err = client.MSet(ctx, "a", "1").Err()
+	assert.EqualError(t, err, "OOM quota exceeded")
+
+	err = client.Get(ctx, "a").Err()
+	assert.EqualError(t, err, string(errInternal))
+
+	assert.Equal(t, "PONG", client.Ping(ctx).Val())
+}
+
+func TestMatchGlob(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		key     string
+		exp     bool
+	}{
+		{pattern: "*", key: "", exp: true},
+		{pattern: "*", key: "a/b", exp: true},
+		{pattern: "a*", key: "a/b", exp: true},
+		{pattern: "a*c", key: "abbc", exp: true},
+		{pattern: "a*c", key: "abbd", exp: false},
+		{pattern: "a?c", key: "abc", exp: true},
+		{pattern: "a?c", key: "ac", exp: false},
+		{pattern: "a[bc]d", key: "acd", exp: true},
+		{pattern: "a[^bc]d", key: "acd", exp: false},
+		{pattern: "a[^bc]d", key: "aed", exp: true},
+		{pattern: "a[a-c]d", key: "abd", exp: true},
+		{pattern: "a[c-a]d", key: "abd", exp: true},
+		{pattern: "a[a-c]d", key: "aed", exp: false},
+		{pattern: `a\*`, key: "a*", exp: true},
+		{pattern: `a\*`, key: "ab", exp: false},
+		{pattern: "a", key: "ab", exp: false},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.exp, matchGlob(testCase.pattern, testCase.key), "%q %q", testCase.pattern, testCase.key)
+	}
+}
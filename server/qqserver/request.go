@@ -0,0 +1,87 @@
+package qqserver
+
+import (
+	"context"
+	"fmt"
+	"qq/pkg/log"
+	"qq/server/qqserver/metrics"
+	"qq/services/qq"
+	"time"
+)
+
+// Request describes a request of a transport to Handle
+type Request struct {
+	Transport string
+	// Operation names the request in the metrics, after the operations of
+	// the other transports
+	Operation string
+	// Name identifies the request in the logs, e.g. a command or a method
+	Name string
+	// Metrics record the request when set
+	Metrics metrics.Metrics
+	// Status is the status recorded for the error of the request; it
+	// defaults to StatusOK and StatusError
+	Status func(err error) string
+	// Internal is returned in place of a panic
+	Internal error
+}
+
+// Handle runs handle for a request that the HTTP middlewares do not see: it
+// counts the request in flight, recovers from a panic, records the status
+// and latency, and logs the request once handled. The error of handle is
+// returned for the transport to reply with.
+func Handle(ctx context.Context, request Request, handle func(ctx context.Context) error) (err error) {
+	start := time.Now()
+
+	if request.Metrics != nil {
+		done := request.Metrics.StartRequest(request.Transport)
+		defer done()
+	}
+
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			log.Error(ctx, "request panicked", log.Args{"panic": recovered, "name": request.Name})
+
+			err = request.Internal
+			if err == nil {
+				err = fmt.Errorf("panicked: %v", recovered)
+			}
+		}
+
+		if request.Metrics != nil {
+			request.Metrics.ObserveRequest(request.Transport, request.Operation, request.status(err), time.Since(start))
+		}
+
+		log.Info(ctx, "handled request", log.Args{
+			"name":    request.Name,
+			"error":   err,
+			"latency": time.Since(start),
+		})
+	}()
+
+	return handle(ctx)
+}
+
+func (r Request) status(err error) string {
+	if r.Status != nil {
+		return r.Status(err)
+	}
+
+	if err != nil {
+		return metrics.StatusError
+	}
+
+	return metrics.StatusOK
+}
+
+// Admit checks the rate limit of operation for the user in ctx; transports
+// call it once the request is authenticated
+func Admit(ctx context.Context, service qq.Service, operation string) error {
+	err := service.Admit(ctx, operation)
+	if err != nil {
+		log.Warning(ctx, "rate limited", log.Args{"error": err, "operation": operation})
+	}
+
+	return err
+}
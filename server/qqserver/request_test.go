@@ -0,0 +1,61 @@
+package qqserver
+
+import (
+	"context"
+	"errors"
+	"qq/server/qqserver/metrics"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandle(t *testing.T) {
+	errHandle := errors.New("handle")
+	errInternal := errors.New("internal")
+
+	testCases := []struct {
+		name     string
+		request  Request
+		handle   func(ctx context.Context) error
+		expErr   error
+		expPanic bool
+	}{
+		{
+			name:    "ok",
+			request: Request{Metrics: metrics.New(nil, nil)},
+			handle:  func(ctx context.Context) error { return nil },
+		},
+		{
+			name:    "error",
+			request: Request{Metrics: metrics.New(nil, nil)},
+			handle:  func(ctx context.Context) error { return errHandle },
+			expErr:  errHandle,
+		},
+		{
+			name:    "panic",
+			request: Request{Internal: errInternal},
+			handle:  func(ctx context.Context) error { panic("handle") },
+			expErr:  errInternal,
+		},
+		{
+			name:     "panic without an internal error",
+			handle:   func(ctx context.Context) error { panic("handle") },
+			expPanic: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.request.Transport = metrics.TransportRabbitMQ
+			testCase.request.Operation = "get"
+
+			err := Handle(context.Background(), testCase.request, testCase.handle)
+			if testCase.expPanic {
+				assert.ErrorContains(t, err, "panicked: handle")
+				return
+			}
+
+			assert.Equal(t, testCase.expErr, err)
+		})
+	}
+}
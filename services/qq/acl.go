@@ -0,0 +1,257 @@
+package qq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"qq/pkg/log"
+	"qq/pkg/qqcontext"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionRead Action = "read"
+	// ActionWrite covers adding, updating and removing entities
+	ActionWrite Action = "write"
+	// ActionAdmin covers the admin endpoints, which are not tied to a key;
+	// they are checked against the empty key, and denied without a policy
+	ActionAdmin Action = "admin"
+)
+
+// AnyUser in Rule.Users matches every user, including unauthenticated ones
+const AnyUser = "*"
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Rule allows Users to perform Actions on Key, or on every key starting with
+// Prefix when Key is empty; an empty Prefix matches all keys
+type Rule struct {
+	Users   []string `json:"users"`
+	Key     string   `json:"key,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Actions []Action `json:"actions"`
+}
+
+func (r Rule) matches(userId string, action Action, key string) bool {
+	return r.matchesUser(userId) && r.matchesAction(action) && r.matchesKey(key)
+}
+
+func (r Rule) matchesUser(userId string) bool {
+	for _, user := range r.Users {
+		if user == AnyUser || user == userId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r Rule) matchesAction(action Action) bool {
+	for _, ruleAction := range r.Actions {
+		if ruleAction == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r Rule) matchesKey(key string) bool {
+	if r.Key != "" {
+		return r.Key == key
+	}
+
+	return strings.HasPrefix(key, r.Prefix)
+}
+
+// Policy denies everything that no rule allows
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+func (p *Policy) Allows(userId string, action Action, key string) bool {
+	for _, rule := range p.Rules {
+		if rule.matches(userId, action, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Policy) validate() error {
+	for i, rule := range p.Rules {
+		if len(rule.Users) == 0 {
+			return fmt.Errorf("rule %d has no users", i)
+		}
+
+		if rule.Key != "" && rule.Prefix != "" {
+			return fmt.Errorf("rule %d has both key and prefix", i)
+		}
+
+		for _, action := range rule.Actions {
+			if action != ActionRead && action != ActionWrite && action != ActionAdmin {
+				return fmt.Errorf("rule %d has invalid action %q", i, action)
+			}
+		}
+	}
+
+	return nil
+}
+
+func ParsePolicy(data []byte) (*Policy, error) {
+	var policy Policy
+
+	err := json.Unmarshal(data, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	err = policy.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+
+	return &policy, nil
+}
+
+type PolicySource interface {
+	Policy() *Policy
+}
+
+// PolicyFile reloads the policy when the file changes; a file that fails to
+// parse is logged and the previous policy is kept
+type PolicyFile struct {
+	path    string
+	policy  atomic.Value
+	modTime time.Time
+}
+
+var _ PolicySource = &PolicyFile{}
+
+const PolicyReloadInterval = 5 * time.Second
+
+func LoadPolicyFile(path string) (*PolicyFile, error) {
+	f := &PolicyFile{path: path}
+
+	_, err := f.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *PolicyFile) Policy() *Policy {
+	return f.policy.Load().(*Policy)
+}
+
+// Run checks the file for changes every interval until ctx is done
+func (f *PolicyFile) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := f.reload()
+			if err != nil {
+				log.Error(ctx, "failed to reload policy", log.Args{"path": f.path, "error": err})
+				continue
+			}
+
+			if reloaded {
+				log.Info(ctx, "reloaded policy", log.Args{"path": f.path, "rules": len(f.Policy().Rules)})
+			}
+		}
+	}
+}
+
+func (f *PolicyFile) reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat policy file: %w", err)
+	}
+
+	if info.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return false, err
+	}
+
+	f.policy.Store(policy)
+	f.modTime = info.ModTime()
+
+	return true, nil
+}
+
+// SystemUserId is the user of the reads and writes the service and the
+// servers make by themselves, e.g. the removal of expired entities
+const SystemUserId = "system"
+
+// systemMethod marks the identity of WithSystemIdentity, which no
+// authenticator returns
+const systemMethod = "system"
+
+// WithSystemIdentity lets ctx read and write every key whatever the policy;
+// it is for the service and the servers, never for a request
+func WithSystemIdentity(ctx context.Context) context.Context {
+	ctx = qqcontext.WithIdentityValue(ctx, qqcontext.Identity{UserId: SystemUserId, Method: systemMethod})
+	return qqcontext.WithUserIdValue(ctx, SystemUserId)
+}
+
+func isSystem(ctx context.Context) bool {
+	identity, ok := qqcontext.GetIdentityValue(ctx)
+	return ok && identity.Method == systemMethod
+}
+
+// Authorize checks the identity in ctx against the policy; everything but
+// ActionAdmin is allowed when the service has no policy
+func (s service) Authorize(ctx context.Context, action Action, key string) error {
+	return s.authorize(ctx, action, s.options.KeyPolicy.Normalize(key))
+}
+
+// authorize expects a normalized key
+func (s service) authorize(ctx context.Context, action Action, key string) error {
+	if !s.allows(ctx, action, key) {
+		log.Warning(ctx, "permission denied", log.Args{"action": action, "key": key})
+		return fmt.Errorf("%w: %s %q", ErrPermissionDenied, action, key)
+	}
+
+	return nil
+}
+
+func (s service) allows(ctx context.Context, action Action, key string) bool {
+	if isSystem(ctx) {
+		return action != ActionAdmin
+	}
+
+	if s.options.Policy == nil {
+		return action != ActionAdmin
+	}
+
+	userId := ""
+	identity, ok := qqcontext.GetIdentityValue(ctx)
+	if ok {
+		userId = identity.UserId
+	}
+
+	return s.options.Policy.Policy().Allows(userId, action, key)
+}
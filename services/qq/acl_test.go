@@ -0,0 +1,158 @@
+package qq
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"qq/models"
+	"qq/pkg/qqcontext"
+	"qq/repos/cacheqq"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `{
+	"rules": [
+		{"users": ["reader"], "actions": ["read"]},
+		{"users": ["team-a"], "prefix": "team-a/", "actions": ["read", "write"]},
+		{"users": ["*"], "key": "public", "actions": ["read"]}
+	]
+}`
+
+func TestPolicyAllows(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		userId string
+		action Action
+		key    string
+		exp    bool
+	}{
+		{name: "ReaderReads", userId: "reader", action: ActionRead, key: "team-a/x", exp: true},
+		{name: "ReaderWrites", userId: "reader", action: ActionWrite, key: "team-a/x", exp: false},
+		{name: "TeamWritesPrefix", userId: "team-a", action: ActionWrite, key: "team-a/x", exp: true},
+		{name: "TeamWritesOutsidePrefix", userId: "team-a", action: ActionWrite, key: "team-b/x", exp: false},
+		{name: "AnyoneReadsKey", userId: "", action: ActionRead, key: "public", exp: true},
+		{name: "AnyoneReadsOtherKey", userId: "", action: ActionRead, key: "public2", exp: false},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.exp, policy.Allows(testCase.userId, testCase.action, testCase.key))
+		})
+	}
+}
+
+func TestParsePolicyInvalid(t *testing.T) {
+	_, err := ParsePolicy([]byte(`{"rules": [{"users": ["a"], "actions": ["delete"]}]}`))
+	assert.Error(t, err)
+
+	_, err = ParsePolicy([]byte(`{"rules": [{"users": ["a"], "key": "a", "prefix": "a", "actions": ["read"]}]}`))
+	assert.Error(t, err)
+
+	_, err = ParsePolicy([]byte(`{"rules": [{"actions": ["read"]}]}`))
+	assert.Error(t, err)
+}
+
+func TestPolicyFileReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+
+	err := ioutil.WriteFile(path, []byte(`{"rules": []}`), 0o600)
+	require.NoError(t, err)
+
+	policyFile, err := LoadPolicyFile(path)
+	require.NoError(t, err)
+	assert.False(t, policyFile.Policy().Allows("reader", ActionRead, "a"))
+
+	go policyFile.Run(ctx, time.Millisecond)
+
+	err = ioutil.WriteFile(path, []byte(`{"rules": [{"users": ["reader"], "actions": ["read"]}]}`), 0o600)
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+
+	assert.Eventually(t, func() bool {
+		return policyFile.Policy().Allows("reader", ActionRead, "a")
+	}, time.Second, time.Millisecond)
+
+	err = ioutil.WriteFile(path, []byte(`{`), 0o600)
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, policyFile.Policy().Allows("reader", ActionRead, "a"), "broken file replaced the policy")
+}
+
+func TestServiceWithoutPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewService(newDatabaseStub(t), cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{})
+	require.NoError(t, err)
+
+	assert.NoError(t, s.Authorize(ctx, ActionRead, "a"))
+	assert.NoError(t, s.Authorize(ctx, ActionWrite, "a"))
+	assert.ErrorIs(t, s.Authorize(ctx, ActionAdmin, ""), ErrPermissionDenied)
+}
+
+type staticPolicy struct {
+	policy *Policy
+}
+
+func (p staticPolicy) Policy() *Policy {
+	return p.policy
+}
+
+func TestServiceAccessControl(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	database := newDatabaseStub(t,
+		models.Entity{Key: "team-a/x", Value: "a"},
+		models.Entity{Key: "team-b/x", Value: "b"},
+	)
+
+	s, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{Policy: staticPolicy{policy: policy}})
+	require.NoError(t, err)
+
+	teamA := qqcontext.WithIdentityValue(context.Background(), qqcontext.Identity{UserId: "team-a"})
+	reader := qqcontext.WithIdentityValue(context.Background(), qqcontext.Identity{UserId: "reader"})
+
+	assert.NotNil(t, s.Get(teamA, "team-a/x"))
+	assert.Nil(t, s.Get(teamA, "team-b/x"))
+	assert.NotNil(t, s.Get(reader, "team-b/x"))
+
+	assert.False(t, s.Add(reader, models.Entity{Key: "team-a/y", Value: "y"}))
+	assert.Nil(t, database.Database.Get("team-a/y"))
+	assert.True(t, s.Add(teamA, models.Entity{Key: "team-a/y", Value: "y"}))
+
+	assert.False(t, s.Remove(teamA, "team-b/x"))
+	assert.NotNil(t, database.Database.Get("team-b/x"))
+
+	_, err = s.Update(reader, "team-a/x", func(current *models.Entity) (*models.Entity, error) {
+		return current, nil
+	})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+
+	assert.ErrorIs(t, s.Authorize(teamA, ActionWrite, "team-b/x"), ErrPermissionDenied)
+	assert.NoError(t, s.Authorize(teamA, ActionWrite, "team-a/x"))
+
+	keys := []string{}
+	for _, entity := range s.GetAll(teamA) {
+		keys = append(keys, entity.Key)
+	}
+	assert.ElementsMatch(t, []string{"team-a/x", "team-a/y"}, keys)
+
+	// the page of team-b/x is empty, and the scan goes on
+	entities, next := s.Scan(teamA, "team-a/y", 1)
+	assert.Empty(t, entities)
+	assert.Equal(t, "team-b/x", next)
+}
@@ -0,0 +1,74 @@
+package qq
+
+import (
+	"context"
+	"errors"
+	"qq/models"
+	"qq/pkg/log"
+	"qq/pkg/qqcontext"
+	"qq/repos/auditqq"
+	"time"
+)
+
+var ErrAuditDisabled = errors.New("audit log is disabled")
+
+// requestUserId prefers the verified identity to the user id claimed by the
+// client
+func requestUserId(ctx context.Context) string {
+	identity, ok := qqcontext.GetIdentityValue(ctx)
+	if ok {
+		return identity.UserId
+	}
+
+	return qqcontext.GetUserIdValue(ctx)
+}
+
+func entityHash(entity *models.Entity) string {
+	if entity == nil {
+		return ""
+	}
+
+	return auditqq.ValueHash(entity.Value)
+}
+
+// audit records a write that has been made; a record that fails to append is
+// logged, the write itself being done already
+func (s service) audit(ctx context.Context, operation auditqq.Operation, key string, previous *models.Entity, next *models.Entity) {
+	if s.options.Audit == nil {
+		return
+	}
+
+	_, err := s.options.Audit.Append(auditqq.Record{
+		Time:      time.Now(),
+		UserId:    requestUserId(ctx),
+		Transport: qqcontext.GetTransportValue(ctx),
+		RequestId: qqcontext.GetRequestIdValue(ctx),
+		Operation: operation,
+		Key:       key,
+		OldHash:   entityHash(previous),
+		NewHash:   entityHash(next),
+	})
+	if err != nil {
+		log.Error(ctx, "failed to append audit record", log.Args{"key": key, "operation": operation, "error": err})
+	}
+}
+
+func (s service) Audit(ctx context.Context, query auditqq.Query) ([]auditqq.Record, error) {
+	if s.options.Audit == nil {
+		return nil, ErrAuditDisabled
+	}
+
+	if query.Key != "" {
+		query.Key = s.options.KeyPolicy.Normalize(query.Key)
+	}
+
+	return s.options.Audit.Query(query)
+}
+
+func (s service) VerifyAudit(ctx context.Context) (auditqq.Verification, error) {
+	if s.options.Audit == nil {
+		return auditqq.Verification{}, ErrAuditDisabled
+	}
+
+	return s.options.Audit.Verify()
+}
@@ -0,0 +1,109 @@
+package qq
+
+import (
+	"context"
+	"path/filepath"
+	"qq/models"
+	"qq/pkg/qqcontext"
+	"qq/repos/auditqq"
+	"qq/repos/cacheqq"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceAudit(t *testing.T) {
+	auditLog, err := auditqq.OpenFileLog(filepath.Join(t.TempDir(), "audit.log"), []byte("secret"))
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	database := newDatabaseStub(t, models.Entity{Key: "a", Value: "1"})
+
+	s, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{Audit: auditLog})
+	require.NoError(t, err)
+
+	ctx := qqcontext.WithIdentityValue(context.Background(), qqcontext.Identity{UserId: "alice"})
+	ctx = qqcontext.WithUserIdValue(ctx, "mallory")
+	ctx = qqcontext.WithTransportValue(ctx, "http")
+	ctx = qqcontext.WithRequestIdValue(ctx, "request")
+
+	assert.True(t, s.Add(ctx, models.Entity{Key: "a", Value: "2"}))
+	assert.True(t, s.Remove(ctx, "a"))
+
+	_, err = s.Update(ctx, "b", func(current *models.Entity) (*models.Entity, error) {
+		return &models.Entity{Value: "3"}, nil
+	})
+	require.NoError(t, err)
+
+	records, err := s.Audit(ctx, auditqq.Query{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	assert.Equal(t, auditqq.OperationAdd, records[0].Operation)
+	assert.Equal(t, "alice", records[0].UserId)
+	assert.Equal(t, "http", records[0].Transport)
+	assert.Equal(t, "request", records[0].RequestId)
+	assert.Equal(t, auditqq.ValueHash("1"), records[0].OldHash)
+	assert.Equal(t, auditqq.ValueHash("2"), records[0].NewHash)
+
+	assert.Equal(t, auditqq.OperationRemove, records[1].Operation)
+	assert.Equal(t, auditqq.ValueHash("2"), records[1].OldHash)
+	assert.Empty(t, records[1].NewHash)
+
+	assert.Equal(t, auditqq.OperationUpdate, records[2].Operation)
+	assert.Empty(t, records[2].OldHash)
+	assert.Equal(t, auditqq.ValueHash("3"), records[2].NewHash)
+
+	verification, err := s.VerifyAudit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, auditqq.Verification{Records: 3, Valid: true}, verification)
+}
+
+func TestServiceAuditDisabled(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewService(newDatabaseStub(t), cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{})
+	require.NoError(t, err)
+
+	_, err = s.Audit(ctx, auditqq.Query{})
+	assert.ErrorIs(t, err, ErrAuditDisabled)
+
+	_, err = s.VerifyAudit(ctx)
+	assert.ErrorIs(t, err, ErrAuditDisabled)
+}
+
+func TestServiceExpireAudit(t *testing.T) {
+	auditLog, err := auditqq.OpenFileLog(filepath.Join(t.TempDir(), "audit.log"), []byte("secret"))
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	// the policy does not name the system user
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	s, err := NewService(newDatabaseStub(t), cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{Audit: auditLog, Policy: staticPolicy{policy: policy}})
+	require.NoError(t, err)
+
+	teamA := qqcontext.WithIdentityValue(context.Background(), qqcontext.Identity{UserId: "team-a"})
+
+	ctx, cancel := context.WithCancel(teamA)
+	ctx = qqcontext.WithRequestIdValue(ctx, "request")
+
+	require.True(t, s.Add(ctx, models.Entity{Key: "team-a/a", Value: "1"}))
+	require.NoError(t, s.Expire(ctx, "team-a/a", s.Get(ctx, "team-a/a").Version, 10*time.Millisecond))
+
+	// the request is over before the entity expires
+	cancel()
+
+	require.Eventually(t, func() bool { return s.Get(teamA, "team-a/a") == nil }, time.Second, time.Millisecond)
+
+	records, err := s.Audit(context.Background(), auditqq.Query{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	assert.Equal(t, SystemUserId, records[1].UserId)
+	assert.NotEqual(t, "request", records[1].RequestId)
+	assert.Empty(t, records[1].NewHash)
+}
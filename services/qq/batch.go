@@ -0,0 +1,59 @@
+package qq
+
+import (
+	"context"
+	"qq/models"
+	"qq/pkg/log"
+)
+
+// GetBatch loads every distinct key once, so that a key repeated in the batch
+// costs a single cache or database read
+func (s service) GetBatch(ctx context.Context, keys []string) []*models.Entity {
+	log.Debug(ctx, "service: get batch", log.Args{"keys": len(keys)})
+
+	entities := make([]*models.Entity, len(keys))
+	loaded := make(map[string]*models.Entity, len(keys))
+
+	for i, key := range keys {
+		key = s.options.KeyPolicy.Normalize(key)
+
+		entity, ok := loaded[key]
+		if !ok {
+			entity = s.Get(ctx, key)
+			loaded[key] = entity
+		}
+
+		if entity != nil {
+			entityCopy := *entity
+			entities[i] = &entityCopy
+		}
+	}
+
+	return entities
+}
+
+// AddBatch adds the entities one by one in order, so that the last of
+// several entities with the same key wins
+func (s service) AddBatch(ctx context.Context, entities []models.Entity) []bool {
+	log.Debug(ctx, "service: add batch", log.Args{"entities": len(entities)})
+
+	added := make([]bool, len(entities))
+
+	for i, entity := range entities {
+		added[i] = s.Add(ctx, entity)
+	}
+
+	return added
+}
+
+func (s service) RemoveBatch(ctx context.Context, keys []string) []bool {
+	log.Debug(ctx, "service: remove batch", log.Args{"keys": len(keys)})
+
+	removed := make([]bool, len(keys))
+
+	for i, key := range keys {
+		removed[i] = s.Remove(ctx, key)
+	}
+
+	return removed
+}
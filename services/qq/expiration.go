@@ -0,0 +1,137 @@
+package qq
+
+import (
+	"context"
+	"errors"
+	"qq/models"
+	"qq/pkg/log"
+	"qq/pkg/qqcontext"
+	"sync"
+	"time"
+)
+
+// errOutdated aborts the removal of an expired entity written since
+var errOutdated = errors.New("entity written since its expiration was set")
+
+// systemContext is the context of a write the service makes by itself; it is
+// not cancelled with the request that caused it
+func systemContext() context.Context {
+	return qqcontext.WithRequestIdValue(WithSystemIdentity(context.Background()), qqcontext.NewRequestId())
+}
+
+type expiration struct {
+	version uint64
+	timer   *time.Timer
+}
+
+// expirations holds the timers set by Expire; a timer belongs to the version
+// of the entity it was set for, and any write of the key drops it
+type expirations struct {
+	mu     sync.Mutex
+	timers map[string]*expiration
+}
+
+func newExpirations() *expirations {
+	return &expirations{timers: map[string]*expiration{}}
+}
+
+func (e *expirations) set(key string, version uint64, ttl time.Duration, expire func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stopLocked(key)
+
+	set := &expiration{version: version}
+	set.timer = time.AfterFunc(ttl, func() {
+		e.mu.Lock()
+		current := e.timers[key]
+		if current == set {
+			delete(e.timers, key)
+		}
+		e.mu.Unlock()
+
+		if current == set {
+			expire()
+		}
+	})
+
+	e.timers[key] = set
+}
+
+// drop stops the timer of key unless it was set for entity
+func (e *expirations) drop(key string, entity *models.Entity) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current, ok := e.timers[key]
+	if !ok || (entity != nil && entity.Version == current.version) {
+		return
+	}
+
+	e.stopLocked(key)
+}
+
+func (e *expirations) stopLocked(key string) {
+	current, ok := e.timers[key]
+	if !ok {
+		return
+	}
+
+	current.timer.Stop()
+	delete(e.timers, key)
+}
+
+func (e *expirations) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return len(e.timers)
+}
+
+// Expire removes key after ttl unless the entity is written in the meantime;
+// a zero ttl cancels the expiration of key. The identity in ctx must be
+// allowed to write key, and the removal is made as SystemUserId.
+func (s service) Expire(ctx context.Context, key string, version uint64, ttl time.Duration) error {
+	key = s.options.KeyPolicy.Normalize(key)
+
+	log.Debug(ctx, "service: expire", log.Args{"key": key, "version": version, "ttl": ttl})
+
+	err := s.authorize(ctx, ActionWrite, key)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.locks.lock(key)
+	defer unlock()
+
+	current := s.current(key)
+	if current == nil || current.Version != version {
+		return nil
+	}
+
+	if ttl <= 0 {
+		s.expirations.drop(key, nil)
+		return nil
+	}
+
+	s.expirations.set(key, version, ttl, func() {
+		ctx := systemContext()
+
+		_, err := s.Update(ctx, key, func(current *models.Entity) (*models.Entity, error) {
+			if current == nil || current.Version != version {
+				return nil, errOutdated
+			}
+
+			return nil, nil
+		})
+		if err != nil && !errors.Is(err, errOutdated) {
+			log.Warning(ctx, "failed to remove expired entity", log.Args{"key": key, "error": err})
+		}
+	})
+
+	return nil
+}
+
+func (s service) ExpiringKeys(ctx context.Context) int {
+	return s.expirations.count()
+}
@@ -0,0 +1,53 @@
+package qq
+
+import (
+	"qq/models"
+	"sync"
+)
+
+type flightCall struct {
+	wg     sync.WaitGroup
+	dups   int
+	result *models.Entity
+}
+
+// flightGroup coalesces concurrent loads of the same key into a single call
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: map[string]*flightCall{},
+	}
+}
+
+// do runs load once for all concurrent callers with the same key and reports
+// whether the result was produced by another caller
+func (g *flightGroup) do(key string, load func() *models.Entity) (*models.Entity, bool) {
+	g.mu.Lock()
+	if call, present := g.calls[key]; present {
+		call.dups++
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.result, true
+	}
+
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+
+		call.wg.Done()
+	}()
+
+	call.result = load()
+
+	return call.result, false
+}
@@ -0,0 +1,24 @@
+package qq
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const keyLockStripes = 256
+
+// keyLocks serializes cache fills and writes of the same key so that a slow
+// load can never put a value older than a completed write into the cache
+type keyLocks struct {
+	stripes [keyLockStripes]sync.Mutex
+}
+
+func (l *keyLocks) lock(key string) func() {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+
+	mu := &l.stripes[hash.Sum32()%keyLockStripes]
+	mu.Lock()
+
+	return mu.Unlock
+}
@@ -0,0 +1,41 @@
+package qq
+
+import (
+	"fmt"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+type KeyPolicy string
+
+const (
+	// keys are used as given
+	ExactKeys KeyPolicy = "exact"
+	// keys are brought to Unicode normalization form C, so that "é" typed as
+	// one code point and as "e" with a combining accent are the same key
+	UnicodeNormalizedKeys KeyPolicy = "unicode"
+	// keys are case folded and normalized as with UnicodeNormalizedKeys
+	CaseInsensitiveKeys KeyPolicy = "case-insensitive"
+)
+
+func ParseKeyPolicy(value string) (KeyPolicy, error) {
+	switch policy := KeyPolicy(value); policy {
+	case ExactKeys, UnicodeNormalizedKeys, CaseInsensitiveKeys:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid key policy %s", value)
+	}
+}
+
+// Normalize returns the key under which the entity is stored
+func (p KeyPolicy) Normalize(key string) string {
+	switch p {
+	case UnicodeNormalizedKeys:
+		return norm.NFC.String(key)
+	case CaseInsensitiveKeys:
+		return norm.NFC.String(cases.Fold().String(key))
+	default:
+		return key
+	}
+}
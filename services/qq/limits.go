@@ -0,0 +1,480 @@
+package qq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"qq/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited   = errors.New("rate limited")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// RateLimitError matches ErrRateLimited with errors.Is
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrRateLimited, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// RateLimit allows Rate operations per second on average and bursts of up to
+// Burst operations; a zero Rate is unlimited
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// RateLimits apply to each user and operation separately; operations are
+// named by the transports, e.g. "get" or "batch_put"
+type RateLimits struct {
+	Default    RateLimit            `json:"default"`
+	Operations map[string]RateLimit `json:"operations,omitempty"`
+}
+
+func (l RateLimits) limit(operation string) RateLimit {
+	limit, ok := l.Operations[operation]
+	if !ok {
+		return l.Default
+	}
+
+	return limit
+}
+
+// Quota bounds the number of keys and the bytes of keys and values stored
+// in a namespace or by a user; zero is unlimited
+type Quota struct {
+	MaxKeys  int `json:"max_keys"`
+	MaxBytes int `json:"max_bytes"`
+}
+
+// Quotas apply to every namespace and to every user, a user being charged
+// for the keys it wrote last; writes without a user id are only charged to
+// their namespace
+type Quotas struct {
+	Default     Quota            `json:"default"`
+	Namespaces  map[string]Quota `json:"namespaces,omitempty"`
+	UserDefault Quota            `json:"user_default"`
+	Users       map[string]Quota `json:"users,omitempty"`
+}
+
+func (q Quotas) quota(namespace string) Quota {
+	quota, ok := q.Namespaces[namespace]
+	if !ok {
+		return q.Default
+	}
+
+	return quota
+}
+
+func (q Quotas) userQuota(userId string) Quota {
+	quota, ok := q.Users[userId]
+	if !ok {
+		return q.UserDefault
+	}
+
+	return quota
+}
+
+type Limits struct {
+	RateLimits RateLimits `json:"rate_limits"`
+	Quotas     Quotas     `json:"quotas"`
+}
+
+func ParseLimits(data []byte) (*Limits, error) {
+	var limits Limits
+
+	err := json.Unmarshal(data, &limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	rateLimits := []RateLimit{limits.RateLimits.Default}
+	for _, limit := range limits.RateLimits.Operations {
+		rateLimits = append(rateLimits, limit)
+	}
+
+	for _, limit := range rateLimits {
+		if limit.Rate < 0 || (limit.Rate > 0 && limit.Burst < 1) {
+			return nil, fmt.Errorf("invalid rate limit %+v: burst must be at least 1", limit)
+		}
+	}
+
+	return &limits, nil
+}
+
+func LoadLimits(path string) (*Limits, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read limits file: %w", err)
+	}
+
+	return ParseLimits(data)
+}
+
+// NamespaceSeparator ends the namespace of a key: "team-a/x" is in the
+// "team-a" namespace, and keys without it are in the "" namespace
+const NamespaceSeparator = "/"
+
+func Namespace(key string) string {
+	namespace, _, found := strings.Cut(key, NamespaceSeparator)
+	if !found {
+		return ""
+	}
+
+	return namespace
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// idleBucketTimeout drops the buckets of users that have stopped calling, a
+// dropped bucket being full anyway by then
+const idleBucketTimeout = 10 * time.Minute
+
+type bucketKey struct {
+	userId    string
+	operation string
+}
+
+type rateLimiter struct {
+	limits    RateLimits
+	now       func() time.Time
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		now:     time.Now,
+		buckets: map[bucketKey]*tokenBucket{},
+	}
+}
+
+func (l *rateLimiter) take(userId string, operation string) error {
+	limit := l.limits.limit(operation)
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	key := bucketKey{userId: userId, operation: operation}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed*limit.Rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		retryAfter := time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+		return &RateLimitError{RetryAfter: retryAfter}
+	}
+
+	bucket.tokens--
+
+	return nil
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketTimeout {
+		return
+	}
+
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= idleBucketTimeout {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+// QuotaUsage is the usage of a namespace, or of a user when User is set
+type QuotaUsage struct {
+	Namespace string `json:"namespace"`
+	User      string `json:"user,omitempty"`
+	Keys      int    `json:"keys"`
+	Bytes     int    `json:"bytes"`
+	MaxKeys   int    `json:"max_keys,omitempty"`
+	MaxBytes  int    `json:"max_bytes,omitempty"`
+}
+
+type usage struct {
+	keys  int
+	bytes int
+}
+
+func (u *usage) exceeds(quota Quota, keys int, bytes int) error {
+	if keys > 0 && quota.MaxKeys > 0 && u.keys+keys > quota.MaxKeys {
+		return fmt.Errorf("%d of %d keys", u.keys, quota.MaxKeys)
+	}
+
+	if bytes > 0 && quota.MaxBytes > 0 && u.bytes+bytes > quota.MaxBytes {
+		return fmt.Errorf("%d of %d bytes", u.bytes, quota.MaxBytes)
+	}
+
+	return nil
+}
+
+// quotaTracker counts the keys and bytes of every namespace and user as the
+// service writes them, starting from the database contents, which are not
+// charged to any user
+type quotaTracker struct {
+	quotas    Quotas
+	mu        sync.Mutex
+	usage     map[string]*usage
+	userUsage map[string]*usage
+	// owners are the users that wrote the keys last
+	owners map[string]string
+}
+
+func newQuotaTracker(quotas Quotas, entities []models.Entity) *quotaTracker {
+	t := &quotaTracker{
+		quotas:    quotas,
+		usage:     map[string]*usage{},
+		userUsage: map[string]*usage{},
+		owners:    map[string]string{},
+	}
+
+	for i := range entities {
+		_ = t.apply("", nil, &entities[i], false)
+	}
+
+	return t
+}
+
+func entitySize(entity *models.Entity) int {
+	if entity == nil {
+		return 0
+	}
+
+	return len(entity.Key) + len(entity.Value)
+}
+
+func delta(previous *models.Entity, next *models.Entity) (int, int) {
+	keys := 0
+	if previous == nil && next != nil {
+		keys = 1
+	}
+	if previous != nil && next == nil {
+		keys = -1
+	}
+
+	return keys, entitySize(next) - entitySize(previous)
+}
+
+func entityKey(previous *models.Entity, next *models.Entity) string {
+	if next != nil {
+		return next.Key
+	}
+
+	if previous != nil {
+		return previous.Key
+	}
+
+	return ""
+}
+
+// userDelta is what the replacement of previous with next by userId adds to
+// the usage of userId: the whole of next when the key was written last by
+// another user
+func (t *quotaTracker) userDelta(userId string, previous *models.Entity, next *models.Entity) (int, int) {
+	if t.owners[entityKey(previous, next)] != userId {
+		return delta(nil, next)
+	}
+
+	return delta(previous, next)
+}
+
+// check refuses writes that grow a namespace or a user over its quota;
+// writes that shrink them are always allowed
+func (t *quotaTracker) check(userId string, previous *models.Entity, next *models.Entity) error {
+	namespace := Namespace(entityKey(previous, next))
+	keys, bytes := delta(previous, next)
+
+	current, ok := t.usage[namespace]
+	if !ok {
+		current = &usage{}
+	}
+
+	err := current.exceeds(t.quotas.quota(namespace), keys, bytes)
+	if err != nil {
+		return fmt.Errorf("%w: namespace %q has %v", ErrQuotaExceeded, namespace, err)
+	}
+
+	if userId == "" {
+		return nil
+	}
+
+	keys, bytes = t.userDelta(userId, previous, next)
+
+	current, ok = t.userUsage[userId]
+	if !ok {
+		current = &usage{}
+	}
+
+	err = current.exceeds(t.quotas.userQuota(userId), keys, bytes)
+	if err != nil {
+		return fmt.Errorf("%w: user %q has %v", ErrQuotaExceeded, userId, err)
+	}
+
+	return nil
+}
+
+func add(usages map[string]*usage, name string, keys int, bytes int) {
+	current, ok := usages[name]
+	if !ok {
+		current = &usage{}
+		usages[name] = current
+	}
+
+	current.keys += keys
+	current.bytes += bytes
+
+	if current.keys == 0 && current.bytes == 0 {
+		delete(usages, name)
+	}
+}
+
+// apply records the replacement of previous with next by userId, either of
+// which may be nil, after checking the quotas when enforce is set
+func (t *quotaTracker) apply(userId string, previous *models.Entity, next *models.Entity, enforce bool) error {
+	key := entityKey(previous, next)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if enforce {
+		err := t.check(userId, previous, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, bytes := delta(previous, next)
+	add(t.usage, Namespace(key), keys, bytes)
+
+	// the key moves from its last writer to userId
+	owner := t.owners[key]
+	if owner != "" && owner != userId {
+		keys, bytes := delta(previous, nil)
+		add(t.userUsage, owner, keys, bytes)
+	}
+
+	if userId != "" {
+		keys, bytes := t.userDelta(userId, previous, next)
+		add(t.userUsage, userId, keys, bytes)
+	}
+
+	if next == nil || userId == "" {
+		delete(t.owners, key)
+	} else {
+		t.owners[key] = userId
+	}
+
+	return nil
+}
+
+func (t *quotaTracker) peek(userId string, previous *models.Entity, next *models.Entity) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.check(userId, previous, next)
+}
+
+// snapshot lists the namespaces, then the users
+func (t *quotaTracker) snapshot() []QuotaUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usages := make([]QuotaUsage, 0, len(t.usage)+len(t.userUsage))
+	for namespace, current := range t.usage {
+		quota := t.quotas.quota(namespace)
+		usages = append(usages, QuotaUsage{
+			Namespace: namespace,
+			Keys:      current.keys,
+			Bytes:     current.bytes,
+			MaxKeys:   quota.MaxKeys,
+			MaxBytes:  quota.MaxBytes,
+		})
+	}
+
+	for userId, current := range t.userUsage {
+		quota := t.quotas.userQuota(userId)
+		usages = append(usages, QuotaUsage{
+			User:     userId,
+			Keys:     current.keys,
+			Bytes:    current.bytes,
+			MaxKeys:  quota.MaxKeys,
+			MaxBytes: quota.MaxBytes,
+		})
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].User != usages[j].User {
+			return usages[i].User < usages[j].User
+		}
+
+		return usages[i].Namespace < usages[j].Namespace
+	})
+
+	return usages
+}
+
+// Admit takes a token from the bucket of the user in ctx for operation, or
+// returns a *RateLimitError
+func (s service) Admit(ctx context.Context, operation string) error {
+	if s.limiter == nil {
+		return nil
+	}
+
+	return s.limiter.take(requestUserId(ctx), operation)
+}
+
+// CheckQuota tells whether writing entity would exceed the quota of its
+// namespace or of the user in ctx; the write itself checks again
+func (s service) CheckQuota(ctx context.Context, entity models.Entity) error {
+	if s.quotas == nil {
+		return nil
+	}
+
+	entity.Key = s.options.KeyPolicy.Normalize(entity.Key)
+
+	return s.quotas.peek(requestUserId(ctx), s.current(entity.Key), &entity)
+}
+
+func (s service) QuotaUsage(ctx context.Context) []QuotaUsage {
+	if s.quotas == nil {
+		return []QuotaUsage{}
+	}
+
+	return s.quotas.snapshot()
+}
@@ -0,0 +1,154 @@
+package qq
+
+import (
+	"context"
+	"qq/models"
+	"qq/pkg/qqcontext"
+	"qq/repos/cacheqq"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespace(t *testing.T) {
+	testCases := []struct {
+		name string
+		key  string
+		exp  string
+	}{
+		{name: "NoSeparator", key: "key", exp: ""},
+		{name: "Namespace", key: "team-a/key", exp: "team-a"},
+		{name: "Nested", key: "team-a/b/key", exp: "team-a"},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.exp, Namespace(testCase.key))
+		})
+	}
+}
+
+func TestParseLimitsInvalid(t *testing.T) {
+	_, err := ParseLimits([]byte(`{"rate_limits": {"default": {"rate": 1}}}`))
+	assert.Error(t, err)
+
+	_, err = ParseLimits([]byte(`{"rate_limits": {"operations": {"get": {"rate": -1, "burst": 1}}}}`))
+	assert.Error(t, err)
+
+	_, err = ParseLimits([]byte(`{`))
+	assert.Error(t, err)
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+
+	limiter := newRateLimiter(RateLimits{
+		Default:    RateLimit{Rate: 1, Burst: 2},
+		Operations: map[string]RateLimit{"get": {}},
+	})
+	limiter.now = func() time.Time { return now }
+
+	assert.NoError(t, limiter.take("a", "put"))
+	assert.NoError(t, limiter.take("a", "put"))
+
+	err := limiter.take("a", "put")
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	var rateLimitErr *RateLimitError
+	require.ErrorAs(t, err, &rateLimitErr)
+	assert.Equal(t, time.Second, rateLimitErr.RetryAfter)
+
+	assert.NoError(t, limiter.take("b", "put"), "users share a bucket")
+	assert.NoError(t, limiter.take("a", "delete"), "operations share a bucket")
+	assert.NoError(t, limiter.take("a", "get"), "unlimited operation was limited")
+
+	now = now.Add(time.Second)
+	assert.NoError(t, limiter.take("a", "put"))
+	assert.ErrorIs(t, limiter.take("a", "put"), ErrRateLimited)
+}
+
+func TestServiceQuotas(t *testing.T) {
+	database := newDatabaseStub(t,
+		models.Entity{Key: "team-a/x", Value: "1234"},
+	)
+
+	s, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{
+		Limits: &Limits{
+			Quotas: Quotas{
+				Namespaces: map[string]Quota{"team-a": {MaxKeys: 2, MaxBytes: 24}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx := qqcontext.WithUserIdValue(context.Background(), "team-a")
+
+	assert.NoError(t, s.CheckQuota(ctx, models.Entity{Key: "team-a/y", Value: "1234"}))
+	assert.True(t, s.Add(ctx, models.Entity{Key: "team-a/y", Value: "1234"}))
+
+	assert.ErrorIs(t, s.CheckQuota(ctx, models.Entity{Key: "team-a/z", Value: "1"}), ErrQuotaExceeded)
+	assert.False(t, s.Add(ctx, models.Entity{Key: "team-a/z", Value: "1"}))
+	assert.True(t, s.Add(ctx, models.Entity{Key: "other", Value: "unlimited"}))
+
+	_, err = s.Update(ctx, "team-a/y", func(current *models.Entity) (*models.Entity, error) {
+		return &models.Entity{Key: "team-a/y", Value: "123456789"}, nil
+	})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	assert.True(t, s.Remove(ctx, "team-a/x"))
+	assert.True(t, s.Add(ctx, models.Entity{Key: "team-a/z", Value: "1"}))
+
+	assert.Equal(t, []QuotaUsage{
+		{Namespace: "", Keys: 1, Bytes: 14},
+		{Namespace: "team-a", Keys: 2, Bytes: 21, MaxKeys: 2, MaxBytes: 24},
+		{User: "team-a", Keys: 3, Bytes: 35},
+	}, s.QuotaUsage(ctx))
+}
+
+func TestServiceUserQuotas(t *testing.T) {
+	database := newDatabaseStub(t,
+		models.Entity{Key: "shared/x", Value: "1"},
+	)
+
+	s, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{
+		Limits: &Limits{
+			Quotas: Quotas{
+				UserDefault: Quota{MaxKeys: 2},
+				Users:       map[string]Quota{"bob": {MaxBytes: 20}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	alice := qqcontext.WithUserIdValue(context.Background(), "alice")
+	bob := qqcontext.WithUserIdValue(context.Background(), "bob")
+
+	// the keys of the database are not charged to anyone
+	_, err = s.Update(alice, "shared/x", func(current *models.Entity) (*models.Entity, error) {
+		return &models.Entity{Key: "shared/x", Value: "2"}, nil
+	})
+	require.NoError(t, err)
+	assert.True(t, s.Add(alice, models.Entity{Key: "shared/y", Value: "1"}))
+
+	assert.ErrorIs(t, s.CheckQuota(alice, models.Entity{Key: "shared/z", Value: "1"}), ErrQuotaExceeded)
+	assert.False(t, s.Add(alice, models.Entity{Key: "shared/z", Value: "1"}))
+
+	// a namespace without a quota does not let one user fill it
+	assert.True(t, s.Add(bob, models.Entity{Key: "shared/z", Value: "1"}))
+	assert.False(t, s.Add(bob, models.Entity{Key: "shared/w", Value: "123456789012"}))
+
+	// overwriting a key moves it to the writer
+	assert.True(t, s.Add(bob, models.Entity{Key: "shared/y", Value: "2"}))
+	assert.True(t, s.Add(alice, models.Entity{Key: "shared/w", Value: "1"}))
+
+	assert.True(t, s.Remove(alice, "shared/z"))
+
+	assert.Equal(t, []QuotaUsage{
+		{Namespace: "shared", Keys: 3, Bytes: 27},
+		{User: "alice", Keys: 2, Bytes: 18, MaxKeys: 2},
+		{User: "bob", Keys: 1, Bytes: 9, MaxBytes: 20},
+	}, s.QuotaUsage(alice))
+}
@@ -0,0 +1,42 @@
+package qq
+
+import (
+	"sync/atomic"
+)
+
+type Metrics struct {
+	cacheHits      uint64
+	cacheMisses    uint64
+	cacheErrors    uint64
+	databaseLoads  uint64
+	coalesced      uint64
+	earlyRefreshes uint64
+}
+
+type MetricsSnapshot struct {
+	CacheHits      uint64
+	CacheMisses    uint64
+	CacheErrors    uint64
+	DatabaseLoads  uint64
+	Coalesced      uint64
+	EarlyRefreshes uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		CacheHits:      atomic.LoadUint64(&m.cacheHits),
+		CacheMisses:    atomic.LoadUint64(&m.cacheMisses),
+		CacheErrors:    atomic.LoadUint64(&m.cacheErrors),
+		DatabaseLoads:  atomic.LoadUint64(&m.databaseLoads),
+		Coalesced:      atomic.LoadUint64(&m.coalesced),
+		EarlyRefreshes: atomic.LoadUint64(&m.earlyRefreshes),
+	}
+}
+
+func (m *Metrics) inc(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
@@ -0,0 +1,26 @@
+// Package qqtest builds services for the tests of the transports
+package qqtest
+
+import (
+	"qq/repos/cacheqq"
+	qqRepo "qq/repos/qq"
+	"qq/services/qq"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// NewService returns a service over an empty in-memory database and an LRU cache
+func NewService(t testing.TB) qq.Service {
+	return NewServiceWithOptions(t, qq.Options{})
+}
+
+func NewServiceWithOptions(t testing.TB, options qq.Options) qq.Service {
+	database, err := qqRepo.NewDatabase()
+	require.NoError(t, err)
+
+	service, err := qq.NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), options)
+	require.NoError(t, err)
+
+	return service
+}
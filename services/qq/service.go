@@ -2,10 +2,15 @@ package qq
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"math/rand"
 	"qq/models"
 	"qq/pkg/log"
+	"qq/repos/auditqq"
 	"qq/repos/cacheqq"
 	"qq/repos/qq"
+	"time"
 )
 
 type Service interface {
@@ -13,79 +18,535 @@ type Service interface {
 	Remove(ctx context.Context, key string) bool
 	Get(ctx context.Context, key string) *models.Entity
 	GetAll(ctx context.Context) []models.Entity
+	// Scan reads up to limit keys in key order, starting after the key
+	// after, and returns the entities among them that the identity in ctx
+	// may read, with the key to continue from; that key is empty once every
+	// key has been read. Keys written during a scan may or may not be returned.
+	Scan(ctx context.Context, after string, limit int) ([]models.Entity, string)
+	// Update atomically replaces the entity with the one returned by update,
+	// or removes it when update returns nil; an error from update is returned
+	// as is and nothing is written. current is nil when the entity does not exist.
+	Update(ctx context.Context, key string, update func(current *models.Entity) (*models.Entity, error)) (*models.Entity, error)
+	// batch variants return one result per key or entity, in the same order
+	GetBatch(ctx context.Context, keys []string) []*models.Entity
+	AddBatch(ctx context.Context, entities []models.Entity) []bool
+	RemoveBatch(ctx context.Context, keys []string) []bool
+	// Authorize returns an error matching ErrPermissionDenied when the
+	// identity in ctx may not perform action on key. The other methods check
+	// the policy themselves: denied writes and reads do nothing and return
+	// false or nil, GetAll and Scan return only the entities the identity may read,
+	// and Update returns the error.
+	Authorize(ctx context.Context, action Action, key string) error
+	// Admit returns an error matching ErrRateLimited when the user in ctx
+	// has used up the rate limit of operation
+	Admit(ctx context.Context, operation string) error
+	// CheckQuota returns an error matching ErrQuotaExceeded when writing
+	// entity would exceed the quota of its namespace. Writes check the quota
+	// themselves: Add returns false and Update returns the error.
+	CheckQuota(ctx context.Context, entity models.Entity) error
+	QuotaUsage(ctx context.Context) []QuotaUsage
+	// Audit returns the audit records matching query, or ErrAuditDisabled
+	Audit(ctx context.Context, query auditqq.Query) ([]auditqq.Record, error)
+	VerifyAudit(ctx context.Context) (auditqq.Verification, error)
+	// Watch streams the changes of the keys starting with prefix that the
+	// identity in ctx may read; the channel is closed when ctx is done or
+	// when the watcher falls behind by more than WatchBufferSize changes
+	Watch(ctx context.Context, prefix string) <-chan Change
+	// Expire removes key after ttl, unless the entity is written in the
+	// meantime or is no longer at version; a zero ttl cancels the
+	// expiration. Expirations are held in memory, like the entities.
+	Expire(ctx context.Context, key string, version uint64, ttl time.Duration) error
+	// ExpiringKeys counts the keys waiting to expire
+	ExpiringKeys(ctx context.Context) int
+	// Keys counts the keys of every user, without reading the entities
+	Keys(ctx context.Context) int
+	// Close writes the writes pending under WriteBehind to the database and
+	// stops the flusher; the service must not be written to afterwards
+	Close() error
+}
+
+type Options struct {
+	// KeyPolicy defaults to ExactKeys
+	KeyPolicy KeyPolicy
+	// WritePolicy defaults to WriteThrough
+	WritePolicy WritePolicy
+	// FlushInterval and MaxPendingWrites bound how long and how many writes
+	// may wait for the database under WriteBehind; once MaxPendingWrites keys
+	// are pending, the writes of other keys go to the database synchronously
+	FlushInterval    time.Duration
+	MaxPendingWrites int
+	// EarlyRefreshBeta enables probabilistic early refresh of cached entities
+	// before they expire; 1 is a sensible value, 0 disables it
+	EarlyRefreshBeta float64
+	// EarlyRefreshDelta is the expected time it takes to reload an entity
+	EarlyRefreshDelta time.Duration
+	// ExpirationJitter shortens each cache expiration by a random fraction of up to this value
+	ExpirationJitter float64
+	Metrics          *Metrics
+	// Policy is checked for every operation; everything is allowed when it is nil
+	Policy PolicySource
+	// Limits are not enforced when nil
+	Limits *Limits
+	// Audit records every write when set
+	Audit auditqq.Log
 }
 
 type service struct {
-	database qq.Database
-	cache    cacheqq.Cache
+	database    qq.Database
+	cache       cacheqq.Cache
+	options     Options
+	metrics     *Metrics
+	flights     *flightGroup
+	locks       *keyLocks
+	writes      *writeQueue
+	limiter     *rateLimiter
+	quotas      *quotaTracker
+	watchers    *watchers
+	expirations *expirations
+	// flusher is nil unless the write policy is WriteBehind
+	flusher *flusher
 }
 
 var _ Service = service{}
 
-func NewService(database qq.Database, cache cacheqq.Cache) (Service, error) {
-	return service{
-		database: database,
-		cache:    cache,
-	}, nil
+func NewService(database qq.Database, cache cacheqq.Cache, options Options) (Service, error) {
+	if options.ExpirationJitter < 0 || options.ExpirationJitter >= 1 {
+		return nil, fmt.Errorf("invalid expiration jitter %v", options.ExpirationJitter)
+	}
+
+	if options.KeyPolicy == "" {
+		options.KeyPolicy = ExactKeys
+	}
+
+	_, err := ParseKeyPolicy(string(options.KeyPolicy))
+	if err != nil {
+		return nil, err
+	}
+
+	if options.WritePolicy == "" {
+		options.WritePolicy = WriteThrough
+	}
+
+	_, err = ParseWritePolicy(string(options.WritePolicy))
+	if err != nil {
+		return nil, err
+	}
+
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.MaxPendingWrites <= 0 {
+		options.MaxPendingWrites = DefaultMaxPendingWrites
+	}
+
+	metrics := options.Metrics
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+
+	s := service{
+		database:    database,
+		cache:       cache,
+		options:     options,
+		metrics:     metrics,
+		flights:     newFlightGroup(),
+		locks:       &keyLocks{},
+		writes:      newWriteQueue(options.MaxPendingWrites),
+		watchers:    newWatchers(),
+		expirations: newExpirations(),
+	}
+
+	if options.Limits != nil {
+		s.limiter = newRateLimiter(options.Limits.RateLimits)
+		s.quotas = newQuotaTracker(options.Limits.Quotas, database.GetAll())
+	}
+
+	if options.WritePolicy == WriteBehind {
+		s.flusher = newFlusher()
+		go s.runFlusher(context.Background())
+	}
+
+	return s, nil
 }
 
 func (s service) Add(ctx context.Context, entity models.Entity) bool {
-	log.Debug(ctx, "service: add", log.Args{"entity": entity})
+	entity.Key = s.options.KeyPolicy.Normalize(entity.Key)
 
-	s.database.Add(entity)
+	log.Debug(ctx, "service: add", log.Args{"entity": entity, "policy": s.options.WritePolicy})
 
-	cachedEntity, err := s.cache.GetEntity(ctx, entity.Key)
-	_ = cachedEntity
+	if s.authorize(ctx, ActionWrite, entity.Key) != nil {
+		return false
+	}
 
-	if err != nil {
-		return true
+	unlock := s.locks.lock(entity.Key)
+	defer unlock()
+
+	var previous *models.Entity
+	if s.quotas != nil || s.options.Audit != nil {
+		previous = s.current(entity.Key)
 	}
 
-	err = s.cache.SetEntity(ctx, entity.Key, &entity)
-	if err == nil {
-		log.Debug(ctx, "set to cache", log.Args{"key": entity.Key, "entity": entity})
-	} else {
-		log.Warning(ctx, "failed to set to cache", log.Args{"error": err})
+	if s.quotas != nil {
+		err := s.quotas.apply(requestUserId(ctx), previous, &entity, true)
+		if err != nil {
+			log.Warning(ctx, "quota exceeded", log.Args{"key": entity.Key, "error": err})
+			return false
+		}
 	}
 
-	return true
+	stored, added := s.add(ctx, entity)
+	if added {
+		s.changed(ctx, auditqq.OperationAdd, entity.Key, previous, &stored)
+	}
+
+	return added
 }
 
 func (s service) Remove(ctx context.Context, key string) bool {
-	log.Debug(ctx, "service: remove", log.Args{"key": key})
+	key = s.options.KeyPolicy.Normalize(key)
 
-	err := s.cache.DeleteEntity(ctx, key)
+	log.Debug(ctx, "service: remove", log.Args{"key": key, "policy": s.options.WritePolicy})
+
+	if s.authorize(ctx, ActionWrite, key) != nil {
+		return false
+	}
+
+	unlock := s.locks.lock(key)
+	defer unlock()
+
+	// removing a missing key succeeds but changes nothing to audit or watch
+	previous := s.current(key)
+
+	if s.quotas != nil {
+		_ = s.quotas.apply(requestUserId(ctx), previous, nil, false)
+	}
+
+	removed := s.remove(ctx, key)
+	if removed && previous != nil {
+		s.changed(ctx, auditqq.OperationRemove, key, previous, nil)
+	}
+
+	return removed
+}
+
+func (s service) Update(ctx context.Context, key string, update func(current *models.Entity) (*models.Entity, error)) (*models.Entity, error) {
+	key = s.options.KeyPolicy.Normalize(key)
+
+	log.Debug(ctx, "service: update", log.Args{"key": key, "policy": s.options.WritePolicy})
+
+	err := s.authorize(ctx, ActionWrite, key)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := s.locks.lock(key)
+	defer unlock()
+
+	current := s.current(key)
+
+	var previous *models.Entity
+	if current != nil {
+		previousCopy := *current
+		previous = &previousCopy
+	}
+
+	entity, err := update(current)
 	if err != nil {
-		log.Warning(ctx, "failed to delete from cache", log.Args{"error": err})
+		return nil, err
+	}
+
+	if entity == nil {
+		if s.quotas != nil {
+			_ = s.quotas.apply(requestUserId(ctx), previous, nil, false)
+		}
+
+		if s.remove(ctx, key) {
+			s.changed(ctx, auditqq.OperationUpdate, key, previous, nil)
+		}
+
+		return nil, nil
 	}
 
-	return s.database.Remove(key)
+	entity.Key = key
+
+	if s.quotas != nil {
+		err = s.quotas.apply(requestUserId(ctx), previous, entity, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stored, added := s.add(ctx, *entity)
+	if added {
+		s.changed(ctx, auditqq.OperationUpdate, key, previous, &stored)
+	}
+
+	return &stored, nil
+}
+
+// changed tells the audit log and the watchers about a write that has been
+// made
+func (s service) changed(ctx context.Context, operation auditqq.Operation, key string, previous *models.Entity, next *models.Entity) {
+	s.expirations.drop(key, next)
+	s.audit(ctx, operation, key, previous, next)
+	s.notify(key, next)
+}
+
+// current returns a copy of the entity as the next read will see it, pending
+// writes included
+func (s service) current(key string) *models.Entity {
+	current, pending := s.writes.get(key)
+	if !pending {
+		return s.database.Get(key)
+	}
+
+	if current == nil {
+		return nil
+	}
+
+	currentCopy := *current
+	return &currentCopy
+}
+
+func (s service) add(ctx context.Context, entity models.Entity) (models.Entity, bool) {
+	entity.Version = s.database.NextVersion()
+
+	switch s.options.WritePolicy {
+	case WriteBehind:
+		s.setToCache(ctx, entity.Key, &entity)
+		if s.writes.push(entity.Key, &entity) {
+			return entity, true
+		}
+
+		return entity, s.database.Add(entity)
+
+	case WriteAround:
+		added := s.database.Add(entity)
+		s.deleteFromCache(ctx, entity.Key)
+		return entity, added
+
+	default:
+		added := s.database.Add(entity)
+		s.setToCache(ctx, entity.Key, &entity)
+		return entity, added
+	}
+}
+
+func (s service) remove(ctx context.Context, key string) bool {
+	switch s.options.WritePolicy {
+	case WriteBehind:
+		s.setToCache(ctx, key, nil)
+		if s.writes.push(key, nil) {
+			return true
+		}
+
+		return s.database.Remove(key)
+
+	case WriteAround:
+		removed := s.database.Remove(key)
+		s.deleteFromCache(ctx, key)
+		return removed
+
+	default:
+		removed := s.database.Remove(key)
+		s.setToCache(ctx, key, nil)
+		return removed
+	}
 }
 
 func (s service) Get(ctx context.Context, key string) *models.Entity {
+	key = s.options.KeyPolicy.Normalize(key)
+
 	log.Debug(ctx, "service: get", log.Args{"key": key})
 
-	entity, err := s.cache.GetEntity(ctx, key)
+	if s.authorize(ctx, ActionRead, key) != nil {
+		return nil
+	}
+
+	entity, ttl, err := s.cache.GetEntity(ctx, key)
 
-	log.Debug(ctx, "get from cache", log.Args{"key": key, "entity": entity, "error": err})
+	log.Debug(ctx, "get from cache", log.Args{"key": key, "entity": entity, "ttl": ttl, "error": err})
 
 	if err == nil {
-		return entity
+		s.metrics.inc(&s.metrics.cacheHits)
+
+		if !s.refreshEarly(ttl) {
+			return entity
+		}
+
+		s.metrics.inc(&s.metrics.earlyRefreshes)
+		log.Debug(ctx, "refresh cache early", log.Args{"key": key, "ttl": ttl})
+	} else {
+		s.metrics.inc(&s.metrics.cacheMisses)
+	}
+
+	entity, coalesced := s.flights.do(key, func() *models.Entity {
+		return s.load(ctx, key)
+	})
+
+	if coalesced {
+		s.metrics.inc(&s.metrics.coalesced)
+		log.Debug(ctx, "coalesced with concurrent load", log.Args{"key": key})
+	}
+
+	if entity == nil {
+		return nil
 	}
 
-	entity = s.database.Get(key)
+	entityCopy := *entity
+	return &entityCopy
+}
+
+func (s service) load(ctx context.Context, key string) *models.Entity {
+	unlock := s.locks.lock(key)
+	defer unlock()
+
+	entity, pending := s.writes.get(key)
+	if !pending {
+		s.metrics.inc(&s.metrics.databaseLoads)
+		entity = s.database.Get(key)
+	}
 
-	err = s.cache.SetEntity(ctx, key, entity)
+	s.fillCache(ctx, key, entity)
+
+	return entity
+}
+
+// fillCache caches an entity read from the database, which is not a change
+// for the other instances to be told about
+func (s service) fillCache(ctx context.Context, key string, entity *models.Entity) {
+	err := s.cache.FillEntity(ctx, key, entity, s.expiration())
+	if err == nil {
+		log.Debug(ctx, "filled cache", log.Args{"key": key, "entity": entity})
+		return
+	}
+
+	s.metrics.inc(&s.metrics.cacheErrors)
+	log.Warning(ctx, "failed to fill cache", log.Args{"key": key, "error": err})
+
+	s.deleteFromCache(ctx, key)
+}
+
+// setToCache drops the cached entry when it cannot be updated so that readers
+// fall back to the database instead of seeing the previous value
+func (s service) setToCache(ctx context.Context, key string, entity *models.Entity) {
+	err := s.cache.SetEntity(ctx, key, entity, s.expiration())
 	if err == nil {
 		log.Debug(ctx, "set to cache", log.Args{"key": key, "entity": entity})
-	} else {
-		log.Warning(ctx, "failed to set to cache", log.Args{"error": err})
+		return
 	}
 
-	return entity
+	s.metrics.inc(&s.metrics.cacheErrors)
+	log.Warning(ctx, "failed to set to cache", log.Args{"key": key, "error": err})
+
+	s.deleteFromCache(ctx, key)
+}
+
+func (s service) deleteFromCache(ctx context.Context, key string) {
+	err := s.cache.DeleteEntity(ctx, key)
+	if err != nil {
+		s.metrics.inc(&s.metrics.cacheErrors)
+		log.Warning(ctx, "failed to delete from cache", log.Args{"key": key, "error": err})
+	}
+}
+
+// refreshEarly implements XFetch: the closer the entry is to expiring, the
+// more likely a single reader reloads it ahead of everyone else
+func (s service) refreshEarly(ttl time.Duration) bool {
+	if s.options.EarlyRefreshBeta <= 0 || ttl < 0 {
+		return false
+	}
+
+	gap := -float64(s.options.EarlyRefreshDelta) * s.options.EarlyRefreshBeta * math.Log(rand.Float64())
+
+	return gap >= float64(ttl)
+}
+
+func (s service) expiration() time.Duration {
+	if s.options.ExpirationJitter <= 0 {
+		return cacheqq.Expiration
+	}
+
+	jitter := time.Duration(float64(cacheqq.Expiration) * s.options.ExpirationJitter * rand.Float64())
+
+	return cacheqq.Expiration - jitter
 }
 
 func (s service) GetAll(ctx context.Context) []models.Entity {
 	log.Debug(ctx, "service: get all")
-	return s.database.GetAll()
+
+	entities := s.database.GetAll()
+
+	if s.options.WritePolicy == WriteBehind {
+		entities = s.writes.overlay(entities)
+	}
+
+	if s.options.Policy == nil {
+		return entities
+	}
+
+	readable := make([]models.Entity, 0, len(entities))
+	for _, entity := range entities {
+		if s.allows(ctx, ActionRead, entity.Key) {
+			readable = append(readable, entity)
+		}
+	}
+
+	return readable
+}
+
+func (s service) Keys(ctx context.Context) int {
+	keys := s.database.Stats().Keys
+
+	if s.options.WritePolicy != WriteBehind {
+		return keys
+	}
+
+	// the pending writes add the keys the database lacks and remove the
+	// keys it holds
+	for _, key := range s.writes.keys() {
+		entity, present := s.writes.get(key)
+		if !present {
+			continue
+		}
+
+		stored := s.database.Get(key) != nil
+
+		switch {
+		case entity != nil && !stored:
+			keys++
+		case entity == nil && stored:
+			keys--
+		}
+	}
+
+	return keys
+}
+
+func (s service) Scan(ctx context.Context, after string, limit int) ([]models.Entity, string) {
+	log.Debug(ctx, "service: scan", log.Args{"after": after, "limit": limit})
+
+	if limit <= 0 {
+		return nil, ""
+	}
+
+	entities := s.database.Scan(after, limit)
+
+	next := ""
+	if len(entities) == limit {
+		next = entities[len(entities)-1].Key
+	}
+
+	if s.options.WritePolicy == WriteBehind {
+		entities, next = s.writes.overlayRange(entities, after, next, limit)
+	}
+
+	readable := entities[:0]
+	for _, entity := range entities {
+		if s.allows(ctx, ActionRead, entity.Key) {
+			readable = append(readable, entity)
+		}
+	}
+
+	return readable, next
 }
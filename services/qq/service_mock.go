@@ -3,6 +3,8 @@ package qq
 import (
 	"context"
 	"qq/models"
+	"qq/repos/auditqq"
+	"time"
 )
 
 type ServiceMock struct {
@@ -11,6 +13,30 @@ type ServiceMock struct {
 	RemoveMock func(ctx context.Context, key string) bool
 	GetMock    func(ctx context.Context, key string, counter int) *models.Entity
 	GetAllMock func(ctx context.Context) []models.Entity
+	ScanMock   func(ctx context.Context, after string, limit int) ([]models.Entity, string)
+	UpdateMock func(ctx context.Context, key string, update func(current *models.Entity) (*models.Entity, error)) (*models.Entity, error)
+
+	GetBatchMock    func(ctx context.Context, keys []string) []*models.Entity
+	AddBatchMock    func(ctx context.Context, entities []models.Entity) []bool
+	RemoveBatchMock func(ctx context.Context, keys []string) []bool
+	// AuthorizeMock allows everything when nil
+	AuthorizeMock func(ctx context.Context, action Action, key string) error
+	// AdmitMock and CheckQuotaMock allow everything when nil
+	AdmitMock      func(ctx context.Context, operation string) error
+	CheckQuotaMock func(ctx context.Context, entity models.Entity) error
+	QuotaUsageMock func(ctx context.Context) []QuotaUsage
+
+	AuditMock       func(ctx context.Context, query auditqq.Query) ([]auditqq.Record, error)
+	VerifyAuditMock func(ctx context.Context) (auditqq.Verification, error)
+	// WatchMock sends no changes when nil
+	WatchMock func(ctx context.Context, prefix string) <-chan Change
+	// ExpireMock does nothing and ExpiringKeysMock and KeysMock count
+	// nothing when nil
+	ExpireMock       func(ctx context.Context, key string, version uint64, ttl time.Duration) error
+	ExpiringKeysMock func(ctx context.Context) int
+	KeysMock         func(ctx context.Context) int
+	// CloseMock does nothing when nil
+	CloseMock func() error
 }
 
 var _ Service = &ServiceMock{}
@@ -31,3 +57,105 @@ func (s *ServiceMock) Get(ctx context.Context, key string) *models.Entity {
 func (s *ServiceMock) GetAll(ctx context.Context) []models.Entity {
 	return s.GetAllMock(ctx)
 }
+
+func (s *ServiceMock) Scan(ctx context.Context, after string, limit int) ([]models.Entity, string) {
+	return s.ScanMock(ctx, after, limit)
+}
+
+func (s *ServiceMock) Update(ctx context.Context, key string, update func(current *models.Entity) (*models.Entity, error)) (*models.Entity, error) {
+	return s.UpdateMock(ctx, key, update)
+}
+
+func (s *ServiceMock) GetBatch(ctx context.Context, keys []string) []*models.Entity {
+	return s.GetBatchMock(ctx, keys)
+}
+
+func (s *ServiceMock) AddBatch(ctx context.Context, entities []models.Entity) []bool {
+	return s.AddBatchMock(ctx, entities)
+}
+
+func (s *ServiceMock) RemoveBatch(ctx context.Context, keys []string) []bool {
+	return s.RemoveBatchMock(ctx, keys)
+}
+
+func (s *ServiceMock) Authorize(ctx context.Context, action Action, key string) error {
+	if s.AuthorizeMock == nil {
+		return nil
+	}
+
+	return s.AuthorizeMock(ctx, action, key)
+}
+
+func (s *ServiceMock) Admit(ctx context.Context, operation string) error {
+	if s.AdmitMock == nil {
+		return nil
+	}
+
+	return s.AdmitMock(ctx, operation)
+}
+
+func (s *ServiceMock) CheckQuota(ctx context.Context, entity models.Entity) error {
+	if s.CheckQuotaMock == nil {
+		return nil
+	}
+
+	return s.CheckQuotaMock(ctx, entity)
+}
+
+func (s *ServiceMock) QuotaUsage(ctx context.Context) []QuotaUsage {
+	return s.QuotaUsageMock(ctx)
+}
+
+func (s *ServiceMock) Audit(ctx context.Context, query auditqq.Query) ([]auditqq.Record, error) {
+	return s.AuditMock(ctx, query)
+}
+
+func (s *ServiceMock) VerifyAudit(ctx context.Context) (auditqq.Verification, error) {
+	return s.VerifyAuditMock(ctx)
+}
+
+func (s *ServiceMock) Watch(ctx context.Context, prefix string) <-chan Change {
+	if s.WatchMock == nil {
+		ch := make(chan Change)
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+
+		return ch
+	}
+
+	return s.WatchMock(ctx, prefix)
+}
+
+func (s *ServiceMock) Expire(ctx context.Context, key string, version uint64, ttl time.Duration) error {
+	if s.ExpireMock == nil {
+		return nil
+	}
+
+	return s.ExpireMock(ctx, key, version, ttl)
+}
+
+func (s *ServiceMock) ExpiringKeys(ctx context.Context) int {
+	if s.ExpiringKeysMock == nil {
+		return 0
+	}
+
+	return s.ExpiringKeysMock(ctx)
+}
+
+func (s *ServiceMock) Keys(ctx context.Context) int {
+	if s.KeysMock == nil {
+		return 0
+	}
+
+	return s.KeysMock(ctx)
+}
+
+func (s *ServiceMock) Close() error {
+	if s.CloseMock == nil {
+		return nil
+	}
+
+	return s.CloseMock()
+}
@@ -0,0 +1,596 @@
+package qq
+
+import (
+	"context"
+	"errors"
+	"qq/models"
+	"qq/repos/cacheqq"
+	"qq/repos/qq"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type databaseStub struct {
+	qq.Database
+	getCounter int32
+	getStarted chan struct{}
+	getRelease chan struct{}
+}
+
+func (d *databaseStub) Get(key string) *models.Entity {
+	atomic.AddInt32(&d.getCounter, 1)
+
+	if d.getStarted != nil {
+		d.getStarted <- struct{}{}
+		<-d.getRelease
+	}
+
+	return d.Database.Get(key)
+}
+
+func newDatabaseStub(t *testing.T, entities ...models.Entity) *databaseStub {
+	database, err := qq.NewDatabase()
+	require.NoError(t, err)
+
+	for _, entity := range entities {
+		database.Add(entity)
+	}
+
+	return &databaseStub{Database: database}
+}
+
+func TestServiceGetCoalesced(t *testing.T) {
+	ctx := context.Background()
+	const readers = 10
+
+	database := newDatabaseStub(t, models.Entity{Key: "a", Value: "b"})
+	database.getStarted = make(chan struct{})
+	database.getRelease = make(chan struct{})
+
+	metrics := NewMetrics()
+	qqService, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{Metrics: metrics})
+	require.NoError(t, err)
+
+	s := qqService.(service)
+
+	var wg sync.WaitGroup
+	results := make([]*models.Entity, readers)
+
+	get := func(i int) {
+		defer wg.Done()
+		results[i] = s.Get(ctx, "a")
+	}
+
+	wg.Add(1)
+	go get(0)
+	<-database.getStarted
+
+	for i := 1; i < readers; i++ {
+		wg.Add(1)
+		go get(i)
+	}
+
+	require.Eventually(t, func() bool {
+		s.flights.mu.Lock()
+		defer s.flights.mu.Unlock()
+		return s.flights.calls["a"].dups == readers-1
+	}, time.Second, time.Millisecond)
+
+	close(database.getRelease)
+	wg.Wait()
+
+	for _, result := range results {
+		assert.Equal(t, &models.Entity{Key: "a", Value: "b"}, result)
+	}
+
+	snapshot := metrics.Snapshot()
+	assert.Equal(t, int32(1), database.getCounter)
+	assert.Equal(t, uint64(1), snapshot.DatabaseLoads)
+	assert.Equal(t, uint64(readers-1), snapshot.Coalesced)
+	assert.Equal(t, uint64(readers), snapshot.CacheMisses)
+
+	assert.Equal(t, &models.Entity{Key: "a", Value: "b"}, s.Get(ctx, "a"))
+	assert.Equal(t, int32(1), database.getCounter)
+	assert.Equal(t, uint64(1), metrics.Snapshot().CacheHits)
+}
+
+func TestServiceGetEarlyRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name              string
+		options           Options
+		expDatabaseLoads  uint64
+		expEarlyRefreshes uint64
+	}{
+		{
+			name:              "Disabled",
+			options:           Options{},
+			expDatabaseLoads:  1,
+			expEarlyRefreshes: 0,
+		},
+		{
+			name:              "AlwaysRefresh",
+			options:           Options{EarlyRefreshBeta: 1, EarlyRefreshDelta: 1000 * cacheqq.Expiration},
+			expDatabaseLoads:  2,
+			expEarlyRefreshes: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.options.Metrics = NewMetrics()
+
+			database := newDatabaseStub(t, models.Entity{Key: "a", Value: "b"})
+			cache := cacheqq.NewLRUCache(cacheqq.LRUOptions{Expiration: cacheqq.Expiration})
+
+			s, err := NewService(database, cache, testCase.options)
+			require.NoError(t, err)
+
+			assert.Equal(t, &models.Entity{Key: "a", Value: "b"}, s.Get(ctx, "a"))
+			assert.Equal(t, &models.Entity{Key: "a", Value: "b"}, s.Get(ctx, "a"))
+
+			snapshot := testCase.options.Metrics.Snapshot()
+			assert.Equal(t, testCase.expDatabaseLoads, snapshot.DatabaseLoads)
+			assert.Equal(t, testCase.expEarlyRefreshes, snapshot.EarlyRefreshes)
+		})
+	}
+}
+
+func TestServiceExpirationJitter(t *testing.T) {
+	_, err := NewService(nil, nil, Options{ExpirationJitter: 1})
+	assert.Error(t, err)
+
+	s := service{options: Options{ExpirationJitter: 0.2}}
+
+	for i := 0; i < 100; i++ {
+		expiration := s.expiration()
+		assert.LessOrEqual(t, expiration, cacheqq.Expiration)
+		assert.GreaterOrEqual(t, expiration, cacheqq.Expiration*8/10)
+	}
+}
+
+func TestServiceWritePolicies(t *testing.T) {
+	ctx := context.Background()
+	const writes = 200
+	const readers = 8
+
+	for _, policy := range []WritePolicy{WriteThrough, WriteAround, WriteBehind} {
+		policy := policy
+		t.Run(string(policy), func(t *testing.T) {
+			database := newDatabaseStub(t)
+			cache := cacheqq.NewLRUCache(cacheqq.LRUOptions{MaxEntries: 1})
+
+			qqService, err := NewService(database, cache, Options{
+				WritePolicy:      policy,
+				FlushInterval:    time.Millisecond,
+				MaxPendingWrites: 1,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = qqService.Close() })
+
+			s := qqService.(service)
+
+			var written int32
+			var wg sync.WaitGroup
+
+			for i := 0; i < readers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					last := -1
+					for atomic.LoadInt32(&written) < writes {
+						completed := int(atomic.LoadInt32(&written))
+
+						value := -1
+						if entity := s.Get(ctx, "a"); entity != nil {
+							value, _ = strconv.Atoi(entity.Value)
+						}
+
+						assert.GreaterOrEqual(t, value, last, "value went back in time")
+						assert.GreaterOrEqual(t, value, completed-1, "completed write is not visible")
+						last = value
+
+						s.Get(ctx, "b")
+					}
+				}()
+			}
+
+			for i := 0; i < writes; i++ {
+				s.Add(ctx, models.Entity{Key: "a", Value: strconv.Itoa(i)})
+				s.Add(ctx, models.Entity{Key: "b", Value: "b"})
+				atomic.StoreInt32(&written, int32(i+1))
+			}
+
+			wg.Wait()
+
+			s.flush(ctx)
+
+			entity := s.Get(ctx, "a")
+			require.NotNil(t, entity)
+			assert.Equal(t, strconv.Itoa(writes-1), entity.Value)
+			assert.NotZero(t, entity.Version)
+			assert.Equal(t, entity, database.Database.Get("a"))
+
+			s.Remove(ctx, "a")
+			s.flush(ctx)
+
+			assert.Nil(t, s.Get(ctx, "a"))
+			assert.Nil(t, database.Database.Get("a"))
+		})
+	}
+}
+
+func TestServiceWriteBehind(t *testing.T) {
+	ctx := context.Background()
+
+	database := newDatabaseStub(t, models.Entity{Key: "a", Value: "b"}, models.Entity{Key: "c", Value: "d"})
+	cache := cacheqq.NewLRUCache(cacheqq.LRUOptions{MaxEntries: 1})
+
+	qqService, err := NewService(database, cache, Options{
+		WritePolicy:   WriteBehind,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+
+	s := qqService.(service)
+
+	assert.True(t, s.Add(ctx, models.Entity{Key: "a", Value: "e"}))
+	assert.True(t, s.Remove(ctx, "c"))
+	assert.True(t, s.Add(ctx, models.Entity{Key: "f", Value: "g"}))
+
+	assert.Equal(t, &models.Entity{Key: "a", Value: "b"}, database.Database.Get("a"))
+
+	entity := s.Get(ctx, "a")
+	require.NotNil(t, entity)
+	assert.Equal(t, "e", entity.Value)
+	assert.NotZero(t, entity.Version)
+
+	assert.Nil(t, s.Get(ctx, "c"))
+	assert.ElementsMatch(t, []models.Entity{{Key: "a", Value: "e"}, {Key: "f", Value: "g"}}, withoutVersions(s.GetAll(ctx)))
+	assert.Equal(t, 2, s.Keys(ctx))
+
+	// Close flushes the pending writes
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Close())
+
+	assert.Equal(t, entity, database.Database.Get("a"))
+	assert.Nil(t, database.Database.Get("c"))
+	assert.ElementsMatch(t, []models.Entity{{Key: "a", Value: "e"}, {Key: "f", Value: "g"}}, withoutVersions(database.Database.GetAll()))
+	assert.Equal(t, 2, s.Keys(ctx))
+}
+
+func TestServiceGetEmptyValue(t *testing.T) {
+	ctx := context.Background()
+
+	database := newDatabaseStub(t, models.Entity{Key: "a", Value: ""})
+	cache := cacheqq.NewLRUCache(cacheqq.LRUOptions{})
+
+	s, err := NewService(database, cache, Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, &models.Entity{Key: "a", Value: ""}, s.Get(ctx, "a"))
+	assert.Equal(t, &models.Entity{Key: "a", Value: ""}, s.Get(ctx, "a"))
+	assert.Nil(t, s.Get(ctx, "b"))
+	assert.Nil(t, s.Get(ctx, "b"))
+	assert.Equal(t, int32(2), database.getCounter)
+}
+
+func withoutVersions(entities []models.Entity) []models.Entity {
+	result := make([]models.Entity, 0, len(entities))
+	for _, entity := range entities {
+		entity.Version = 0
+		result = append(result, entity)
+	}
+	return result
+}
+
+func TestServiceScan(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name        string
+		writePolicy WritePolicy
+	}{
+		{name: "WriteThrough", writePolicy: WriteThrough},
+		{name: "WriteBehind", writePolicy: WriteBehind},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			database := newDatabaseStub(t,
+				models.Entity{Key: "b", Value: "1"},
+				models.Entity{Key: "d", Value: "1"},
+				models.Entity{Key: "f", Value: "1"},
+			)
+
+			s, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{
+				WritePolicy:   testCase.writePolicy,
+				FlushInterval: time.Hour,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = s.Close() })
+
+			assert.True(t, s.Add(ctx, models.Entity{Key: "a", Value: "2"}))
+			assert.True(t, s.Add(ctx, models.Entity{Key: "d", Value: "2"}))
+			assert.True(t, s.Remove(ctx, "b"))
+
+			var pages [][]models.Entity
+			after := ""
+			for {
+				entities, next := s.Scan(ctx, after, 2)
+				pages = append(pages, withoutVersions(entities))
+				if next == "" {
+					break
+				}
+				require.Greater(t, next, after)
+				after = next
+			}
+
+			var entities []models.Entity
+			for _, page := range pages {
+				assert.LessOrEqual(t, len(page), 2)
+				entities = append(entities, page...)
+			}
+
+			assert.Equal(t, []models.Entity{{Key: "a", Value: "2"}, {Key: "d", Value: "2"}, {Key: "f", Value: "1"}}, entities)
+		})
+	}
+}
+
+func TestServiceExpire(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewService(newDatabaseStub(t), cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{})
+	require.NoError(t, err)
+
+	version := func(key string) uint64 {
+		entity := s.Get(ctx, key)
+		require.NotNil(t, entity)
+		return entity.Version
+	}
+
+	for _, key := range []string{"expired", "rewritten", "cancelled", "outdated"} {
+		require.True(t, s.Add(ctx, models.Entity{Key: key, Value: "1"}))
+	}
+
+	outdated := version("outdated")
+	require.True(t, s.Add(ctx, models.Entity{Key: "outdated", Value: "2"}))
+
+	require.NoError(t, s.Expire(ctx, "expired", version("expired"), 10*time.Millisecond))
+	require.NoError(t, s.Expire(ctx, "rewritten", version("rewritten"), 10*time.Millisecond))
+	require.NoError(t, s.Expire(ctx, "cancelled", version("cancelled"), 10*time.Millisecond))
+	require.NoError(t, s.Expire(ctx, "outdated", outdated, 10*time.Millisecond))
+	assert.Equal(t, 3, s.ExpiringKeys(ctx))
+
+	require.True(t, s.Add(ctx, models.Entity{Key: "rewritten", Value: "2"}))
+	require.NoError(t, s.Expire(ctx, "cancelled", version("cancelled"), 0))
+	assert.Equal(t, 1, s.ExpiringKeys(ctx))
+
+	assert.Eventually(t, func() bool { return s.Get(ctx, "expired") == nil }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, s.ExpiringKeys(ctx))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.NotNil(t, s.Get(ctx, "rewritten"))
+	assert.NotNil(t, s.Get(ctx, "cancelled"))
+	assert.NotNil(t, s.Get(ctx, "outdated"))
+}
+
+func TestServiceMaxPendingWrites(t *testing.T) {
+	ctx := context.Background()
+
+	database := newDatabaseStub(t)
+
+	qqService, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{
+		WritePolicy:      WriteBehind,
+		FlushInterval:    time.Hour,
+		MaxPendingWrites: 2,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = qqService.Close() })
+
+	s := qqService.(service)
+
+	// the flusher is woken up by the full queue, so it is stopped first
+	s.flusher.once.Do(func() { close(s.flusher.stop) })
+	<-s.flusher.done
+
+	assert.True(t, s.Add(ctx, models.Entity{Key: "a", Value: "1"}))
+	assert.True(t, s.Add(ctx, models.Entity{Key: "b", Value: "1"}))
+	assert.True(t, s.Add(ctx, models.Entity{Key: "c", Value: "1"}))
+	assert.True(t, s.Add(ctx, models.Entity{Key: "a", Value: "2"}))
+
+	assert.ElementsMatch(t, []string{"a", "b"}, s.writes.keys())
+	assert.Nil(t, database.Database.Get("a"))
+	assert.Equal(t, "1", database.Database.Get("c").Value)
+	assert.Equal(t, "2", s.Get(ctx, "a").Value)
+}
+
+func TestServiceUpdate(t *testing.T) {
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	for _, policy := range []WritePolicy{WriteThrough, WriteAround, WriteBehind} {
+		policy := policy
+		t.Run(string(policy), func(t *testing.T) {
+			database := newDatabaseStub(t, models.Entity{Key: "a", Value: "b", Version: 1})
+			cache := cacheqq.NewLRUCache(cacheqq.LRUOptions{})
+
+			qqService, err := NewService(database, cache, Options{WritePolicy: policy, FlushInterval: time.Hour})
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = qqService.Close() })
+
+			s := qqService.(service)
+
+			entity, err := s.Update(ctx, "a", func(current *models.Entity) (*models.Entity, error) {
+				assert.Equal(t, &models.Entity{Key: "a", Value: "b", Version: 1}, current)
+				return nil, errAbort
+			})
+			assert.ErrorIs(t, err, errAbort)
+			assert.Nil(t, entity)
+			assert.Equal(t, "b", s.Get(ctx, "a").Value)
+
+			entity, err = s.Update(ctx, "a", func(current *models.Entity) (*models.Entity, error) {
+				current.Value += "c"
+				return current, nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, "bc", entity.Value)
+			assert.Greater(t, entity.Version, uint64(1))
+			assert.Equal(t, entity, s.Get(ctx, "a"))
+
+			const writers = 20
+			var wg sync.WaitGroup
+
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					_, err := s.Update(ctx, "counter", func(current *models.Entity) (*models.Entity, error) {
+						value := 0
+						if current != nil {
+							value, _ = strconv.Atoi(current.Value)
+						}
+						return &models.Entity{Value: strconv.Itoa(value + 1)}, nil
+					})
+					assert.NoError(t, err)
+				}()
+			}
+
+			wg.Wait()
+
+			assert.Equal(t, &models.Entity{Key: "counter", Value: strconv.Itoa(writers)}, withoutVersion(s.Get(ctx, "counter")))
+
+			entity, err = s.Update(ctx, "a", func(current *models.Entity) (*models.Entity, error) {
+				return nil, nil
+			})
+			require.NoError(t, err)
+			assert.Nil(t, entity)
+			assert.Nil(t, s.Get(ctx, "a"))
+
+			s.flush(ctx)
+			assert.Nil(t, database.Database.Get("a"))
+		})
+	}
+}
+
+func withoutVersion(entity *models.Entity) *models.Entity {
+	if entity == nil {
+		return nil
+	}
+
+	entityCopy := *entity
+	entityCopy.Version = 0
+	return &entityCopy
+}
+
+func TestServiceKeyPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := NewService(nil, nil, Options{KeyPolicy: "upper"})
+	assert.Error(t, err)
+
+	testCases := []struct {
+		name   string
+		policy KeyPolicy
+		key    string
+		expKey string
+		expGet map[string]bool
+	}{
+		{
+			name:   "Exact",
+			policy: ExactKeys,
+			key:    "Cafe\u0301",
+			expKey: "Cafe\u0301",
+			expGet: map[string]bool{"Cafe\u0301": true, "Caf\u00e9": false, "CAFE\u0301": false},
+		},
+		{
+			name:   "UnicodeNormalized",
+			policy: UnicodeNormalizedKeys,
+			key:    "Cafe\u0301",
+			expKey: "Caf\u00e9",
+			expGet: map[string]bool{"Cafe\u0301": true, "Caf\u00e9": true, "CAFE\u0301": false},
+		},
+		{
+			name:   "CaseInsensitive",
+			policy: CaseInsensitiveKeys,
+			key:    "Cafe\u0301",
+			expKey: "caf\u00e9",
+			expGet: map[string]bool{"Cafe\u0301": true, "Caf\u00e9": true, "CAFE\u0301": true, "caf\u00e9": true},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			database := newDatabaseStub(t)
+			s, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{KeyPolicy: testCase.policy})
+			require.NoError(t, err)
+
+			assert.True(t, s.Add(ctx, models.Entity{Key: testCase.key, Value: "a"}))
+			assert.Equal(t, []models.Entity{{Key: testCase.expKey, Value: "a"}}, withoutVersions(s.GetAll(ctx)))
+
+			for key, found := range testCase.expGet {
+				entity := s.Get(ctx, key)
+				if !found {
+					assert.Nil(t, entity, key)
+					continue
+				}
+				require.NotNil(t, entity, key)
+				assert.Equal(t, testCase.expKey, entity.Key)
+			}
+
+			entity, err := s.Update(ctx, testCase.expKey, func(current *models.Entity) (*models.Entity, error) {
+				require.NotNil(t, current)
+				return &models.Entity{Value: "b"}, nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expKey, entity.Key)
+
+			assert.True(t, s.Remove(ctx, testCase.key))
+			assert.Empty(t, s.GetAll(ctx))
+		})
+	}
+}
+
+func TestServiceBatch(t *testing.T) {
+	ctx := context.Background()
+
+	database := newDatabaseStub(t, models.Entity{Key: "a", Value: "b"})
+
+	s, err := NewService(database, cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{KeyPolicy: CaseInsensitiveKeys})
+	require.NoError(t, err)
+
+	entities := s.GetBatch(ctx, []string{"a", "c", "A", "a"})
+	assert.Equal(t, []*models.Entity{{Key: "a", Value: "b"}, nil, {Key: "a", Value: "b"}, {Key: "a", Value: "b"}}, entities)
+	assert.Equal(t, int32(2), database.getCounter)
+
+	entities[0].Value = "changed"
+	assert.Equal(t, "b", entities[2].Value)
+
+	added := s.AddBatch(ctx, []models.Entity{{Key: "c", Value: "d"}, {Key: "e", Value: "f"}, {Key: "C", Value: "g"}})
+	assert.Equal(t, []bool{true, true, true}, added)
+	assert.Equal(t, []*models.Entity{{Key: "c", Value: "g"}, {Key: "e", Value: "f"}}, withoutVersionsBatch(s.GetBatch(ctx, []string{"c", "e"})))
+
+	removed := s.RemoveBatch(ctx, []string{"a", "E"})
+	assert.Equal(t, []bool{true, true}, removed)
+	assert.Equal(t, []models.Entity{{Key: "c", Value: "g"}}, withoutVersions(s.GetAll(ctx)))
+}
+
+func withoutVersionsBatch(entities []*models.Entity) []*models.Entity {
+	result := make([]*models.Entity, 0, len(entities))
+	for _, entity := range entities {
+		result = append(result, withoutVersion(entity))
+	}
+	return result
+}
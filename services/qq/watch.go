@@ -0,0 +1,113 @@
+package qq
+
+import (
+	"context"
+	"qq/models"
+	"strings"
+	"sync"
+)
+
+type ChangeType string
+
+const (
+	ChangePut    ChangeType = "put"
+	ChangeRemove ChangeType = "remove"
+)
+
+// Change is a write seen by Watch; Entity is nil when the key was removed
+type Change struct {
+	Type   ChangeType
+	Key    string
+	Entity *models.Entity
+}
+
+// WatchBufferSize is the number of changes a watcher may fall behind by
+// before it is dropped
+const WatchBufferSize = 64
+
+type watcher struct {
+	ctx    context.Context
+	prefix string
+	ch     chan Change
+}
+
+// watchers fans the writes of this instance out to the watchers; writes made
+// by other instances sharing the database are not seen
+type watchers struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{watchers: map[*watcher]struct{}{}}
+}
+
+func (w *watchers) add(ctx context.Context, prefix string) *watcher {
+	watcher := &watcher{
+		ctx:    ctx,
+		prefix: prefix,
+		ch:     make(chan Change, WatchBufferSize),
+	}
+
+	w.mu.Lock()
+	w.watchers[watcher] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.remove(watcher)
+	}()
+
+	return watcher
+}
+
+func (w *watchers) remove(watcher *watcher) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, ok := w.watchers[watcher]
+	if !ok {
+		return
+	}
+
+	delete(w.watchers, watcher)
+	close(watcher.ch)
+}
+
+// publish never blocks the write: a watcher whose buffer is full is dropped,
+// which closes its channel, and has to watch again
+func (w *watchers) publish(change Change, allows func(watcher *watcher) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for watcher := range w.watchers {
+		if !strings.HasPrefix(change.Key, watcher.prefix) || !allows(watcher) {
+			continue
+		}
+
+		select {
+		case watcher.ch <- change:
+		default:
+			delete(w.watchers, watcher)
+			close(watcher.ch)
+		}
+	}
+}
+
+// Watch streams the changes of the keys starting with prefix that the
+// identity in ctx may read, until ctx is done or the watcher falls behind;
+// the channel is closed in both cases
+func (s service) Watch(ctx context.Context, prefix string) <-chan Change {
+	return s.watchers.add(ctx, s.options.KeyPolicy.Normalize(prefix)).ch
+}
+
+func (s service) notify(key string, entity *models.Entity) {
+	change := Change{Type: ChangePut, Key: key, Entity: entity}
+	if entity == nil {
+		change.Type = ChangeRemove
+	}
+
+	s.watchers.publish(change, func(watcher *watcher) bool {
+		return s.allows(watcher.ctx, ActionRead, key)
+	})
+}
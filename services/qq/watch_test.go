@@ -0,0 +1,69 @@
+package qq
+
+import (
+	"context"
+	"qq/models"
+	"qq/pkg/qqcontext"
+	"qq/repos/cacheqq"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	s, err := NewService(newDatabaseStub(t), cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{Policy: staticPolicy{policy: policy}})
+	require.NoError(t, err)
+
+	teamA := qqcontext.WithIdentityValue(ctx, qqcontext.Identity{UserId: "team-a"})
+	anyone := qqcontext.WithIdentityValue(ctx, qqcontext.Identity{UserId: "anyone"})
+
+	changes := s.Watch(teamA, "")
+	publicChanges := s.Watch(anyone, "")
+
+	assert.True(t, s.Remove(teamA, "team-a/x"))
+	assert.True(t, s.Add(teamA, models.Entity{Key: "team-a/x", Value: "1"}))
+	assert.True(t, s.Remove(teamA, "team-a/x"))
+
+	// the removal of the missing key is not watched
+	change := <-changes
+	assert.Equal(t, ChangePut, change.Type)
+	assert.Equal(t, "team-a/x", change.Key)
+	require.NotNil(t, change.Entity)
+	assert.Equal(t, "1", change.Entity.Value)
+
+	change = <-changes
+	assert.Equal(t, Change{Type: ChangeRemove, Key: "team-a/x"}, change)
+
+	assert.Empty(t, publicChanges, "change of unreadable key was watched")
+
+	cancel()
+
+	_, open := <-changes
+	assert.False(t, open)
+}
+
+func TestServiceWatchFallsBehind(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewService(newDatabaseStub(t), cacheqq.NewLRUCache(cacheqq.LRUOptions{}), Options{})
+	require.NoError(t, err)
+
+	changes := s.Watch(ctx, "a")
+
+	for i := 0; i <= WatchBufferSize; i++ {
+		assert.True(t, s.Add(ctx, models.Entity{Key: "a", Value: "b"}))
+	}
+
+	received := 0
+	for range changes {
+		received++
+	}
+	assert.Equal(t, WatchBufferSize, received)
+}
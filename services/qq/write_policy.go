@@ -0,0 +1,251 @@
+package qq
+
+import (
+	"context"
+	"fmt"
+	"qq/models"
+	"qq/pkg/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type WritePolicy string
+
+const (
+	// the database and then the cache are updated synchronously
+	WriteThrough WritePolicy = "write-through"
+	// the database is updated synchronously and the cached entry is invalidated
+	WriteAround WritePolicy = "write-around"
+	// the cache is updated synchronously and the database later by a flusher
+	WriteBehind WritePolicy = "write-behind"
+)
+
+const (
+	DefaultFlushInterval    = time.Second
+	DefaultMaxPendingWrites = 1000
+)
+
+func ParseWritePolicy(value string) (WritePolicy, error) {
+	switch policy := WritePolicy(value); policy {
+	case WriteThrough, WriteAround, WriteBehind:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid write policy %s", value)
+	}
+}
+
+// writeQueue keeps the latest pending write per key; a nil entity means removal
+type writeQueue struct {
+	mu        sync.Mutex
+	pending   map[string]*models.Entity
+	maxLength int
+	notify    chan struct{}
+}
+
+func newWriteQueue(maxLength int) *writeQueue {
+	return &writeQueue{
+		pending:   map[string]*models.Entity{},
+		maxLength: maxLength,
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// push returns false, leaving the write to the caller, when the queue is
+// full and has no pending write for key to replace
+func (q *writeQueue) push(key string, entity *models.Entity) bool {
+	q.mu.Lock()
+	_, present := q.pending[key]
+	if !present && len(q.pending) >= q.maxLength {
+		q.mu.Unlock()
+		q.wake()
+		return false
+	}
+
+	q.pending[key] = entity
+	full := len(q.pending) >= q.maxLength
+	q.mu.Unlock()
+
+	if full {
+		q.wake()
+	}
+
+	return true
+}
+
+func (q *writeQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *writeQueue) get(key string) (*models.Entity, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entity, present := q.pending[key]
+	return entity, present
+}
+
+func (q *writeQueue) pop(key string) (*models.Entity, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entity, present := q.pending[key]
+	delete(q.pending, key)
+	return entity, present
+}
+
+func (q *writeQueue) keys() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys := make([]string, 0, len(q.pending))
+	for key := range q.pending {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// overlay applies pending writes to entities read from the database
+func (q *writeQueue) overlay(entities []models.Entity) []models.Entity {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return entities
+	}
+
+	result := make([]models.Entity, 0, len(entities)+len(q.pending))
+	for _, entity := range entities {
+		if _, present := q.pending[entity.Key]; !present {
+			result = append(result, entity)
+		}
+	}
+
+	for _, entity := range q.pending {
+		if entity != nil {
+			result = append(result, *entity)
+		}
+	}
+
+	return result
+}
+
+// overlayRange applies pending writes to a page of Scan, read from the
+// database after the key after and up to the key next, or to the end when
+// next is empty; the page is cut at limit entities again and next moved back
+func (q *writeQueue) overlayRange(entities []models.Entity, after string, next string, limit int) ([]models.Entity, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	page := make(map[string]*models.Entity, len(entities))
+	for i := range entities {
+		page[entities[i].Key] = &entities[i]
+	}
+
+	overlaid := false
+	for key, entity := range q.pending {
+		if key > after && (next == "" || key <= next) {
+			page[key] = entity
+			overlaid = true
+		}
+	}
+
+	if !overlaid {
+		return entities, next
+	}
+
+	keys := make([]string, 0, len(page))
+	for key := range page {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]models.Entity, 0, len(keys))
+	for _, key := range keys {
+		entity := page[key]
+		if entity == nil {
+			continue
+		}
+
+		result = append(result, *entity)
+		if len(result) == limit {
+			return result, key
+		}
+	}
+
+	return result, next
+}
+
+// flusher runs until stop is closed, and flushes once more before closing done
+type flusher struct {
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFlusher() *flusher {
+	return &flusher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (s service) runFlusher(ctx context.Context) {
+	defer close(s.flusher.done)
+
+	ticker := time.NewTicker(s.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.writes.notify:
+		case <-s.flusher.stop:
+			s.flush(ctx)
+			return
+		}
+
+		s.flush(ctx)
+	}
+}
+
+// Close stops the flusher once the pending writes are in the database
+func (s service) Close() error {
+	if s.flusher == nil {
+		return nil
+	}
+
+	s.flusher.once.Do(func() {
+		close(s.flusher.stop)
+	})
+	<-s.flusher.done
+
+	return nil
+}
+
+func (s service) flush(ctx context.Context) {
+	keys := s.writes.keys()
+	if len(keys) == 0 {
+		return
+	}
+
+	log.Debug(ctx, "flush pending writes", log.Args{"count": len(keys)})
+
+	for _, key := range keys {
+		unlock := s.locks.lock(key)
+
+		entity, present := s.writes.pop(key)
+		if present {
+			if entity != nil {
+				s.database.Add(*entity)
+			} else {
+				s.database.Remove(key)
+			}
+		}
+
+		unlock()
+	}
+}